@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"noteflow/clientip"
+	"noteflow/model"
+
+	"github.com/google/uuid"
+)
+
+// Журнал аудита: события безопасности и изменения аккаунта пишутся в audit_events
+// вместе с IP, User-Agent и сессией запроса.
+
+const (
+	securityActivityLimit = 50
+	auditQueryMaxLimit    = 500
+)
+
+// audit записывает событие пользователя userID ("" — пользователь неизвестен)
+// с сессией текущего запроса. Ошибка записи только логируется.
+func (h *Handler) audit(r *http.Request, userID, event string, details map[string]interface{}) {
+	h.auditSession(r, userID, getSessionID(r), event, details)
+}
+
+// auditSession записывает событие с явно заданной сессией (например, только что созданной при входе)
+func (h *Handler) auditSession(r *http.Request, userID, sessionID, event string, details map[string]interface{}) {
+	e := &model.AuditEvent{
+		Event:     event,
+		ClientIP:  clientip.FromRequest(r),
+		UserAgent: truncate(r.UserAgent(), 512),
+		SessionID: sessionID,
+	}
+	// Запись не должна теряться, если клиент закрыл соединение
+	h.recordAudit(r.Context(), e, userID, details)
+}
+
+// auditSystem записывает событие фоновой задачи (без IP и сессии)
+func (h *Handler) auditSystem(ctx context.Context, userID, event string, details map[string]interface{}) {
+	h.recordAudit(ctx, &model.AuditEvent{Event: event}, userID, details)
+}
+
+func (h *Handler) recordAudit(ctx context.Context, e *model.AuditEvent, userID string, details map[string]interface{}) {
+	if userID != "" {
+		e.UserID = &userID
+	}
+	if details != nil {
+		raw, err := json.Marshal(details)
+		if err != nil {
+			log.Printf("Failed to encode audit details for %s: %v", e.Event, err)
+		} else {
+			e.Details = raw
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := h.Store.AuditRepository.Record(ctx, e); err != nil {
+		log.Printf("Failed to record audit event %s for user %s: %v", e.Event, userID, err)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// HandleSecurityActivity возвращает последние события безопасности пользователя:
+// входы, ошибки входа, блокировки, смену пароля, токены и привязки
+func (h *Handler) HandleSecurityActivity(w http.ResponseWriter, r *http.Request) {
+	events, err := h.Store.AuditRepository.ListUserEvents(r.Context(), getUserID(r), model.SecurityAuditEvents, securityActivityLimit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// HandleQueryAudit — выборка журнала для администратора. Фильтры (query):
+// userId, event (через запятую), ip, since и until (RFC 3339), before (id для
+// следующей страницы), limit (по умолчанию 100, не больше 500).
+func (h *Handler) HandleQueryAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := model.AuditFilter{
+		UserID:   q.Get("userId"),
+		ClientIP: q.Get("ip"),
+		Limit:    100,
+	}
+	if f.UserID != "" {
+		if _, err := uuid.Parse(f.UserID); err != nil {
+			http.Error(w, "Invalid userId", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, event := range strings.Split(q.Get("event"), ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			f.Events = append(f.Events, event)
+		}
+	}
+	for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": expected RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		f.BeforeID = id
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(n, auditQueryMaxLimit)
+	}
+
+	events, err := h.Store.AuditRepository.Query(r.Context(), f)
+	if err != nil {
+		log.Printf("Audit query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"events": events}
+	// Полная страница: следующую запрашивают с before = id последнего события
+	if len(events) == f.Limit {
+		resp["nextBefore"] = events[len(events)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -1,57 +1,126 @@
 package api
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 	"net/mail"
+	"noteflow/auth"
+	"noteflow/clientip"
 	"noteflow/model"
 	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 )
 
 var validate = validator.New()
 
-// generateTokenPair создает Access (JWT) и Refresh (Random String) токены
-func (h *Handler) generateTokenPair(userID, ip, userAgent string) (string, string, error) {
-	// 1. Access Token (Живет 15 минут)
-	// ИСПРАВЛЕНИЕ: Используем стандартный claim "sub" для ID пользователя
-	accessClaims := jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(15 * time.Minute).Unix(),
-		"iat": time.Now().Unix(),
+// hashToken возвращает SHA-256 хеш непрозрачного токена для хранения в БД
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// newOpaqueToken генерирует случайный токен (refresh-токен, SSE-тикет)
+func newOpaqueToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
 	}
-	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims).SignedString(h.JWTSecret)
+	return base64.URLEncoding.EncodeToString(randomBytes), nil
+}
+
+// signAccessToken подписывает Access (JWT) токен сессии (живет AccessTokenTTL)
+func (h *Handler) signAccessToken(ctx context.Context, userID, sessionID string) (string, error) {
+	// ИСПРАВЛЕНИЕ: Используем стандартный claim "sub" для ID пользователя
+	return h.Keys.Sign(ctx, auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: userID},
+		SessionID:        sessionID,
+	})
+}
+
+// HandleJWKS публикует открытые ключи проверки access-токенов (RFC 7517)
+func (h *Handler) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(auth.JWKSMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(h.Keys.JWKS())
+}
+
+// generateTokenPair создает новую сессию: Access (JWT) и Refresh (Random String) токены.
+// Возвращает токены и ID сессии.
+func (h *Handler) generateTokenPair(ctx context.Context, userID, ip, userAgent string) (string, string, string, error) {
+	sessionID := uuid.New().String()
+
+	// 1. Refresh Token (Живет RefreshTokenTTL), в БД храним только хеш
+	refreshToken, err := newOpaqueToken()
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
+	}
+	if err := h.Store.SessionRepository.CreateRefreshToken(ctx, hashToken(refreshToken), userID, sessionID, ip, userAgent, h.RefreshTokenTTL); err != nil {
+		return "", "", "", err
 	}
 
-	// 2. Refresh Token (Живет 30 дней)
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
+	// 2. Access Token
+	accessToken, err := h.signAccessToken(ctx, userID, sessionID)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
-	refreshToken := base64.URLEncoding.EncodeToString(randomBytes)
 
-	// 3. Сохраняем хеш рефреш токена в БД
-	hash := sha256.Sum256([]byte(refreshToken))
-	hashString := hex.EncodeToString(hash[:])
+	return accessToken, refreshToken, sessionID, nil
+}
 
-	_, err = h.Store.DB.Exec(`
-		INSERT INTO refresh_tokens (token_hash, user_id, expires_at, client_ip, user_agent)
-		VALUES ($1, $2, NOW() + INTERVAL '30 days', $3, $4)
-	`, hashString, userID, ip, userAgent)
+// sessionResponse — ответ на вход: токены новой сессии и профиль с информацией о подписке
+func sessionResponse(userID, accessToken, refreshToken string, profile model.UserProfile) map[string]interface{} {
+	return map[string]interface{}{
+		"token":                 accessToken,
+		"refreshToken":          refreshToken,
+		"user_id":               userID,
+		"storageLimit":          profile.StorageLimit,
+		"storageUsed":           profile.StorageUsed,
+		"tier":                  profile.Tier,
+		"maxFileSize":           profile.MaxFileSize,
+		"subscriptionExpiresAt": profile.SubscriptionExpiresAt,
+		"freeSince":             profile.FreeSince,
+		"cleanupWarningDate":    profile.CleanupWarningDate,
+		"hasSyncAccess":         profile.HasSyncAccess,
+	}
+}
+
+// validatePassword проверяет новый пароль; возвращает текст ошибки или ""
+func validatePassword(password string) string {
+	if len(password) < 8 {
+		return "Password must be at least 8 characters"
+	}
+	if len(password) > 128 {
+		return "Password too long"
+	}
+	if strings.ContainsAny(password, "\x00") {
+		return "Password contains invalid characters"
+	}
+	return ""
+}
 
-	return accessToken, refreshToken, err
+// rehashPassword сохраняет хеш пароля с текущими параметрами. Ошибка не мешает входу.
+func (h *Handler) rehashPassword(ctx context.Context, userID, oldHash, password string) {
+	newHash, err := h.Passwords.Hash(password)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %s: %v", userID, err)
+		return
+	}
+	// Только если хеш не сменился параллельно (например, сменой пароля)
+	if _, err := h.Store.UserRepository.UpdatePasswordHash(ctx, userID, oldHash, newHash); err != nil {
+		log.Printf("Failed to store rehashed password of user %s: %v", userID, err)
+	}
 }
 
 func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
@@ -74,16 +143,8 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Stronger password validation
-	if len(req.Password) < 8 {
-		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
-		return
-	}
-	if len(req.Password) > 128 {
-		http.Error(w, "Password too long", http.StatusBadRequest)
-		return
-	}
-	if strings.ContainsAny(req.Password, "\x00") {
-		http.Error(w, "Password contains invalid characters", http.StatusBadRequest)
+	if msg := validatePassword(req.Password); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
@@ -98,23 +159,24 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := h.Passwords.Hash(req.Password)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	id, err := h.Store.UserRepository.CreateUser(req.Email, string(hash))
+	id, err := h.Store.UserRepository.CreateUser(req.Email, hash)
 	if err != nil {
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
 	}
 
-	accessToken, refreshToken, err := h.generateTokenPair(id, r.RemoteAddr, r.UserAgent())
+	accessToken, refreshToken, sessionID, err := h.generateTokenPair(r.Context(), id, clientip.FromRequest(r), r.UserAgent())
 	if err != nil {
 		http.Error(w, "Token generation failed", http.StatusInternalServerError)
 		return
 	}
+	h.auditSession(r, id, sessionID, model.AuditRegister, nil)
 
 	// Get user profile with subscription info
 	profile, err := h.Store.UserRepository.GetUserProfile(id)
@@ -124,19 +186,7 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token":                 accessToken,
-		"refreshToken":          refreshToken,
-		"user_id":               id,
-		"storageLimit":          profile.StorageLimit,
-		"storageUsed":           profile.StorageUsed,
-		"tier":                  profile.Tier,
-		"maxFileSize":           profile.MaxFileSize,
-		"subscriptionExpiresAt": profile.SubscriptionExpiresAt,
-		"freeSince":             profile.FreeSince,
-		"cleanupWarningDate":    profile.CleanupWarningDate,
-		"hasSyncAccess":         profile.HasSyncAccess,
-	})
+	json.NewEncoder(w).Encode(sessionResponse(id, accessToken, refreshToken, profile))
 }
 
 func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -161,22 +211,58 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, hash, err := h.Store.UserRepository.GetUserByEmail(req.Email)
+	// Задержка или блокировка после неудачных попыток: проверяется до поиска
+	// пользователя, ответ одинаков для существующих и несуществующих email
+	key := loginKey(req.Email)
+	blockedUntil, err := h.Store.LoginAttemptRepository.GetBlockedUntil(r.Context(), key)
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		log.Printf("Failed to check login lockout: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !blockedUntil.IsZero() {
+		h.audit(r, "", model.AuditLoginFailed, map[string]interface{}{"email": req.Email, "reason": "blocked"})
+		writeLoginBlocked(w, blockedUntil)
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
+	id, hash, err := h.Store.UserRepository.GetUserByEmail(req.Email)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to load user for login: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Нет аккаунта или пароля (вход через OIDC): проверяем заглушку, чтобы
+	// время ответа не отличалось от проверки настоящего хеша
+	verifyHash := hash
+	if err == sql.ErrNoRows || hash == "" {
+		verifyHash = h.dummyHash
+	}
+	ok, needsRehash, err := h.Passwords.Verify(req.Password, verifyHash)
+	if err != nil {
+		log.Printf("Failed to verify password of user %s: %v", id, err)
+	}
+	if !ok || verifyHash != hash {
+		h.audit(r, id, model.AuditLoginFailed, map[string]interface{}{"email": req.Email, "reason": "invalid_credentials"})
+		h.recordLoginFailure(r, key, id, req.Email)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if err := h.Store.LoginAttemptRepository.Reset(r.Context(), key); err != nil {
+		log.Printf("Failed to reset login attempts of user %s: %v", id, err)
+	}
+	// Хеш bcrypt или устаревшие параметры Argon2id: обновляем, пока пароль известен
+	if needsRehash {
+		h.rehashPassword(r.Context(), id, hash, req.Password)
+	}
 
-	accessToken, refreshToken, err := h.generateTokenPair(id, r.RemoteAddr, r.UserAgent())
+	accessToken, refreshToken, sessionID, err := h.generateTokenPair(r.Context(), id, clientip.FromRequest(r), r.UserAgent())
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+	h.auditSession(r, id, sessionID, model.AuditLogin, map[string]interface{}{"method": "password"})
 
 	// Get user profile with subscription info
 	profile, err := h.Store.UserRepository.GetUserProfile(id)
@@ -186,19 +272,7 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token":                 accessToken,
-		"refreshToken":          refreshToken,
-		"user_id":               id,
-		"storageLimit":          profile.StorageLimit,
-		"storageUsed":           profile.StorageUsed,
-		"tier":                  profile.Tier,
-		"maxFileSize":           profile.MaxFileSize,
-		"subscriptionExpiresAt": profile.SubscriptionExpiresAt,
-		"freeSince":             profile.FreeSince,
-		"cleanupWarningDate":    profile.CleanupWarningDate,
-		"hasSyncAccess":         profile.HasSyncAccess,
-	})
+	json.NewEncoder(w).Encode(sessionResponse(id, accessToken, refreshToken, profile))
 }
 
 func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
@@ -215,16 +289,16 @@ func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hash := sha256.Sum256([]byte(req.RefreshToken))
-	hashString := hex.EncodeToString(hash[:])
-
-	var userID string
-	err := h.Store.DB.QueryRow(`
-		SELECT user_id FROM refresh_tokens 
-		WHERE token_hash=$1 AND expires_at > NOW()
-	`, hashString).Scan(&userID)
+	newRefresh, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Generation failed", http.StatusInternalServerError)
+		return
+	}
 
+	// Ротация: старый токен удаляется, новый наследует сессию
+	userID, sessionID, _, err := h.Store.SessionRepository.RotateRefreshToken(r.Context(), hashToken(req.RefreshToken), hashToken(newRefresh), "", clientip.FromRequest(r), r.UserAgent(), h.RefreshTokenTTL)
 	if err == sql.ErrNoRows {
+		h.checkRefreshTokenReuse(r, hashToken(req.RefreshToken))
 		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
 		return
 	} else if err != nil {
@@ -232,9 +306,7 @@ func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.Store.DB.Exec("DELETE FROM refresh_tokens WHERE token_hash=$1", hashString)
-
-	newAccess, newRefresh, err := h.generateTokenPair(userID, r.RemoteAddr, r.UserAgent())
+	newAccess, err := h.signAccessToken(r.Context(), userID, sessionID)
 	if err != nil {
 		http.Error(w, "Generation failed", http.StatusInternalServerError)
 		return
@@ -246,3 +318,132 @@ func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 		"refreshToken": newRefresh,
 	})
 }
+
+// refreshReuseGrace — повтор в пределах этого времени после ротации считается
+// гонкой параллельных запросов клиента, а не утечкой токена
+const refreshReuseGrace = 30 * time.Second
+
+// checkRefreshTokenReuse проверяет, не был ли отклоненный refresh-токен уже
+// использован. Повторное предъявление замененного токена означает, что его
+// копия есть у кого-то еще: сессия отзывается целиком, событие пишется в журнал.
+func (h *Handler) checkRefreshTokenReuse(r *http.Request, tokenHash string) {
+	userID, sessionID, rotatedAt, err := h.Store.SessionRepository.FindRotatedRefreshToken(r.Context(), tokenHash)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Printf("Refresh token reuse check failed: %v", err)
+		return
+	}
+
+	var revoked int64
+	if time.Since(rotatedAt) > refreshReuseGrace {
+		revoked, err = h.Store.SessionRepository.RevokeSession(r.Context(), userID, sessionID)
+		if err != nil {
+			log.Printf("Failed to revoke session %s after refresh token reuse: %v", sessionID, err)
+		} else {
+			h.Broker.EvictUser(userID)
+		}
+		log.Printf("Refresh token reuse detected for user %s, session %s revoked", userID, sessionID)
+	}
+	h.auditSession(r, userID, sessionID, model.AuditRefreshTokenReuse, map[string]interface{}{
+		"rotatedAt":      rotatedAt,
+		"sessionRevoked": revoked > 0,
+		"revokedTokens":  revoked,
+	})
+}
+
+// HandleChangePassword меняет пароль и завершает остальные сессии пользователя.
+// Пользователь без пароля (вход через OIDC) может задать его без currentPassword.
+//
+// Ключ E2EE выводится клиентом из пароля: перед сменой клиент должен
+// перешифровать мастер-ключ новым паролем, иначе заметки не расшифровать.
+func (h *Handler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024) // 10 KB
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.CurrentPassword = strings.TrimSpace(req.CurrentPassword)
+	req.NewPassword = strings.TrimSpace(req.NewPassword)
+
+	if msg := validatePassword(req.NewPassword); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	oldHash, err := h.Store.UserRepository.GetPasswordHash(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if oldHash != "" {
+		// Подбор текущего пароля через украденную сессию ограничен тем же
+		// счетчиком, что и вход: ошибки здесь и в /auth/login суммируются
+		email, err := h.Store.UserRepository.GetUserEmail(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		key := loginKey(email)
+		blockedUntil, err := h.Store.LoginAttemptRepository.GetBlockedUntil(r.Context(), key)
+		if err != nil {
+			log.Printf("Failed to check login lockout: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if !blockedUntil.IsZero() {
+			writeLoginBlocked(w, blockedUntil)
+			return
+		}
+
+		ok := false
+		if len(req.CurrentPassword) <= 128 {
+			ok, _, err = h.Passwords.Verify(req.CurrentPassword, oldHash)
+			if err != nil {
+				log.Printf("Failed to verify password of user %s: %v", userID, err)
+			}
+		}
+		if !ok {
+			h.recordLoginFailure(r, key, userID, email)
+			http.Error(w, "Invalid current password", http.StatusForbidden)
+			return
+		}
+		if err := h.Store.LoginAttemptRepository.Reset(r.Context(), key); err != nil {
+			log.Printf("Failed to reset login attempts of user %s: %v", userID, err)
+		}
+	}
+
+	newHash, err := h.Passwords.Hash(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	updated, err := h.Store.UserRepository.UpdatePasswordHash(r.Context(), userID, oldHash, newHash)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "Password was changed concurrently, try again", http.StatusConflict)
+		return
+	}
+
+	// Остальные сессии приложения завершаются; токены API и OAuth-клиентов остаются
+	revoked, err := h.Store.SessionRepository.RevokeOtherSessions(r.Context(), userID, getSessionID(r))
+	if err != nil {
+		log.Printf("Failed to revoke sessions of user %s after password change: %v", userID, err)
+	} else if revoked > 0 {
+		h.Broker.EvictUser(userID)
+	}
+	log.Printf("User %s changed password, %d other sessions revoked", userID, revoked)
+	h.audit(r, userID, model.AuditPasswordChanged, map[string]interface{}{"revokedSessions": revoked})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"revokedSessions": revoked})
+}
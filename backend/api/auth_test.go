@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectLoginFailure — запись неудачной попытки без задержки
+func expectLoginFailure(mock sqlmock.Sqlmock, key string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO login_attempts").
+		WithArgs(key, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_count", "locked"}).AddRow(1, false))
+	mock.ExpectExec("UPDATE login_attempts SET blocked_until").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestLogin_SameResponseForMissingAccount(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	hash, err := h.Passwords.Hash("correct-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(email string, user *sqlmock.Rows) *httptest.ResponseRecorder {
+		key := loginKey(email)
+		mock.ExpectQuery("SELECT blocked_until FROM login_attempts").
+			WithArgs(key).
+			WillReturnError(sql.ErrNoRows)
+		q := mock.ExpectQuery("SELECT id, password_hash FROM users").WithArgs(email)
+		if user != nil {
+			q.WillReturnRows(user)
+		} else {
+			q.WillReturnError(sql.ErrNoRows)
+		}
+		mock.ExpectExec("INSERT INTO audit_events").
+			WithArgs(sqlmock.AnyArg(), "login_failed", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectLoginFailure(mock, key)
+
+		body := `{"email":"` + email + `","password":"wrong-password"}`
+		rec := httptest.NewRecorder()
+		h.HandleLogin(rec, httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(body)))
+		return rec
+	}
+
+	existing := login("user@example.com", sqlmock.NewRows([]string{"id", "password_hash"}).AddRow("user-1", hash))
+	missing := login("nobody@example.com", nil)
+
+	if existing.Code != http.StatusUnauthorized || missing.Code != existing.Code {
+		t.Errorf("status %d for existing account, %d for missing, want 401", existing.Code, missing.Code)
+	}
+	if existing.Body.String() != missing.Body.String() {
+		t.Errorf("body %q for existing account, %q for missing", existing.Body, missing.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func changePassword(h *Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/user/password", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), UserIDContextKey, "user-1"))
+	rec := httptest.NewRecorder()
+	h.HandleChangePassword(rec, req)
+	return rec
+}
+
+func TestChangePassword_WrongCurrentPasswordCountsAsLoginFailure(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	hash, err := h.Passwords.Hash("correct-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := loginKey("user@example.com")
+
+	mock.ExpectQuery("SELECT password_hash FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+	mock.ExpectQuery("SELECT email FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@example.com"))
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").
+		WithArgs(key).
+		WillReturnError(sql.ErrNoRows)
+	expectLoginFailure(mock, key)
+
+	rec := changePassword(h, `{"currentPassword":"wrong-password","newPassword":"new-password-123"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangePassword_BlockedAfterLoginFailures(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	hash, err := h.Passwords.Hash("correct-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Даже верный пароль не проверяется, пока вход заблокирован
+	mock.ExpectQuery("SELECT password_hash FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+	mock.ExpectQuery("SELECT email FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@example.com"))
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").
+		WithArgs(loginKey("user@example.com")).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(time.Now().Add(15 * time.Minute)))
+
+	rec := changePassword(h, `{"currentPassword":"correct-password","newPassword":"new-password-123"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"log"
 	"net/http"
+	"noteflow/model"
 	"strings"
 	"time"
 )
@@ -19,6 +20,13 @@ func (h *Handler) HandlePresignedUpload(w http.ResponseWriter, r *http.Request)
 	}
 	json.NewDecoder(r.Body).Decode(&req)
 
+	// Сверх лимита (например, после возврата оплаты) файлы доступны только для чтения и удаления
+	limit, used := h.Store.UserRepository.GetUserStorageStats(userID)
+	if used+req.Size > limit {
+		http.Error(w, "Quota Exceeded", 413)
+		return
+	}
+
 	s3Key := fmt.Sprintf("%s/%s", userID, req.ID)
 	// We use the minio client directly here for presigning as it's not a persistence op
 	url, err := h.Store.Minio.PresignedPutObject(context.Background(), h.S3Bucket, s3Key, time.Minute*15)
@@ -109,6 +117,7 @@ func (h *Handler) HandlePermanentDelete(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Final delete failed", 500)
 		return
 	}
+	h.audit(r, userID, model.AuditNoteDeleted, map[string]interface{}{"noteId": noteID, "files": len(keysToDelete)})
 
 	w.WriteHeader(200)
 }
\ No newline at end of file
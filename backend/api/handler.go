@@ -1,26 +1,155 @@
 package api
 
 import (
+	"context"
+	"log"
 	"net/http"
+	"noteflow/auth"
+	"noteflow/config"
+	"noteflow/mail"
+	"noteflow/payments"
 	"noteflow/store"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type contextKey string
 const UserIDContextKey contextKey = "user_id"
+const SessionIDContextKey contextKey = "session_id"
+const ScopesContextKey contextKey = "scopes"
+const AuthMethodContextKey contextKey = "auth_method"
+
+// Способ аутентификации запроса
+const (
+	AuthMethodSession = "session" // access-токен сессии (вход по паролю)
+	AuthMethodToken   = "token"   // personal access token
+	AuthMethodOAuth   = "oauth"   // access-токен стороннего OAuth-клиента
+)
 
 type Handler struct {
-	Store     *store.Store
-	JWTSecret []byte
-	S3Bucket  string
-	Broker    *SSEBroker
+	Store    *store.Store
+	Keys     *auth.KeyManager
+	S3Bucket string
+	Broker   *SSEBroker
+
+	// Passwords хеширует пароли (Argon2id) и проверяет старые хеши bcrypt
+	Passwords *auth.PasswordHasher
+	// dummyHash проверяется при входе в несуществующий аккаунт (выравнивание времени ответа)
+	dummyHash string
+
+	// Задержки и блокировка после неудачных входов в аккаунт
+	Lockout auth.LockoutPolicy
+	// Mailer отправляет письма пользователям; nil, если SMTP не настроен
+	Mailer mail.Sender
+
+	// Прием платежей: PaymentProvider — клиент YooKassa (в DevMode можно ее эмулятор);
+	// nil, если магазин не настроен
+	Payments        config.PaymentsConfig
+	PaymentProvider payments.PaymentProvider
+	// webhookIPs — подсети, с которых принимаются уведомления о платежах (пусто — любые)
+	webhookIPs []string
+	// Автопродление подписок
+	Billing config.BillingConfig
+
+	// Время жизни токенов (из конфигурации)
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	TicketTTL       time.Duration
+
+	// Параметры OAuth2 (device flow, коды авторизации)
+	OAuth config.OAuthConfig
+
+	// Вход через внешние OIDC-провайдеры
+	OIDC          config.OIDCConfig
+	oidcProviders map[string]*oidcProvider
+
+	// Активные WebSocket-соединения (для graceful shutdown)
+	streams sync.WaitGroup
 }
 
-func New(store *store.Store, secret []byte, bucket string) *Handler {
+// New создает обработчики. Если broker == nil, используется in-memory брокер.
+// keys подписывает access-токены и проверяет их в authMiddleware.
+func New(store *store.Store, cfg *config.Config, broker *SSEBroker, keys *auth.KeyManager) *Handler {
+	if broker == nil {
+		broker = NewSSEBroker(DefaultBrokerConfig(), nil)
+	}
+	passwords := auth.NewPasswordHasher(auth.Argon2Params{
+		Memory:      cfg.Auth.PasswordMemoryKiB,
+		Iterations:  cfg.Auth.PasswordIterations,
+		Parallelism: cfg.Auth.PasswordParallelism,
+	})
+	// Хеш случайного пароля с текущими параметрами: совпасть с ним ничто не может
+	dummyHash, err := passwords.Hash(uuid.New().String())
+	if err != nil {
+		log.Printf("Failed to prepare dummy password hash: %v", err)
+	}
+	lockout := auth.LockoutPolicy{
+		FreeAttempts:    cfg.Lockout.FreeAttempts,
+		BaseDelay:       cfg.Lockout.BaseDelay,
+		MaxDelay:        cfg.Lockout.MaxDelay,
+		Threshold:       cfg.Lockout.Threshold,
+		LockoutDuration: cfg.Lockout.Duration,
+		ResetAfter:      cfg.Lockout.ResetAfter,
+	}
+	var mailer mail.Sender
+	if cfg.Mail.SMTPHost != "" {
+		sender, err := mail.NewSMTPSender(mail.Config{
+			Host:     cfg.Mail.SMTPHost,
+			Port:     cfg.Mail.SMTPPort,
+			Username: cfg.Mail.Username,
+			Password: cfg.Mail.Password,
+			From:     cfg.Mail.From,
+		})
+		if err != nil {
+			log.Printf("Mail disabled: %v", err)
+		} else {
+			mailer = sender
+		}
+	}
+	paymentProvider, err := newPaymentProvider(cfg.Payments)
+	if err != nil {
+		log.Printf("Payments disabled: %v", err)
+	}
+	webhookIPs, err := normalizeAllowedIPs(cfg.Payments.WebhookAllowedIPs)
+	if err != nil {
+		log.Printf("Invalid payment webhook IPs, accepting webhooks from any address: %v", err)
+	}
 	return &Handler{
-		Store:     store,
-		JWTSecret: secret,
-		S3Bucket:  bucket,
-		Broker:    NewSSEBroker(),
+		Store:           store,
+		Keys:            keys,
+		Passwords:       passwords,
+		dummyHash:       dummyHash,
+		Lockout:         lockout,
+		Mailer:          mailer,
+		Payments:        cfg.Payments,
+		PaymentProvider: paymentProvider,
+		webhookIPs:      webhookIPs,
+		Billing:         cfg.Billing,
+		S3Bucket:        cfg.S3.Bucket,
+		Broker:          broker,
+		AccessTokenTTL:  cfg.Auth.AccessTokenTTL,
+		RefreshTokenTTL: cfg.Auth.RefreshTokenTTL,
+		TicketTTL:       cfg.Auth.TicketTTL,
+		OAuth:           cfg.OAuth,
+		OIDC:            cfg.OIDC,
+		oidcProviders:   newOIDCProviders(cfg.OIDC),
+	}
+}
+
+// WaitStreams ждет завершения WebSocket-соединений или истечения ctx
+func (h *Handler) WaitStreams(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.streams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -31,4 +160,28 @@ func getUserID(r *http.Request) string {
 		return val
 	}
 	return ""
-}
\ No newline at end of file
+}
+
+// Helper to get SessionID (claim "sid" access-токена) from context
+func getSessionID(r *http.Request) string {
+	if val, ok := r.Context().Value(SessionIDContextKey).(string); ok {
+		return val
+	}
+	return ""
+}
+
+// Helper to get granted scopes from context
+func getScopes(r *http.Request) []string {
+	if val, ok := r.Context().Value(ScopesContextKey).([]string); ok {
+		return val
+	}
+	return nil
+}
+
+// Helper to get auth method (AuthMethodSession / AuthMethodToken) from context
+func getAuthMethod(r *http.Request) string {
+	if val, ok := r.Context().Value(AuthMethodContextKey).(string); ok {
+		return val
+	}
+	return ""
+}
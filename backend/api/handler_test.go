@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"noteflow/auth"
+	"noteflow/config"
+	"noteflow/model"
+	"noteflow/store"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+)
+
+// newMockHandler собирает Handler поверх sqlmock. configure меняет
+// конфигурацию по умолчанию до создания обработчиков.
+func newMockHandler(t *testing.T, configure func(cfg *config.Config)) (*Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := config.Default()
+	// Дешевое хеширование: New хеширует пароль для выравнивания времени входа
+	cfg.Auth.PasswordMemoryKiB = 64
+	cfg.Auth.PasswordIterations = 1
+	cfg.Auth.PasswordParallelism = 1
+	if configure != nil {
+		configure(cfg)
+	}
+	h := New(store.NewWithDB(db, nil), cfg, nil, newTestKeys(t))
+	t.Cleanup(h.Broker.Stop)
+	return h, mock
+}
+
+// withURLParam добавляет в запрос параметр маршрута chi
+func withURLParam(r *http.Request, key, value string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add(key, value)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+// memKeyRepo хранит ключи подписи в памяти (вместо таблицы signing_keys)
+type memKeyRepo struct {
+	mu   sync.Mutex
+	keys []model.SigningKey
+}
+
+func (r *memKeyRepo) ListSigningKeys(ctx context.Context) ([]model.SigningKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]model.SigningKey(nil), r.keys...), nil
+}
+
+func (r *memKeyRepo) CreateSigningKeyIfNeeded(ctx context.Context, key model.SigningKey, coveredUntil time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append(r.keys, key)
+	return true, nil
+}
+
+func (r *memKeyRepo) DeleteExpiredSigningKeys(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+// newTestKeys создает KeyManager с одним действующим ключом
+func newTestKeys(t *testing.T) *auth.KeyManager {
+	t.Helper()
+	keys, err := auth.NewKeyManager(&memKeyRepo{}, auth.KeyManagerConfig{
+		Issuer:           "noteflow-test",
+		AccessTokenTTL:   15 * time.Minute,
+		RotationInterval: 24 * time.Hour,
+		Secret:           []byte("test-secret"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"noteflow/invoice"
+	"noteflow/model"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	billingHistoryLimit    = 50
+	billingHistoryMaxLimit = 100
+)
+
+// HandleListPayments возвращает историю оплат пользователя (новые первыми) с
+// номерами счетов. Query: before (createdAt последней транзакции предыдущей
+// страницы, RFC 3339), limit (по умолчанию 50, не больше 100).
+func (h *Handler) HandleListPayments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var before time.Time
+	if v := q.Get("before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid before: expected RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		before = t
+	}
+	limit := billingHistoryLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, billingHistoryMaxLimit)
+	}
+
+	records, err := h.Store.InvoiceRepository.ListBillingHistory(r.Context(), getUserID(r), before, limit)
+	if err != nil {
+		log.Printf("Failed to list payments of user %s: %v", getUserID(r), err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"payments": records}
+	if len(records) == limit {
+		resp["nextBefore"] = records[len(records)-1].CreatedAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleGetInvoice отдает счет за оплаченный платеж в PDF
+func (h *Handler) HandleGetInvoice(w http.ResponseWriter, r *http.Request) {
+	inv, err := h.Store.InvoiceRepository.GetInvoice(r.Context(), getUserID(r), chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Invoice not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get invoice for payment %s: %v", chi.URLParam(r, "id"), err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	seller := h.Payments.Invoice
+	pdf := invoice.Render(invoice.Invoice{
+		Number:      inv.Number,
+		IssuedAt:    inv.IssuedAt,
+		Seller:      invoice.Seller{Name: seller.Seller, TaxID: seller.TaxID, Address: seller.Address},
+		Customer:    inv.Email,
+		Description: invoiceDescription(inv.Transaction),
+		Amount:      inv.Transaction.Amount,
+		Currency:    inv.Transaction.Currency,
+		VATCode:     h.Payments.Receipt.VATCode,
+		PaymentID:   inv.Transaction.PaymentID,
+	})
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="invoice-%s.pdf"`, inv.Number))
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdf)))
+	w.Write(pdf)
+}
+
+// invoiceDescription — оплаченная услуга в счете (счета на английском)
+func invoiceDescription(t model.Transaction) string {
+	name := string(t.Tier)
+	if plan, ok := model.FindPlan(t.Tier); ok {
+		name = plan.Localize("en", nil).Name
+	}
+	var meta struct {
+		Kind string `json:"kind"`
+	}
+	json.Unmarshal(t.Metadata, &meta)
+	if meta.Kind == model.PaymentUpgrade {
+		return fmt.Sprintf("NoteFlow %s upgrade for the rest of the billing period", name)
+	}
+	period := "1 month"
+	if t.Period == model.PeriodYearly {
+		period = "1 year"
+	}
+	return fmt.Sprintf("NoteFlow %s subscription, %s", name, period)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Блокировка входа по аккаунту. Счетчик ведется по хешу email, а не по userID:
+// для несуществующих email запросы проходят тот же путь (запись ошибки,
+// задержка, 429), поэтому ни ответ, ни время ответа не выдают наличие аккаунта.
+
+// NotificationLoginLocked — уведомление о блокировке входа после неудачных попыток
+const NotificationLoginLocked = "login_locked"
+
+// loginKey — ключ счетчика неудачных попыток для email
+func loginKey(email string) string {
+	return hashToken(strings.ToLower(email))
+}
+
+// writeLoginBlocked отвечает 429 с Retry-After до окончания запрета входа
+func writeLoginBlocked(w http.ResponseWriter, until time.Time) {
+	seconds := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+// recordLoginFailure учитывает неудачный вход. userID пустой, если аккаунта нет.
+// При первом достижении порога блокировки пользователь получает уведомление.
+func (h *Handler) recordLoginFailure(r *http.Request, key, userID, email string) {
+	until, locked, err := h.Store.LoginAttemptRepository.RecordFailure(r.Context(), key, userID, h.Lockout.ResetAfter, h.Lockout.Delay)
+	if err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+		return
+	}
+	if locked && userID != "" {
+		log.Printf("Login for user %s locked until %s after repeated failures", userID, until.Format(time.RFC3339))
+		h.audit(r, userID, model.AuditLoginLocked, map[string]interface{}{"until": until})
+		go h.notifyLoginLocked(userID, email, until)
+	}
+}
+
+// notifyLoginLocked сообщает пользователю о блокировке: в приложении и по почте (если настроена)
+func (h *Handler) notifyLoginLocked(userID, email string, until time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	title := "Sign-in temporarily locked"
+	body := fmt.Sprintf("We noticed repeated failed sign-in attempts to your account. "+
+		"Password sign-in is locked until %s UTC. If this was not you, change your password "+
+		"once the lock expires and review your active sessions.", until.UTC().Format("2006-01-02 15:04"))
+
+	if err := h.Store.NotificationRepository.CreateNotification(ctx, userID, NotificationLoginLocked, title, body); err != nil {
+		log.Printf("Failed to create lockout notification for user %s: %v", userID, err)
+	}
+	if h.Mailer != nil {
+		if err := h.Mailer.Send(ctx, email, title, body); err != nil {
+			log.Printf("Failed to send lockout email to user %s: %v", userID, err)
+		}
+	}
+}
+
+// IsAdmin проверяет права администратора (для requireAdmin)
+func (h *Handler) IsAdmin(ctx context.Context, userID string) (bool, error) {
+	return h.Store.UserRepository.IsAdmin(ctx, userID)
+}
+
+// HandleListLockouts возвращает аккаунты с действующей блокировкой или задержкой входа
+func (h *Handler) HandleListLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := h.Store.LoginAttemptRepository.ListLockouts(r.Context())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lockouts)
+}
+
+// HandleUnlockUser снимает блокировку входа с аккаунта
+func (h *Handler) HandleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(userID); err != nil {
+		http.Error(w, "Lockout not found", http.StatusNotFound)
+		return
+	}
+
+	found, err := h.Store.LoginAttemptRepository.UnlockUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Lockout not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Admin %s unlocked login for user %s", getUserID(r), userID)
+	h.audit(r, userID, model.AuditLoginUnlocked, map[string]interface{}{"adminId": getUserID(r)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListNotifications возвращает последние уведомления пользователя
+func (h *Handler) HandleListNotifications(w http.ResponseWriter, r *http.Request) {
+	notifications, err := h.Store.NotificationRepository.ListNotifications(r.Context(), getUserID(r))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// HandleMarkNotificationsRead отмечает все уведомления пользователя прочитанными
+func (h *Handler) HandleMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	if err := h.Store.NotificationRepository.MarkNotificationsRead(r.Context(), getUserID(r)); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
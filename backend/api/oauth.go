@@ -0,0 +1,905 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"noteflow/auth"
+	"noteflow/clientip"
+	"noteflow/model"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// OAuth2 authorization server для сторонних клиентов (веб-клиппер, CLI).
+//
+// Поддерживаются authorization code + PKCE (S256, обязателен для всех клиентов),
+// device authorization grant (RFC 8628) и refresh_token. Страницы согласия
+// рисует фронтенд: он вызывает /oauth/authorize и /oauth/device от имени
+// вошедшего пользователя. Refresh-токены клиентов хранятся в refresh_tokens
+// с client_id и областями, access-токены несут claims client_id и scope.
+
+const (
+	oauthClientSecretPrefix = "nf_cs_"
+
+	maxOAuthClientsPerUser = 20
+	maxRedirectURIs        = 10
+
+	// Интервал опроса token endpoint в device flow и шаг его увеличения (slow_down)
+	devicePollInterval = 5
+	devicePollSlowDown = 5
+
+	// Код пользователя: 8 символов без гласных и похожих букв (RFC 8628 §6.1)
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// ==================== HELPERS ====================
+
+// writeOAuthError отвечает ошибкой в формате RFC 6749 §5.2
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newUserCode генерирует код вида BDFG-HJKL
+func newUserCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, userCodeLength+1)
+	for i, v := range b {
+		if i == userCodeLength/2 {
+			code = append(code, '-')
+		}
+		// 256 % 20 != 0, но смещение распределения пренебрежимо для одноразового кода
+		code = append(code, userCodeAlphabet[int(v)%len(userCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode приводит введенный пользователем код к виду BDFG-HJKL
+func normalizeUserCode(input string) string {
+	var chars []byte
+	for _, c := range strings.ToUpper(input) {
+		if strings.ContainsRune(userCodeAlphabet, c) {
+			chars = append(chars, byte(c))
+		}
+	}
+	if len(chars) != userCodeLength {
+		return ""
+	}
+	return string(chars[:userCodeLength/2]) + "-" + string(chars[userCodeLength/2:])
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validRedirectURI проверяет redirect URI при регистрации клиента (RFC 8252):
+// https, http только для loopback (CLI) или private-use схема вида com.example.app
+func validRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return errors.New("redirect URI must be absolute: " + raw)
+	}
+	if u.Fragment != "" {
+		return errors.New("redirect URI must not contain a fragment: " + raw)
+	}
+	switch {
+	case u.Scheme == "https" && u.Host != "":
+	case u.Scheme == "http" && isLoopbackHost(u.Hostname()):
+	case strings.Contains(u.Scheme, "."):
+	default:
+		return errors.New("redirect URI must use https, a loopback http address or a private-use scheme: " + raw)
+	}
+	return nil
+}
+
+// redirectURIMatches сравнивает redirect URI запроса с зарегистрированным.
+// Для loopback-адресов порт не учитывается: CLI получает его от ОС (RFC 8252 §7.3).
+func redirectURIMatches(registered, requested string) bool {
+	if registered == requested {
+		return true
+	}
+	reg, err1 := url.Parse(registered)
+	req, err2 := url.Parse(requested)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	if reg.Scheme != "http" || !isLoopbackHost(reg.Hostname()) {
+		return false
+	}
+	return req.Scheme == reg.Scheme &&
+		req.Hostname() == reg.Hostname() &&
+		req.Path == reg.Path &&
+		req.RawQuery == reg.RawQuery &&
+		req.Fragment == ""
+}
+
+// resolveScopes разбирает параметр scope; пустой запрос означает все области клиента
+func resolveScopes(scope string, allowed []string) ([]string, bool) {
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return allowed, len(allowed) > 0
+	}
+	scopes, ok := auth.NormalizeScopes(requested)
+	if !ok || !auth.HasScopes(allowed, scopes...) {
+		return nil, false
+	}
+	return scopes, true
+}
+
+// mergeScopes объединяет согласованные ранее и новые области
+func mergeScopes(a, b []string) []string {
+	merged, _ := auth.NormalizeScopes(append(slices.Clone(a), b...))
+	return merged
+}
+
+// narrowScopes оставляет из выданных областей granted только запрошенные
+func narrowScopes(granted, requested []string) []string {
+	var out []string
+	for _, s := range granted {
+		if slices.Contains(requested, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// clientInfo — публичные сведения о клиенте для страницы согласия
+func clientInfo(c *model.OAuthClient) map[string]string {
+	return map[string]string{
+		"clientId": c.ID,
+		"name":     c.Name,
+	}
+}
+
+// ==================== CLIENT REGISTRATION ====================
+
+// HandleCreateOAuthClient регистрирует OAuth-клиента пользователя.
+// Секрет конфиденциального клиента возвращается один раз.
+func (h *Handler) HandleCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024) // 10 KB
+	var req model.CreateOAuthClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > 100 {
+		http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.GrantTypes) == 0 {
+		req.GrantTypes = []string{model.GrantAuthorizationCode, model.GrantRefreshToken}
+	}
+	for _, g := range req.GrantTypes {
+		switch g {
+		case model.GrantAuthorizationCode, model.GrantRefreshToken, model.GrantDeviceCode:
+		default:
+			http.Error(w, "Unsupported grant type: "+g, http.StatusBadRequest)
+			return
+		}
+	}
+	slices.Sort(req.GrantTypes)
+	req.GrantTypes = slices.Compact(req.GrantTypes)
+
+	if slices.Contains(req.GrantTypes, model.GrantAuthorizationCode) && len(req.RedirectURIs) == 0 {
+		http.Error(w, "authorization_code grant requires at least one redirect URI", http.StatusBadRequest)
+		return
+	}
+	if len(req.RedirectURIs) > maxRedirectURIs {
+		http.Error(w, "Too many redirect URIs", http.StatusBadRequest)
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if err := validRedirectURI(uri); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	scopes := auth.AllScopes
+	if len(req.Scopes) > 0 {
+		var ok bool
+		if scopes, ok = auth.NormalizeScopes(req.Scopes); !ok {
+			http.Error(w, "Invalid scopes, allowed: "+strings.Join(auth.AllScopes, ", "), http.StatusBadRequest)
+			return
+		}
+	}
+
+	clients, err := h.Store.OAuthRepository.ListClients(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(clients) >= maxOAuthClientsPerUser {
+		http.Error(w, "Too many OAuth clients", http.StatusConflict)
+		return
+	}
+
+	clientID, err := randomString(16)
+	if err != nil {
+		http.Error(w, "Generation failed", http.StatusInternalServerError)
+		return
+	}
+	client := model.OAuthClient{
+		ID:           clientID,
+		OwnerUserID:  userID,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		GrantTypes:   req.GrantTypes,
+		Scopes:       scopes,
+	}
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+
+	var secret string
+	if req.Confidential {
+		raw, err := randomString(32)
+		if err != nil {
+			http.Error(w, "Generation failed", http.StatusInternalServerError)
+			return
+		}
+		secret = oauthClientSecretPrefix + raw
+		secretHash := hashToken(secret)
+		client.SecretHash = &secretHash
+	}
+
+	if err := h.Store.OAuthRepository.CreateClient(r.Context(), &client); err != nil {
+		log.Printf("Failed to create OAuth client for user %s: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(model.CreateOAuthClientResponse{OAuthClient: client, ClientSecret: secret})
+}
+
+// HandleListOAuthClients возвращает клиентов, зарегистрированных пользователем
+func (h *Handler) HandleListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := h.Store.OAuthRepository.ListClients(r.Context(), getUserID(r))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clients)
+}
+
+// HandleDeleteOAuthClient удаляет клиента вместе с выданными ему токенами
+func (h *Handler) HandleDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	found, err := h.Store.OAuthRepository.DeleteClient(r.Context(), getUserID(r), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ==================== AUTHORIZATION CODE + PKCE ====================
+
+// authorizeRequest — параметры запроса авторизации (RFC 6749 §4.1.1, RFC 7636)
+type authorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// checkAuthorizeRequest проверяет запрос авторизации. Ошибки клиента и
+// redirect URI возвращаются пользователю, а не на redirect URI (RFC 6749 §4.1.2.1).
+func (h *Handler) checkAuthorizeRequest(ctx context.Context, req authorizeRequest) (*model.OAuthClient, []string, int, string) {
+	client, err := h.Store.OAuthRepository.GetClient(ctx, req.ClientID)
+	if err == sql.ErrNoRows {
+		return nil, nil, http.StatusBadRequest, "Unknown client"
+	} else if err != nil {
+		return nil, nil, http.StatusInternalServerError, "Database error"
+	}
+	if !slices.Contains(client.GrantTypes, model.GrantAuthorizationCode) {
+		return nil, nil, http.StatusBadRequest, "Client is not allowed to use the authorization code grant"
+	}
+	if !slices.ContainsFunc(client.RedirectURIs, func(reg string) bool { return redirectURIMatches(reg, req.RedirectURI) }) {
+		return nil, nil, http.StatusBadRequest, "Redirect URI is not registered for this client"
+	}
+	if req.ResponseType != "code" {
+		return nil, nil, http.StatusBadRequest, "response_type must be code"
+	}
+	if req.CodeChallengeMethod != auth.PKCEMethodS256 || !auth.ValidCodeChallenge(req.CodeChallenge) {
+		return nil, nil, http.StatusBadRequest, "PKCE with code_challenge_method=S256 is required"
+	}
+	if len(req.State) > 512 {
+		return nil, nil, http.StatusBadRequest, "state is too long"
+	}
+	scopes, ok := resolveScopes(req.Scope, client.Scopes)
+	if !ok {
+		return nil, nil, http.StatusBadRequest, "Invalid scope"
+	}
+	return client, scopes, 0, ""
+}
+
+// HandleAuthorizeInfo возвращает фронтенду сведения для страницы согласия:
+// клиент, запрошенные области и нужно ли спрашивать пользователя
+func (h *Handler) HandleAuthorizeInfo(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := authorizeRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+
+	client, scopes, status, msg := h.checkAuthorizeRequest(r.Context(), req)
+	if client == nil {
+		http.Error(w, msg, status)
+		return
+	}
+
+	consented, err := h.Store.OAuthRepository.GetConsentScopes(r.Context(), getUserID(r), client.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"client":          clientInfo(client),
+		"scopes":          scopes,
+		"redirectUri":     req.RedirectURI,
+		"state":           req.State,
+		"consentRequired": !auth.HasScopes(consented, scopes...),
+	})
+}
+
+// HandleAuthorizeDecision принимает решение пользователя и возвращает URL,
+// на который фронтенд перенаправляет браузер (с code или error=access_denied)
+func (h *Handler) HandleAuthorizeDecision(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024) // 10 KB
+	var req struct {
+		authorizeRequest
+		Approve bool `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	client, scopes, status, msg := h.checkAuthorizeRequest(r.Context(), req.authorizeRequest)
+	if client == nil {
+		http.Error(w, msg, status)
+		return
+	}
+
+	redirect, _ := url.Parse(req.RedirectURI)
+	params := redirect.Query()
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	if !req.Approve {
+		params.Set("error", "access_denied")
+	} else {
+		consented, err := h.Store.OAuthRepository.GetConsentScopes(r.Context(), userID, client.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := h.Store.OAuthRepository.SaveConsent(r.Context(), userID, client.ID, mergeScopes(consented, scopes)); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		code, err := randomString(32)
+		if err != nil {
+			http.Error(w, "Generation failed", http.StatusInternalServerError)
+			return
+		}
+		err = h.Store.OAuthRepository.CreateAuthorizationCode(r.Context(), model.OAuthAuthorizationCode{
+			CodeHash:      hashToken(code),
+			ClientID:      client.ID,
+			UserID:        userID,
+			RedirectURI:   req.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: req.CodeChallenge,
+			ExpiresAt:     time.Now().Add(h.OAuth.AuthorizationCodeTTL),
+		})
+		if err != nil {
+			log.Printf("Failed to create authorization code: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		params.Set("code", code)
+	}
+	redirect.RawQuery = params.Encode()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"redirectUri": redirect.String()})
+}
+
+// ==================== DEVICE AUTHORIZATION GRANT ====================
+
+// HandleDeviceAuthorization выдает device_code и user_code (RFC 8628 §3.1-3.2)
+func (h *Handler) HandleDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024) // 10 KB
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if !slices.Contains(client.GrantTypes, model.GrantDeviceCode) {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Client is not allowed to use the device grant")
+		return
+	}
+	scopes, ok := resolveScopes(r.PostForm.Get("scope"), client.Scopes)
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Invalid scope")
+		return
+	}
+
+	deviceCode, err := randomString(32)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Generation failed")
+		return
+	}
+
+	// user_code короткий: при редкой коллизии с действующим кодом пробуем еще раз
+	var userCode string
+	for attempt := 0; attempt < 3; attempt++ {
+		if userCode, err = newUserCode(); err != nil {
+			break
+		}
+		err = h.Store.OAuthRepository.CreateDeviceCode(r.Context(), model.OAuthDeviceCode{
+			DeviceCodeHash: hashToken(deviceCode),
+			UserCode:       userCode,
+			ClientID:       client.ID,
+			Scopes:         scopes,
+			PollInterval:   devicePollInterval,
+			ExpiresAt:      time.Now().Add(h.OAuth.DeviceCodeTTL),
+		})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to create device code: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return
+	}
+
+	complete, _ := url.Parse(h.OAuth.DeviceVerificationURI)
+	q := complete.Query()
+	q.Set("user_code", userCode)
+	complete.RawQuery = q.Encode()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          h.OAuth.DeviceVerificationURI,
+		"verification_uri_complete": complete.String(),
+		"expires_in":                int(h.OAuth.DeviceCodeTTL.Seconds()),
+		"interval":                  devicePollInterval,
+	})
+}
+
+// HandleDeviceInfo возвращает фронтенду сведения о запросе по коду пользователя
+func (h *Handler) HandleDeviceInfo(w http.ResponseWriter, r *http.Request) {
+	userCode := normalizeUserCode(r.URL.Query().Get("user_code"))
+	if userCode == "" {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	dc, err := h.Store.OAuthRepository.GetPendingDeviceCode(r.Context(), userCode)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Code not found or expired", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	client, err := h.Store.OAuthRepository.GetClient(r.Context(), dc.ClientID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"client":   clientInfo(client),
+		"scopes":   dc.Scopes,
+		"userCode": dc.UserCode,
+	})
+}
+
+// HandleDeviceDecision фиксирует решение пользователя по коду устройства
+func (h *Handler) HandleDeviceDecision(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 5*1024) // 5 KB
+	var req struct {
+		UserCode string `json:"user_code"`
+		Approve  bool   `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	userCode := normalizeUserCode(req.UserCode)
+	if userCode == "" {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	dc, err := h.Store.OAuthRepository.GetPendingDeviceCode(r.Context(), userCode)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Code not found or expired", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	status := model.DeviceCodeDenied
+	if req.Approve {
+		status = model.DeviceCodeApproved
+		consented, err := h.Store.OAuthRepository.GetConsentScopes(r.Context(), userID, dc.ClientID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := h.Store.OAuthRepository.SaveConsent(r.Context(), userID, dc.ClientID, mergeScopes(consented, dc.Scopes)); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	decided, err := h.Store.OAuthRepository.DecideDeviceCode(r.Context(), userCode, userID, status)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !decided {
+		http.Error(w, "Code not found or expired", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// ==================== TOKEN ENDPOINT ====================
+
+// authenticateClient определяет клиента по HTTP Basic или client_id/client_secret
+// в форме. Конфиденциальный клиент обязан предъявить секрет. При ошибке
+// ответ уже записан.
+func (h *Handler) authenticateClient(w http.ResponseWriter, r *http.Request) (*model.OAuthClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 §2.3.1: значения в Basic закодированы как form-urlencoded
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
+
+	client, err := h.Store.OAuthRepository.GetClient(r.Context(), clientID)
+	if err == sql.ErrNoRows {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return nil, false
+	}
+
+	if client.Confidential() {
+		if secret == "" || subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(*client.SecretHash)) != 1 {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+			return nil, false
+		}
+	}
+	return client, true
+}
+
+// HandleOAuthToken — token endpoint (RFC 6749 §3.2)
+func (h *Handler) HandleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024) // 10 KB
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Malformed form body")
+		return
+	}
+
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if !slices.Contains(client.GrantTypes, grantType) {
+		switch grantType {
+		case model.GrantAuthorizationCode, model.GrantRefreshToken, model.GrantDeviceCode:
+			writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Client is not allowed to use this grant type")
+		default:
+			writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type")
+		}
+		return
+	}
+
+	switch grantType {
+	case model.GrantAuthorizationCode:
+		h.grantAuthorizationCode(w, r, client)
+	case model.GrantRefreshToken:
+		h.grantRefreshToken(w, r, client)
+	case model.GrantDeviceCode:
+		h.grantDeviceCode(w, r, client)
+	}
+}
+
+func (h *Handler) grantAuthorizationCode(w http.ResponseWriter, r *http.Request, client *model.OAuthClient) {
+	verifier := r.PostForm.Get("code_verifier")
+	if !auth.ValidCodeVerifier(verifier) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	// Клиент, redirect_uri и PKCE сверяются при погашении: неподходящий запрос код не тратит
+	code, err := h.Store.OAuthRepository.ConsumeAuthorizationCode(r.Context(), hashToken(r.PostForm.Get("code")),
+		client.ID, r.PostForm.Get("redirect_uri"), auth.PKCEChallenge(verifier))
+	if err == sql.ErrNoRows {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return
+	}
+
+	h.issueClientTokens(w, r, client.ID, code.UserID, code.Scopes)
+}
+
+func (h *Handler) grantRefreshToken(w http.ResponseWriter, r *http.Request, client *model.OAuthClient) {
+	refreshToken := r.PostForm.Get("refresh_token")
+	if refreshToken == "" || len(refreshToken) > 512 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "refresh_token is required")
+		return
+	}
+
+	// Клиент может запросить access-токен с более узкими областями (RFC 6749 §6);
+	// refresh-токен сохраняет исходные. Области сверяются до ротации, чтобы
+	// отказ invalid_scope не сжег refresh-токен клиента.
+	requested := strings.Fields(r.PostForm.Get("scope"))
+	if len(requested) > 0 {
+		granted, err := h.Store.SessionRepository.GetRefreshTokenScopes(r.Context(), hashToken(refreshToken), client.ID)
+		if err == sql.ErrNoRows {
+			h.checkRefreshTokenReuse(r, hashToken(refreshToken))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+			return
+		} else if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+			return
+		}
+		if len(narrowScopes(granted, requested)) == 0 {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Requested scope was not granted")
+			return
+		}
+	}
+
+	newRefresh, err := newOpaqueToken()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Generation failed")
+		return
+	}
+
+	// Ротация в рамках той же сессии; токен другого клиента или сессии GLYF не подойдет
+	userID, sessionID, scopes, err := h.Store.SessionRepository.RotateRefreshToken(r.Context(), hashToken(refreshToken), hashToken(newRefresh), client.ID, clientip.FromRequest(r), r.UserAgent(), h.RefreshTokenTTL)
+	if err == sql.ErrNoRows {
+		h.checkRefreshTokenReuse(r, hashToken(refreshToken))
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return
+	}
+
+	accessScopes := scopes
+	if len(requested) > 0 {
+		accessScopes = narrowScopes(scopes, requested)
+	}
+
+	h.writeClientTokens(w, r, userID, sessionID, client.ID, accessScopes, newRefresh)
+}
+
+func (h *Handler) grantDeviceCode(w http.ResponseWriter, r *http.Request, client *model.OAuthClient) {
+	deviceCodeHash := hashToken(r.PostForm.Get("device_code"))
+
+	dc, err := h.Store.OAuthRepository.GetDeviceCode(r.Context(), deviceCodeHash)
+	if err == sql.ErrNoRows || (err == nil && dc.ClientID != client.ID) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return
+	}
+
+	now := time.Now()
+	if now.After(dc.ExpiresAt) {
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "Device code expired")
+		return
+	}
+
+	switch dc.Status {
+	case model.DeviceCodePending:
+		// Клиент опрашивает чаще, чем разрешено: увеличиваем интервал (RFC 8628 §3.5)
+		interval := dc.PollInterval
+		slowDown := dc.LastPolledAt != nil && now.Sub(*dc.LastPolledAt) < time.Duration(interval)*time.Second
+		if slowDown {
+			interval += devicePollSlowDown
+		}
+		if err := h.Store.OAuthRepository.TouchDeviceCode(r.Context(), deviceCodeHash, interval); err != nil {
+			log.Printf("Failed to update device code poll time: %v", err)
+		}
+		if slowDown {
+			writeOAuthError(w, http.StatusBadRequest, "slow_down", "Polling too fast, new interval is "+strconv.Itoa(interval)+"s")
+		} else {
+			writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "The user has not yet approved the request")
+		}
+
+	case model.DeviceCodeDenied:
+		h.Store.OAuthRepository.ConsumeDeviceCode(r.Context(), deviceCodeHash, model.DeviceCodeDenied)
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "The user denied the request")
+
+	case model.DeviceCodeApproved:
+		approved, err := h.Store.OAuthRepository.ConsumeDeviceCode(r.Context(), deviceCodeHash, model.DeviceCodeApproved)
+		if err == sql.ErrNoRows || (err == nil && approved.UserID == nil) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Device code already used")
+			return
+		} else if err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+			return
+		}
+		h.issueClientTokens(w, r, client.ID, *approved.UserID, approved.Scopes)
+
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+	}
+}
+
+// issueClientTokens открывает новую сессию клиента: refresh-токен в refresh_tokens
+// (с client_id и областями) и access-токен с claims client_id и scope
+func (h *Handler) issueClientTokens(w http.ResponseWriter, r *http.Request, clientID, userID string, scopes []string) {
+	sessionID := uuid.New().String()
+
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Generation failed")
+		return
+	}
+	err = h.Store.SessionRepository.CreateClientRefreshToken(r.Context(), hashToken(refreshToken), userID, sessionID, clientID, scopes, clientip.FromRequest(r), r.UserAgent(), h.RefreshTokenTTL)
+	if err != nil {
+		log.Printf("Failed to create refresh token for client %s: %v", clientID, err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Database error")
+		return
+	}
+
+	h.writeClientTokens(w, r, userID, sessionID, clientID, scopes, refreshToken)
+}
+
+func (h *Handler) writeClientTokens(w http.ResponseWriter, r *http.Request, userID, sessionID, clientID string, scopes []string, refreshToken string) {
+	scope := strings.Join(scopes, " ")
+	accessToken, err := h.Keys.Sign(r.Context(), auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: userID},
+		SessionID:        sessionID,
+		ClientID:         clientID,
+		Scope:            scope,
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Generation failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(model.OAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(h.AccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	})
+}
+
+// ==================== CONSENTS ====================
+
+// HandleListConsents возвращает приложения, которым пользователь выдал доступ
+func (h *Handler) HandleListConsents(w http.ResponseWriter, r *http.Request) {
+	consents, err := h.Store.OAuthRepository.ListConsents(r.Context(), getUserID(r))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(consents)
+}
+
+// HandleRevokeConsent отзывает доступ приложения и его refresh-токены.
+// Выданные access-токены истекают сами (AccessTokenTTL).
+func (h *Handler) HandleRevokeConsent(w http.ResponseWriter, r *http.Request) {
+	found, err := h.Store.OAuthRepository.RevokeConsent(r.Context(), getUserID(r), chi.URLParam(r, "clientId"))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Consent not found", http.StatusNotFound)
+		return
+	}
+	h.audit(r, getUserID(r), model.AuditConsentRevoked, map[string]interface{}{"clientId": chi.URLParam(r, "clientId")})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,336 @@
+package api
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"noteflow/auth"
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValidRedirectURI(t *testing.T) {
+	valid := []string{
+		"https://clipper.example.com/callback",
+		"http://127.0.0.1/callback",
+		"http://[::1]:8080/cb",
+		"http://localhost:3000/cb",
+		"com.example.clipper:/oauth",
+	}
+	for _, uri := range valid {
+		if err := validRedirectURI(uri); err != nil {
+			t.Errorf("%s: unexpected error %v", uri, err)
+		}
+	}
+
+	invalid := []string{
+		"http://example.com/callback",
+		"https://example.com/cb#frag",
+		"/relative/path",
+		"javascript:alert(1)",
+		"",
+	}
+	for _, uri := range invalid {
+		if err := validRedirectURI(uri); err == nil {
+			t.Errorf("%s: expected error", uri)
+		}
+	}
+}
+
+func TestRedirectURIMatches(t *testing.T) {
+	tests := []struct {
+		registered, requested string
+		want                  bool
+	}{
+		{"https://example.com/cb", "https://example.com/cb", true},
+		{"https://example.com/cb", "https://example.com/cb/", false},
+		{"https://example.com/cb", "https://example.com:8443/cb", false},
+		// Для loopback порт выбирает ОС
+		{"http://127.0.0.1/cb", "http://127.0.0.1:51234/cb", true},
+		{"http://127.0.0.1/cb", "http://127.0.0.1:51234/other", false},
+		{"http://127.0.0.1/cb", "http://localhost:51234/cb", false},
+		{"http://127.0.0.1/cb", "https://127.0.0.1:51234/cb", false},
+	}
+	for _, tt := range tests {
+		if got := redirectURIMatches(tt.registered, tt.requested); got != tt.want {
+			t.Errorf("redirectURIMatches(%q, %q) = %v, want %v", tt.registered, tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestUserCode(t *testing.T) {
+	code, err := newUserCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != userCodeLength+1 || code[userCodeLength/2] != '-' {
+		t.Fatalf("unexpected user code format %q", code)
+	}
+	if normalizeUserCode(code) != code {
+		t.Errorf("normalizeUserCode(%q) changed a valid code", code)
+	}
+
+	if got := normalizeUserCode(" bdfg hjkl "); got != "BDFG-HJKL" {
+		t.Errorf("got %q, want BDFG-HJKL", got)
+	}
+	for _, bad := range []string{"BDFG-HJK", "BDFG-HJKLM", ""} {
+		if got := normalizeUserCode(bad); got != "" {
+			t.Errorf("normalizeUserCode(%q) = %q, want empty", bad, got)
+		}
+	}
+	if strings.ContainsAny(code, "AEIOUY") {
+		t.Errorf("user code %q contains vowels", code)
+	}
+}
+
+const (
+	testClientID    = "client-1"
+	testRedirectURI = "https://clipper.example.com/callback"
+	testVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+var oauthClientColumns = []string{"id", "owner_user_id", "name", "secret_hash", "redirect_uris", "grant_types", "scopes", "created_at"}
+
+// expectPublicClient ожидает загрузку публичного клиента с разрешенными grant types
+func expectPublicClient(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE id = $1")).
+		WithArgs(testClientID).
+		WillReturnRows(sqlmock.NewRows(oauthClientColumns).AddRow(
+			testClientID, "owner-1", "Clipper", nil,
+			[]byte(`["`+testRedirectURI+`"]`),
+			[]byte(`["authorization_code","refresh_token","urn:ietf:params:oauth:grant-type:device_code"]`),
+			[]byte(`["notes:read"]`), time.Now()))
+}
+
+func postToken(h *Handler, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.HandleOAuthToken(rec, req)
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec, body
+}
+
+func codeForm(code, redirectURI, verifier string) url.Values {
+	return url.Values{
+		"grant_type":    {model.GrantAuthorizationCode},
+		"client_id":     {testClientID},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+}
+
+func TestOAuthToken_AuthorizationCodeExchange(t *testing.T) {
+	codeColumns := []string{"code_hash", "client_id", "user_id", "redirect_uri", "scopes", "code_challenge", "expires_at"}
+	consume := regexp.QuoteMeta("DELETE FROM oauth_authorization_codes")
+
+	tests := []struct {
+		name        string
+		form        url.Values
+		clientID    string
+		redirectURI string
+		// consumed — код найден по всем условиям и удален
+		consumed   bool
+		wantStatus int
+		wantError  string
+	}{
+		{"valid PKCE", codeForm("code-1", testRedirectURI, testVerifier), testClientID, testRedirectURI, true, http.StatusOK, ""},
+		{"wrong verifier", codeForm("code-1", testRedirectURI, strings.Repeat("x", 43)), testClientID, testRedirectURI, false, http.StatusBadRequest, "invalid_grant"},
+		{"wrong redirect URI", codeForm("code-1", "https://evil.example.com/cb", testVerifier), testClientID, "https://evil.example.com/cb", false, http.StatusBadRequest, "invalid_grant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t, nil)
+			expectPublicClient(mock)
+			// Клиент, redirect_uri и challenge входят в условие удаления:
+			// неподходящий запрос код не гасит
+			rows := sqlmock.NewRows(codeColumns)
+			if tt.consumed {
+				rows.AddRow(hashToken("code-1"), testClientID, "user-1", testRedirectURI, []byte(`["notes:read"]`), auth.PKCEChallenge(testVerifier), time.Now().Add(time.Minute))
+			}
+			mock.ExpectQuery(consume).
+				WithArgs(hashToken("code-1"), tt.clientID, tt.redirectURI, auth.PKCEChallenge(tt.form.Get("code_verifier"))).
+				WillReturnRows(rows)
+			if tt.consumed {
+				mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			rec, body := postToken(h, tt.form)
+			if rec.Code != tt.wantStatus || (tt.wantError != "" && body["error"] != tt.wantError) {
+				t.Fatalf("status %d, body %v", rec.Code, body)
+			}
+			access, _ := body["access_token"].(string)
+			refresh, _ := body["refresh_token"].(string)
+			if tt.consumed && (access == "" || refresh == "" || body["scope"] != "notes:read") {
+				t.Errorf("unexpected token response: %v", body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestOAuthToken_MalformedVerifierDoesNotTouchCode(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	expectPublicClient(mock)
+
+	rec, body := postToken(h, codeForm("code-1", testRedirectURI, "short"))
+	if rec.Code != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("status %d, body %v", rec.Code, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOAuthToken_WrongClientCannotUseCode(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE id = $1")).
+		WithArgs("client-2").
+		WillReturnRows(sqlmock.NewRows(oauthClientColumns).AddRow(
+			"client-2", "owner-2", "Other", nil, []byte(`["`+testRedirectURI+`"]`), []byte(`["authorization_code"]`), []byte(`["notes:read"]`), time.Now()))
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM oauth_authorization_codes")).
+		WithArgs(hashToken("code-1"), "client-2", testRedirectURI, auth.PKCEChallenge(testVerifier)).
+		WillReturnError(sql.ErrNoRows)
+
+	form := codeForm("code-1", testRedirectURI, testVerifier)
+	form.Set("client_id", "client-2")
+	rec, body := postToken(h, form)
+	if rec.Code != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("status %d, body %v", rec.Code, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOAuthToken_ReusedCodeRejected(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	consume := regexp.QuoteMeta("DELETE FROM oauth_authorization_codes")
+	args := []driver.Value{hashToken("code-1"), testClientID, testRedirectURI, auth.PKCEChallenge(testVerifier)}
+
+	expectPublicClient(mock)
+	mock.ExpectQuery(consume).WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"code_hash", "client_id", "user_id", "redirect_uri", "scopes", "code_challenge", "expires_at"}).
+			AddRow(hashToken("code-1"), testClientID, "user-1", testRedirectURI, []byte(`["notes:read"]`), auth.PKCEChallenge(testVerifier), time.Now().Add(time.Minute)))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	// Код уже удален
+	expectPublicClient(mock)
+	mock.ExpectQuery(consume).WithArgs(args...).WillReturnError(sql.ErrNoRows)
+
+	if rec, _ := postToken(h, codeForm("code-1", testRedirectURI, testVerifier)); rec.Code != http.StatusOK {
+		t.Fatalf("first exchange: status %d", rec.Code)
+	}
+	rec, body := postToken(h, codeForm("code-1", testRedirectURI, testVerifier))
+	if rec.Code != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Fatalf("reused code: status %d, body %v", rec.Code, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOAuthToken_DevicePolling(t *testing.T) {
+	deviceColumns := []string{"device_code_hash", "user_code", "client_id", "scopes", "status", "user_id", "poll_interval", "last_polled_at", "expires_at"}
+	now := time.Now()
+	justPolled := now.Add(-time.Second)
+
+	tests := []struct {
+		name       string
+		lastPolled interface{}
+		expiresAt  time.Time
+		// newInterval — интервал, сохраненный при опросе (0 — опрос не записывается)
+		newInterval int
+		wantError   string
+	}{
+		{"first poll", nil, now.Add(10 * time.Minute), 5, "authorization_pending"},
+		{"polling too fast", justPolled, now.Add(10 * time.Minute), 5 + devicePollSlowDown, "slow_down"},
+		{"expired", nil, now.Add(-time.Second), 0, "expired_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t, nil)
+			expectPublicClient(mock)
+			mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_device_codes WHERE device_code_hash = $1")).
+				WithArgs(hashToken("device-1")).
+				WillReturnRows(sqlmock.NewRows(deviceColumns).AddRow(
+					hashToken("device-1"), "ABCD-EFGH", testClientID, []byte(`["notes:read"]`), model.DeviceCodePending, nil, 5, tt.lastPolled, tt.expiresAt))
+			if tt.newInterval > 0 {
+				mock.ExpectExec("UPDATE oauth_device_codes SET last_polled_at").
+					WithArgs(hashToken("device-1"), tt.newInterval).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			rec, body := postToken(h, url.Values{
+				"grant_type":  {model.GrantDeviceCode},
+				"client_id":   {testClientID},
+				"device_code": {"device-1"},
+			})
+			if rec.Code != http.StatusBadRequest || body["error"] != tt.wantError {
+				t.Fatalf("status %d, body %v", rec.Code, body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestOAuthToken_RefreshScopeCheckedBeforeRotation(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	scopesQuery := regexp.QuoteMeta("SELECT scopes FROM refresh_tokens")
+	refreshForm := func(scope string) url.Values {
+		return url.Values{
+			"grant_type":    {model.GrantRefreshToken},
+			"client_id":     {testClientID},
+			"refresh_token": {"refresh-1"},
+			"scope":         {scope},
+		}
+	}
+
+	// Область не выдана: отказ без ротации, токен остается действующим
+	expectPublicClient(mock)
+	mock.ExpectQuery(scopesQuery).
+		WithArgs(hashToken("refresh-1"), testClientID).
+		WillReturnRows(sqlmock.NewRows([]string{"scopes"}).AddRow([]byte(`["notes:read","files:read"]`)))
+	rec, body := postToken(h, refreshForm("files:write"))
+	if rec.Code != http.StatusBadRequest || body["error"] != "invalid_scope" {
+		t.Fatalf("ungranted scope: status %d, body %v", rec.Code, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Тот же токен с выданной областью ротируется, access-токен сужен
+	expectPublicClient(mock)
+	mock.ExpectQuery(scopesQuery).
+		WithArgs(hashToken("refresh-1"), testClientID).
+		WillReturnRows(sqlmock.NewRows([]string{"scopes"}).AddRow([]byte(`["notes:read","files:read"]`)))
+	mock.ExpectBegin()
+	mock.ExpectQuery("DELETE FROM refresh_tokens").
+		WithArgs(hashToken("refresh-1"), testClientID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "session_id", "client_id", "scopes", "expires_at"}).
+			AddRow("user-1", "session-1", testClientID, []byte(`["notes:read","files:read"]`), time.Now().Add(time.Hour)))
+	mock.ExpectExec("INSERT INTO rotated_refresh_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	rec, body = postToken(h, refreshForm("notes:read"))
+	if rec.Code != http.StatusOK || body["scope"] != "notes:read" || body["refresh_token"] == "" {
+		t.Fatalf("granted scope: status %d, body %v", rec.Code, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,500 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"noteflow/auth"
+	"noteflow/clientip"
+	"noteflow/config"
+	"noteflow/model"
+	"noteflow/oidc"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Вход через внешние OpenID Connect провайдеры (корпоративный IdP).
+//
+// Поток: фронтенд открывает /auth/oidc/{provider}/login, API перенаправляет на IdP,
+// IdP возвращает пользователя на /auth/oidc/{provider}/callback. API проверяет
+// ID-токен, находит или создает пользователя и перенаправляет браузер на
+// страницу фронтенда с одноразовым кодом, который фронтенд обменивает на токены
+// через POST /auth/oidc/token. Токены не попадают в URL и историю браузера.
+//
+// Пароль от IdP не подходит для E2EE: мастер-ключ хранится в хранилище (vault),
+// зашифрованный на клиенте отдельной парольной фразой (см. HandleGetVault).
+
+const (
+	// Время жизни кода обмена результата входа на токены
+	oidcLoginCodeTTL = time.Minute
+
+	maxVaultWrappedKeySize = 4 * 1024
+	maxVaultKDFSize        = 1024
+)
+
+// Коды ошибок, с которыми браузер возвращается на фронтенд
+const (
+	oidcErrAccessDenied     = "access_denied"
+	oidcErrLoginFailed      = "login_failed"
+	oidcErrInvalidState     = "invalid_state"
+	oidcErrDomainNotAllowed = "domain_not_allowed"
+	oidcErrEmailNotVerified = "email_not_verified"
+	oidcErrAccountExists    = "account_exists" // есть аккаунт с этим email: войдите паролем и привяжите провайдера
+	oidcErrSignupDisabled   = "signup_disabled"
+	oidcErrIdentityInUse    = "identity_in_use" // учетная запись IdP привязана к другому пользователю
+	oidcErrAlreadyLinked    = "already_linked"  // у пользователя уже привязана другая учетная запись этого IdP
+)
+
+// oidcProvider — настроенный провайдер и его клиент
+type oidcProvider struct {
+	config.OIDCProvider
+	client *oidc.Provider
+}
+
+// newOIDCProviders создает клиентов для провайдеров из конфигурации
+func newOIDCProviders(cfg config.OIDCConfig) map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider, len(cfg.Providers))
+	base := strings.TrimSuffix(cfg.CallbackBaseURL, "/")
+	for _, p := range cfg.Providers {
+		scopes := p.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"email", "profile"}
+		}
+		providers[p.ID] = &oidcProvider{
+			OIDCProvider: p,
+			client: oidc.NewProvider(oidc.Config{
+				Issuer:       p.Issuer,
+				ClientID:     p.ClientID,
+				ClientSecret: p.ClientSecret,
+				Scopes:       scopes,
+				RedirectURL:  base + "/auth/oidc/" + p.ID + "/callback",
+			}, nil),
+		}
+	}
+	return providers
+}
+
+// emailDomainAllowed проверяет домен email по списку провайдера (пустой список — любой домен)
+func emailDomainAllowed(email string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	return slices.ContainsFunc(domains, func(d string) bool { return strings.EqualFold(d, domain) })
+}
+
+func (h *Handler) provider(r *http.Request) *oidcProvider {
+	return h.oidcProviders[chi.URLParam(r, "provider")]
+}
+
+// HandleOIDCProviders возвращает провайдеры для кнопок входа
+func (h *Handler) HandleOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	type providerInfo struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	providers := []providerInfo{}
+	for _, p := range h.OIDC.Providers {
+		name := p.Name
+		if name == "" {
+			name = p.ID
+		}
+		providers = append(providers, providerInfo{ID: p.ID, Name: name})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+// startOIDCLogin сохраняет state и возвращает адрес страницы входа IdP.
+// linkUserID != nil — провайдер привязывается к аккаунту этого пользователя.
+func (h *Handler) startOIDCLogin(ctx context.Context, p *oidcProvider, linkUserID *string) (string, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := p.client.AuthCodeURL(ctx, state, nonce, auth.PKCEChallenge(verifier))
+	if err != nil {
+		return "", err
+	}
+
+	err = h.Store.IdentityRepository.CreateLoginState(ctx, model.OIDCLoginState{
+		StateHash:    hashToken(state),
+		Provider:     p.ID,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(h.OIDC.LoginTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return authURL, nil
+}
+
+// HandleOIDCLogin перенаправляет браузер на страницу входа IdP
+func (h *Handler) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p := h.provider(r)
+	if p == nil {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	authURL, err := h.startOIDCLogin(r.Context(), p, nil)
+	if err != nil {
+		log.Printf("OIDC login start failed for provider %s: %v", p.ID, err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// HandleLinkIdentity начинает привязку провайдера к аккаунту вошедшего пользователя.
+// Возвращает адрес IdP: фронтенд открывает его в браузере (fetch не может
+// пройти редирект с заголовком Authorization).
+func (h *Handler) HandleLinkIdentity(w http.ResponseWriter, r *http.Request) {
+	p := h.provider(r)
+	if p == nil {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	userID := getUserID(r)
+	authURL, err := h.startOIDCLogin(r.Context(), p, &userID)
+	if err != nil {
+		log.Printf("OIDC link start failed for provider %s: %v", p.ID, err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"authorizationUrl": authURL})
+}
+
+// redirectToFrontend возвращает браузер на страницу фронтенда с результатом входа
+func (h *Handler) redirectToFrontend(w http.ResponseWriter, r *http.Request, params url.Values) {
+	u, err := url.Parse(h.OIDC.FrontendRedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid frontend redirect URI", http.StatusInternalServerError)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// HandleOIDCCallback принимает пользователя, вернувшегося от IdP
+func (h *Handler) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := h.provider(r)
+	if p == nil {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	fail := func(code string) {
+		h.redirectToFrontend(w, r, url.Values{"error": {code}, "provider": {p.ID}})
+	}
+
+	state, err := h.Store.IdentityRepository.ConsumeLoginState(r.Context(), hashToken(q.Get("state")))
+	if err == sql.ErrNoRows || (err == nil && state.Provider != p.ID) {
+		fail(oidcErrInvalidState)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Пользователь отказался или IdP вернул ошибку
+	if idpErr := q.Get("error"); idpErr != "" {
+		if idpErr == oidcErrAccessDenied {
+			fail(oidcErrAccessDenied)
+		} else {
+			log.Printf("OIDC provider %s returned error: %s", p.ID, idpErr)
+			fail(oidcErrLoginFailed)
+		}
+		return
+	}
+
+	idToken, err := p.client.Exchange(r.Context(), q.Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC code exchange failed for provider %s: %v", p.ID, err)
+		fail(oidcErrLoginFailed)
+		return
+	}
+	email := strings.TrimSpace(idToken.Email)
+
+	if len(p.AllowedDomains) > 0 && (!idToken.EmailVerified || !emailDomainAllowed(email, p.AllowedDomains)) {
+		fail(oidcErrDomainNotAllowed)
+		return
+	}
+
+	// Привязка к аккаунту вошедшего пользователя
+	if state.LinkUserID != nil {
+		code := h.linkIdentity(r, p, *state.LinkUserID, idToken.Subject, email)
+		if code != "" {
+			fail(code)
+			return
+		}
+		h.redirectToFrontend(w, r, url.Values{"linked": {p.ID}})
+		return
+	}
+
+	userID, createdUser, code := h.resolveOIDCUser(r, p, idToken.Subject, email, idToken.EmailVerified)
+	if code != "" {
+		fail(code)
+		return
+	}
+	h.audit(r, userID, model.AuditOIDCLogin, map[string]interface{}{"provider": p.ID, "newUser": createdUser})
+
+	loginCode, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Generation failed", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Store.IdentityRepository.CreateLoginCode(r.Context(), hashToken(loginCode), userID, createdUser, oidcLoginCodeTTL); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	h.redirectToFrontend(w, r, url.Values{"code": {loginCode}, "provider": {p.ID}})
+}
+
+// linkIdentity привязывает учетную запись IdP к пользователю; возвращает код ошибки или ""
+func (h *Handler) linkIdentity(r *http.Request, p *oidcProvider, userID, subject, email string) string {
+	ctx := r.Context()
+	existing, err := h.Store.IdentityRepository.GetUserIDByIdentity(ctx, p.ID, subject)
+	if err == nil {
+		if existing != userID {
+			return oidcErrIdentityInUse
+		}
+		return ""
+	} else if err != sql.ErrNoRows {
+		log.Printf("OIDC identity lookup failed: %v", err)
+		return oidcErrLoginFailed
+	}
+
+	created, err := h.Store.IdentityRepository.CreateIdentity(ctx, userID, p.ID, subject, email)
+	if err != nil {
+		log.Printf("Failed to link %s identity to user %s: %v", p.ID, userID, err)
+		return oidcErrLoginFailed
+	}
+	if !created {
+		return oidcErrAlreadyLinked
+	}
+	log.Printf("User %s linked %s identity", userID, p.ID)
+	h.audit(r, userID, model.AuditIdentityLinked, map[string]interface{}{"provider": p.ID})
+	return ""
+}
+
+// resolveOIDCUser находит пользователя по учетной записи IdP. Если привязки нет,
+// привязывает существующий аккаунт с тем же подтвержденным email (если провайдеру
+// это разрешено) или создает новый аккаунт. Возвращает код ошибки или "".
+func (h *Handler) resolveOIDCUser(r *http.Request, p *oidcProvider, subject, email string, emailVerified bool) (string, bool, string) {
+	ctx := r.Context()
+	repo := h.Store.IdentityRepository
+
+	userID, err := repo.GetUserIDByIdentity(ctx, p.ID, subject)
+	if err == nil {
+		if err := repo.TouchIdentity(ctx, p.ID, subject, email); err != nil {
+			log.Printf("Failed to update %s identity: %v", p.ID, err)
+		}
+		return userID, false, ""
+	} else if err != sql.ErrNoRows {
+		log.Printf("OIDC identity lookup failed: %v", err)
+		return "", false, oidcErrLoginFailed
+	}
+
+	if email == "" || !emailVerified {
+		return "", false, oidcErrEmailNotVerified
+	}
+
+	// Аккаунт с таким email уже есть: без явного доверия к IdP не привязываем,
+	// иначе IdP мог бы войти в любой аккаунт, назвав его email
+	userID, err = repo.GetUserIDByEmail(ctx, email)
+	if err == nil {
+		if !p.LinkVerifiedEmail {
+			return "", false, oidcErrAccountExists
+		}
+		if code := h.linkIdentity(r, p, userID, subject, email); code != "" {
+			return "", false, code
+		}
+		return userID, false, ""
+	} else if err != sql.ErrNoRows {
+		log.Printf("OIDC user lookup failed: %v", err)
+		return "", false, oidcErrLoginFailed
+	}
+
+	if !p.AllowSignup {
+		return "", false, oidcErrSignupDisabled
+	}
+	userID, err = repo.CreateUserWithIdentity(ctx, email, p.ID, subject)
+	if err != nil {
+		// Одновременная регистрация с тем же email
+		log.Printf("Failed to create user from %s identity: %v", p.ID, err)
+		return "", false, oidcErrAccountExists
+	}
+	log.Printf("User %s signed up via %s", userID, p.ID)
+	return userID, true, ""
+}
+
+// HandleOIDCToken обменивает одноразовый код входа на токены сессии
+func (h *Handler) HandleOIDCToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 5*1024) // 5 KB
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || len(req.Code) > 512 {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	userID, createdUser, err := h.Store.IdentityRepository.ConsumeLoginCode(r.Context(), hashToken(req.Code))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, refreshToken, sessionID, err := h.generateTokenPair(r.Context(), userID, clientip.FromRequest(r), r.UserAgent())
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	h.auditSession(r, userID, sessionID, model.AuditLogin, map[string]interface{}{"method": "oidc"})
+
+	profile, err := h.Store.UserRepository.GetUserProfile(userID)
+	if err != nil {
+		http.Error(w, "Failed to load user profile", http.StatusInternalServerError)
+		return
+	}
+	hasVault, err := h.Store.IdentityRepository.HasVault(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := sessionResponse(userID, accessToken, refreshToken, profile)
+	resp["newUser"] = createdUser
+	// Без хранилища клиент должен предложить задать парольную фразу и создать ключ
+	resp["vaultConfigured"] = hasVault
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleListIdentities возвращает привязанные провайдеры пользователя
+func (h *Handler) HandleListIdentities(w http.ResponseWriter, r *http.Request) {
+	identities, err := h.Store.IdentityRepository.ListIdentities(r.Context(), getUserID(r))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identities)
+}
+
+// HandleUnlinkIdentity отвязывает провайдера, если у пользователя остается способ входа
+func (h *Handler) HandleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	found, deleted, err := h.Store.IdentityRepository.DeleteIdentity(r.Context(), getUserID(r), chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Cannot unlink the only sign-in method", http.StatusConflict)
+		return
+	}
+	h.audit(r, getUserID(r), model.AuditIdentityUnlinked, map[string]interface{}{"identityId": chi.URLParam(r, "id")})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ==================== VAULT ====================
+
+// HandleGetVault возвращает зашифрованный мастер-ключ E2EE. Клиент расшифровывает
+// его ключом, выведенным из парольной фразы хранилища по параметрам kdf.
+func (h *Handler) HandleGetVault(w http.ResponseWriter, r *http.Request) {
+	vault, err := h.Store.IdentityRepository.GetVault(r.Context(), getUserID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vault not configured", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(vault)
+}
+
+// HandlePutVault сохраняет зашифрованный мастер-ключ (создание или смена
+// парольной фразы). version — версия, которую видел клиент (0 при создании).
+func (h *Handler) HandlePutVault(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024) // 10 KB
+	var req struct {
+		WrappedKey string          `json:"wrappedKey"`
+		KDF        json.RawMessage `json:"kdf"`
+		Version    int             `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.WrappedKey == "" || len(req.WrappedKey) > maxVaultWrappedKeySize {
+		http.Error(w, "Invalid wrapped key", http.StatusBadRequest)
+		return
+	}
+	var kdf map[string]interface{}
+	if len(req.KDF) > maxVaultKDFSize || json.Unmarshal(req.KDF, &kdf) != nil || len(kdf) == 0 {
+		http.Error(w, "kdf must be a JSON object with key derivation parameters", http.StatusBadRequest)
+		return
+	}
+	if req.Version < 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	vault := model.Vault{WrappedKey: req.WrappedKey, KDF: req.KDF}
+	saved, err := h.Store.IdentityRepository.PutVault(r.Context(), getUserID(r), &vault, req.Version)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !saved {
+		http.Error(w, "Vault was changed on another device", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vault)
+}
@@ -0,0 +1,28 @@
+package api
+
+import "testing"
+
+func TestEmailDomainAllowed(t *testing.T) {
+	domains := []string{"corp.example", "Sub.Corp.Example"}
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@corp.example", true},
+		{"alice@CORP.example", true},
+		{"bob@sub.corp.example", true},
+		{"eve@corp.example.evil", false},
+		{"eve@evilcorp.example", false},
+		{"no-at-sign", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := emailDomainAllowed(tt.email, domains); got != tt.want {
+			t.Errorf("emailDomainAllowed(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+	if !emailDomainAllowed("anyone@anywhere.example", nil) {
+		t.Error("empty domain list should allow any email")
+	}
+}
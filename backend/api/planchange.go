@@ -0,0 +1,254 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"noteflow/model"
+)
+
+// Смена тарифа при действующей подписке. Повышение оплачивается сразу: новый
+// тариф за остаток периода за вычетом неиспользованного остатка текущего, срок
+// подписки не меняется. Понижение вступает в силу при следующем продлении.
+
+// Действия смены тарифа
+const (
+	planUpgrade   = "upgrade"
+	planDowngrade = "downgrade"
+	planKeep      = "keep" // выбран текущий тариф: запланированный переход отменяется
+)
+
+// billingPeriod — оплаченный период текущего тарифа
+type billingPeriod struct {
+	tier model.UserTier
+	end  time.Time
+	// period и currency — по ним выбираются цены при смене тарифа
+	period   model.BillingPeriod
+	currency string
+	// sub — подписка с автопродлением (nil, если тариф оплачен без нее)
+	sub         *model.Subscription
+	storageUsed int64
+}
+
+// currentPeriod возвращает действующий оплаченный период пользователя (nil —
+// тариф free или пробный период: его заменяет любая покупка)
+func (h *Handler) currentPeriod(ctx context.Context, userID string) (*billingPeriod, error) {
+	profile, err := h.Store.UserRepository.GetUserProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+	if profile.Tier == model.TierFree || profile.SubscriptionExpiresAt == nil || !profile.SubscriptionExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	p := &billingPeriod{tier: profile.Tier, end: *profile.SubscriptionExpiresAt, storageUsed: profile.StorageUsed, period: model.PeriodMonthly}
+	if len(h.Payments.Currencies) > 0 {
+		p.currency = h.Payments.Currencies[0]
+	}
+
+	sub, err := h.Store.SubscriptionRepository.GetSubscription(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if sub != nil && sub.Status != model.SubscriptionExpired && sub.Tier == profile.Tier {
+		// Конец оплаченного периода без льготного
+		p.sub = sub
+		p.end = sub.CurrentPeriodEnd
+		p.period = sub.Period
+		p.currency = sub.Currency
+		return p, nil
+	}
+
+	trial, err := h.Store.SubscriptionRepository.GetTrial(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if trial != nil && trial.Tier == profile.Tier && trial.Active(time.Now()) {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// planChange — расчет смены тарифа (ответ предпросмотра)
+type planChange struct {
+	Action      string         `json:"action"`
+	CurrentTier model.UserTier `json:"currentTier"`
+	NewTier     model.UserTier `json:"newTier"`
+	// Credit и Charge — остаток текущего тарифа и сумма к оплате сейчас (только upgrade)
+	model.Proration
+	Currency    string              `json:"currency"`
+	Period      model.BillingPeriod `json:"period"`
+	EffectiveAt time.Time           `json:"effectiveAt"`
+	PeriodEnd   time.Time           `json:"periodEnd"`
+	// NextRenewalAmount — цена нового тарифа при следующем продлении
+	NextRenewalAmount float64 `json:"nextRenewalAmount"`
+	// StorageExceeded — файлы не помещаются в хранилище нового тарифа, понижение будет отклонено
+	StorageUsed     int64 `json:"storageUsed"`
+	StorageLimit    int64 `json:"storageLimit"`
+	StorageExceeded bool  `json:"storageExceeded"`
+
+	plan   model.Plan
+	price  model.PlanPrice
+	period *billingPeriod
+}
+
+// preparePlanChange читает запрос {"tier": ...} и считает смену тарифа.
+// При ошибке отвечает клиенту сам и возвращает nil.
+func (h *Handler) preparePlanChange(w http.ResponseWriter, r *http.Request) *planChange {
+	var req struct {
+		Tier string `json:"tier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil
+	}
+	plan, ok := model.FindPlan(model.UserTier(req.Tier))
+	if !ok || !plan.Active {
+		http.Error(w, "Invalid tier", http.StatusBadRequest)
+		return nil
+	}
+
+	period, err := h.currentPeriod(r.Context(), getUserID(r))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil
+	}
+	if period == nil {
+		http.Error(w, "No active subscription", http.StatusConflict)
+		return nil
+	}
+	if period.sub != nil && period.sub.Status == model.SubscriptionPastDue {
+		http.Error(w, "Subscription payment is overdue", http.StatusConflict)
+		return nil
+	}
+	current, ok := model.FindPlan(period.tier)
+	if !ok {
+		http.Error(w, "Unknown current tier", http.StatusInternalServerError)
+		return nil
+	}
+	// Цены обоих тарифов — за период и в валюте текущей подписки
+	currentPrice, ok := current.Price(period.period, period.currency)
+	if !ok {
+		http.Error(w, "The current plan is no longer sold for your billing period and currency", http.StatusConflict)
+		return nil
+	}
+	price, ok := plan.Price(period.period, period.currency)
+	if !ok {
+		http.Error(w, "The plan is not available for your billing period and currency", http.StatusBadRequest)
+		return nil
+	}
+
+	now := time.Now()
+	storageLimit, _ := model.GetTierLimits(plan.Tier)
+	c := &planChange{
+		CurrentTier:       current.Tier,
+		NewTier:           plan.Tier,
+		Currency:          price.Currency,
+		Period:            price.Period,
+		PeriodEnd:         period.end,
+		NextRenewalAmount: price.Amount,
+		StorageUsed:       period.storageUsed,
+		StorageLimit:      storageLimit,
+		plan:              plan,
+		price:             price,
+		period:            period,
+	}
+	switch {
+	case plan.Tier == current.Tier:
+		c.Action = planKeep
+		c.EffectiveAt = now
+	case price.Amount > currentPrice.Amount:
+		c.Action = planUpgrade
+		c.EffectiveAt = now
+		c.Proration = model.Prorate(currentPrice, price, now, period.end)
+		if c.Charge < model.MinimumCharge {
+			c.Charge = model.MinimumCharge
+		}
+	default:
+		c.Action = planDowngrade
+		c.EffectiveAt = period.end
+		c.StorageExceeded = period.storageUsed > storageLimit
+	}
+	return c
+}
+
+// HandlePreviewPlanChange показывает, сколько будет списано и когда сменится тариф
+func (h *Handler) HandlePreviewPlanChange(w http.ResponseWriter, r *http.Request) {
+	c := h.preparePlanChange(w, r)
+	if c == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// HandleChangePlan меняет тариф: для повышения создает платеж на доплату
+// (ответ как у /subscription/create), понижение планирует на конец периода
+func (h *Handler) HandleChangePlan(w http.ResponseWriter, r *http.Request) {
+	c := h.preparePlanChange(w, r)
+	if c == nil {
+		return
+	}
+	userID := getUserID(r)
+	sub := c.period.sub
+
+	switch c.Action {
+	case planUpgrade:
+		if h.PaymentProvider == nil {
+			http.Error(w, "Payments are not configured", http.StatusServiceUnavailable)
+			return
+		}
+		h.startCheckout(w, r, checkout{
+			userID:      userID,
+			plan:        c.plan,
+			price:       c.price,
+			amount:      c.Charge,
+			description: fmt.Sprintf("NoteFlow %s, доплата до %s", c.plan.Name(), c.PeriodEnd.UTC().Format("02.01.2006")),
+			kind:        model.PaymentUpgrade,
+			fromTier:    c.period.tier,
+		})
+		return
+
+	case planDowngrade:
+		if c.StorageExceeded {
+			http.Error(w, fmt.Sprintf("Files take more space than the %s plan allows; delete some files before downgrading", c.plan.Name()), http.StatusConflict)
+			return
+		}
+		if sub == nil || !sub.AutoRenew {
+			http.Error(w, "A downgrade takes effect on renewal: turn on automatic renewal first", http.StatusConflict)
+			return
+		}
+
+	case planKeep:
+		if sub == nil || sub.ScheduledTier == "" {
+			http.Error(w, "Already on this plan", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scheduled := c.NewTier
+	if c.Action == planKeep {
+		scheduled = ""
+	}
+	if ok, err := h.Store.SubscriptionRepository.ScheduleTierChange(r.Context(), userID, scheduled); err != nil {
+		log.Printf("Failed to schedule plan change for user %s: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	h.audit(r, userID, model.AuditPlanChanged, map[string]interface{}{
+		"from":        c.CurrentTier,
+		"to":          scheduled,
+		"effectiveAt": c.EffectiveAt,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"noteflow/config"
+	"noteflow/model"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// catalogRefreshInterval — как часто перечитывать каталог тарифов из БД
+// (изменения, сделанные через другой экземпляр сервера)
+const catalogRefreshInterval = time.Minute
+
+// RefreshCatalog загружает каталог тарифов из БД в кэш модели
+func (h *Handler) RefreshCatalog(ctx context.Context) error {
+	plans, err := h.Store.PlanRepository.ListPlans(ctx)
+	if err != nil {
+		return err
+	}
+	if len(plans) == 0 {
+		return errors.New("plan catalog is empty")
+	}
+	model.SetCatalog(model.NewCatalog(plans))
+	return nil
+}
+
+// RunCatalogRefresh обновляет кэш каталога, пока не отменен ctx
+func (h *Handler) RunCatalogRefresh(ctx context.Context) {
+	ticker := time.NewTicker(catalogRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := h.RefreshCatalog(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to refresh plan catalog: %v", err)
+		}
+	}
+}
+
+// requestLanguage возвращает язык из ?lang= или первого тега Accept-Language
+func requestLanguage(r *http.Request) string {
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang, _, _ = strings.Cut(r.Header.Get("Accept-Language"), ",")
+	}
+	lang, _, _ = strings.Cut(lang, ";")
+	lang, _, _ = strings.Cut(strings.TrimSpace(lang), "-")
+	if lang == "" || lang == "*" {
+		return model.DefaultLanguage
+	}
+	return strings.ToLower(lang)
+}
+
+// HandleListPlans возвращает весь каталог тарифов, включая снятые с продажи
+func (h *Handler) HandleListPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := h.Store.PlanRepository.ListPlans(r.Context())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plans)
+}
+
+// HandlePutPlan создает или изменяет тариф {tier}. Снять тариф с продажи —
+// active: false; удалить нельзя, пока на нем есть пользователи и платежи.
+func (h *Handler) HandlePutPlan(w http.ResponseWriter, r *http.Request) {
+	var plan model.Plan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	plan.Tier = model.UserTier(chi.URLParam(r, "tier"))
+	if err := plan.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, price := range plan.Prices {
+		if !slices.Contains(config.YooKassaCurrencies, price.Currency) {
+			http.Error(w, "Currency "+price.Currency+" is not supported by the payment provider", http.StatusBadRequest)
+			return
+		}
+	}
+	if plan.Tier == model.TierFree && !plan.Active {
+		http.Error(w, "The free tier cannot be deactivated", http.StatusBadRequest)
+		return
+	}
+	if plan.Features == nil {
+		plan.Features = map[string]bool{}
+	}
+
+	if err := h.Store.PlanRepository.UpsertPlan(r.Context(), plan); err != nil {
+		log.Printf("Failed to save plan %s: %v", plan.Tier, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := h.RefreshCatalog(r.Context()); err != nil {
+		log.Printf("Failed to refresh plan catalog: %v", err)
+	}
+	log.Printf("Admin %s updated plan %s", getUserID(r), plan.Tier)
+	h.audit(r, getUserID(r), model.AuditPlanUpdated, map[string]interface{}{
+		"tier":         plan.Tier,
+		"prices":       plan.Prices,
+		"storageLimit": plan.StorageLimit,
+		"active":       plan.Active,
+	})
+
+	saved, _ := model.CurrentCatalog().Plan(plan.Tier)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// planRows — строки ListPlans для каталога plans
+func planRows(t *testing.T, plans []model.Plan) *sqlmock.Rows {
+	t.Helper()
+	rows := sqlmock.NewRows([]string{"tier", "prices", "trial_days", "storage_limit", "max_file_size",
+		"features", "display", "sort_order", "active", "updated_at"})
+	for _, p := range plans {
+		if p.Prices == nil {
+			p.Prices = []model.PlanPrice{}
+		}
+		prices, _ := json.Marshal(p.Prices)
+		features, _ := json.Marshal(p.Features)
+		display, _ := json.Marshal(p.Display)
+		rows.AddRow(string(p.Tier), prices, p.TrialDays, p.StorageLimit, p.MaxFileSize,
+			features, display, p.SortOrder, p.Active, time.Now())
+	}
+	return rows
+}
+
+func putPlan(h *Handler, tier, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/admin/plans/"+tier, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), UserIDContextKey, "admin-1"))
+	rec := httptest.NewRecorder()
+	h.HandlePutPlan(rec, withURLParam(req, "tier", tier))
+	return rec
+}
+
+func TestPutPlan_Validation(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	display := `"display":{"ru":{"name":"Pro"}}`
+	tests := []struct {
+		name, tier, body string
+	}{
+		{"invalid json", "pro", `{`},
+		{"invalid tier", "Pro-Plan", `{"prices":[{"period":"monthly","currency":"RUB","amount":199}],` + display + `}`},
+		{"paid tier without prices", "pro", `{` + display + `}`},
+		{"amount below minimum", "pro", `{"prices":[{"period":"monthly","currency":"RUB","amount":0.5}],` + display + `}`},
+		{"unsupported currency", "pro", `{"prices":[{"period":"monthly","currency":"GBP","amount":5}],` + display + `}`},
+		{"missing default language", "pro", `{"prices":[{"period":"monthly","currency":"RUB","amount":199}],"display":{"en":{"name":"Pro"}}}`},
+		{"deactivated free tier", "free", `{"active":false,` + display + `}`},
+	}
+	for _, tt := range tests {
+		if rec := putPlan(h, tt.tier, tt.body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tt.name, rec.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPutPlan_RefreshesCatalog(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	prev := model.CurrentCatalog()
+	t.Cleanup(func() { model.SetCatalog(prev) })
+
+	pro := model.Plan{
+		Tier:         "pro",
+		Prices:       []model.PlanPrice{{Period: model.PeriodMonthly, Currency: "RUB", Amount: 199}},
+		StorageLimit: 20 << 30,
+		MaxFileSize:  1 << 30,
+		Features:     map[string]bool{model.FeatureSync: true},
+		Display:      map[string]model.PlanDisplay{"ru": {Name: "Pro"}},
+		SortOrder:    5,
+		Active:       true,
+	}
+	body, _ := json.Marshal(pro)
+
+	// Сохраненный тариф сразу попадает в кэш каталога, без ожидания RunCatalogRefresh
+	mock.ExpectExec("INSERT INTO plans").
+		WithArgs("pro", sqlmock.AnyArg(), pro.StorageLimit, pro.MaxFileSize, sqlmock.AnyArg(), sqlmock.AnyArg(), 5, true, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM plans").
+		WillReturnRows(planRows(t, append(model.DefaultPlans(), pro)))
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), "plan_updated", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rec := putPlan(h, "pro", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var saved model.Plan
+	json.NewDecoder(rec.Body).Decode(&saved)
+	if saved.Tier != "pro" || saved.StorageLimit != pro.StorageLimit {
+		t.Errorf("response plan %+v", saved)
+	}
+	plan, ok := model.FindPlan("pro")
+	if !ok {
+		t.Fatal("pro is not in the catalog after PUT")
+	}
+	if price, ok := plan.Price(model.PeriodMonthly, "RUB"); !ok || price.Amount != 199 {
+		t.Errorf("catalog price %+v, %v", price, ok)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListPlans_IncludesInactive(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	plans := model.DefaultPlans()
+	plans[1].Active = false
+	mock.ExpectQuery("FROM plans").WillReturnRows(planRows(t, plans))
+
+	rec := httptest.NewRecorder()
+	h.HandleListPlans(rec, httptest.NewRequest(http.MethodGet, "/admin/plans", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	var got []model.Plan
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(plans) || got[1].Tier != plans[1].Tier || got[1].Active {
+		t.Errorf("plans %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
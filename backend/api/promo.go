@@ -0,0 +1,175 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"noteflow/model"
+	"noteflow/store"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// couponError отвечает клиенту, почему промокод не применен
+func couponError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, model.ErrCouponNotFound), errors.Is(err, model.ErrCouponExpired),
+		errors.Is(err, model.ErrCouponNotApplicable):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, model.ErrCouponExhausted), errors.Is(err, model.ErrCouponAlreadyUsed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Failed to check coupon: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
+
+// HandleCheckCoupon показывает цену тарифа ?tier= (&period=, &currency=) с
+// промокодом {code}, ничего не резервируя
+func (h *Handler) HandleCheckCoupon(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	plan, ok := model.FindPlan(model.UserTier(q.Get("tier")))
+	if !ok || !plan.Active {
+		http.Error(w, "Invalid tier", http.StatusBadRequest)
+		return
+	}
+	price, ok := h.selectPrice(w, plan, q.Get("period"), q.Get("currency"))
+	if !ok {
+		return
+	}
+	code := model.NormalizeCouponCode(chi.URLParam(r, "code"))
+	coupon, err := h.Store.CouponRepository.CheckCoupon(r.Context(), code, getUserID(r), plan, price)
+	if err != nil {
+		couponError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"coupon":    coupon.Code,
+		"tier":      plan.Tier,
+		"period":    price.Period,
+		"listPrice": price.Amount,
+		"amount":    coupon.Apply(price.Amount),
+		"currency":  price.Currency,
+		"expiresAt": coupon.ExpiresAt,
+	})
+}
+
+// HandleGetTrial возвращает пробный период пользователя (404 — его не было)
+func (h *Handler) HandleGetTrial(w http.ResponseWriter, r *http.Request) {
+	trial, err := h.Store.SubscriptionRepository.GetTrial(r.Context(), getUserID(r))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Trial not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trial)
+}
+
+// HandleStartTrial включает пробный период тарифа {"tier": ...} без оплаты.
+// Доступен один раз на аккаунт и только на тарифе free.
+func (h *Handler) HandleStartTrial(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	var req struct {
+		Tier string `json:"tier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	plan, ok := model.FindPlan(model.UserTier(req.Tier))
+	if !ok || !plan.Active || plan.TrialDays == 0 {
+		http.Error(w, "No trial is available for this plan", http.StatusBadRequest)
+		return
+	}
+
+	period := time.Duration(plan.TrialDays) * 24 * time.Hour
+	trial, err := h.Store.SubscriptionRepository.StartTrial(r.Context(), userID, plan.Tier, period)
+	switch {
+	case errors.Is(err, store.ErrTrialUsed):
+		http.Error(w, "The trial has already been used", http.StatusConflict)
+		return
+	case errors.Is(err, store.ErrSubscriptionActive):
+		http.Error(w, "A paid plan is already active", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to start trial for user %s: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s started a %s trial until %s", userID, plan.Tier, trial.EndsAt.Format(time.RFC3339))
+	h.audit(r, userID, model.AuditTrialStarted, map[string]interface{}{
+		"tier":   plan.Tier,
+		"endsAt": trial.EndsAt,
+	})
+	h.audit(r, userID, model.AuditTierChanged, map[string]interface{}{
+		"tier":      plan.Tier,
+		"expiresAt": trial.EndsAt,
+		"source":    "trial",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(trial)
+}
+
+// HandleListCoupons возвращает все промокоды с числом использований
+func (h *Handler) HandleListCoupons(w http.ResponseWriter, r *http.Request) {
+	coupons, err := h.Store.CouponRepository.ListCoupons(r.Context())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if coupons == nil {
+		coupons = []model.Coupon{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupons)
+}
+
+// HandlePutCoupon создает или изменяет промокод {code}. Отключить промокод —
+// active: false; использованные промокоды не удаляются.
+func (h *Handler) HandlePutCoupon(w http.ResponseWriter, r *http.Request) {
+	var coupon model.Coupon
+	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	coupon.Code = model.NormalizeCouponCode(chi.URLParam(r, "code"))
+	if err := coupon.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, tier := range coupon.Tiers {
+		if _, ok := model.FindPlan(tier); !ok {
+			http.Error(w, "Unknown paid tier: "+string(tier), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.Store.CouponRepository.UpsertCoupon(r.Context(), coupon); err != nil {
+		log.Printf("Failed to save coupon %s: %v", coupon.Code, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %s updated coupon %s", getUserID(r), coupon.Code)
+	h.audit(r, getUserID(r), model.AuditCouponUpdated, map[string]interface{}{
+		"code":           coupon.Code,
+		"percentOff":     coupon.PercentOff,
+		"amountOff":      coupon.AmountOff,
+		"maxRedemptions": coupon.MaxRedemptions,
+		"active":         coupon.Active,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupon)
+}
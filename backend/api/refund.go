@@ -0,0 +1,240 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+
+	"noteflow/model"
+	"noteflow/payments"
+	"noteflow/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// refundRequest — тело запросов возврата и чарджбэка. Amount == 0 — вся еще
+// не возвращенная часть платежа.
+type refundRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// HandleRefundPayment возвращает деньги за платеж {id} (ID платежа YooKassa)
+// полностью или частично. Проведенный возврат сразу уменьшает доступ
+// пользователя; если YooKassa еще обрабатывает возврат, ответ — 202, а
+// доступ изменится по уведомлению refund.succeeded.
+func (h *Handler) HandleRefundPayment(w http.ResponseWriter, r *http.Request) {
+	if h.PaymentProvider == nil {
+		http.Error(w, "Payments are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	transaction, req, ok := h.decodeRefund(w, r)
+	if !ok {
+		return
+	}
+
+	amount := payments.NewAmount(req.Amount, transaction.Currency)
+	receipt, err := h.refundReceipt(r.Context(), transaction, amount)
+	if err != nil {
+		log.Printf("Failed to get email of user %s: %v", transaction.UserID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	refund, err := h.PaymentProvider.CreateRefund(r.Context(), payments.CreateRefundRequest{
+		PaymentID:   transaction.PaymentID,
+		Amount:      amount,
+		Description: req.Reason,
+		Receipt:     receipt,
+	}, uuid.New().String())
+	if err != nil {
+		log.Printf("Failed to refund payment %s: %v", transaction.PaymentID, err)
+		http.Error(w, "Failed to create refund", http.StatusBadGateway)
+		return
+	}
+	log.Printf("Admin %s refunded %s %s of payment %s (refund %s, %s)", getUserID(r), refund.Amount.Value, refund.Amount.Currency, transaction.PaymentID, refund.ID, refund.Status)
+
+	w.Header().Set("Content-Type", "application/json")
+	if refund.Status != payments.RefundSucceeded {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{"refundId": refund.ID, "status": refund.Status})
+		return
+	}
+
+	upd, err := h.applyRefund(r.Context(), r, model.Refund{
+		ID:        refund.ID,
+		PaymentID: transaction.PaymentID,
+		Amount:    refund.Amount.Float(),
+		Currency:  refund.Amount.Currency,
+		Kind:      model.RefundKindRefund,
+		Reason:    req.Reason,
+	}, nil)
+	if err != nil {
+		// Деньги уже возвращены: доступ изменится при доставке refund.succeeded
+		log.Printf("Failed to apply refund %s: %v", refund.ID, err)
+		http.Error(w, "Refund created but not applied", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(refundResponse(refund.ID, refund.Status, upd))
+}
+
+// refundReceipt возвращает чек возврата суммы amount по транзакции: та же
+// услуга, что в чеке платежа, на сумму возврата (nil — чеки не передаются)
+func (h *Handler) refundReceipt(ctx context.Context, transaction *model.Transaction, amount payments.Amount) (*payments.Receipt, error) {
+	if !h.receiptsEnabled(amount.Currency) {
+		return nil, nil
+	}
+	email, err := h.Store.UserRepository.GetUserEmail(ctx, transaction.UserID)
+	if err != nil {
+		return nil, err
+	}
+	name := string(transaction.Tier)
+	if plan, ok := model.FindPlan(transaction.Tier); ok {
+		name = plan.Name()
+	}
+	description := fmt.Sprintf("NoteFlow %s, подписка на %s", name, periodTitle(transaction.Period))
+	return h.receipt(email, description, amount), nil
+}
+
+// HandleChargeback учитывает чарджбэк по платежу {id}: банк вернул деньги
+// плательщику в обход YooKassa, поэтому возврат только записывается, а
+// сохраненный способ оплаты удаляется.
+func (h *Handler) HandleChargeback(w http.ResponseWriter, r *http.Request) {
+	transaction, req, ok := h.decodeRefund(w, r)
+	if !ok {
+		return
+	}
+
+	id := "chargeback:" + uuid.New().String()
+	upd, err := h.applyRefund(r.Context(), r, model.Refund{
+		ID:        id,
+		PaymentID: transaction.PaymentID,
+		Amount:    req.Amount,
+		Currency:  transaction.Currency,
+		Kind:      model.RefundKindChargeback,
+		Reason:    req.Reason,
+	}, nil)
+	if !writeRefundError(w, transaction.PaymentID, err) {
+		return
+	}
+	log.Printf("Admin %s recorded chargeback of %.2f %s for payment %s", getUserID(r), req.Amount, transaction.Currency, transaction.PaymentID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refundResponse(id, payments.RefundSucceeded, upd))
+}
+
+// decodeRefund читает тело запроса возврата и находит транзакцию платежа {id}.
+// Сумма по умолчанию — вся еще не возвращенная часть.
+func (h *Handler) decodeRefund(w http.ResponseWriter, r *http.Request) (*model.Transaction, refundRequest, bool) {
+	var req refundRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return nil, req, false
+		}
+	}
+
+	paymentID := chi.URLParam(r, "id")
+	transaction, err := h.Store.UserRepository.GetTransactionByPaymentID(paymentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return nil, req, false
+	} else if err != nil {
+		log.Printf("Failed to get transaction for payment %s: %v", paymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, req, false
+	}
+	if !transaction.Refundable() {
+		http.Error(w, "Payment cannot be refunded in status "+string(transaction.Status), http.StatusConflict)
+		return nil, req, false
+	}
+
+	remaining := math.Round((transaction.Amount-transaction.RefundedAmount)*100) / 100
+	if req.Amount == 0 {
+		req.Amount = remaining
+	}
+	req.Amount = math.Round(req.Amount*100) / 100
+	if req.Amount <= 0 || req.Amount > remaining {
+		http.Error(w, "Amount must be positive and not exceed the remaining payment amount", http.StatusBadRequest)
+		return nil, req, false
+	}
+	return transaction, req, true
+}
+
+// writeRefundError отвечает на ошибку учета возврата; false — ответ уже отправлен
+func writeRefundError(w http.ResponseWriter, paymentID string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Payment not found", http.StatusNotFound)
+	case errors.Is(err, store.ErrRefundExceedsPayment):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, store.ErrIllegalTransition):
+		http.Error(w, "Payment cannot be refunded", http.StatusConflict)
+	default:
+		log.Printf("Failed to apply refund of payment %s: %v", paymentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+func refundResponse(id, status string, upd *store.RefundUpdate) map[string]interface{} {
+	return map[string]interface{}{
+		"refundId":    id,
+		"status":      status,
+		"transaction": upd.Transaction,
+		"tier":        upd.Tier,
+		"expiresAt":   upd.ExpiresAt,
+		"overQuota":   upd.OverQuota(),
+	}
+}
+
+// applyRefund учитывает проведенный возврат и записывает в аудит, как
+// изменился доступ пользователя. r == nil — возврат пришел уведомлением.
+func (h *Handler) applyRefund(ctx context.Context, r *http.Request, refund model.Refund, event *model.PaymentEvent) (*store.RefundUpdate, error) {
+	upd, err := h.Store.PaymentRepository.ApplyRefund(ctx, refund, event)
+	if err != nil || !upd.Changed {
+		return upd, err
+	}
+
+	userID := upd.Transaction.UserID
+	audit := func(event string, details map[string]interface{}) {
+		if r != nil {
+			h.audit(r, userID, event, details)
+		} else {
+			h.auditSystem(ctx, userID, event, details)
+		}
+	}
+	audit(model.AuditPaymentRefunded, map[string]interface{}{
+		"paymentId": refund.PaymentID,
+		"refundId":  refund.ID,
+		"amount":    refund.Amount,
+		"currency":  refund.Currency,
+		"kind":      refund.Kind,
+		"reason":    refund.Reason,
+		"status":    upd.Transaction.Status,
+		"tier":      upd.Tier,
+		"expiresAt": upd.ExpiresAt,
+	})
+	if upd.TierChanged {
+		log.Printf("User %s downgraded to tier %s after %s %s", userID, upd.Tier, refund.Kind, refund.ID)
+		audit(model.AuditTierChanged, map[string]interface{}{
+			"tier":      upd.Tier,
+			"expiresAt": upd.ExpiresAt,
+			"source":    refund.Kind,
+		})
+	}
+	if upd.OverQuota() {
+		audit(model.AuditStorageOverQuota, map[string]interface{}{
+			"used":  upd.StorageUsed,
+			"limit": upd.StorageLimit,
+		})
+	}
+	return upd, nil
+}
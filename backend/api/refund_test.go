@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"noteflow/payments"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// postRefund вызывает обработчик возврата (или чарджбэка) платежа paymentID от имени администратора
+func postRefund(handler http.HandlerFunc, paymentID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/admin/payments/"+paymentID+"/refund", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), UserIDContextKey, "admin-1"))
+	rec := httptest.NewRecorder()
+	handler(rec, withURLParam(req, "id", paymentID))
+	return rec
+}
+
+// expectPartialRefund ожидает учет частичного возврата (kind — refund или
+// chargeback) покупки: период сокращается, тариф остается
+func expectPartialRefund(mock sqlmock.Sqlmock, paymentID, kind string, amount float64) {
+	expiresAt := time.Now().AddDate(0, 0, 30)
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE").
+		WithArgs(paymentID).
+		WillReturnRows(transactionRow("tx-1", paymentID, 99, "succeeded"))
+	mock.ExpectExec("INSERT INTO refunds").
+		WithArgs(sqlmock.AnyArg(), "tx-1", amount, "RUB", kind, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions SET status").
+		WithArgs("tx-1", "partially_refunded", amount).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT tier, subscription_expires_at FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"tier", "subscription_expires_at"}).AddRow("start", expiresAt))
+	mock.ExpectExec("UPDATE users SET subscription_expires_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE subscriptions SET current_period_end").WillReturnResult(sqlmock.NewResult(0, 1))
+	if kind == "chargeback" {
+		// Чарджбэк удаляет сохраненный способ оплаты даже при частичной сумме
+		mock.ExpectExec("SET auto_renew = FALSE, payment_method_id = NULL").
+			WithArgs("user-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectQuery("SELECT u.tier").
+		WillReturnRows(sqlmock.NewRows([]string{"tier", "subscription_expires_at", "storage_limit", "used"}).
+			AddRow("start", expiresAt.AddDate(0, 0, -10), 5<<30, 0))
+	mock.ExpectCommit()
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), "payment_refunded", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestRefundPayment_SendsReceipt(t *testing.T) {
+	h, mock, fake := newPaymentsHandler(t)
+	h.Payments.Receipt.Enabled = true
+
+	// Платеж с чеком: YooKassa требует и чек возврата
+	amount := payments.NewAmount(99, "RUB")
+	payment, err := h.PaymentProvider.CreatePayment(context.Background(), payments.CreatePaymentRequest{
+		Amount:    amount,
+		ReturnURL: "http://localhost/subscription",
+		Capture:   true,
+		Receipt:   payments.NewServiceReceipt("user@example.com", "NoteFlow Start", amount, 1, 0),
+	}, "tx-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Confirm(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "succeeded"))
+	mock.ExpectQuery("SELECT email FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@example.com"))
+	expectPartialRefund(mock, payment.ID, "refund", 33)
+
+	// Чек частичного возврата — на сумму возврата; иначе эмулятор отклонит возврат
+	rec := postRefund(h.HandleRefundPayment, payment.ID, `{"amount":33}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Status string `json:"status"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Status != payments.RefundSucceeded {
+		t.Errorf("refund status %q", resp.Status)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// refundResult — ответ обработчиков возврата и чарджбэка
+type refundResult struct {
+	Status      string `json:"status"`
+	Tier        string `json:"tier"`
+	OverQuota   bool   `json:"overQuota"`
+	Transaction struct {
+		Status         string  `json:"status"`
+		RefundedAmount float64 `json:"refundedAmount"`
+	} `json:"transaction"`
+}
+
+// confirmedPayment создает в эмуляторе оплаченный платеж на 99 RUB
+func confirmedPayment(t *testing.T, h *Handler, fake *payments.FakeServer) *payments.Payment {
+	t.Helper()
+	payment := createFakePayment(t, h, "tx-1", 99)
+	if err := fake.Confirm(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	return payment
+}
+
+func TestRefundPayment_Partial(t *testing.T) {
+	h, mock, fake := newPaymentsHandler(t)
+	payment := confirmedPayment(t, h, fake)
+
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "succeeded"))
+	expectPartialRefund(mock, payment.ID, "refund", 33)
+
+	rec := postRefund(h.HandleRefundPayment, payment.ID, `{"amount":33,"reason":"goodwill"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp refundResult
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Transaction.Status != "partially_refunded" || resp.Tier != "start" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefundPayment_FullDowngradesToFree(t *testing.T) {
+	h, mock, fake := newPaymentsHandler(t)
+	payment := confirmedPayment(t, h, fake)
+
+	// Без суммы возвращается весь платеж: оплаченный период сокращается на
+	// целый месяц и уже прошел, автопродление выключается
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "succeeded"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "succeeded"))
+	mock.ExpectExec("INSERT INTO refunds").
+		WithArgs(sqlmock.AnyArg(), "tx-1", 99.0, "RUB", "refund", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions SET status").
+		WithArgs("tx-1", "refunded", 99.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT tier, subscription_expires_at FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"tier", "subscription_expires_at"}).AddRow("start", time.Now().AddDate(0, 0, 20)))
+	mock.ExpectExec("SET tier = 'free'").WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SET status = 'expired'").WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE subscriptions SET auto_renew = FALSE").WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT u.tier").
+		WillReturnRows(sqlmock.NewRows([]string{"tier", "subscription_expires_at", "storage_limit", "used"}).
+			AddRow("free", time.Now(), 0, 0))
+	mock.ExpectCommit()
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), "payment_refunded", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), "tier_changed", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rec := postRefund(h.HandleRefundPayment, payment.ID, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp refundResult
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Transaction.Status != "refunded" || resp.Transaction.RefundedAmount != 99 || resp.Tier != "free" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefundPayment_RejectsAmountOverPayment(t *testing.T) {
+	h, mock, fake := newPaymentsHandler(t)
+	payment := confirmedPayment(t, h, fake)
+
+	// Проверяется до обращения к YooKassa: деньги не возвращаются
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "succeeded"))
+
+	if rec := postRefund(h.HandleRefundPayment, payment.ID, `{"amount":150}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChargeback_ExceedsConcurrentRefund(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	now := time.Now()
+
+	// Пока администратор оформлял чарджбэк, 90 RUB уже вернули: сумма
+	// проверяется повторно под блокировкой строки (ErrRefundExceedsPayment)
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs("pay-1").
+		WillReturnRows(transactionRow("tx-1", "pay-1", 99, "succeeded"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE").
+		WithArgs("pay-1").
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx-1", "user-1", "pay-1", "start", 99.0, "RUB", "monthly", "partially_refunded", 90.0, []byte(`{}`), now, now))
+	mock.ExpectExec("INSERT INTO refunds").
+		WithArgs(sqlmock.AnyArg(), "tx-1", 99.0, "RUB", "chargeback", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	if rec := postRefund(h.HandleChargeback, "pay-1", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChargeback_DisablesAutoRenewal(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs("pay-1").
+		WillReturnRows(transactionRow("tx-1", "pay-1", 99, "succeeded"))
+	expectPartialRefund(mock, "pay-1", "chargeback", 33)
+
+	rec := postRefund(h.HandleChargeback, "pay-1", `{"amount":33,"reason":"fraud"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp refundResult
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Status != payments.RefundSucceeded || resp.Transaction.Status != "partially_refunded" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefundWebhook_DuplicateRefundIsNoop(t *testing.T) {
+	h, mock, fake := newPaymentsHandler(t)
+	payment := confirmedPayment(t, h, fake)
+	refund, err := h.PaymentProvider.CreateRefund(context.Background(), payments.CreateRefundRequest{
+		PaymentID: payment.ID,
+		Amount:    payments.NewAmount(33, "RUB"),
+	}, "refund-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// Возврат уже учтен обработчиком администратора: уведомление записывается
+	// во входящие, но доступ и аудит не меняются
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO payment_webhook_inbox").
+		WithArgs("refund:"+refund.ID+":succeeded", "refund.succeeded", refund.ID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FOR UPDATE").
+		WithArgs(payment.ID).
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx-1", "user-1", payment.ID, "start", 99.0, "RUB", "monthly", "partially_refunded", 33.0, []byte(`{}`), now, now))
+	mock.ExpectExec("INSERT INTO refunds").
+		WithArgs(refund.ID, "tx-1", 33.0, "RUB", "refund", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	if rec := postWebhook(h, "", "refund.succeeded", refund.ID); rec.Code != http.StatusOK {
+		t.Errorf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
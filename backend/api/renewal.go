@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"noteflow/model"
+	"noteflow/payments"
+	"noteflow/store"
+
+	"github.com/google/uuid"
+)
+
+// Автопродление: за Billing.RenewBefore до конца оплаченного периода подписка
+// оплачивается сохраненным способом оплаты. Неудачное списание повторяется
+// (с письмом пользователю), пока тариф действует до конца льготного периода.
+
+const (
+	renewalBatchSize = 50
+	// renewalLease — через сколько повторить продление, прерванное сбоем
+	// или еще не завершенным платежом
+	renewalLease = 30 * time.Minute
+)
+
+// NotificationPaymentFailed — уведомление о неудачном списании за продление
+const NotificationPaymentFailed = "payment_failed"
+
+// RunRenewals продлевает подписки раз в Billing.CheckInterval, пока не отменен ctx
+func (h *Handler) RunRenewals(ctx context.Context) {
+	if h.PaymentProvider == nil {
+		log.Printf("Subscription renewals disabled: payments are not configured")
+		return
+	}
+	ticker := time.NewTicker(h.Billing.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		h.renewDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewDue продлевает все подписки, которым пора
+func (h *Handler) renewDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		subs, err := h.Store.SubscriptionRepository.ClaimDueRenewals(ctx, h.Billing.RenewBefore, renewalLease, h.Billing.MaxAttempts, renewalBatchSize)
+		if err != nil {
+			log.Printf("Failed to claim subscriptions for renewal: %v", err)
+			return
+		}
+		for _, sub := range subs {
+			h.renew(ctx, sub)
+		}
+		if len(subs) < renewalBatchSize {
+			return
+		}
+	}
+}
+
+// renew списывает оплату следующего периода сохраненным способом оплаты
+func (h *Handler) renew(ctx context.Context, sub model.Subscription) {
+	// Запланированное понижение тарифа вступает в силу с новым периодом
+	tier := sub.Tier
+	if sub.ScheduledTier != "" {
+		tier = sub.ScheduledTier
+	}
+	plan, ok := model.FindPlan(tier)
+	if !ok {
+		log.Printf("Renewal of user %s skipped: unknown tier %s", sub.UserID, tier)
+		return
+	}
+	price, ok := plan.Price(sub.Period, sub.Currency)
+	if !ok {
+		log.Printf("Renewal of user %s skipped: tier %s has no %s price in %s", sub.UserID, tier, sub.Period, sub.Currency)
+		return
+	}
+
+	// Ключ одинаков для повторов одной попытки: если сервер упадет после
+	// списания, повтор вернет тот же платеж, а не спишет деньги второй раз
+	attemptID := fmt.Sprintf("%s:%d:%d:%s", sub.UserID, sub.CurrentPeriodEnd.Unix(), sub.FailedAttempts, tier)
+	transactionID := uuid.NewSHA1(uuid.NameSpaceOID, []byte(attemptID)).String()
+	key := "renewal-" + transactionID
+
+	amount := payments.NewAmount(price.Amount, price.Currency)
+	description := fmt.Sprintf("NoteFlow %s, продление на %s", plan.Name(), periodTitle(price.Period))
+	payment, err := h.PaymentProvider.CreatePayment(ctx, payments.CreatePaymentRequest{
+		Amount:      amount,
+		Description: description,
+		Capture:     true,
+		Metadata: map[string]string{
+			"transactionId": transactionID,
+			"userId":        sub.UserID,
+			"tier":          string(plan.Tier),
+			"kind":          model.PaymentRenewal,
+			"period":        string(price.Period),
+		},
+		PaymentMethodID: sub.PaymentMethodID,
+		Receipt:         h.receipt(sub.Email, description, amount),
+	}, key)
+	if err != nil {
+		var apiErr *payments.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode < 500 {
+			// Способ оплаты отклонен сервисом (удален, истек срок карты)
+			h.renewalFailed(ctx, sub, plan, price, apiErr.Code)
+			return
+		}
+		// Сеть или сбой YooKassa: попытка повторится после renewalLease
+		log.Printf("Failed to create renewal payment for user %s: %v", sub.UserID, err)
+		return
+	}
+
+	transaction, err := h.Store.UserRepository.GetTransactionByPaymentID(payment.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		metadata, _ := json.Marshal(map[string]interface{}{"test": payment.Test, "kind": model.PaymentRenewal})
+		transaction = &model.Transaction{
+			ID:        transactionID,
+			UserID:    sub.UserID,
+			PaymentID: payment.ID,
+			Tier:      plan.Tier,
+			Amount:    price.Amount,
+			Currency:  price.Currency,
+			Period:    price.Period,
+			Status:    model.TransactionPending,
+			Metadata:  metadata,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		err = h.Store.UserRepository.CreateTransaction(transaction)
+	}
+	if err != nil {
+		log.Printf("Failed to record renewal payment %s for user %s: %v", payment.ID, sub.UserID, err)
+		return
+	}
+
+	// pending: результат придет вебхуком, а до тех пор подписка занята renewalLease
+	if payment.Status != payments.StatusSucceeded && payment.Status != payments.StatusCanceled {
+		return
+	}
+	if err := h.applyPaymentStatus(ctx, nil, transaction, payment, nil, "renewal"); err != nil && !errors.Is(err, store.ErrIllegalTransition) {
+		log.Printf("Failed to apply renewal payment %s: %v", payment.ID, err)
+		return
+	}
+	if payment.Status == payments.StatusCanceled {
+		reason := "canceled"
+		if payment.CancellationDetails != nil {
+			reason = payment.CancellationDetails.Reason
+		}
+		h.renewalFailed(ctx, sub, plan, price, reason)
+		return
+	}
+	log.Printf("Subscription of user %s renewed (%s)", sub.UserID, plan.Tier)
+}
+
+// renewalFailed планирует следующую попытку и продлевает тариф на льготный период
+func (h *Handler) renewalFailed(ctx context.Context, sub model.Subscription, plan model.Plan, price model.PlanPrice, reason string) {
+	attempt := sub.FailedAttempts + 1
+	graceUntil := sub.CurrentPeriodEnd.Add(h.Billing.GracePeriod)
+	var next *time.Time
+	if attempt < h.Billing.MaxAttempts {
+		t := time.Now().Add(h.Billing.RetryInterval)
+		next = &t
+	}
+
+	if err := h.Store.SubscriptionRepository.RecordRenewalFailure(ctx, sub.UserID, next, graceUntil); err != nil {
+		log.Printf("Failed to record renewal failure for user %s: %v", sub.UserID, err)
+		return
+	}
+	log.Printf("Renewal of user %s failed (attempt %d/%d): %s", sub.UserID, attempt, h.Billing.MaxAttempts, reason)
+	h.auditSystem(ctx, sub.UserID, model.AuditRenewalFailed, map[string]interface{}{
+		"tier":       sub.Tier,
+		"attempt":    attempt,
+		"reason":     reason,
+		"graceUntil": graceUntil,
+	})
+	h.notifyRenewalFailed(ctx, sub, plan, price, next, graceUntil)
+}
+
+// notifyRenewalFailed сообщает пользователю о неудачном списании (уведомление и письмо)
+func (h *Handler) notifyRenewalFailed(ctx context.Context, sub model.Subscription, plan model.Plan, price model.PlanPrice, next *time.Time, graceUntil time.Time) {
+	const layout = "2006-01-02 15:04"
+	method := sub.PaymentMethodTitle
+	if method == "" {
+		method = "your saved payment method"
+	}
+
+	title := "Subscription payment failed"
+	body := fmt.Sprintf("We could not charge %s for your NoteFlow %s subscription (%.2f %s). ",
+		method, plan.Name(), price.Amount, price.Currency)
+	if next != nil {
+		body += fmt.Sprintf("We will try again on %s UTC. Your plan stays active until %s UTC; "+
+			"to keep it, make sure the payment method can be charged or pay for the subscription manually.",
+			next.UTC().Format(layout), graceUntil.UTC().Format(layout))
+	} else {
+		body += fmt.Sprintf("This was the last automatic attempt. Your plan stays active until %s UTC, "+
+			"after that your account moves to the free plan unless you pay for the subscription manually.",
+			graceUntil.UTC().Format(layout))
+	}
+
+	if err := h.Store.NotificationRepository.CreateNotification(ctx, sub.UserID, NotificationPaymentFailed, title, body); err != nil {
+		log.Printf("Failed to create payment failure notification for user %s: %v", sub.UserID, err)
+	}
+	if h.Mailer != nil {
+		if err := h.Mailer.Send(ctx, sub.Email, title, body); err != nil {
+			log.Printf("Failed to send payment failure email to user %s: %v", sub.UserID, err)
+		}
+	}
+}
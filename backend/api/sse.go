@@ -2,225 +2,377 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// SSEBroker рассылает сигналы "sync_needed" подключенным устройствам пользователя.
+//
+// Каждое соединение обслуживается своей горутиной (HTTP-обработчиком SSE или WS),
+// которая единолично пишет в сокет. Брокер лишь кладет сигнал в буфер подписки
+// без блокировки, поэтому медленный клиент не задерживает остальных, а Notify
+// держит read-lock только на время копирования списка подписок.
+
+var (
+	// ErrTooManyDevices — достигнут лимит подключений одного пользователя (HTTP 429)
+	ErrTooManyDevices = errors.New("sse: too many devices connected for user")
+	// ErrTooManyConnections — достигнут глобальный лимит подключений (HTTP 503)
+	ErrTooManyConnections = errors.New("sse: too many connections")
+	// ErrBrokerStopped — брокер остановлен, сервер завершает работу (HTTP 503)
+	ErrBrokerStopped = errors.New("sse: broker stopped")
+)
+
+// BrokerBackend доставляет уведомления о синхронизации между экземплярами API.
+// Publish рассылает событие всем экземплярам (включая текущий),
+// Listen блокируется и вызывает deliver для каждого полученного события.
+type BrokerBackend interface {
+	Publish(ctx context.Context, userID string) error
+	Listen(ctx context.Context, deliver func(userID string)) error
+}
+
+// BrokerConfig задает лимиты брокера (0 = без ограничения)
+type BrokerConfig struct {
+	MaxDevicesPerUser   int
+	MaxTotalConnections int
+	// Timeout — сколько подписка может не подавать признаков жизни (Touch),
+	// прежде чем брокер ее вытеснит
+	Timeout time.Duration
+}
+
+// DefaultBrokerConfig возвращает лимиты по умолчанию
+func DefaultBrokerConfig() BrokerConfig {
+	return BrokerConfig{
+		MaxDevicesPerUser:   5,
+		MaxTotalConnections: 0,
+		Timeout:             5 * time.Minute,
+	}
+}
+
+// CloseReason объясняет, почему брокер закрыл подписку
+type CloseReason int32
+
+const (
+	CloseUnsubscribed CloseReason = iota // обработчик сам отписался
+	CloseEvicted                         // вытеснена по таймауту или через EvictUser
+	CloseShutdown                        // брокер остановлен
+)
+
+// Subscription — подписка одного соединения
+type Subscription struct {
+	UserID string
+
+	notify    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	reason    atomic.Int32
+	lastSeen  atomic.Int64 // unix nano
+}
+
+func newSubscription(userID string) *Subscription {
+	sub := &Subscription{
+		UserID: userID,
+		// Буфер 1: несколько сигналов подряд схлопываются в один
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	sub.Touch()
+	return sub
+}
+
+// Notifications возвращает канал сигналов о необходимости синхронизации
+func (s *Subscription) Notifications() <-chan struct{} {
+	return s.notify
+}
+
+// Done закрывается, когда брокер закрыл подписку
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Reason возвращает причину закрытия (имеет смысл после закрытия Done)
+func (s *Subscription) Reason() CloseReason {
+	return CloseReason(s.reason.Load())
+}
+
+// Touch отмечает, что соединение живо (вызывается после успешной записи клиенту)
+func (s *Subscription) Touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (s *Subscription) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, s.lastSeen.Load()))
+}
+
+func (s *Subscription) close(reason CloseReason) {
+	s.closeOnce.Do(func() {
+		s.reason.Store(int32(reason))
+		close(s.done)
+	})
+}
+
 type SSEBroker struct {
-	// Map: UserID -> Map of Client Channels -> last active time
-	clients map[string]map[chan struct{}]time.Time
+	cfg BrokerConfig
+
 	mu      sync.RWMutex
-	// Timeout duration for clients: if no heartbeat after this, client is removed
-	timeout time.Duration
-	stop    chan struct{}
-	// Max devices per user (0 = unlimited)
-	maxDevicesPerUser int
-	// Global connection limit (0 = unlimited)
-	maxTotalConnections int
-	// Semaphore for global limit (nil if maxTotalConnections == 0)
-	sem chan struct{}
-}
-
-func NewSSEBroker() *SSEBroker {
-	broker := &SSEBroker{
-		clients:              make(map[string]map[chan struct{}]time.Time),
-		timeout:              time.Minute * 5, // default timeout 5 minutes
-		stop:                 make(chan struct{}),
-		maxDevicesPerUser:    3,  // по умолчанию не более 5 устройств на пользователя
-		maxTotalConnections:  0,  // по умолчанию нет глобального лимита (0 = unlimited)
-		sem:                  nil, // будет инициализирован только если maxTotalConnections > 0
-	}
-	// Инициализируем семафор, если лимит задан
-	if broker.maxTotalConnections > 0 {
-		broker.sem = make(chan struct{}, broker.maxTotalConnections)
-	}
-	go broker.backgroundTasks()
-	return broker
-}
-
-// NewSSEBrokerWithTimeout creates a broker with a custom timeout
-func NewSSEBrokerWithTimeout(timeout time.Duration) *SSEBroker {
-	broker := &SSEBroker{
-		clients:              make(map[string]map[chan struct{}]time.Time),
-		timeout:              timeout,
-		stop:                 make(chan struct{}),
-		maxDevicesPerUser:    5,
-		maxTotalConnections:  0, // по умолчанию нет глобального лимита
-		sem:                  nil,
-	}
-	if broker.maxTotalConnections > 0 {
-		broker.sem = make(chan struct{}, broker.maxTotalConnections)
-	}
-	go broker.backgroundTasks()
-	return broker
-}
-
-// Subscribe создает канал для конкретного клиента и возвращает его
-func (b *SSEBroker) Subscribe(userID string) chan struct{} {
-	// Глобальный лимит (если задан)
-	if b.sem != nil {
-		b.sem <- struct{}{}
-	}
-	
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	clients map[string]map[*Subscription]struct{} // UserID -> подписки
+	total   int
+	stopped bool
+
+	// Backend for cross-instance fan-out (nil = только текущий процесс)
+	backend BrokerBackend
+
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
 
-	if _, ok := b.clients[userID]; !ok {
-		b.clients[userID] = make(map[chan struct{}]time.Time)
+// NewSSEBroker создает брокер. Если backend == nil, уведомления доставляются
+// только устройствам, подключенным к этому экземпляру.
+func NewSSEBroker(cfg BrokerConfig, backend BrokerBackend) *SSEBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &SSEBroker{
+		cfg:     cfg,
+		clients: make(map[string]map[*Subscription]struct{}),
+		backend: backend,
+		cancel:  cancel,
 	}
 
-	// Проверяем лимит устройств на пользователя
-	if b.maxDevicesPerUser > 0 && len(b.clients[userID]) >= b.maxDevicesPerUser {
-		// Достигнут лимит – закрываем самое старое соединение
-		var oldestChan chan struct{}
-		var oldestTime time.Time
-		for ch, t := range b.clients[userID] {
-			if oldestChan == nil || t.Before(oldestTime) {
-				oldestChan = ch
-				oldestTime = t
-			}
+	if cfg.Timeout > 0 {
+		b.wg.Add(1)
+		go b.evictIdleLoop(ctx)
+	}
+	if backend != nil {
+		b.wg.Add(1)
+		go b.listen(ctx)
+	}
+	return b
+}
+
+// listen держит подписку на бэкенд и переподключается при ошибках
+func (b *SSEBroker) listen(ctx context.Context) {
+	defer b.wg.Done()
+	for {
+		err := b.backend.Listen(ctx, b.deliver)
+		if ctx.Err() != nil {
+			return
 		}
-		if oldestChan != nil {
-			delete(b.clients[userID], oldestChan)
-			close(oldestChan)
-			// Освобождаем слот глобального лимита, если он был занят этим соединением
-			if b.sem != nil {
-				select {
-				case <-b.sem:
-					// успешно извлекли
-				default:
-					// не должно происходить
-				}
-			}
+		log.Printf("SSE broker backend listen failed: %v, retrying in 2s", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
 		}
 	}
-
-	// Создаем буферизированный канал (размер 1), чтобы не блокировать отправку
-	ch := make(chan struct{}, 1)
-	b.clients[userID][ch] = time.Now()
-	return ch
 }
 
-// Unsubscribe удаляет канал
-func (b *SSEBroker) Unsubscribe(userID string, ch chan struct{}) {
+// Subscribe регистрирует соединение пользователя. Никогда не блокируется:
+// при превышении лимитов возвращает ErrTooManyDevices или ErrTooManyConnections.
+func (b *SSEBroker) Subscribe(userID string) (*Subscription, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if userClients, ok := b.clients[userID]; ok {
-		if _, ok := userClients[ch]; ok {
-			delete(userClients, ch)
-			close(ch)
-			if len(userClients) == 0 {
-				delete(b.clients, userID)
-			}
-			// Освобождаем слот глобального лимита
-			if b.sem != nil {
-				select {
-				case <-b.sem:
-					// успешно извлекли
-				default:
-					// не должно происходить
-				}
-			}
-		}
+	if b.stopped {
+		return nil, ErrBrokerStopped
+	}
+	if b.cfg.MaxTotalConnections > 0 && b.total >= b.cfg.MaxTotalConnections {
+		return nil, ErrTooManyConnections
+	}
+	userClients := b.clients[userID]
+	if b.cfg.MaxDevicesPerUser > 0 && len(userClients) >= b.cfg.MaxDevicesPerUser {
+		return nil, ErrTooManyDevices
+	}
+
+	if userClients == nil {
+		userClients = make(map[*Subscription]struct{})
+		b.clients[userID] = userClients
+	}
+	sub := newSubscription(userID)
+	userClients[sub] = struct{}{}
+	b.total++
+	return sub, nil
+}
+
+// Unsubscribe удаляет подписку (безопасно вызывать повторно)
+func (b *SSEBroker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	b.remove(sub)
+	b.mu.Unlock()
+	sub.close(CloseUnsubscribed)
+}
+
+// remove удаляет подписку из карты; вызывается под b.mu
+func (b *SSEBroker) remove(sub *Subscription) bool {
+	userClients, ok := b.clients[sub.UserID]
+	if !ok {
+		return false
+	}
+	if _, ok := userClients[sub]; !ok {
+		return false
+	}
+	delete(userClients, sub)
+	if len(userClients) == 0 {
+		delete(b.clients, sub.UserID)
+	}
+	b.total--
+	return true
+}
+
+// EvictUser закрывает все подписки пользователя при отзыве сессий. Клиенты
+// переподключаются с новым тикетом, а отозванная сессия тикет уже не получит.
+func (b *SSEBroker) EvictUser(userID string) {
+	b.mu.Lock()
+	var evicted []*Subscription
+	for sub := range b.clients[userID] {
+		evicted = append(evicted, sub)
+		b.remove(sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range evicted {
+		sub.close(CloseEvicted)
 	}
 }
 
-// Notify отправляет сигнал всем устройствам пользователя
+// Notify публикует событие через бэкенд, чтобы его получили устройства
+// пользователя, подключенные к любому экземпляру API
 func (b *SSEBroker) Notify(userID string) {
+	if b.backend == nil {
+		b.deliver(userID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := b.backend.Publish(ctx, userID); err != nil {
+		// Бэкенд недоступен – доставляем хотя бы локальным клиентам
+		log.Printf("SSE broker publish failed for user %s: %v", userID, err)
+		b.deliver(userID)
+	}
+}
+
+// deliver отправляет сигнал всем локально подключенным устройствам пользователя
+func (b *SSEBroker) deliver(userID string) {
 	b.mu.RLock()
-	defer b.mu.RUnlock()
+	subs := make([]*Subscription, 0, len(b.clients[userID]))
+	for sub := range b.clients[userID] {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
 
-	if userClients, ok := b.clients[userID]; ok {
-		for ch := range userClients {
-			select {
-			case ch <- struct{}{}:
-				// signal sent, update last active time
-				b.mu.Lock()
-				if _, ok := b.clients[userID][ch]; ok {
-					b.clients[userID][ch] = time.Now()
-				}
-				b.mu.Unlock()
-			default:
-				// Если канал полон (клиент еще не обработал предыдущий сигнал), пропускаем
-				// This is safe; client may be slow but still alive
-			}
+	for _, sub := range subs {
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+			// Сигнал уже ждет обработки – клиент все равно сделает pull
 		}
 	}
 }
 
-// backgroundTasks runs heartbeat and cleanup in a single goroutine
-func (b *SSEBroker) backgroundTasks() {
-	heartbeatTicker := time.NewTicker(b.timeout / 2)
-	defer heartbeatTicker.Stop()
-	cleanupTicker := time.NewTicker(b.timeout)
-	defer cleanupTicker.Stop()
+// Connections возвращает число активных подписок
+func (b *SSEBroker) Connections() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.total
+}
+
+// evictIdleLoop периодически вытесняет подписки, не подававшие признаков жизни дольше Timeout
+func (b *SSEBroker) evictIdleLoop(ctx context.Context) {
+	defer b.wg.Done()
+
+	interval := b.cfg.Timeout / 2
+	if interval <= 0 {
+		interval = b.cfg.Timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-b.stop:
+		case <-ctx.Done():
 			return
-		case <-heartbeatTicker.C:
-			b.sendHeartbeats()
-		case <-cleanupTicker.C:
-			b.cleanupStaleClients()
+		case <-ticker.C:
+			b.evictIdle(time.Now())
 		}
 	}
 }
 
-// sendHeartbeats sends a heartbeat to all clients
-func (b *SSEBroker) sendHeartbeats() {
+func (b *SSEBroker) evictIdle(now time.Time) {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	now := time.Now()
-	for userID, userClients := range b.clients {
-		for ch, lastActive := range userClients {
-			// Если клиент был активен недавно (меньше чем timeout/2), можно пропустить heartbeat
-			if now.Sub(lastActive) < b.timeout/2 {
-				continue
-			}
-			select {
-			case ch <- struct{}{}:
-				// heartbeat sent, update last active time
-				b.clients[userID][ch] = now
-			default:
-				// channel full, client may be dead; leave for cleanup
+	var evicted []*Subscription
+	for _, userClients := range b.clients {
+		for sub := range userClients {
+			if sub.idleSince(now) > b.cfg.Timeout {
+				evicted = append(evicted, sub)
 			}
 		}
 	}
+	for _, sub := range evicted {
+		b.remove(sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range evicted {
+		sub.close(CloseEvicted)
+	}
 }
 
-// cleanupStaleClients removes clients that have been inactive beyond timeout
-func (b *SSEBroker) cleanupStaleClients() {
+// Drain закрывает все подписки с причиной CloseShutdown и отклоняет новые,
+// не останавливая бэкенд. Обработчики в ответ отправляют клиентам событие
+// "reconnect" (первый шаг graceful shutdown).
+func (b *SSEBroker) Drain() {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	now := time.Now()
-	for userID, userClients := range b.clients {
-		for ch, lastActive := range userClients {
-			if now.Sub(lastActive) > b.timeout {
-				delete(userClients, ch)
-				close(ch)
-				// Освобождаем слот глобального лимита
-				if b.sem != nil {
-					select {
-					case <-b.sem:
-						// успешно извлекли
-					default:
-						// не должно происходить
-					}
-				}
-			}
-		}
-		// Remove empty user entries
-		if len(userClients) == 0 {
-			delete(b.clients, userID)
+	b.stopped = true
+	var all []*Subscription
+	for _, userClients := range b.clients {
+		for sub := range userClients {
+			all = append(all, sub)
 		}
 	}
+	b.clients = make(map[string]map[*Subscription]struct{})
+	b.total = 0
+	b.mu.Unlock()
+
+	for _, sub := range all {
+		sub.close(CloseShutdown)
+	}
 }
 
-// Stop прекращает фоновые задачи (для graceful shutdown)
+// Stop закрывает все подписки, отклоняет новые и останавливает фоновые задачи
+// (для graceful shutdown). Повторный вызов безопасен.
 func (b *SSEBroker) Stop() {
-	close(b.stop)
+	b.stopOnce.Do(func() {
+		b.Drain()
+		b.cancel()
+		b.wg.Wait()
+	})
+}
+
+const (
+	reconnectMinDelay = time.Second
+	reconnectJitter   = 14 * time.Second
+)
+
+// ReconnectDelay возвращает случайную задержку переподключения, чтобы клиенты
+// после рестарта не пришли на новые экземпляры одновременно
+func ReconnectDelay() time.Duration {
+	return reconnectMinDelay + rand.N(reconnectJitter)
+}
+
+// writeBrokerError переводит отказ брокера в HTTP-ответ
+func writeBrokerError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrTooManyDevices:
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many devices connected", http.StatusTooManyRequests)
+	default:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Sync events temporarily unavailable", http.StatusServiceUnavailable)
+	}
 }
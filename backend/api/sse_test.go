@@ -0,0 +1,418 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+)
+
+func waitClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestSubscribe_PerUserLimit(t *testing.T) {
+	b := NewSSEBroker(BrokerConfig{MaxDevicesPerUser: 2}, nil)
+	defer b.Stop()
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.Subscribe("user1"); err != nil {
+			t.Fatalf("subscribe %d failed: %v", i, err)
+		}
+	}
+
+	if _, err := b.Subscribe("user1"); !errors.Is(err, ErrTooManyDevices) {
+		t.Errorf("expected ErrTooManyDevices, got %v", err)
+	}
+
+	// Лимит считается отдельно для каждого пользователя
+	if _, err := b.Subscribe("user2"); err != nil {
+		t.Errorf("subscribe for another user failed: %v", err)
+	}
+}
+
+func TestSubscribe_GlobalLimit(t *testing.T) {
+	b := NewSSEBroker(BrokerConfig{MaxTotalConnections: 2}, nil)
+	defer b.Stop()
+
+	sub1, _ := b.Subscribe("user1")
+	if _, err := b.Subscribe("user2"); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	// Третье подключение отклоняется сразу, а не ждет освобождения слота
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Subscribe("user3")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTooManyConnections) {
+			t.Errorf("expected ErrTooManyConnections, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe blocked on global limit")
+	}
+
+	// После отписки слот освобождается
+	b.Unsubscribe(sub1)
+	if _, err := b.Subscribe("user3"); err != nil {
+		t.Errorf("subscribe after unsubscribe failed: %v", err)
+	}
+	if got := b.Connections(); got != 2 {
+		t.Errorf("expected 2 connections, got %d", got)
+	}
+}
+
+func TestNotify_DeliversToAllDevices(t *testing.T) {
+	b := NewSSEBroker(DefaultBrokerConfig(), nil)
+	defer b.Stop()
+
+	sub1, _ := b.Subscribe("user1")
+	sub2, _ := b.Subscribe("user1")
+	other, _ := b.Subscribe("user2")
+
+	b.Notify("user1")
+
+	waitSignal := func(sub *Subscription, name string) {
+		select {
+		case <-sub.Notifications():
+		case <-time.After(time.Second):
+			t.Errorf("%s did not receive notification", name)
+		}
+	}
+	waitSignal(sub1, "sub1")
+	waitSignal(sub2, "sub2")
+
+	select {
+	case <-other.Notifications():
+		t.Error("other user received notification")
+	default:
+	}
+}
+
+func TestNotify_CoalescesPendingSignals(t *testing.T) {
+	b := NewSSEBroker(DefaultBrokerConfig(), nil)
+	defer b.Stop()
+
+	sub, _ := b.Subscribe("user1")
+
+	// Клиент не читает: Notify не должен блокироваться
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			b.Notify("user1")
+		}
+		close(done)
+	}()
+	waitClosed(t, done, "Notify with slow consumer")
+
+	<-sub.Notifications()
+	select {
+	case <-sub.Notifications():
+		t.Error("expected pending signals to be coalesced into one")
+	default:
+	}
+}
+
+func TestEvictUser(t *testing.T) {
+	b := NewSSEBroker(DefaultBrokerConfig(), nil)
+	defer b.Stop()
+
+	sub1, _ := b.Subscribe("user1")
+	sub2, _ := b.Subscribe("user1")
+	other, _ := b.Subscribe("user2")
+
+	b.EvictUser("user1")
+
+	waitClosed(t, sub1.Done(), "sub1 eviction")
+	waitClosed(t, sub2.Done(), "sub2 eviction")
+	if sub1.Reason() != CloseEvicted {
+		t.Errorf("expected CloseEvicted, got %v", sub1.Reason())
+	}
+
+	select {
+	case <-other.Done():
+		t.Error("other user's subscription was evicted")
+	default:
+	}
+	if got := b.Connections(); got != 1 {
+		t.Errorf("expected 1 connection, got %d", got)
+	}
+
+	// Повторная отписка вытесненной подписки безопасна и не портит счетчик
+	b.Unsubscribe(sub1)
+	if got := b.Connections(); got != 1 {
+		t.Errorf("expected 1 connection after double unsubscribe, got %d", got)
+	}
+}
+
+func TestEvictIdle(t *testing.T) {
+	b := NewSSEBroker(BrokerConfig{Timeout: 50 * time.Millisecond}, nil)
+	defer b.Stop()
+
+	idle, _ := b.Subscribe("user1")
+	active, _ := b.Subscribe("user1")
+
+	stopTouch := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopTouch:
+				return
+			case <-ticker.C:
+				active.Touch()
+			}
+		}
+	}()
+	defer close(stopTouch)
+
+	waitClosed(t, idle.Done(), "idle eviction")
+	if idle.Reason() != CloseEvicted {
+		t.Errorf("expected CloseEvicted, got %v", idle.Reason())
+	}
+
+	select {
+	case <-active.Done():
+		t.Error("active subscription was evicted")
+	default:
+	}
+}
+
+func TestStop_ClosesSubscriptionsAndRejectsNew(t *testing.T) {
+	b := NewSSEBroker(DefaultBrokerConfig(), nil)
+
+	sub, _ := b.Subscribe("user1")
+	b.Stop()
+
+	waitClosed(t, sub.Done(), "shutdown")
+	if sub.Reason() != CloseShutdown {
+		t.Errorf("expected CloseShutdown, got %v", sub.Reason())
+	}
+
+	if _, err := b.Subscribe("user1"); !errors.Is(err, ErrBrokerStopped) {
+		t.Errorf("expected ErrBrokerStopped, got %v", err)
+	}
+
+	// После остановки вызовы не паникуют
+	b.Notify("user1")
+	b.Unsubscribe(sub)
+	b.Stop()
+}
+
+// fakeBackend имитирует общий канал между экземплярами API
+type fakeBackend struct {
+	mu        sync.Mutex
+	listeners []func(string)
+	ready     chan struct{}
+	once      sync.Once
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{ready: make(chan struct{})}
+}
+
+func (f *fakeBackend) Publish(ctx context.Context, userID string) error {
+	f.mu.Lock()
+	listeners := append([]func(string){}, f.listeners...)
+	f.mu.Unlock()
+	for _, deliver := range listeners {
+		deliver(userID)
+	}
+	return nil
+}
+
+func (f *fakeBackend) Listen(ctx context.Context, deliver func(string)) error {
+	f.mu.Lock()
+	f.listeners = append(f.listeners, deliver)
+	n := len(f.listeners)
+	f.mu.Unlock()
+	if n == 2 {
+		f.once.Do(func() { close(f.ready) })
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestNotify_FansOutAcrossInstances(t *testing.T) {
+	backend := newFakeBackend()
+	a := NewSSEBroker(DefaultBrokerConfig(), backend)
+	defer a.Stop()
+	b := NewSSEBroker(DefaultBrokerConfig(), backend)
+	defer b.Stop()
+	waitClosed(t, backend.ready, "backend listeners")
+
+	sub, _ := b.Subscribe("user1")
+
+	// Push обработан экземпляром A, устройство подключено к B
+	a.Notify("user1")
+
+	select {
+	case <-sub.Notifications():
+	case <-time.After(time.Second):
+		t.Error("notification did not reach the other instance")
+	}
+}
+
+func TestBroker_ConcurrentSubscribeNotifyEvictStop(t *testing.T) {
+	b := NewSSEBroker(BrokerConfig{MaxDevicesPerUser: 3, MaxTotalConnections: 50, Timeout: 20 * time.Millisecond}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("user%d", i%5)
+			for j := 0; j < 50; j++ {
+				sub, err := b.Subscribe(userID)
+				if err != nil {
+					continue
+				}
+				b.Notify(userID)
+				select {
+				case <-sub.Notifications():
+				case <-sub.Done():
+				default:
+				}
+				sub.Touch()
+				if j%7 == 0 {
+					b.EvictUser(userID)
+				}
+				b.Unsubscribe(sub)
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		b.Stop()
+	}()
+
+	wg.Wait()
+
+	if got := b.Connections(); got != 0 {
+		t.Errorf("expected 0 connections after stop, got %d", got)
+	}
+}
+
+// expectSyncStream выдает тикет аудитории audience и ожидает его погашения с живой сессией
+func expectSyncStream(t *testing.T, h *Handler, mock sqlmock.Sqlmock, audience string) string {
+	t.Helper()
+	ticket := issueTestTicket(t, h, mock, audience)
+	mock.ExpectQuery(consumeTicketQuery).
+		WithArgs(hashToken(ticket), audience).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "session_id"}).AddRow("user-1", "session-1"))
+	mock.ExpectQuery("SELECT GREATEST").
+		WithArgs("session-1").
+		WillReturnRows(sqlmock.NewRows([]string{"greatest"}).AddRow(time.Now().Add(time.Hour)))
+	return ticket
+}
+
+func checkReconnectDelay(t *testing.T, ms int) {
+	t.Helper()
+	if d := time.Duration(ms) * time.Millisecond; d < reconnectMinDelay || d > reconnectMinDelay+reconnectJitter {
+		t.Errorf("retry %v outside [%v, %v]", d, reconnectMinDelay, reconnectMinDelay+reconnectJitter)
+	}
+}
+
+func TestDrain_SendsReconnectHintToSSE(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleSSE))
+	defer srv.Close()
+
+	ticket := expectSyncStream(t, h, mock, sseTicketAudience)
+	resp, err := http.Get(srv.URL + "?ticket=" + ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := bufio.NewReader(resp.Body)
+	if line, _ := body.ReadString('\n'); !strings.HasPrefix(line, ": connected") {
+		t.Fatalf("unexpected first line %q", line)
+	}
+	body.ReadString('\n')
+
+	h.Broker.Drain()
+
+	var retry int
+	if line, _ := body.ReadString('\n'); !strings.HasPrefix(line, "retry: ") {
+		t.Fatalf("expected retry line, got %q", line)
+	} else {
+		retry, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "retry: ")))
+	}
+	checkReconnectDelay(t, retry)
+	if line, _ := body.ReadString('\n'); line != "event: reconnect\n" {
+		t.Errorf("expected reconnect event, got %q", line)
+	}
+	if line, _ := body.ReadString('\n'); line != fmt.Sprintf("data: {\"retryAfter\":%d}\n", retry) {
+		t.Errorf("unexpected data %q", line)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaitStreams_ReturnsAfterDrainOrDeadline(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleWS))
+	defer srv.Close()
+
+	ticket := expectSyncStream(t, h, mock, wsTicketAudience)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?ticket="+ticket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Ответ на ping: соединение уже учтено в streams
+	conn.WriteJSON(wsFrame{Type: "ping", ID: "1"})
+	var frame wsFrame
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "pong" {
+		t.Fatalf("ping: %+v, %v", frame, err)
+	}
+
+	// Пока соединение открыто, ожидание заканчивается по сроку
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.WaitStreams(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitStreams with open stream = %v, want deadline exceeded", err)
+	}
+
+	h.Broker.Drain()
+
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "reconnect" {
+		t.Fatalf("expected reconnect frame, got %+v, %v", frame, err)
+	}
+	checkReconnectDelay(t, frame.RetryAfter)
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Errorf("expected close 1012, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.WaitStreams(ctx); err != nil {
+		t.Errorf("WaitStreams after drain = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
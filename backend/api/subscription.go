@@ -2,13 +2,25 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
+	"noteflow/clientip"
+	"noteflow/config"
 	"noteflow/model"
+	"noteflow/payments"
+	"noteflow/store"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
@@ -30,14 +42,46 @@ func (h *Handler) HandleGetUserProfile(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(profile)
 }
 
-// HandleGetSubscriptionPlans возвращает доступные тарифные планы
+// HandleGetSubscriptionPlans возвращает доступные тарифные планы на языке
+// запроса (?lang= или Accept-Language)
 func (h *Handler) HandleGetSubscriptionPlans(w http.ResponseWriter, r *http.Request) {
-	plans := model.GetSubscriptionPlans()
+	plans := model.GetSubscriptionPlans(requestLanguage(r), h.Payments.Currencies)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(plans)
 }
 
-// HandleCreatePayment создает платежную транзакцию (заглушка для YooKassa)
+// newPaymentProvider создает клиент YooKassa. Провайдер "fake" (только DevMode)
+// запускает встроенный эмулятор API YooKassa на 127.0.0.1: страница оплаты
+// открывается локально и сразу подтверждает платеж.
+func newPaymentProvider(cfg config.PaymentsConfig) (payments.PaymentProvider, error) {
+	yk := payments.Config{ShopID: cfg.ShopID, SecretKey: cfg.SecretKey, BaseURL: cfg.APIURL}
+	if cfg.Provider == "fake" {
+		fake := payments.NewFakeServer("fake-shop", "fake-secret")
+		log.Printf("Payments: using fake YooKassa at %s", fake.URL)
+		yk = fake.Config()
+	}
+	client, err := payments.NewYooKassa(yk)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// transactionStatus переводит статус платежа YooKassa в статус транзакции
+func transactionStatus(paymentStatus string) model.TransactionStatus {
+	switch paymentStatus {
+	case payments.StatusSucceeded:
+		return model.TransactionSucceeded
+	case payments.StatusCanceled:
+		return model.TransactionCanceled
+	default:
+		// pending и waiting_for_capture: деньги еще не списаны
+		return model.TransactionPending
+	}
+}
+
+// HandleCreatePayment создает платеж YooKassa по цене тарифа из каталога
+// и возвращает ссылку на страницу оплаты
 func (h *Handler) HandleCreatePayment(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(r)
 	if userID == "" {
@@ -47,87 +91,401 @@ func (h *Handler) HandleCreatePayment(w http.ResponseWriter, r *http.Request) {
 
 	var req struct {
 		Tier string `json:"tier"`
+		// AutoRenew (по умолчанию true) сохраняет способ оплаты для автопродления
+		AutoRenew *bool `json:"autoRenew"`
+		// Coupon — промокод на скидку (только на эту оплату)
+		Coupon string `json:"coupon"`
+		// Period и Currency выбирают цену тарифа (по умолчанию monthly и первая валюта из настроек)
+		Period   string `json:"period"`
+		Currency string `json:"currency"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	autoRenew := req.AutoRenew == nil || *req.AutoRenew
 
-	// Проверяем валидность тарифа
-	if !model.IsValidTier(req.Tier) || req.Tier == "free" {
+	plan, ok := model.FindPlan(model.UserTier(req.Tier))
+	if !ok {
 		http.Error(w, "Invalid tier", http.StatusBadRequest)
 		return
 	}
-
-	// Получаем информацию о тарифе для определения цены
-	var price float64
-	switch model.UserTier(req.Tier) {
-	case model.TierStart:
-		price = 99.0
-	case model.TierMedium:
-		price = 299.0
-	case model.TierUltra:
-		price = 999.0
-	default:
+	price, ok := h.selectPrice(w, plan, req.Period, req.Currency)
+	if !ok {
+		return
+	}
+	if h.PaymentProvider == nil {
+		http.Error(w, "Payments are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	// Другой тариф при действующей подписке оплачивается с учетом остатка периода
+	if current, err := h.currentPeriod(r.Context(), userID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if current != nil && current.tier != plan.Tier {
+		http.Error(w, "Use /subscription/change to switch plans", http.StatusConflict)
+		return
+	} else if current == nil && !plan.Active {
+		// Снятый с продажи тариф могут продлить только те, у кого он уже есть
 		http.Error(w, "Invalid tier", http.StatusBadRequest)
 		return
 	}
 
-	// Генерируем уникальный ID платежа
-	paymentID := "yookassa_test_" + uuid.New().String()
+	h.startCheckout(w, r, checkout{
+		userID:      userID,
+		plan:        plan,
+		price:       price,
+		amount:      price.Amount,
+		description: fmt.Sprintf("NoteFlow %s, подписка на %s", plan.Name(), periodTitle(price.Period)),
+		kind:        model.PaymentPurchase,
+		saveMethod:  autoRenew,
+		coupon:      model.NormalizeCouponCode(req.Coupon),
+	})
+}
 
-	// Создаем транзакцию
+// selectPrice выбирает цену тарифа за period (по умолчанию monthly) в валюте
+// currency (по умолчанию первая из Payments.Currencies). Валюта должна быть
+// среди принимаемых. При ошибке отвечает клиенту сам.
+func (h *Handler) selectPrice(w http.ResponseWriter, plan model.Plan, period, currency string) (model.PlanPrice, bool) {
+	if period == "" {
+		period = string(model.PeriodMonthly)
+	}
+	if currency == "" && len(h.Payments.Currencies) > 0 {
+		currency = h.Payments.Currencies[0]
+	}
+	currency = strings.ToUpper(currency)
+	if !slices.Contains(h.Payments.Currencies, currency) {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return model.PlanPrice{}, false
+	}
+	price, ok := plan.Price(model.BillingPeriod(period), currency)
+	if !ok {
+		http.Error(w, "The plan has no price for this billing period and currency", http.StatusBadRequest)
+		return model.PlanPrice{}, false
+	}
+	return price, true
+}
+
+// periodTitle — период оплаты в описании платежа
+func periodTitle(p model.BillingPeriod) string {
+	if p == model.PeriodYearly {
+		return "год"
+	}
+	return "месяц"
+}
+
+// receiptsEnabled сообщает, передается ли с платежом в валюте currency чек
+// по 54-ФЗ: онлайн-касса YooKassa принимает только платежи в рублях
+func (h *Handler) receiptsEnabled(currency string) bool {
+	return h.Payments.Receipt.Enabled && currency == "RUB"
+}
+
+// receipt возвращает чек платежа на сумму amount (nil — чек не нужен)
+func (h *Handler) receipt(email, description string, amount payments.Amount) *payments.Receipt {
+	if !h.receiptsEnabled(amount.Currency) {
+		return nil
+	}
+	rc := h.Payments.Receipt
+	return payments.NewServiceReceipt(email, description, amount, rc.VATCode, rc.TaxSystemCode)
+}
+
+// checkout — платеж, который пользователь подтверждает на странице YooKassa
+type checkout struct {
+	userID      string
+	plan        model.Plan
+	price       model.PlanPrice // цена тарифа: период и валюта платежа
+	amount      float64
+	description string
+	kind        string // назначение платежа (model.PaymentPurchase, ...)
+	saveMethod  bool
+	coupon      string // промокод ("" — без скидки)
+	// fromTier — тариф до повышения: на него пользователь вернется при полном возврате доплаты
+	fromTier model.UserTier
+}
+
+// startCheckout создает платеж и транзакцию и отвечает ссылкой на страницу оплаты
+func (h *Handler) startCheckout(w http.ResponseWriter, r *http.Request, c checkout) {
+	// ID транзакции служит и ключом идемпотентности: повтор запроса к YooKassa
+	// после сетевой ошибки не создаст второй платеж
+	transactionID := uuid.New().String()
+	metadata := map[string]string{
+		"transactionId": transactionID,
+		"userId":        c.userID,
+		"tier":          string(c.plan.Tier),
+		"kind":          c.kind,
+		"period":        string(c.price.Period),
+	}
+
+	// Чек отправляется на email аккаунта
+	var email string
+	if h.receiptsEnabled(c.price.Currency) {
+		var err error
+		if email, err = h.Store.UserRepository.GetUserEmail(r.Context(), c.userID); err != nil {
+			log.Printf("Failed to get email of user %s: %v", c.userID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Промокод резервируется за транзакцией; если платеж не создан, резерв снимается
+	amount := c.amount
+	release := func() {}
+	if c.coupon != "" {
+		coupon, err := h.Store.CouponRepository.ReserveCoupon(r.Context(), c.coupon, c.userID, c.plan, c.price, transactionID)
+		if err != nil {
+			couponError(w, err)
+			return
+		}
+		amount = coupon.Apply(c.amount)
+		metadata["coupon"] = coupon.Code
+		release = func() {
+			if err := h.Store.CouponRepository.ReleaseCoupon(context.WithoutCancel(r.Context()), transactionID); err != nil {
+				log.Printf("Failed to release coupon %s of transaction %s: %v", coupon.Code, transactionID, err)
+			}
+		}
+	}
+
+	paymentAmount := payments.NewAmount(amount, c.price.Currency)
+	payment, err := h.PaymentProvider.CreatePayment(r.Context(), payments.CreatePaymentRequest{
+		Amount:            paymentAmount,
+		Description:       c.description,
+		ReturnURL:         h.Payments.ReturnURL,
+		Capture:           true,
+		Metadata:          metadata,
+		SavePaymentMethod: c.saveMethod,
+		Receipt:           h.receipt(email, c.description, paymentAmount),
+	}, transactionID)
+	if err != nil {
+		log.Printf("Failed to create YooKassa payment: %v", err)
+		release()
+		http.Error(w, "Failed to create payment", http.StatusBadGateway)
+		return
+	}
+	if payment.Confirmation == nil || payment.Confirmation.ConfirmationURL == "" {
+		log.Printf("YooKassa payment %s has no confirmation URL", payment.ID)
+		release()
+		http.Error(w, "Failed to create payment", http.StatusBadGateway)
+		return
+	}
+
+	details := map[string]interface{}{"test": payment.Test, "kind": c.kind}
+	if c.coupon != "" {
+		details["coupon"] = c.coupon
+		details["listPrice"] = c.amount
+	}
+	if c.fromTier != "" {
+		details["fromTier"] = c.fromTier
+	}
+	rawMetadata, _ := json.Marshal(details)
 	transaction := &model.Transaction{
-		ID:        uuid.New().String(),
-		UserID:    userID,
-		PaymentID: paymentID,
-		Tier:      model.UserTier(req.Tier),
-		Amount:    price,
-		Currency:  "RUB",
-		Status:    model.TransactionPending,
-		Metadata:  json.RawMessage(`{"test": true}`),
+		ID:        transactionID,
+		UserID:    c.userID,
+		PaymentID: payment.ID,
+		Tier:      c.plan.Tier,
+		Amount:    amount,
+		Currency:  c.price.Currency,
+		Period:    c.price.Period,
+		Status:    transactionStatus(payment.Status),
+		Metadata:  rawMetadata,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
 	// Сохраняем транзакцию в БД
 	if err := h.Store.UserRepository.CreateTransaction(transaction); err != nil {
-		log.Printf("Failed to create transaction: %v", err)
+		log.Printf("Failed to create transaction for payment %s: %v", payment.ID, err)
+		release()
 		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
 		return
 	}
 
-	// В реальной реализации здесь был бы вызов API YooKassa
-	// и возврат confirmation_url для редиректа пользователя
-	// Для заглушки возвращаем тестовые данные
-	response := map[string]interface{}{
-		"paymentId":       paymentID,
-		"confirmationUrl": "https://yookassa.test/confirmation/" + paymentID,
-		"amount":          price,
-		"currency":        "RUB",
-		"test":            true,
-		"message":         "Это заглушка. В рабочем окружении здесь будет реальный вызов YooKassa API",
+	resp := map[string]interface{}{
+		"paymentId":       payment.ID,
+		"confirmationUrl": payment.Confirmation.ConfirmationURL,
+		"amount":          amount,
+		"currency":        c.price.Currency,
+		"period":          c.price.Period,
+		"test":            payment.Test,
+	}
+	if c.coupon != "" {
+		resp["coupon"] = c.coupon
+		resp["listPrice"] = c.amount
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleGetPaymentStatus возвращает статус платежа пользователя. Пока платеж
+// не завершен, статус запрашивается у YooKassa — это работает и без вебхука.
+func (h *Handler) HandleGetPaymentStatus(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	paymentID := chi.URLParam(r, "id")
+
+	transaction, err := h.Store.UserRepository.GetTransactionByPaymentID(paymentID)
+	if err != nil || transaction.UserID != userID {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+
+	if transaction.Status == model.TransactionPending && h.PaymentProvider != nil {
+		payment, err := h.PaymentProvider.GetPayment(r.Context(), paymentID)
+		if err != nil {
+			log.Printf("Failed to fetch YooKassa payment %s: %v", paymentID, err)
+		} else if err := h.applyPaymentStatus(r.Context(), r, transaction, payment, nil, "status_check"); err != nil && !errors.Is(err, store.ErrIllegalTransition) {
+			log.Printf("Failed to apply status of payment %s: %v", paymentID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"paymentId": transaction.PaymentID,
+		"status":    transaction.Status,
+		"tier":      transaction.Tier,
+		"amount":    transaction.Amount,
+		"currency":  transaction.Currency,
+		"period":    transaction.Period,
+	})
 }
 
-// HandleWebhook обрабатывает вебхук от YooKassa
+// HandleGetSubscription возвращает подписку пользователя: срок, автопродление,
+// способ оплаты и неудачные попытки списания
+func (h *Handler) HandleGetSubscription(w http.ResponseWriter, r *http.Request) {
+	sub, err := h.Store.SubscriptionRepository.GetSubscription(r.Context(), getUserID(r))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
+
+// HandleCancelAutoRenew отключает автопродление: тариф действует до конца оплаченного периода
+func (h *Handler) HandleCancelAutoRenew(w http.ResponseWriter, r *http.Request) {
+	h.setAutoRenew(w, r, false)
+}
+
+// HandleResumeAutoRenew снова включает автопродление сохраненным способом оплаты
+func (h *Handler) HandleResumeAutoRenew(w http.ResponseWriter, r *http.Request) {
+	h.setAutoRenew(w, r, true)
+}
+
+func (h *Handler) setAutoRenew(w http.ResponseWriter, r *http.Request, autoRenew bool) {
+	userID := getUserID(r)
+	ok, err := h.Store.SubscriptionRepository.SetAutoRenew(r.Context(), userID, autoRenew)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if autoRenew {
+			http.Error(w, "No active subscription with a saved payment method", http.StatusConflict)
+		} else {
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+		}
+		return
+	}
+	h.audit(r, userID, model.AuditAutoRenewChanged, map[string]interface{}{"autoRenew": autoRenew})
+	h.HandleGetSubscription(w, r)
+}
+
+// paymentKind возвращает назначение платежа из его метаданных
+func paymentKind(payment *payments.Payment) string {
+	switch kind := payment.Metadata["kind"]; kind {
+	case model.PaymentRenewal, model.PaymentUpgrade:
+		return kind
+	default:
+		return model.PaymentPurchase
+	}
+}
+
+// applyPaymentStatus сохраняет статус платежа в транзакции; после успешной
+// оплаты в той же транзакции БД продлевает тариф на оплаченный период и
+// сохраняет способ оплаты для автопродления. event — уведомление, из-за которого
+// меняется статус (nil при проверке статуса), source — для журнала аудита.
+// r == nil для фоновых задач.
+func (h *Handler) applyPaymentStatus(ctx context.Context, r *http.Request, transaction *model.Transaction, payment *payments.Payment, event *model.PaymentEvent, source string) error {
+	status := transactionStatus(payment.Status)
+	if transaction.Status == status && event == nil {
+		return nil
+	}
+
+	outcome := model.PaymentOutcome{Kind: paymentKind(payment)}
+	// Способ оплаты продлений уже сохранен: повторно его не записываем, чтобы
+	// не включить автопродление, отключенное пользователем во время списания
+	if m := payment.PaymentMethod; m != nil && m.Saved && outcome.Kind != model.PaymentRenewal {
+		outcome.PaymentMethodID = m.ID
+		outcome.PaymentMethodTitle = m.Title
+	}
+
+	upd, err := h.Store.PaymentRepository.ApplyPaymentStatus(ctx, transaction.PaymentID, status, event, outcome)
+	if err != nil {
+		return err
+	}
+	*transaction = *upd.Transaction
+	if !upd.Changed || status != model.TransactionSucceeded {
+		return nil
+	}
+
+	log.Printf("User %s upgraded to tier %s until %s", transaction.UserID, transaction.Tier, upd.ExpiresAt.Format(time.RFC3339))
+	audit := func(event string, details map[string]interface{}) {
+		if r != nil {
+			h.audit(r, transaction.UserID, event, details)
+		} else {
+			h.auditSystem(ctx, transaction.UserID, event, details)
+		}
+	}
+	audit(model.AuditPaymentSucceeded, map[string]interface{}{
+		"paymentId": transaction.PaymentID,
+		"tier":      transaction.Tier,
+		"amount":    transaction.Amount,
+		"currency":  transaction.Currency,
+	})
+	audit(model.AuditTierChanged, map[string]interface{}{
+		"tier":      transaction.Tier,
+		"expiresAt": upd.ExpiresAt,
+		"source":    source,
+	})
+	if upd.OverQuota() {
+		// Как после возврата: файлы остаются, но новые не загрузятся, пока
+		// пользователь не освободит место
+		log.Printf("User %s is over the storage quota of tier %s: %d of %d bytes used", transaction.UserID, transaction.Tier, upd.StorageUsed, upd.StorageLimit)
+		audit(model.AuditStorageOverQuota, map[string]interface{}{
+			"used":  upd.StorageUsed,
+			"limit": upd.StorageLimit,
+		})
+	}
+	return nil
+}
+
+// HandleWebhook обрабатывает уведомление YooKassa. YooKassa не подписывает
+// уведомления, поэтому телу не доверяем: проверяем адрес отправителя, а статус
+// платежа заново запрашиваем в API. Повторные доставки отсеиваются по
+// payment_webhook_inbox. Ответ не 200 — YooKassa повторит доставку позже.
 func (h *Handler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	// В реальной реализации нужно проверять подпись вебхука
-	// Для заглушки просто принимаем запрос
+	if ip := clientip.FromRequest(r); !ipAllowed(h.webhookIPs, ip) {
+		log.Printf("Payment webhook rejected: address %s is not allowed", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Invalid webhook data", http.StatusBadRequest)
+		return
+	}
 	var webhookData struct {
+		Type   string `json:"type"`
 		Event  string `json:"event"`
 		Object struct {
-			ID       string                 `json:"id"`
-			Status   string                 `json:"status"`
-			Metadata map[string]interface{} `json:"metadata"`
+			ID string `json:"id"`
 		} `json:"object"`
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&webhookData); err != nil {
+	if err := json.Unmarshal(payload, &webhookData); err != nil {
 		http.Error(w, "Invalid webhook data", http.StatusBadRequest)
 		return
 	}
@@ -137,48 +495,123 @@ func (h *Handler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing payment ID", http.StatusBadRequest)
 		return
 	}
+	if webhookData.Event != "refund.succeeded" && !strings.HasPrefix(webhookData.Event, "payment.") {
+		// Уведомления о выплатах не обрабатываются
+		log.Printf("Payment webhook %s for %s ignored", webhookData.Event, paymentID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if h.PaymentProvider == nil {
+		http.Error(w, "Payments are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if webhookData.Event == "refund.succeeded" {
+		h.handleRefundWebhook(w, r, webhookData.Object.ID, webhookData.Event, payload)
+		return
+	}
 
 	// Получаем транзакцию по payment_id
 	transaction, err := h.Store.UserRepository.GetTransactionByPaymentID(paymentID)
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
 		log.Printf("Transaction not found for payment ID: %s", paymentID)
 		http.Error(w, "Transaction not found", http.StatusNotFound)
 		return
+	} else if err != nil {
+		log.Printf("Failed to get transaction for payment %s: %v", paymentID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Статус берем из API YooKassa, а не из тела уведомления
+	payment, err := h.PaymentProvider.GetPayment(r.Context(), paymentID)
+	if err != nil {
+		log.Printf("Failed to fetch YooKassa payment %s: %v", paymentID, err)
+		http.Error(w, "Failed to verify payment", http.StatusBadGateway)
+		return
+	}
+	if payment.Amount != payments.NewAmount(transaction.Amount, transaction.Currency) ||
+		(payment.Metadata["transactionId"] != "" && payment.Metadata["transactionId"] != transaction.ID) {
+		log.Printf("Payment %s does not match transaction %s: amount %s %s", paymentID, transaction.ID, payment.Amount.Value, payment.Amount.Currency)
+		http.Error(w, "Payment does not match transaction", http.StatusBadRequest)
+		return
 	}
 
-	// Обновляем статус транзакции
-	newStatus := webhookData.Object.Status
-	if err := h.Store.UserRepository.UpdateTransactionStatus(paymentID, newStatus); err != nil {
+	// Ключ — платеж и его фактический статус: повторная доставка того же
+	// события (или подделка с другим событием) не изменит результат
+	event := &model.PaymentEvent{
+		Key:      "payment:" + payment.ID + ":" + payment.Status,
+		Event:    webhookData.Event,
+		ObjectID: payment.ID,
+		Payload:  payload,
+	}
+	err = h.applyPaymentStatus(r.Context(), r, transaction, payment, event, "webhook")
+	switch {
+	case errors.Is(err, store.ErrDuplicatePaymentEvent):
+		// Уже обработано: подтверждаем доставку
+	case errors.Is(err, store.ErrIllegalTransition):
+		log.Printf("Payment %s: ignoring transition %s -> %s", paymentID, transaction.Status, payment.Status)
+	case err != nil:
 		log.Printf("Failed to update transaction status: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Если платеж успешен, обновляем тариф пользователя
-	if newStatus == string(model.TransactionSucceeded) {
-		// Устанавливаем срок подписки (30 дней от текущей даты)
-		expiresAt := time.Now().Add(30 * 24 * time.Hour)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
 
-		if err := h.Store.UserRepository.UpdateUserTier(transaction.UserID, string(transaction.Tier), expiresAt); err != nil {
-			log.Printf("Failed to update user tier: %v", err)
-			// Не прерываем выполнение, так как транзакция уже обновлена
-		}
+// handleRefundWebhook учитывает возврат refundID, проведенный YooKassa (в том
+// числе созданный в личном кабинете магазина)
+func (h *Handler) handleRefundWebhook(w http.ResponseWriter, r *http.Request, refundID, eventName string, payload []byte) {
+	refund, err := h.PaymentProvider.GetRefund(r.Context(), refundID)
+	if err != nil {
+		log.Printf("Failed to fetch YooKassa refund %s: %v", refundID, err)
+		http.Error(w, "Failed to verify refund", http.StatusBadGateway)
+		return
+	}
+	if refund.Status != payments.RefundSucceeded {
+		log.Printf("Refund %s is %s, webhook ignored", refund.ID, refund.Status)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-		log.Printf("User %s upgraded to tier %s", transaction.UserID, transaction.Tier)
+	event := &model.PaymentEvent{
+		Key:      "refund:" + refund.ID + ":" + refund.Status,
+		Event:    eventName,
+		ObjectID: refund.ID,
+		Payload:  payload,
+	}
+	_, err = h.applyRefund(r.Context(), nil, model.Refund{
+		ID:        refund.ID,
+		PaymentID: refund.PaymentID,
+		Amount:    refund.Amount.Float(),
+		Currency:  refund.Amount.Currency,
+		Kind:      model.RefundKindRefund,
+		Reason:    refund.Description,
+	}, event)
+	switch {
+	case errors.Is(err, store.ErrDuplicatePaymentEvent):
+		// Уже обработано: подтверждаем доставку
+	case errors.Is(err, sql.ErrNoRows):
+		log.Printf("Transaction not found for refunded payment ID: %s", refund.PaymentID)
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	case errors.Is(err, store.ErrIllegalTransition), errors.Is(err, store.ErrRefundExceedsPayment):
+		log.Printf("Refund %s of payment %s ignored: %v", refund.ID, refund.PaymentID, err)
+	case err != nil:
+		log.Printf("Failed to apply refund %s: %v", refund.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
-// HandleUpgradeTier обновляет тариф пользователя (для тестирования)
-func (h *Handler) HandleUpgradeTier(w http.ResponseWriter, r *http.Request) {
-	userID := getUserID(r)
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
+// HandleSetUserTier вручную назначает пользователю {id} тариф до expiresAt
+// (компенсации, поддержка). Пользователи меняют тариф только через оплату.
+func (h *Handler) HandleSetUserTier(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
 	var req struct {
 		Tier      string    `json:"tier"`
 		ExpiresAt time.Time `json:"expiresAt"`
@@ -192,11 +625,28 @@ func (h *Handler) HandleUpgradeTier(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid tier", http.StatusBadRequest)
 		return
 	}
+	// Платный тариф с прошедшим сроком сразу снял бы фоновый процесс
+	if req.Tier != string(model.TierFree) && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expiresAt must be in the future for a paid tier", http.StatusBadRequest)
+		return
+	}
 
-	if err := h.Store.UserRepository.UpdateUserTier(userID, req.Tier, req.ExpiresAt); err != nil {
+	err := h.Store.UserRepository.UpdateUserTier(userID, req.Tier, req.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to set tier of user %s: %v", userID, err)
 		http.Error(w, "Failed to update tier", http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Admin %s set tier %s for user %s", getUserID(r), req.Tier, userID)
+	h.audit(r, userID, model.AuditTierChanged, map[string]interface{}{
+		"tier":      req.Tier,
+		"expiresAt": req.ExpiresAt,
+		"source":    "admin",
+		"adminId":   getUserID(r),
+	})
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -205,19 +655,6 @@ func (h *Handler) HandleUpgradeTier(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// verifyWebhookSignature проверяет подпись вебхука от YooKassa
-func verifyWebhookSignature(secret, signature string, body []byte) bool {
-	// В реальной реализации нужно использовать секрет от YooKassa
-	// Для заглушки всегда возвращаем true
-	return true
-
-	// Пример реальной реализации:
-	// h := hmac.New(sha256.New, []byte(secret))
-	// h.Write(body)
-	// expectedSignature := hex.EncodeToString(h.Sum(nil))
-	// return hmac.Equal([]byte(signature), []byte(expectedSignature))
-}
-
 // updateTierBasedStorageLimits обновляет лимиты хранилища на основе тарифа
 func (h *Handler) updateTierBasedStorageLimits() {
 	// Эта функция может быть вызвана из фоновой горутины
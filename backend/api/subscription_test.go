@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"noteflow/config"
+	"noteflow/payments"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var transactionColumns = []string{"id", "user_id", "payment_id", "tier", "amount", "currency", "billing_period", "status",
+	"refunded_amount", "metadata", "created_at", "updated_at"}
+
+// newPaymentsHandler собирает Handler с эмулятором YooKassa; вебхуки
+// принимаются только с адреса httptest.NewRequest (192.0.2.1)
+func newPaymentsHandler(t *testing.T) (*Handler, sqlmock.Sqlmock, *payments.FakeServer) {
+	t.Helper()
+	h, mock := newMockHandler(t, func(cfg *config.Config) {
+		cfg.Payments.WebhookAllowedIPs = []string{"192.0.2.1"}
+	})
+	fake := payments.NewFakeServer("test-shop", "test-secret")
+	t.Cleanup(fake.Close)
+	provider, err := payments.NewYooKassa(fake.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.PaymentProvider = provider
+	return h, mock, fake
+}
+
+// createFakePayment создает в эмуляторе платеж транзакции transactionID на сумму amount
+func createFakePayment(t *testing.T, h *Handler, transactionID string, amount float64) *payments.Payment {
+	t.Helper()
+	payment, err := h.PaymentProvider.CreatePayment(context.Background(), payments.CreatePaymentRequest{
+		Amount:    payments.NewAmount(amount, "RUB"),
+		ReturnURL: "http://localhost/subscription",
+		Capture:   true,
+		Metadata:  map[string]string{"transactionId": transactionID, "kind": "purchase"},
+	}, transactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payment
+}
+
+func transactionRow(id, paymentID string, amount float64, status string) *sqlmock.Rows {
+	now := time.Now()
+	return sqlmock.NewRows(transactionColumns).
+		AddRow(id, "user-1", paymentID, "start", amount, "RUB", "monthly", status, 0.0, []byte(`{}`), now, now)
+}
+
+func postWebhook(h *Handler, remoteAddr, event, paymentID string) *httptest.ResponseRecorder {
+	body := `{"type":"notification","event":"` + event + `","object":{"id":"` + paymentID + `","status":"succeeded"}}`
+	req := httptest.NewRequest(http.MethodPost, "/subscription/webhook", strings.NewReader(body))
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	rec := httptest.NewRecorder()
+	h.HandleWebhook(rec, req)
+	return rec
+}
+
+func TestWebhook_RejectsAddressOutsideAllowlist(t *testing.T) {
+	h, mock, _ := newPaymentsHandler(t)
+
+	rec := postWebhook(h, "203.0.113.7:4000", "payment.succeeded", "pay-1")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhook_StatusTakenFromProvider(t *testing.T) {
+	h, mock, _ := newPaymentsHandler(t)
+	payment := createFakePayment(t, h, "tx-1", 99)
+
+	// Уведомление утверждает, что платеж оплачен, но в YooKassa он еще ждет
+	// оплаты: тариф не выдается, во входящие записывается фактический статус
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "pending"))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO payment_webhook_inbox").
+		WithArgs("payment:"+payment.ID+":pending", "payment.succeeded", payment.ID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FOR UPDATE").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "pending"))
+	mock.ExpectCommit()
+
+	rec := postWebhook(h, "", "payment.succeeded", payment.ID)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhook_RejectsAmountMismatch(t *testing.T) {
+	h, mock, fake := newPaymentsHandler(t)
+	payment := createFakePayment(t, h, "tx-1", 99)
+	if err := fake.Confirm(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Оплачено 99 RUB, а транзакция — на 299 RUB
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 299, "pending"))
+
+	rec := postWebhook(h, "", "payment.succeeded", payment.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhook_DuplicateDeliveryIsNoop(t *testing.T) {
+	h, mock, fake := newPaymentsHandler(t)
+	payment := createFakePayment(t, h, "tx-1", 99)
+	if err := fake.Confirm(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Событие уже во входящих: транзакция и тариф не меняются
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(payment.ID).
+		WillReturnRows(transactionRow("tx-1", payment.ID, 99, "succeeded"))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO payment_webhook_inbox").
+		WithArgs("payment:"+payment.ID+":succeeded", "payment.succeeded", payment.ID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	rec := postWebhook(h, "", "payment.succeeded", payment.ID)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// captureArg запоминает строковый аргумент запроса (ID, созданные обработчиком)
+type captureArg struct{ v *string }
+
+func (c captureArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.v = s
+	return ok
+}
+
+func TestPurchase_EndToEnd(t *testing.T) {
+	h, mock, _ := newPaymentsHandler(t)
+
+	// 1. Пользователь на бесплатном тарифе создает платеж за Start
+	var transactionID, paymentID string
+	mock.ExpectQuery("FROM users u").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"tier", "storage_limit", "subscription_expires_at", "free_since", "email", "storage_used"}).
+			AddRow("free", 0, nil, nil, "user@example.com", 0))
+	mock.ExpectExec("INSERT INTO transactions").
+		WithArgs(captureArg{&transactionID}, "user-1", captureArg{&paymentID}, "start", 99.0, "RUB", "monthly", "pending",
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx := context.WithValue(context.Background(), UserIDContextKey, "user-1")
+	rec := httptest.NewRecorder()
+	h.HandleCreatePayment(rec, httptest.NewRequest(http.MethodPost, "/subscription/create", strings.NewReader(`{"tier":"start"}`)).WithContext(ctx))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create payment: status %d: %s", rec.Code, rec.Body)
+	}
+	var created struct {
+		PaymentID       string `json:"paymentId"`
+		ConfirmationURL string `json:"confirmationUrl"`
+	}
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.PaymentID == "" || created.PaymentID != paymentID {
+		t.Fatalf("payment %q, stored %q", created.PaymentID, paymentID)
+	}
+
+	// 2. Пользователь оплачивает на странице эмулятора (редирект на фронтенд не нужен)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(created.ConfirmationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("confirm: status %d", resp.StatusCode)
+	}
+
+	// 3. Вебхук: транзакция оплачена, тариф выдан на месяц, выставлен счет
+	expiresAt := time.Now().AddDate(0, 1, 0).UTC()
+	mock.ExpectQuery("FROM transactions t").
+		WithArgs(paymentID).
+		WillReturnRows(transactionRow(transactionID, paymentID, 99, "pending"))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO payment_webhook_inbox").
+		WithArgs("payment:"+paymentID+":succeeded", "payment.succeeded", paymentID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FOR UPDATE").
+		WithArgs(paymentID).
+		WillReturnRows(transactionRow(transactionID, paymentID, 99, "pending"))
+	mock.ExpectExec("UPDATE transactions SET status").
+		WithArgs(transactionID, "succeeded").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE users").
+		WithArgs("user-1", "start", 1, "purchase").
+		WillReturnRows(sqlmock.NewRows([]string{"subscription_expires_at"}).AddRow(expiresAt))
+	mock.ExpectExec("INSERT INTO subscriptions").
+		WithArgs("user-1", "start", sqlmock.AnyArg(), "Bank card *4444", expiresAt, "monthly", "RUB").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO invoices").
+		WithArgs(transactionID, "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), "payment_succeeded", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(sqlmock.AnyArg(), "tier_changed", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if rec := postWebhook(h, "", "payment.succeeded", paymentID); rec.Code != http.StatusOK {
+		t.Fatalf("webhook: status %d: %s", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func postSetUserTier(h *Handler, userID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/"+userID+"/tier", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), UserIDContextKey, "admin-1"))
+	rec := httptest.NewRecorder()
+	h.HandleSetUserTier(rec, withURLParam(req, "id", userID))
+	return rec
+}
+
+func TestSetUserTier_RejectsPastExpiration(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for _, body := range []string{
+		`{"tier":"start","expiresAt":"` + past + `"}`,
+		`{"tier":"start"}`,
+	} {
+		if rec := postSetUserTier(h, "user-1", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetUserTier_UnknownUser(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	mock.ExpectExec("UPDATE users").
+		WithArgs("missing", "free", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Ничего не обновлено — аудит не пишется
+	if rec := postSetUserTier(h, "missing", `{"tier":"free"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,43 +1,81 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"noteflow/model"
 	"strconv"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
-// HandleSSE управляет Server-Sent Events соединением
-func (h *Handler) HandleSSE(w http.ResponseWriter, r *http.Request) {
-	// 1. Получаем токен из URL параметров
-	tokenString := r.URL.Query().Get("token")
-	if tokenString == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+// sseTicketAudience ограничивает применение тикета подключением к SSE
+const sseTicketAudience = "sse"
+
+// HandleSSETicket выдает одноразовый короткоживущий тикет для подключения к SSE.
+// EventSource не умеет передавать заголовки, поэтому в URL попадает тикет,
+// а не access token: после первого использования он бесполезен в логах прокси.
+func (h *Handler) HandleSSETicket(w http.ResponseWriter, r *http.Request) {
+	h.issueTicket(w, r, sseTicketAudience)
+}
+
+// issueTicket выдает тикет, привязанный к сессии и ограниченный аудиторией (sse, ws)
+func (h *Handler) issueTicket(w http.ResponseWriter, r *http.Request, audience string) {
+	userID := getUserID(r)
+	sessionID := getSessionID(r)
+	if userID == "" || sessionID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// 2. Валидируем токен вручную
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return h.JWTSecret, nil
+	ticket, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.Store.SessionRepository.CreateSSETicket(r.Context(), hashToken(ticket), userID, sessionID, audience, h.TicketTTL); err != nil {
+		log.Printf("Failed to create %s ticket: %v", audience, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":    ticket,
+		"expiresIn": int(h.TicketTTL.Seconds()),
 	})
+}
 
-	if err != nil || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+// HandleSSE управляет Server-Sent Events соединением
+func (h *Handler) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	// 1. Получаем тикет из URL параметров
+	ticket := r.URL.Query().Get("ticket")
+	if ticket == "" {
+		http.Error(w, "Missing ticket", http.StatusUnauthorized)
 		return
 	}
 
-	// ИСПРАВЛЕНИЕ: Теперь мы используем GetSubject(), и это будет работать,
-	// так как при генерации мы установили поле "sub".
-	userID, err := token.Claims.GetSubject()
-	if err != nil || userID == "" {
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+	// 2. Погашаем тикет (одноразовый) и проверяем, что сессия еще жива
+	userID, sessionID, err := h.Store.SessionRepository.ConsumeSSETicket(r.Context(), hashToken(ticket), sseTicketAudience)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired ticket", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	sessionExpiresAt, err := h.Store.SessionRepository.GetSessionExpiry(r.Context(), sessionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
@@ -45,23 +83,44 @@ func (h *Handler) HandleSSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("X-Accel-Buffering", "no")
-	flusher, ok := w.(http.Flusher)
-	if !ok {
+	if _, ok := w.(http.Flusher); !ok {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
 		return
 	}
 
-	// 4. Подписываемся на обновления
-	msgChan := h.Broker.Subscribe(userID)
-	defer h.Broker.Unsubscribe(userID, msgChan)
+	// 4. Подписываемся на обновления (при превышении лимитов — 429/503, а не ожидание)
+	sub, err := h.Broker.Subscribe(userID)
+	if err != nil {
+		writeBrokerError(w, err)
+		return
+	}
+	defer h.Broker.Unsubscribe(sub)
+
+	// Запись в зависший сокет не должна держать горутину бесконечно
+	rc := http.NewResponseController(w)
+	send := func(msg string) bool {
+		rc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := fmt.Fprint(w, msg); err != nil {
+			return false
+		}
+		if err := rc.Flush(); err != nil {
+			return false
+		}
+		sub.Touch()
+		return true
+	}
 
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	fmt.Fprintf(w, ": connected\n\n")
-	flusher.Flush()
+	// Поток закрывается вместе с сессией
+	sessionTimer := time.NewTimer(time.Until(sessionExpiresAt))
+	defer sessionTimer.Stop()
+
+	if !send(": connected\n\n") {
+		return
+	}
 
 	// 5. Главный цикл ожидания событий
 	for {
@@ -69,17 +128,55 @@ func (h *Handler) HandleSSE(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			return
 
-		case <-msgChan:
-			fmt.Fprintf(w, "data: sync_needed\n\n")
-			flusher.Flush()
+		case <-sub.Done():
+			// Брокер вытеснил подписку или останавливается
+			if sub.Reason() == CloseShutdown {
+				retry := ReconnectDelay().Milliseconds()
+				send(fmt.Sprintf("retry: %d\nevent: reconnect\ndata: {\"retryAfter\":%d}\n\n", retry, retry))
+			}
+			return
+
+		case <-sub.Notifications():
+			if !send("data: sync_needed\n\n") {
+				return
+			}
 
 		case <-ticker.C:
-			fmt.Fprintf(w, ": keep-alive\n\n")
-			flusher.Flush()
+			// Заодно проверяем, что сессию не отозвали (logout, удаление токенов)
+			if !h.refreshSessionTimer(r.Context(), sessionID, sessionTimer) {
+				send("event: session_expired\ndata: {}\n\n")
+				return
+			}
+			if !send(": keep-alive\n\n") {
+				return
+			}
+
+		case <-sessionTimer.C:
+			// Ротация refresh-токена продлевает сессию, поэтому перепроверяем
+			if !h.refreshSessionTimer(r.Context(), sessionID, sessionTimer) {
+				send("event: session_expired\ndata: {}\n\n")
+				return
+			}
 		}
 	}
 }
 
+// refreshSessionTimer перечитывает срок сессии и переставляет таймер.
+// Возвращает false, если сессия истекла или была отозвана.
+func (h *Handler) refreshSessionTimer(ctx context.Context, sessionID string, timer *time.Timer) bool {
+	expiresAt, err := h.Store.SessionRepository.GetSessionExpiry(ctx, sessionID)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		// Временная ошибка БД не должна обрывать поток
+		log.Printf("SSE session check failed: %v", err)
+		return true
+	}
+	timer.Stop()
+	timer.Reset(time.Until(expiresAt))
+	return true
+}
+
 // HandlePush принимает зашифрованные изменения от клиента
 func (h *Handler) HandlePush(w http.ResponseWriter, r *http.Request) {
 	// ИСПРАВЛЕНИЕ: Используем хелпер getUserID (который использует безопасный ключ)
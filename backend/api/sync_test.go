@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// consumeTicketQuery — погашение тикета: только своей аудитории и не истекшего
+var consumeTicketQuery = regexp.QuoteMeta("DELETE FROM sse_tickets WHERE ticket_hash = $1 AND audience = $2 AND expires_at > NOW()")
+
+// issueTestTicket выдает тикет аудитории audience для сессии session-1
+func issueTestTicket(t *testing.T, h *Handler, mock sqlmock.Sqlmock, audience string) string {
+	t.Helper()
+	mock.ExpectExec("INSERT INTO sse_tickets").
+		WithArgs(sqlmock.AnyArg(), "user-1", "session-1", audience, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx := context.WithValue(context.Background(), UserIDContextKey, "user-1")
+	ctx = context.WithValue(ctx, SessionIDContextKey, "session-1")
+	rec := httptest.NewRecorder()
+	h.issueTicket(rec, httptest.NewRequest(http.MethodPost, "/sync/ticket", nil).WithContext(ctx), audience)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("issue ticket: status %d", rec.Code)
+	}
+	var resp struct {
+		Ticket string `json:"ticket"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Ticket == "" {
+		t.Fatal("empty ticket")
+	}
+	return resp.Ticket
+}
+
+func getSSE(t *testing.T, srv *httptest.Server, ticket string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "?ticket=" + ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, ""
+	}
+	line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+	return resp.StatusCode, line
+}
+
+func TestSSETicket_SingleUse(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleSSE))
+	defer srv.Close()
+
+	ticket := issueTestTicket(t, h, mock, sseTicketAudience)
+	mock.ExpectQuery(consumeTicketQuery).
+		WithArgs(hashToken(ticket), sseTicketAudience).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "session_id"}).AddRow("user-1", "session-1"))
+	mock.ExpectQuery("SELECT GREATEST").
+		WithArgs("session-1").
+		WillReturnRows(sqlmock.NewRows([]string{"greatest"}).AddRow(time.Now().Add(time.Hour)))
+	// Тикет удален при первом использовании
+	mock.ExpectQuery(consumeTicketQuery).
+		WithArgs(hashToken(ticket), sseTicketAudience).
+		WillReturnError(sql.ErrNoRows)
+
+	if code, line := getSSE(t, srv, ticket); code != http.StatusOK || !strings.HasPrefix(line, ": connected") {
+		t.Fatalf("first use: status %d, %q", code, line)
+	}
+	if code, _ := getSSE(t, srv, ticket); code != http.StatusUnauthorized {
+		t.Errorf("second use: status %d, want 401", code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSSETicket_WrongAudienceRejected(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	// Тикет для WebSocket не открывает SSE, и наоборот: каждый канал гасит
+	// тикет только своей аудитории
+	wsTicket := issueTestTicket(t, h, mock, wsTicketAudience)
+	mock.ExpectQuery(consumeTicketQuery).
+		WithArgs(hashToken(wsTicket), sseTicketAudience).
+		WillReturnError(sql.ErrNoRows)
+	rec := httptest.NewRecorder()
+	h.HandleSSE(rec, httptest.NewRequest(http.MethodGet, "/sync/events?ticket="+wsTicket, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("ws ticket on SSE: status %d, want 401", rec.Code)
+	}
+
+	sseTicket := issueTestTicket(t, h, mock, sseTicketAudience)
+	mock.ExpectQuery(consumeTicketQuery).
+		WithArgs(hashToken(sseTicket), wsTicketAudience).
+		WillReturnError(sql.ErrNoRows)
+	rec = httptest.NewRecorder()
+	h.HandleWS(rec, httptest.NewRequest(http.MethodGet, "/sync/ws?ticket="+sseTicket, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("sse ticket on WS: status %d, want 401", rec.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSSETicket_ExpiredRejected(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	h.TicketTTL = time.Millisecond
+
+	ticket := issueTestTicket(t, h, mock, sseTicketAudience)
+	// Истекший тикет не проходит условие expires_at > NOW()
+	mock.ExpectQuery(consumeTicketQuery).
+		WithArgs(hashToken(ticket), sseTicketAudience).
+		WillReturnError(sql.ErrNoRows)
+
+	rec := httptest.NewRecorder()
+	h.HandleSSE(rec, httptest.NewRequest(http.MethodGet, "/sync/events?ticket="+ticket, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired ticket: status %d, want 401", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSSETicket_RevokedSessionRejected(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	ticket := issueTestTicket(t, h, mock, sseTicketAudience)
+	mock.ExpectQuery(consumeTicketQuery).
+		WithArgs(hashToken(ticket), sseTicketAudience).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "session_id"}).AddRow("user-1", "session-1"))
+	// Refresh-токены сессии удалены (logout): срока у сессии больше нет
+	mock.ExpectQuery("SELECT GREATEST").
+		WithArgs("session-1").
+		WillReturnRows(sqlmock.NewRows([]string{"greatest"}).AddRow(nil))
+
+	rec := httptest.NewRecorder()
+	h.HandleSSE(rec, httptest.NewRequest(http.MethodGet, "/sync/events?ticket="+ticket, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked session: status %d, want 401", rec.Code)
+	}
+	if h.Broker.Connections() != 0 {
+		t.Error("revoked session must not subscribe")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangePassword_EvictsSyncStreams(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	sub, err := h.Broker.Subscribe("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Пароль задается впервые (вход через OIDC): текущий не нужен
+	mock.ExpectQuery("SELECT password_hash FROM users").
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(""))
+	mock.ExpectExec("UPDATE users SET password_hash").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM refresh_tokens").
+		WithArgs("user-1", "session-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO audit_events").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx := context.WithValue(context.Background(), UserIDContextKey, "user-1")
+	ctx = context.WithValue(ctx, SessionIDContextKey, "session-1")
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"newPassword":"correct-Horse-battery-9"}`)
+	h.HandleChangePassword(rec, httptest.NewRequest(http.MethodPost, "/auth/password", body).WithContext(ctx))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Потоки отозванных сессий закрыты; текущее устройство переподключится с новым тикетом
+	select {
+	case <-sub.Done():
+		if sub.Reason() != CloseEvicted {
+			t.Errorf("reason = %v, want CloseEvicted", sub.Reason())
+		}
+	default:
+		t.Error("stream was not evicted")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
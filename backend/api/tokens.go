@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"noteflow/auth"
+	"noteflow/model"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// PersonalTokenPrefix отличает personal access token от JWT в заголовке Authorization
+	PersonalTokenPrefix = "nf_pat_"
+
+	maxTokensPerUser  = 50
+	maxTokenAllowedIP = 20
+	tokenDisplayChars = 12
+)
+
+var ErrTokenIPNotAllowed = errors.New("token is not allowed from this IP")
+
+// newPersonalToken генерирует токен вида nf_pat_<43 символа base64url>
+func newPersonalToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+	return PersonalTokenPrefix + base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// normalizeAllowedIPs приводит адреса и подсети к виду CIDR
+func normalizeAllowedIPs(entries []string) ([]string, error) {
+	out := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			out = append(out, prefix.Masked().String())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, errors.New("invalid IP or CIDR: " + entry)
+		}
+		out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()).String())
+	}
+	return out, nil
+}
+
+// ipAllowed проверяет адрес клиента по списку CIDR (пустой список — любой адрес)
+func ipAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, cidr := range allowed {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticateToken проверяет personal access token и IP клиента.
+// Возвращает sql.ErrNoRows для неизвестного, отозванного или истекшего токена.
+func (h *Handler) AuthenticateToken(ctx context.Context, token, clientIP string) (*model.PersonalAccessToken, error) {
+	pat, err := h.Store.TokenRepository.GetTokenByHash(ctx, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if !ipAllowed(pat.AllowedIPs, clientIP) {
+		return nil, ErrTokenIPNotAllowed
+	}
+	if err := h.Store.TokenRepository.TouchToken(ctx, pat.ID, clientIP); err != nil {
+		log.Printf("Failed to update last use of token %s: %v", pat.ID, err)
+	}
+	return pat, nil
+}
+
+// HandleCreateToken создает personal access token. Токен возвращается один раз.
+func (h *Handler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024) // 10 KB
+	var req model.CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > 100 {
+		http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+		return
+	}
+	scopes, ok := auth.NormalizeScopes(req.Scopes)
+	if !ok || len(scopes) == 0 {
+		http.Error(w, "Invalid scopes, allowed: "+strings.Join(auth.AllScopes, ", "), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+		return
+	}
+	if len(req.AllowedIPs) > maxTokenAllowedIP {
+		http.Error(w, "Too many allowed IPs", http.StatusBadRequest)
+		return
+	}
+	allowedIPs, err := normalizeAllowedIPs(req.AllowedIPs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count, err := h.Store.TokenRepository.CountTokens(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxTokensPerUser {
+		http.Error(w, "Too many tokens, revoke unused ones first", http.StatusConflict)
+		return
+	}
+
+	token, err := newPersonalToken()
+	if err != nil {
+		http.Error(w, "Generation failed", http.StatusInternalServerError)
+		return
+	}
+
+	pat := model.PersonalAccessToken{
+		UserID:     userID,
+		Name:       req.Name,
+		Prefix:     token[:tokenDisplayChars],
+		TokenHash:  hashToken(token),
+		Scopes:     scopes,
+		AllowedIPs: allowedIPs,
+		ExpiresAt:  req.ExpiresAt,
+	}
+	if err := h.Store.TokenRepository.CreateToken(r.Context(), &pat); err != nil {
+		log.Printf("Failed to create token for user %s: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, userID, model.AuditTokenCreated, map[string]interface{}{"tokenId": pat.ID, "name": pat.Name, "scopes": pat.Scopes})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(model.CreateTokenResponse{Token: token, PersonalAccessToken: pat})
+}
+
+// HandleListTokens возвращает токены пользователя (без самих значений)
+func (h *Handler) HandleListTokens(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+
+	tokens, err := h.Store.TokenRepository.ListTokens(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// HandleRevokeToken отзывает токен пользователя
+func (h *Handler) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(r)
+	tokenID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(tokenID); err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	found, err := h.Store.TokenRepository.DeleteToken(r.Context(), userID, tokenID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	h.audit(r, userID, model.AuditTokenRevoked, map[string]interface{}{"tokenId": tokenID})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAllowedIPs(t *testing.T) {
+	got, err := normalizeAllowedIPs([]string{"203.0.113.7", " 10.1.2.3/8 ", "2001:db8::1", "::ffff:192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"203.0.113.7/32", "10.0.0.0/8", "2001:db8::1/128", "192.0.2.1/32"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"example.com", "10.0.0.0/33", ""} {
+		if _, err := normalizeAllowedIPs([]string{bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	allowed := []string{"10.0.0.0/8", "203.0.113.7/32", "2001:db8::/32"}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.20.30.40", true},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8:1::5", true},
+		{"2001:db9::1", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := ipAllowed(allowed, tt.ip); got != tt.want {
+			t.Errorf("ipAllowed(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if !ipAllowed(nil, "198.51.100.1") {
+		t.Error("empty allowlist must allow any address")
+	}
+}
+
+func TestNewPersonalToken(t *testing.T) {
+	a, err := newPersonalToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newPersonalToken()
+	if !strings.HasPrefix(a, PersonalTokenPrefix) || len(a) != len(PersonalTokenPrefix)+43 {
+		t.Errorf("unexpected token format: %q", a)
+	}
+	if a == b {
+		t.Error("tokens must be unique")
+	}
+}
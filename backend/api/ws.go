@@ -0,0 +1,426 @@
+// api/ws.go
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"noteflow/model"
+	"noteflow/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket-канал синхронизации: push, pull и подтверждения в одном соединении.
+// SSE (/sync/events) и REST (/sync/push, /sync/pull) остаются запасными вариантами.
+//
+// Протокол — JSON text frames вида {"type": ..., ...}:
+//
+//	client -> server
+//	  push        {id, payload}        пакет изменений; ответ push_ack с результатом по каждому элементу
+//	  pull        {id, since, limit}   изменения после since (время или курсор); ответ changes
+//	  checkpoint  {cursor}             клиент применил изменения до cursor; ответ checkpoint_ack
+//	  ping        {}                   ответ pong
+//
+//	server -> client
+//	  changes     {id?, payload, cursor, hasMore?}  ответ на pull или доставка по инициативе сервера (без id);
+//	                                       hasMore — страница обрезана по limit, следующий pull продолжит с cursor
+//	  push_ack    {id, items}
+//	  checkpoint_ack {cursor}
+//	  sync_needed                          есть изменения, но курсор клиента неизвестен (нужен pull)
+//	  pong, error {id?, error}
+//	  session_expired                      сессия истекла, соединение будет закрыто
+//	  reconnect   {retryAfter}             сервер перезапускается, переподключиться через retryAfter мс
+
+const (
+	wsTicketAudience = "ws"
+
+	wsMaxMessageSize = 15 * 1024 * 1024
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = 30 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Аутентификация идет по одноразовому тикету, а не по cookie,
+	// поэтому проверка Origin не защищает от CSRF и только мешает Tauri/Capacitor
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsFrame — единый формат кадра протокола
+type wsFrame struct {
+	Type    string             `json:"type"`
+	ID      string             `json:"id,omitempty"`
+	Payload *model.SyncPayload `json:"payload,omitempty"`
+	Since   string             `json:"since,omitempty"`
+	Limit   int                `json:"limit,omitempty"`
+	Cursor  string             `json:"cursor,omitempty"`
+	HasMore bool               `json:"hasMore,omitempty"`
+	Items   []wsItemAck        `json:"items,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	// RetryAfter — подсказка клиенту, через сколько миллисекунд переподключаться
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// wsItemAck — результат сохранения одного элемента пакета
+type wsItemAck struct {
+	Kind  string `json:"kind"` // note, folder, file, tag
+	ID    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HandleWSTicket выдает одноразовый тикет для подключения к /sync/ws
+func (h *Handler) HandleWSTicket(w http.ResponseWriter, r *http.Request) {
+	h.issueTicket(w, r, wsTicketAudience)
+}
+
+// HandleWS обслуживает WebSocket-канал синхронизации
+func (h *Handler) HandleWS(w http.ResponseWriter, r *http.Request) {
+	ticket := r.URL.Query().Get("ticket")
+	if ticket == "" {
+		http.Error(w, "Missing ticket", http.StatusUnauthorized)
+		return
+	}
+
+	userID, sessionID, err := h.Store.SessionRepository.ConsumeSSETicket(r.Context(), hashToken(ticket), wsTicketAudience)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired ticket", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	sessionExpiresAt, err := h.Store.SessionRepository.GetSessionExpiry(r.Context(), sessionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Подписываемся до Upgrade, чтобы отказ по лимитам был обычным HTTP 429/503
+	sub, err := h.Broker.Subscribe(userID)
+	if err != nil {
+		writeBrokerError(w, err)
+		return
+	}
+	defer h.Broker.Unsubscribe(sub)
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade уже отправил ответ с ошибкой
+		return
+	}
+	defer conn.Close()
+
+	// http.Server.Shutdown не ждет захваченные соединения — учитываем их сами
+	h.streams.Add(1)
+	defer h.streams.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Чтение в отдельной горутине; все записи — только из цикла ниже (один writer)
+	incoming := make(chan wsFrame)
+	readErr := make(chan error, 1)
+	go func() {
+		conn.SetReadLimit(wsMaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			var frame wsFrame
+			if err := conn.ReadJSON(&frame); err != nil {
+				readErr <- err
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			select {
+			case incoming <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	sessionTimer := time.NewTimer(time.Until(sessionExpiresAt))
+	defer sessionTimer.Stop()
+
+	// cursor — позиция, до которой клиент получил изменения
+	cursor := ""
+
+	for {
+		var out *wsFrame
+
+		select {
+		case err := <-readErr:
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WS read error for user %s: %v", userID, err)
+			}
+			return
+
+		case frame := <-incoming:
+			out = h.handleWSFrame(ctx, userID, frame, &cursor)
+
+		case <-sub.Done():
+			// Брокер вытеснил подписку или останавливается
+			if sub.Reason() == CloseShutdown {
+				retry := int(ReconnectDelay().Milliseconds())
+				h.wsClose(conn, &wsFrame{Type: "reconnect", RetryAfter: retry}, websocket.CloseServiceRestart)
+			} else {
+				h.wsClose(conn, nil, websocket.CloseNormalClosure)
+			}
+			return
+
+		case <-sub.Notifications():
+			if cursor == "" {
+				// Клиент еще не сообщил свою позицию — пусть сделает pull сам
+				out = &wsFrame{Type: "sync_needed"}
+				break
+			}
+			out = h.wsChanges(ctx, userID, "", cursor, 0)
+			if out.Error == "" {
+				cursor = out.Cursor
+			}
+
+		case <-ping.C:
+			if !h.refreshSessionTimer(ctx, sessionID, sessionTimer) {
+				h.wsClose(conn, &wsFrame{Type: "session_expired"}, websocket.CloseNormalClosure)
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			sub.Touch()
+
+		case <-sessionTimer.C:
+			if !h.refreshSessionTimer(ctx, sessionID, sessionTimer) {
+				h.wsClose(conn, &wsFrame{Type: "session_expired"}, websocket.CloseNormalClosure)
+				return
+			}
+		}
+
+		if out != nil {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(out); err != nil {
+				return
+			}
+			sub.Touch()
+		}
+	}
+}
+
+// handleWSFrame обрабатывает кадр клиента и возвращает ответ
+func (h *Handler) handleWSFrame(ctx context.Context, userID string, frame wsFrame, cursor *string) *wsFrame {
+	switch frame.Type {
+	case "ping":
+		return &wsFrame{Type: "pong", ID: frame.ID}
+
+	case "pull":
+		since := frame.Since
+		if since == "" {
+			since = *cursor
+		}
+		limit := frame.Limit
+		if limit > 1000 {
+			limit = 1000
+		}
+		out := h.wsChanges(ctx, userID, frame.ID, since, limit)
+		if out.Error == "" {
+			*cursor = out.Cursor
+		}
+		return out
+
+	case "checkpoint":
+		if _, err := model.ParseSyncCursor(frame.Cursor); err != nil {
+			return &wsFrame{Type: "error", ID: frame.ID, Error: "Invalid cursor"}
+		}
+		*cursor = frame.Cursor
+		return &wsFrame{Type: "checkpoint_ack", ID: frame.ID, Cursor: frame.Cursor}
+
+	case "push":
+		if frame.Payload == nil {
+			return &wsFrame{Type: "error", ID: frame.ID, Error: "Missing payload"}
+		}
+		tier, _, _, err := h.Store.UserRepository.GetUserTier(userID)
+		if err != nil {
+			return &wsFrame{Type: "error", ID: frame.ID, Error: "Failed to get user tier"}
+		}
+		if !model.UserTier(tier).HasSyncAccess() {
+			return &wsFrame{Type: "error", ID: frame.ID, Error: "Sync not available for free tier"}
+		}
+
+		items := h.wsSavePush(ctx, userID, *frame.Payload)
+		for _, item := range items {
+			if item.OK {
+				go h.Broker.Notify(userID)
+				break
+			}
+		}
+		return &wsFrame{Type: "push_ack", ID: frame.ID, Items: items}
+
+	default:
+		return &wsFrame{Type: "error", ID: frame.ID, Error: "Unknown frame type: " + frame.Type}
+	}
+}
+
+// wsSavePush сохраняет пакет одной транзакцией; если она не прошла,
+// сохраняет элементы по одному, чтобы сообщить клиенту, какие именно не приняты
+func (h *Handler) wsSavePush(ctx context.Context, userID string, payload model.SyncPayload) []wsItemAck {
+	type item struct {
+		ack     wsItemAck
+		payload model.SyncPayload
+	}
+	var items []item
+	for _, n := range payload.Notes {
+		items = append(items, item{wsItemAck{Kind: "note", ID: n.ID}, model.SyncPayload{Notes: []model.NoteDTO{n}}})
+	}
+	for _, f := range payload.Folders {
+		items = append(items, item{wsItemAck{Kind: "folder", ID: f.ID}, model.SyncPayload{Folders: []model.FolderDTO{f}}})
+	}
+	for _, f := range payload.Files {
+		items = append(items, item{wsItemAck{Kind: "file", ID: f.ID}, model.SyncPayload{Files: []model.FileDTO{f}}})
+	}
+	for _, t := range payload.Tags {
+		items = append(items, item{wsItemAck{Kind: "tag", ID: t.ID}, model.SyncPayload{Tags: []model.TagDTO{t}}})
+	}
+
+	acks := make([]wsItemAck, 0, len(items))
+
+	if res, err := h.Store.DataRepository.SaveSyncBatch(ctx, userID, payload); err == nil {
+		// Порядок items совпадает с порядком результатов: заметки, папки, файлы, теги
+		outcomes := append(append(append(append([]error{}, res.Notes...), res.Folders...), res.Files...), res.Tags...)
+		for i, it := range items {
+			acks = append(acks, wsAck(it.ack, outcomes[i]))
+		}
+		return acks
+	}
+
+	for _, it := range items {
+		res, err := h.Store.DataRepository.SaveSyncBatch(ctx, userID, it.payload)
+		if err == nil {
+			err = firstSyncOutcome(res)
+		} else {
+			log.Printf("WS push item %s %s failed for user %s: %v", it.ack.Kind, it.ack.ID, userID, err)
+		}
+		acks = append(acks, wsAck(it.ack, err))
+	}
+	return acks
+}
+
+// wsAck заполняет подтверждение элемента по результату его сохранения
+func wsAck(ack wsItemAck, err error) wsItemAck {
+	switch {
+	case err == nil:
+		ack.OK = true
+	case errors.Is(err, store.ErrSyncMissingID):
+		ack.Error = "Missing ID"
+	case errors.Is(err, store.ErrSyncNotOwned):
+		ack.Error = "Forbidden"
+	default:
+		ack.Error = "DB/Sync Error"
+	}
+	return ack
+}
+
+// firstSyncOutcome — результат единственного элемента пакета
+func firstSyncOutcome(res *store.SyncSaveResult) error {
+	for _, outcomes := range [][]error{res.Notes, res.Folders, res.Files, res.Tags} {
+		if len(outcomes) > 0 {
+			return outcomes[0]
+		}
+	}
+	return nil
+}
+
+// wsChanges формирует кадр changes с изменениями после since и новым курсором
+func (h *Handler) wsChanges(ctx context.Context, userID, id, since string, limit int) *wsFrame {
+	after := model.SyncCursor{}
+	if since != "" {
+		c, err := model.ParseSyncCursor(since)
+		if err != nil {
+			return &wsFrame{Type: "error", ID: id, Error: "Invalid cursor"}
+		}
+		after = c
+	}
+
+	payload, err := h.Store.DataRepository.GetSyncPage(ctx, userID, after, limit)
+	if err != nil {
+		return &wsFrame{Type: "error", ID: id, Error: "DB Error"}
+	}
+
+	next, hasMore := nextSyncCursor(payload, after, limit)
+	return &wsFrame{Type: "changes", ID: id, Payload: payload, Cursor: next.String(), HasMore: hasMore}
+}
+
+// nextSyncCursor возвращает курсор, до которого клиент получил все изменения.
+// Каждый тип выбирается отдельно со своим limit: если какой-то тип обрезан,
+// курсор встает на последнюю запись самого раннего из обрезанных типов (более
+// поздние записи других типов придут повторно), иначе — на последнюю запись.
+func nextSyncCursor(payload *model.SyncPayload, after model.SyncCursor, limit int) (model.SyncCursor, bool) {
+	var last []model.SyncCursor
+	var truncated []model.SyncCursor
+	add := func(n int, c func(i int) model.SyncCursor) {
+		if n == 0 {
+			return
+		}
+		last = append(last, c(n-1))
+		if limit > 0 && n >= limit {
+			truncated = append(truncated, c(n-1))
+		}
+	}
+	add(len(payload.Notes), func(i int) model.SyncCursor {
+		return model.SyncCursor{Time: payload.Notes[i].ServerUpdatedAt, ID: payload.Notes[i].ID}
+	})
+	add(len(payload.Folders), func(i int) model.SyncCursor {
+		return model.SyncCursor{Time: payload.Folders[i].ServerUpdatedAt, ID: payload.Folders[i].ID}
+	})
+	add(len(payload.Files), func(i int) model.SyncCursor {
+		return model.SyncCursor{Time: payload.Files[i].ServerUpdatedAt, ID: payload.Files[i].ID}
+	})
+	add(len(payload.Tags), func(i int) model.SyncCursor {
+		return model.SyncCursor{Time: payload.Tags[i].ServerUpdatedAt, ID: payload.Tags[i].ID}
+	})
+
+	if len(truncated) > 0 {
+		next := truncated[0]
+		for _, c := range truncated[1:] {
+			if c.Before(next) {
+				next = c
+			}
+		}
+		return next, true
+	}
+	next := after
+	for _, c := range last {
+		if next.Before(c) {
+			next = c
+		}
+	}
+	return next, false
+}
+
+// wsClose отправляет финальный кадр и корректно закрывает соединение
+func (h *Handler) wsClose(conn *websocket.Conn, frame *wsFrame, code int) {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if frame != nil {
+		payload, _ := json.Marshal(frame)
+		conn.WriteMessage(websocket.TextMessage, payload)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+}
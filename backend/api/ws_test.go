@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var (
+	wsNoteColumns   = []string{"id", "folder_id", "title", "content", "is_pinned", "is_archived", "is_deleted", "color", "cover_image", "tags", "attachments", "created_at", "updated_at", "server_updated_at"}
+	wsFolderColumns = []string{"id", "parent_id", "name", "color", "is_deleted", "updated_at", "server_updated_at"}
+	wsFileColumns   = []string{"id", "note_id", "name", "type", "size", "s3_key", "created_at", "updated_at", "server_updated_at"}
+	wsTagColumns    = []string{"id", "name", "color", "updated_at", "server_updated_at"}
+)
+
+func TestWSPull_TruncatedPageResumesFromEarliestCutoff(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+	t1 := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	t3 := t1.Add(time.Hour)
+	note := func(id string, at time.Time) []driver.Value {
+		return []driver.Value{id, nil, "", "", false, false, false, "", "", []byte(`[]`), []byte(`[]`), at, at, at}
+	}
+
+	// Первая страница: заметки обрезаны по limit, а папка новее последней заметки.
+	// Заметка n3 с тем же временем, что и n2, в страницу не попала.
+	mock.ExpectQuery(regexp.QuoteMeta("FROM notes WHERE user_id=$1 AND (server_updated_at, id) > ($2, $3) ORDER BY server_updated_at, id LIMIT $4")).
+		WithArgs("user-1", time.Time{}, nil, 2).
+		WillReturnRows(sqlmock.NewRows(wsNoteColumns).AddRow(note("n1", t1)...).AddRow(note("n2", t2)...))
+	mock.ExpectQuery("FROM folders").
+		WillReturnRows(sqlmock.NewRows(wsFolderColumns).AddRow("f1", nil, "Folder", "", false, t3, t3))
+	mock.ExpectQuery("FROM files").WillReturnRows(sqlmock.NewRows(wsFileColumns))
+	mock.ExpectQuery("FROM tags").WillReturnRows(sqlmock.NewRows(wsTagColumns))
+
+	cursor := ""
+	out := h.handleWSFrame(context.Background(), "user-1", wsFrame{Type: "pull", ID: "1", Limit: 2}, &cursor)
+	if out.Type != "changes" || !out.HasMore || len(out.Payload.Notes) != 2 || len(out.Payload.Folders) != 1 {
+		t.Fatalf("unexpected first page: %+v", out)
+	}
+	want := model.SyncCursor{Time: t2, ID: "n2"}.String()
+	if out.Cursor != want || cursor != want {
+		t.Fatalf("cursor = %q (connection %q), want %q", out.Cursor, cursor, want)
+	}
+
+	// Вторая страница продолжает с (t2, n2): n3 и папка приходят снова
+	mock.ExpectQuery(regexp.QuoteMeta("FROM notes WHERE user_id=$1 AND (server_updated_at, id) > ($2, $3)")).
+		WithArgs("user-1", t2, "n2", 2).
+		WillReturnRows(sqlmock.NewRows(wsNoteColumns).AddRow(note("n3", t2)...))
+	mock.ExpectQuery("FROM folders").
+		WillReturnRows(sqlmock.NewRows(wsFolderColumns).AddRow("f1", nil, "Folder", "", false, t3, t3))
+	mock.ExpectQuery("FROM files").WillReturnRows(sqlmock.NewRows(wsFileColumns))
+	mock.ExpectQuery("FROM tags").WillReturnRows(sqlmock.NewRows(wsTagColumns))
+
+	out = h.handleWSFrame(context.Background(), "user-1", wsFrame{Type: "pull", ID: "2", Limit: 2}, &cursor)
+	if out.Type != "changes" || out.HasMore || len(out.Payload.Notes) != 1 || out.Payload.Notes[0].ID != "n3" {
+		t.Fatalf("unexpected second page: %+v", out)
+	}
+	if want := (model.SyncCursor{Time: t3, ID: "f1"}).String(); out.Cursor != want {
+		t.Errorf("cursor = %q, want %q", out.Cursor, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWSPull_InvalidCursor(t *testing.T) {
+	h, _ := newMockHandler(t, nil)
+	cursor := ""
+	out := h.handleWSFrame(context.Background(), "user-1", wsFrame{Type: "pull", ID: "1", Since: "yesterday"}, &cursor)
+	if out.Type != "error" || cursor != "" {
+		t.Errorf("expected error for invalid cursor, got %+v", out)
+	}
+}
+
+func TestWSSavePush_AcksEachItemByOutcome(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO notes").
+		ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	// Тег с чужим ID: upsert не меняет строк
+	mock.ExpectPrepare("INSERT INTO tags").
+		ExpectExec().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	acks := h.wsSavePush(context.Background(), "user-1", model.SyncPayload{
+		Notes: []model.NoteDTO{{ID: ""}, {ID: "n1"}},
+		Tags:  []model.TagDTO{{ID: "t1"}},
+	})
+	want := []wsItemAck{
+		{Kind: "note", ID: "", Error: "Missing ID"},
+		{Kind: "note", ID: "n1", OK: true},
+		{Kind: "tag", ID: "t1", Error: "Forbidden"},
+	}
+	if len(acks) != len(want) {
+		t.Fatalf("got %d acks, want %d: %+v", len(acks), len(want), acks)
+	}
+	for i := range want {
+		if acks[i] != want[i] {
+			t.Errorf("ack %d = %+v, want %+v", i, acks[i], want[i])
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWSSavePush_FallsBackToSingleItems(t *testing.T) {
+	h, mock := newMockHandler(t, nil)
+
+	// Пакет целиком не прошел из-за второй заметки
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO notes")
+	mock.ExpectExec("INSERT INTO notes").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO notes").WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	// По одной: первая сохраняется, вторая снова падает
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO notes").
+		ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO notes").
+		ExpectExec().WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	acks := h.wsSavePush(context.Background(), "user-1", model.SyncPayload{
+		Notes: []model.NoteDTO{{ID: "n1"}, {ID: "n2"}},
+	})
+	if len(acks) != 2 || !acks[0].OK || acks[1].OK || acks[1].Error != "DB/Sync Error" {
+		t.Errorf("unexpected acks: %+v", acks)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
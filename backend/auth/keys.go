@@ -0,0 +1,452 @@
+// auth/keys.go
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"noteflow/model"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access-токены подписываются EdDSA (Ed25519). Ключи живут в БД и общие для всех
+// реплик; в заголовке токена указывается kid ключа.
+//
+// Жизненный цикл ключа:
+//   - создается и сразу публикуется в JWKS (за keyPrepublish до начала подписи,
+//     чтобы внешние сервисы успели обновить кэш);
+//   - подписывает токены с NotBefore до RetiresAt (RotationInterval);
+//   - остается в JWKS до ExpiresAt = RetiresAt + AccessTokenTTL, пока живут
+//     выданные им токены.
+
+const (
+	AlgEdDSA = "EdDSA"
+
+	// keyPrepublish — за сколько до начала подписи новый ключ появляется в JWKS
+	keyPrepublish = time.Hour
+	// rotateCheckInterval — как часто реплика проверяет, не пора ли выпустить ключ
+	rotateCheckInterval = 10 * time.Minute
+	// unknownKIDRefreshInterval ограничивает перечитывание ключей из БД
+	// при встрече незнакомого kid (ключ мог выпустить другой экземпляр)
+	unknownKIDRefreshInterval = 10 * time.Second
+	// clockSkew — допуск на расхождение часов между серверами
+	clockSkew = time.Minute
+
+	// JWKSMaxAge — время кэширования JWKS клиентами (меньше keyPrepublish)
+	JWKSMaxAge = 10 * time.Minute
+)
+
+var (
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrNoSigningKey = errors.New("auth: no active signing key")
+)
+
+// KeyRepository — хранилище ключей (store.SigningKeyRepository)
+type KeyRepository interface {
+	ListSigningKeys(ctx context.Context) ([]model.SigningKey, error)
+	CreateSigningKeyIfNeeded(ctx context.Context, key model.SigningKey, coveredUntil time.Time) (bool, error)
+	DeleteExpiredSigningKeys(ctx context.Context) (int64, error)
+}
+
+// Claims — claims access-токена. У токенов сессии приложения GLYF ClientID
+// пуст и доступны все области; токены OAuth-клиентов несут client_id и scope.
+type Claims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	// Scope — области через пробел (RFC 8693)
+	Scope string `json:"scope,omitempty"`
+}
+
+// Verifier проверяет access-токены. Один экземпляр используется всеми
+// обработчиками, которые принимают токен.
+type Verifier interface {
+	Verify(ctx context.Context, token string) (*Claims, error)
+}
+
+type KeyManagerConfig struct {
+	Issuer           string
+	AccessTokenTTL   time.Duration
+	RotationInterval time.Duration
+	// Secret шифрует приватные ключи в БД
+	Secret []byte
+}
+
+type signingKey struct {
+	kid       string
+	public    ed25519.PublicKey
+	private   ed25519.PrivateKey // nil, если ключ не удалось расшифровать
+	notBefore time.Time
+	retiresAt time.Time
+	expiresAt time.Time
+}
+
+// KeyManager выпускает, ротирует и кэширует ключи подписи
+type KeyManager struct {
+	repo  KeyRepository
+	cfg   KeyManagerConfig
+	aead  cipher.AEAD
+	kekID string
+
+	mu          sync.RWMutex
+	keys        map[string]*signingKey
+	lastRefresh time.Time
+
+	refreshMu sync.Mutex
+
+	now func() time.Time
+}
+
+func NewKeyManager(repo KeyRepository, cfg KeyManagerConfig) (*KeyManager, error) {
+	if len(cfg.Secret) == 0 {
+		return nil, errors.New("auth: key encryption secret is required")
+	}
+	kek, err := hkdf.Key(sha256.New, cfg.Secret, nil, "noteflow/signing-keys", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// Идентификатор секрета: ключи, зашифрованные другим секретом, этот
+	// экземпляр использует только для проверки токенов
+	kekID, err := hkdf.Key(sha256.New, cfg.Secret, nil, "noteflow/signing-keys/id", 8)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyManager{
+		repo:  repo,
+		cfg:   cfg,
+		aead:  aead,
+		kekID: hex.EncodeToString(kekID),
+		keys:  make(map[string]*signingKey),
+		now:   time.Now,
+	}, nil
+}
+
+// Rotate выпускает новый ключ, если текущие перестают подписывать раньше чем
+// через keyPrepublish, и перечитывает ключи из БД. Вызывается при старте
+// (создает первый ключ) и периодически из Run.
+func (m *KeyManager) Rotate(ctx context.Context) error {
+	if err := m.Refresh(ctx); err != nil {
+		return err
+	}
+
+	now := m.now()
+	coveredUntil := now.Add(keyPrepublish)
+
+	// Новый ключ начинает подписывать, когда последний действующий уходит в отставку
+	notBefore := now
+	m.mu.RLock()
+	for _, k := range m.keys {
+		if k.private != nil && k.retiresAt.After(notBefore) {
+			notBefore = k.retiresAt
+		}
+	}
+	m.mu.RUnlock()
+	if notBefore.After(coveredUntil) {
+		return nil
+	}
+
+	key, err := m.generateKey(notBefore)
+	if err != nil {
+		return err
+	}
+	created, err := m.repo.CreateSigningKeyIfNeeded(ctx, key, coveredUntil)
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Printf("JWT signing key %s created (signs from %s until %s)", key.KID, key.NotBefore.Format(time.RFC3339), key.RetiresAt.Format(time.RFC3339))
+	}
+	return m.Refresh(ctx)
+}
+
+func (m *KeyManager) generateKey(notBefore time.Time) (model.SigningKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return model.SigningKey{}, err
+	}
+
+	kidBytes := make([]byte, 16)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return model.SigningKey{}, err
+	}
+	kid := base64.RawURLEncoding.EncodeToString(kidBytes)
+
+	sealed, err := m.seal(kid, private.Seed())
+	if err != nil {
+		return model.SigningKey{}, err
+	}
+
+	retiresAt := notBefore.Add(m.cfg.RotationInterval)
+	return model.SigningKey{
+		KID:        kid,
+		Algorithm:  AlgEdDSA,
+		PublicKey:  public,
+		PrivateKey: sealed,
+		KEKID:      m.kekID,
+		NotBefore:  notBefore,
+		RetiresAt:  retiresAt,
+		ExpiresAt:  retiresAt.Add(m.cfg.AccessTokenTTL + clockSkew),
+	}, nil
+}
+
+// seal шифрует seed приватного ключа; kid служит associated data,
+// чтобы зашифрованный ключ нельзя было подставить в другую запись
+func (m *KeyManager) seal(kid string, seed []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, seed, []byte(kid)), nil
+}
+
+func (m *KeyManager) open(kid string, sealed []byte) (ed25519.PrivateKey, error) {
+	n := m.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("sealed key too short")
+	}
+	seed, err := m.aead.Open(nil, sealed[:n], sealed[n:], []byte(kid))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid key seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Refresh перечитывает ключи из БД
+func (m *KeyManager) Refresh(ctx context.Context) error {
+	rows, err := m.repo.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*signingKey, len(rows))
+	for _, row := range rows {
+		if row.Algorithm != AlgEdDSA || len(row.PublicKey) != ed25519.PublicKeySize {
+			log.Printf("Skipping JWT signing key %s: unsupported algorithm %q", row.KID, row.Algorithm)
+			continue
+		}
+		k := &signingKey{
+			kid:       row.KID,
+			public:    ed25519.PublicKey(row.PublicKey),
+			notBefore: row.NotBefore,
+			retiresAt: row.RetiresAt,
+			expiresAt: row.ExpiresAt,
+		}
+		// Ключ без приватной части (зашифрован прежним секретом) все равно
+		// годится для проверки токенов
+		if row.KEKID == m.kekID {
+			if private, err := m.open(row.KID, row.PrivateKey); err != nil {
+				log.Printf("Cannot decrypt JWT signing key %s: %v", row.KID, err)
+			} else {
+				k.private = private
+			}
+		}
+		keys[row.KID] = k
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.lastRefresh = m.now()
+	m.mu.Unlock()
+	return nil
+}
+
+// Run периодически ротирует ключи и удаляет истекшие, пока не отменен ctx
+func (m *KeyManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(rotateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		opCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := m.Rotate(opCtx); err != nil {
+			log.Printf("JWT signing key rotation failed: %v", err)
+		}
+		if n, err := m.repo.DeleteExpiredSigningKeys(opCtx); err != nil {
+			log.Printf("Failed to delete expired JWT signing keys: %v", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d expired JWT signing keys", n)
+		}
+		cancel()
+	}
+}
+
+// currentKey возвращает ключ, которым сейчас следует подписывать
+func (m *KeyManager) currentKey() *signingKey {
+	now := m.now()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var current *signingKey
+	for _, k := range m.keys {
+		if k.private == nil || now.Before(k.notBefore) || !now.Before(k.retiresAt) {
+			continue
+		}
+		if current == nil || k.notBefore.After(current.notBefore) {
+			current = k
+		}
+	}
+	return current
+}
+
+// Sign подписывает claims текущим ключом. Issuer, IssuedAt и ExpiresAt
+// (AccessTokenTTL) заполняются, если не заданы.
+func (m *KeyManager) Sign(ctx context.Context, claims Claims) (string, error) {
+	key := m.currentKey()
+	if key == nil {
+		// Например, фоновая ротация не успела: выпускаем ключ синхронно
+		if err := m.Rotate(ctx); err != nil {
+			return "", err
+		}
+		if key = m.currentKey(); key == nil {
+			return "", ErrNoSigningKey
+		}
+	}
+
+	now := m.now()
+	if claims.Issuer == "" {
+		claims.Issuer = m.cfg.Issuer
+	}
+	if claims.IssuedAt == nil {
+		claims.IssuedAt = jwt.NewNumericDate(now)
+	}
+	if claims.ExpiresAt == nil {
+		claims.ExpiresAt = jwt.NewNumericDate(now.Add(m.cfg.AccessTokenTTL))
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// lookup ищет ключ проверки по kid; незнакомый kid приводит к перечитыванию
+// ключей из БД не чаще unknownKIDRefreshInterval
+func (m *KeyManager) lookup(ctx context.Context, kid string) *signingKey {
+	m.mu.RLock()
+	key := m.keys[kid]
+	m.mu.RUnlock()
+	if key != nil {
+		return key
+	}
+
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+
+	m.mu.RLock()
+	key = m.keys[kid]
+	stale := m.now().Sub(m.lastRefresh) >= unknownKIDRefreshInterval
+	m.mu.RUnlock()
+	if key != nil || !stale {
+		return key
+	}
+
+	if err := m.Refresh(ctx); err != nil {
+		log.Printf("Failed to refresh JWT signing keys: %v", err)
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys[kid]
+}
+
+// Verify проверяет подпись, алгоритм, kid, issuer и срок действия токена
+func (m *KeyManager) Verify(ctx context.Context, tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("missing kid")
+		}
+		key := m.lookup(ctx, kid)
+		if key == nil || !m.now().Before(key.expiresAt) {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		return key.public, nil
+	},
+		jwt.WithValidMethods([]string{AlgEdDSA}),
+		jwt.WithIssuer(m.cfg.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(clockSkew),
+		jwt.WithTimeFunc(m.now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// JWK — открытый ключ в формате RFC 8037 (OKP / Ed25519)
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS возвращает все ключи, которыми сейчас можно проверить токен,
+// включая уже опубликованные, но еще не подписывающие
+func (m *KeyManager) JWKS() JWKSet {
+	now := m.now()
+	m.mu.RLock()
+	keys := make([]*signingKey, 0, len(m.keys))
+	for _, k := range m.keys {
+		if now.Before(k.expiresAt) {
+			keys = append(keys, k)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].notBefore.Before(keys[j].notBefore) })
+
+	set := JWKSet{Keys: make([]JWK, 0, len(keys))}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(k.public),
+			Kid: k.kid,
+			Use: "sig",
+			Alg: AlgEdDSA,
+		})
+	}
+	return set
+}
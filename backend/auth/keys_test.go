@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// memKeyRepo — общее для нескольких KeyManager хранилище ключей (как таблица signing_keys)
+type memKeyRepo struct {
+	mu   sync.Mutex
+	keys []model.SigningKey
+	now  func() time.Time
+}
+
+func (r *memKeyRepo) ListSigningKeys(ctx context.Context) ([]model.SigningKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []model.SigningKey
+	for _, k := range r.keys {
+		if k.ExpiresAt.After(r.now()) {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+func (r *memKeyRepo) CreateSigningKeyIfNeeded(ctx context.Context, key model.SigningKey, coveredUntil time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k.KEKID == key.KEKID && k.RetiresAt.After(coveredUntil) {
+			return false, nil
+		}
+	}
+	r.keys = append(r.keys, key)
+	return true, nil
+}
+
+func (r *memKeyRepo) DeleteExpiredSigningKeys(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kept []model.SigningKey
+	for _, k := range r.keys {
+		if k.ExpiresAt.After(r.now()) {
+			kept = append(kept, k)
+		}
+	}
+	n := int64(len(r.keys) - len(kept))
+	r.keys = kept
+	return n, nil
+}
+
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.t = t
+	c.mu.Unlock()
+}
+
+func newTestManager(t *testing.T, repo *memKeyRepo, clock *testClock, secret string) *KeyManager {
+	t.Helper()
+	m, err := NewKeyManager(repo, KeyManagerConfig{
+		Issuer:           "noteflow",
+		AccessTokenTTL:   15 * time.Minute,
+		RotationInterval: 24 * time.Hour,
+		Secret:           []byte(secret),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.now = clock.Now
+	return m
+}
+
+func setup(t *testing.T) (*KeyManager, *memKeyRepo, *testClock) {
+	clock := &testClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	repo := &memKeyRepo{now: clock.Now}
+	m := newTestManager(t, repo, clock, "test-secret-at-least-32-bytes-long!!")
+	if err := m.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return m, repo, clock
+}
+
+func sign(t *testing.T, m *KeyManager) string {
+	t.Helper()
+	token, err := m.Sign(context.Background(), Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "user1"},
+		SessionID:        "session1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSignVerify(t *testing.T) {
+	m, _, _ := setup(t)
+
+	token := sign(t, m)
+	claims, err := m.Verify(context.Background(), token)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if claims.Subject != "user1" || claims.SessionID != "session1" || claims.Issuer != "noteflow" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	parsed, _, _ := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if parsed.Method.Alg() != AlgEdDSA {
+		t.Errorf("alg = %s, want EdDSA", parsed.Method.Alg())
+	}
+	if kid, _ := parsed.Header["kid"].(string); kid == "" {
+		t.Error("token has no kid header")
+	}
+}
+
+func TestVerify_Rejects(t *testing.T) {
+	m, _, clock := setup(t)
+	ctx := context.Background()
+	valid := sign(t, m)
+	kid := m.JWKS().Keys[0].Kid
+
+	// HS256-токен с тем же kid (в т.ч. с открытым ключом в качестве секрета)
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject: "user1", Issuer: "noteflow", ExpiresAt: jwt.NewNumericDate(clock.Now().Add(time.Minute)),
+	}})
+	hs.Header["kid"] = kid
+	hsToken, _ := hs.SignedString([]byte(m.keys[kid].public))
+
+	// Подписан чужим ключом с существующим kid
+	_, foreign, _ := ed25519.GenerateKey(nil)
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject: "user1", Issuer: "noteflow", ExpiresAt: jwt.NewNumericDate(clock.Now().Add(time.Minute)),
+	}})
+	forged.Header["kid"] = kid
+	forgedToken, _ := forged.SignedString(foreign)
+
+	wrongIssuer, _ := m.Sign(ctx, Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "user1", Issuer: "other"}})
+
+	tests := map[string]string{
+		"hs256":        hsToken,
+		"forged":       forgedToken,
+		"wrong issuer": wrongIssuer,
+		"garbage":      "not.a.token",
+	}
+	for name, token := range tests {
+		if _, err := m.Verify(ctx, token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+		}
+	}
+
+	// Истекший токен
+	clock.Set(clock.Now().Add(20 * time.Minute))
+	if _, err := m.Verify(ctx, valid); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	m, repo, clock := setup(t)
+	ctx := context.Background()
+	start := clock.Now()
+
+	oldToken := sign(t, m)
+	oldKID := m.JWKS().Keys[0].Kid
+
+	// Пока до отставки ключа далеко, новый не выпускается
+	if err := m.Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.JWKS().Keys); n != 1 {
+		t.Fatalf("expected 1 key, got %d", n)
+	}
+
+	// За 30 минут до отставки выпускается следующий ключ и сразу публикуется в JWKS
+	clock.Set(start.Add(24*time.Hour - 30*time.Minute))
+	if err := m.Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	jwks := m.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected 2 published keys, got %d", len(jwks.Keys))
+	}
+	newKID := jwks.Keys[1].Kid
+
+	// ...но подписывает старый, пока не наступит его время
+	token := sign(t, m)
+	parsed, _, _ := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if parsed.Header["kid"] != oldKID {
+		t.Error("new key signs before its not_before")
+	}
+
+	// После отставки подписывает новый, токены старого ключа еще проверяются
+	clock.Set(start.Add(24*time.Hour + time.Minute))
+	token = sign(t, m)
+	parsed, _, _ = jwt.NewParser().ParseUnverified(token, &Claims{})
+	if parsed.Header["kid"] != newKID {
+		t.Errorf("expected token signed with %s, got %v", newKID, parsed.Header["kid"])
+	}
+	lastOld := func() string {
+		// Токен, выпущенный старым ключом прямо перед отставкой
+		clock.Set(start.Add(24*time.Hour - time.Minute))
+		defer clock.Set(start.Add(24*time.Hour + time.Minute))
+		return sign(t, m)
+	}()
+	if _, err := m.Verify(ctx, lastOld); err != nil {
+		t.Errorf("token of retired key rejected: %v", err)
+	}
+
+	// Когда все токены старого ключа истекли, он пропадает из JWKS
+	clock.Set(start.Add(24*time.Hour + 20*time.Minute))
+	if err := m.Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := repo.DeleteExpiredSigningKeys(ctx); n != 1 {
+		t.Errorf("expected 1 expired key deleted, got %d", n)
+	}
+	for _, k := range m.JWKS().Keys {
+		if k.Kid == oldKID {
+			t.Error("expired key still published")
+		}
+	}
+	if _, err := m.Verify(ctx, oldToken); err == nil {
+		t.Error("token of expired key accepted")
+	}
+}
+
+func TestVerify_KeyFromOtherInstance(t *testing.T) {
+	a, repo, clock := setup(t)
+	b := newTestManager(t, repo, clock, "test-secret-at-least-32-bytes-long!!")
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Экземпляр A выпускает следующий ключ; B его еще не видел
+	clock.Set(clock.Now().Add(24*time.Hour + time.Minute))
+	token := sign(t, a)
+
+	if _, err := b.Verify(context.Background(), token); err != nil {
+		t.Errorf("instance B failed to verify token with new kid: %v", err)
+	}
+}
+
+func TestPrivateKeysEncryptedAtRest(t *testing.T) {
+	m, repo, clock := setup(t)
+	key := repo.keys[0]
+
+	if len(key.PrivateKey) == ed25519.SeedSize || len(key.PrivateKey) == ed25519.PrivateKeySize {
+		t.Error("private key looks unencrypted")
+	}
+	if private, err := m.open(key.KID, key.PrivateKey); err != nil || !private.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(key.PublicKey)) {
+		t.Errorf("failed to decrypt own key: %v", err)
+	}
+
+	// С другим секретом ключ не расшифровать, но проверять токены можно
+	other := newTestManager(t, repo, clock, "another-secret-at-least-32-bytes!!!")
+	if err := other.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if other.currentKey() != nil {
+		t.Error("key decrypted with a wrong secret")
+	}
+	if _, err := other.Verify(context.Background(), sign(t, m)); err != nil {
+		t.Errorf("verification with public key failed: %v", err)
+	}
+
+	// После смены секрета сразу выпускается ключ, который можно расшифровать
+	if _, err := other.Sign(context.Background(), Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "user1"}}); err != nil {
+		t.Errorf("sign after secret change failed: %v", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	m, repo, _ := setup(t)
+
+	jwks := m.JWKS()
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(jwks.Keys))
+	}
+	k := jwks.Keys[0]
+	if k.Kty != "OKP" || k.Crv != "Ed25519" || k.Alg != AlgEdDSA || k.Use != "sig" || k.Kid != repo.keys[0].KID {
+		t.Errorf("unexpected JWK: %+v", k)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || !ed25519.PublicKey(x).Equal(ed25519.PublicKey(repo.keys[0].PublicKey)) {
+		t.Error("JWK x does not match the public key")
+	}
+}
@@ -0,0 +1,45 @@
+// auth/lockout.go
+package auth
+
+import "time"
+
+// LockoutPolicy — задержки после неудачных попыток входа в один аккаунт.
+//
+// Первые FreeAttempts ошибок не ограничиваются, дальше каждая следующая
+// попытка возможна через BaseDelay * 2^(n-FreeAttempts), но не дольше MaxDelay.
+// После Threshold ошибок аккаунт блокируется на LockoutDuration.
+// Счетчик сбрасывается успешным входом или через ResetAfter после последней ошибки.
+type LockoutPolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	Threshold       int
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration
+}
+
+// DefaultLockoutPolicy — 3 попытки без задержки, блокировка на 15 минут после 10 ошибок
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Minute,
+	Threshold:       10,
+	LockoutDuration: 15 * time.Minute,
+	ResetAfter:      24 * time.Hour,
+}
+
+// Delay возвращает, сколько ждать до следующей попытки после failures ошибок подряд,
+// и достигнута ли блокировка
+func (p LockoutPolicy) Delay(failures int) (time.Duration, bool) {
+	if p.Threshold > 0 && failures >= p.Threshold {
+		return p.LockoutDuration, true
+	}
+	if failures < p.FreeAttempts {
+		return 0, false
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay), false
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	p := DefaultLockoutPolicy
+
+	tests := []struct {
+		failures int
+		delay    time.Duration
+		locked   bool
+	}{
+		{0, 0, false},
+		{2, 0, false},
+		{3, time.Second, false},
+		{4, 2 * time.Second, false},
+		{6, 8 * time.Second, false},
+		{9, 64 * time.Second, false},
+		{10, 15 * time.Minute, true},
+		{50, 15 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		delay, locked := p.Delay(tt.failures)
+		if delay != tt.delay || locked != tt.locked {
+			t.Errorf("Delay(%d) = %v, %v; want %v, %v", tt.failures, delay, locked, tt.delay, tt.locked)
+		}
+	}
+
+	// Задержка не превышает MaxDelay, даже если блокировка отключена
+	p.Threshold = 0
+	if delay, locked := p.Delay(40); delay != p.MaxDelay || locked {
+		t.Errorf("Delay(40) without lockout = %v, %v; want %v", delay, locked, p.MaxDelay)
+	}
+}
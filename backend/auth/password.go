@@ -0,0 +1,154 @@
+// auth/password.go
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Хеширование паролей: Argon2id (RFC 9106) в формате PHC
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<соль>$<хеш>
+//
+// Алгоритм и параметры хранятся в самой строке, поэтому параметры можно
+// усиливать без миграции: устаревшие хеши (включая bcrypt) проверяются как есть
+// и перехешируются при следующем успешном входе.
+
+var (
+	// ErrUnknownHashFormat — строка хеша не распознана
+	ErrUnknownHashFormat = errors.New("auth: unknown password hash format")
+	// ErrNoPassword — у пользователя нет пароля (вход только через внешний провайдер)
+	ErrNoPassword = errors.New("auth: user has no password")
+)
+
+// Argon2Params — параметры Argon2id
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params — 64 MiB, 3 прохода, 2 потока (выше минимума OWASP)
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordHasher хеширует и проверяет пароли. Каждое вычисление Argon2id
+// занимает Memory KiB, поэтому число одновременных вычислений ограничено:
+// поток попыток входа не исчерпает память сервера.
+type PasswordHasher struct {
+	params Argon2Params
+	slots  chan struct{}
+}
+
+// NewPasswordHasher создает хешер с заданными параметрами
+func NewPasswordHasher(params Argon2Params) *PasswordHasher {
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2Params.SaltLength
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2Params.KeyLength
+	}
+	return &PasswordHasher{
+		params: params,
+		slots:  make(chan struct{}, runtime.NumCPU()),
+	}
+}
+
+func (h *PasswordHasher) argon2id(password string, salt []byte, p Argon2Params) []byte {
+	h.slots <- struct{}{}
+	defer func() { <-h.slots }()
+	return argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+}
+
+// Hash возвращает хеш пароля в формате PHC
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := h.argon2id(password, salt, h.params)
+
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Verify проверяет пароль. needsRehash = true, если пароль верный, но хеш
+// создан другим алгоритмом или с другими параметрами.
+func (h *PasswordHasher) Verify(password, encoded string) (ok, needsRehash bool, err error) {
+	switch {
+	case encoded == "":
+		return false, false, ErrNoPassword
+
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, false, err
+		}
+		computed := h.argon2id(password, salt, params)
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false, nil
+		}
+		return true, params != h.params, nil
+
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		// Хеши bcrypt, созданные до перехода на Argon2id
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) || errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+	return false, false, ErrUnknownHashFormat
+}
+
+// decodeArgon2id разбирает строку $argon2id$v=19$m=...,t=...,p=...$salt$hash
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("%w: unsupported argon2 version", ErrUnknownHashFormat)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %v", ErrUnknownHashFormat, err)
+	}
+	if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, fmt.Errorf("%w: invalid argon2 parameters", ErrUnknownHashFormat)
+	}
+
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("%w: %v", ErrUnknownHashFormat, err)
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("%w: invalid key", ErrUnknownHashFormat)
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Небольшие параметры, чтобы тесты шли быстро
+var testArgon2Params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func TestPasswordHashVerify(t *testing.T) {
+	h := NewPasswordHasher(testArgon2Params)
+
+	hash, err := h.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("unexpected hash format: %s", hash)
+	}
+	if other, _ := h.Hash("correct horse battery staple"); other == hash {
+		t.Error("hashes of the same password must use different salts")
+	}
+
+	ok, rehash, err := h.Verify("correct horse battery staple", hash)
+	if err != nil || !ok || rehash {
+		t.Errorf("Verify(correct) = %v, %v, %v", ok, rehash, err)
+	}
+	if ok, _, err := h.Verify("wrong password", hash); ok || err != nil {
+		t.Errorf("Verify(wrong) = %v, %v", ok, err)
+	}
+}
+
+func TestPasswordLongerThanBcryptLimit(t *testing.T) {
+	h := NewPasswordHasher(testArgon2Params)
+	long := strings.Repeat("a", 100)
+
+	hash, err := h.Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bcrypt учитывал только первые 72 байта
+	if ok, _, _ := h.Verify(strings.Repeat("a", 72), hash); ok {
+		t.Error("password prefix accepted")
+	}
+	if ok, _, _ := h.Verify(long, hash); !ok {
+		t.Error("long password rejected")
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	old := NewPasswordHasher(testArgon2Params)
+	hash, _ := old.Hash("secret-password")
+
+	stronger := testArgon2Params
+	stronger.Iterations = 2
+	h := NewPasswordHasher(stronger)
+
+	ok, rehash, err := h.Verify("secret-password", hash)
+	if err != nil || !ok || !rehash {
+		t.Errorf("outdated params: Verify = %v, %v, %v; want ok and rehash", ok, rehash, err)
+	}
+}
+
+func TestPasswordLegacyBcrypt(t *testing.T) {
+	h := NewPasswordHasher(testArgon2Params)
+	legacy, err := bcrypt.GenerateFromPassword([]byte("legacy-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, rehash, err := h.Verify("legacy-password", string(legacy))
+	if err != nil || !ok || !rehash {
+		t.Errorf("bcrypt: Verify = %v, %v, %v; want ok and rehash", ok, rehash, err)
+	}
+	if ok, _, err := h.Verify("wrong", string(legacy)); ok || err != nil {
+		t.Errorf("bcrypt wrong password: Verify = %v, %v", ok, err)
+	}
+}
+
+func TestPasswordInvalidHashes(t *testing.T) {
+	h := NewPasswordHasher(testArgon2Params)
+
+	if _, _, err := h.Verify("x", ""); !errors.Is(err, ErrNoPassword) {
+		t.Errorf("empty hash: expected ErrNoPassword, got %v", err)
+	}
+	for _, bad := range []string{
+		"plaintext",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+	} {
+		if _, _, err := h.Verify("x", bad); !errors.Is(err, ErrUnknownHashFormat) {
+			t.Errorf("%q: expected ErrUnknownHashFormat, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// auth/pkce.go
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// PKCE (RFC 7636). Поддерживается только метод S256: plain не защищает
+// от перехвата кода и не нужен современным клиентам.
+
+const PKCEMethodS256 = "S256"
+
+// validPKCEString проверяет длину и алфавит (unreserved characters, RFC 7636 §4.1)
+func validPKCEString(s string, minLen, maxLen int) bool {
+	if len(s) < minLen || len(s) > maxLen {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidCodeChallenge проверяет code_challenge метода S256 (base64url SHA-256, 43 символа)
+func ValidCodeChallenge(challenge string) bool {
+	return validPKCEString(challenge, 43, 43)
+}
+
+// ValidCodeVerifier проверяет code_verifier (43-128 символов)
+func ValidCodeVerifier(verifier string) bool {
+	return validPKCEString(verifier, 43, 128)
+}
+
+// PKCEChallenge вычисляет code_challenge метода S256 для code_verifier
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyPKCE сверяет code_verifier с сохраненным code_challenge (S256)
+func VerifyPKCE(verifier, challenge string) bool {
+	if !ValidCodeVerifier(verifier) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(PKCEChallenge(verifier)), []byte(challenge)) == 1
+}
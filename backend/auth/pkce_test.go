@@ -0,0 +1,25 @@
+package auth
+
+import "testing"
+
+func TestVerifyPKCE(t *testing.T) {
+	// Пример из RFC 7636, Appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !ValidCodeChallenge(challenge) {
+		t.Error("valid challenge rejected")
+	}
+	if !VerifyPKCE(verifier, challenge) {
+		t.Error("RFC 7636 test vector failed")
+	}
+	if VerifyPKCE(verifier+"x", challenge) {
+		t.Error("wrong verifier accepted")
+	}
+	if VerifyPKCE("short", challenge) {
+		t.Error("too short verifier accepted")
+	}
+	if ValidCodeChallenge("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw+cM") {
+		t.Error("challenge with invalid characters accepted")
+	}
+}
@@ -0,0 +1,55 @@
+// auth/scopes.go
+package auth
+
+import "slices"
+
+// Области доступа (scopes) для personal access tokens и сторонних клиентов.
+// Access-токен сессии (вход по паролю) имеет все области.
+const (
+	ScopeSyncRead    = "sync:read"
+	ScopeSyncWrite   = "sync:write"
+	ScopeFilesRead   = "files:read"
+	ScopeFilesWrite  = "files:write"
+	ScopeProfileRead = "profile:read"
+)
+
+// AllScopes — все известные области в каноническом порядке
+var AllScopes = []string{
+	ScopeSyncRead,
+	ScopeSyncWrite,
+	ScopeFilesRead,
+	ScopeFilesWrite,
+	ScopeProfileRead,
+}
+
+// ValidScope сообщает, известна ли область
+func ValidScope(scope string) bool {
+	return slices.Contains(AllScopes, scope)
+}
+
+// NormalizeScopes удаляет дубликаты и упорядочивает области.
+// Возвращает false, если встретилась неизвестная область.
+func NormalizeScopes(scopes []string) ([]string, bool) {
+	out := make([]string, 0, len(scopes))
+	for _, known := range AllScopes {
+		if slices.Contains(scopes, known) {
+			out = append(out, known)
+		}
+	}
+	for _, s := range scopes {
+		if !ValidScope(s) {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// HasScopes сообщает, входят ли все required в granted
+func HasScopes(granted []string, required ...string) bool {
+	for _, r := range required {
+		if !slices.Contains(granted, r) {
+			return false
+		}
+	}
+	return true
+}
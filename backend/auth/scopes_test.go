@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeScopes(t *testing.T) {
+	got, ok := NormalizeScopes([]string{ScopeProfileRead, ScopeSyncRead, ScopeSyncRead})
+	if !ok || strings.Join(got, " ") != "sync:read profile:read" {
+		t.Errorf("got %v, %v", got, ok)
+	}
+	if _, ok := NormalizeScopes([]string{ScopeSyncRead, "admin"}); ok {
+		t.Error("unknown scope accepted")
+	}
+}
+
+func TestHasScopes(t *testing.T) {
+	granted := []string{ScopeSyncRead, ScopeFilesRead}
+	if !HasScopes(granted, ScopeSyncRead) || !HasScopes(granted) {
+		t.Error("expected granted scopes to pass")
+	}
+	if HasScopes(granted, ScopeSyncRead, ScopeSyncWrite) {
+		t.Error("missing sync:write must fail")
+	}
+	if HasScopes(nil, ScopeSyncRead) {
+		t.Error("no scopes must fail")
+	}
+}
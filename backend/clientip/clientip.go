@@ -0,0 +1,152 @@
+// clientip/clientip.go
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Определение IP клиента за балансировщиками и прокси.
+// X-Forwarded-For и X-Real-IP может прислать кто угодно, поэтому им верим только
+// тогда, когда их добавил доверенный прокси: цепочка X-Forwarded-For проходится
+// справа налево, пока адреса принадлежат доверенным подсетям, и первым
+// недоверенным адресом оказывается клиент. Без доверенных подсетей заголовки
+// игнорируются и клиентом считается адрес TCP-соединения.
+
+type contextKey string
+
+const ipContextKey contextKey = "client_ip"
+
+// ParseTrusted разбирает список доверенных прокси: подсети в нотации CIDR
+// ("10.0.0.0/8") или отдельные адреса ("192.168.1.10")
+func ParseTrusted(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Resolver определяет IP клиента по адресу соединения и заголовкам доверенных прокси
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+func NewResolver(trusted []netip.Prefix) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+// Trusted сообщает, принадлежит ли адрес доверенному прокси
+func (res *Resolver) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range res.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve возвращает IP клиента запроса (без порта)
+func (res *Resolver) Resolve(r *http.Request) string {
+	peer, ok := parseHop(r.RemoteAddr)
+	if !ok {
+		return hostOnly(r.RemoteAddr)
+	}
+	if !res.Trusted(peer) {
+		return peer.String()
+	}
+
+	// Соединение от доверенного прокси: идем по X-Forwarded-For справа налево.
+	// Каждый прокси дописывает адрес своего собеседника в конец списка.
+	client := peer
+	if hops := forwardedFor(r.Header); len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseHop(hops[i])
+			if !ok {
+				// Испорченная запись: левее нее доверять нечему
+				return client.String()
+			}
+			client = hop
+			if !res.Trusted(hop) {
+				return hop.String()
+			}
+		}
+		// Все адреса цепочки доверенные: клиент — самый левый
+		return client.String()
+	}
+
+	if hop, ok := parseHop(r.Header.Get("X-Real-IP")); ok {
+		return hop.String()
+	}
+	return client.String()
+}
+
+// Middleware кладет IP клиента в контекст запроса (см. FromRequest)
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ipContextKey, res.Resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FromRequest возвращает IP клиента, определенный Middleware. Если Middleware не
+// подключен, возвращается адрес соединения.
+func FromRequest(r *http.Request) string {
+	if ip, ok := r.Context().Value(ipContextKey).(string); ok {
+		return ip
+	}
+	return hostOnly(r.RemoteAddr)
+}
+
+// forwardedFor собирает записи всех заголовков X-Forwarded-For по порядку
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop разбирает адрес с портом или без ("1.2.3.4", "1.2.3.4:80", "[::1]:80")
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,177 @@
+package clientip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTrusted(t *testing.T) {
+	prefixes, err := ParseTrusted([]string{"10.0.0.0/8", " 192.168.1.10 ", "::ffff:172.16.0.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.10/32", "172.16.0.1/32", "fd00::/8"}
+	for i, p := range prefixes {
+		if p.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, p, want[i])
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "proxy.local", ""} {
+		if _, err := ParseTrusted([]string{bad}); err == nil {
+			t.Errorf("ParseTrusted(%q): expected error", bad)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	trusted, _ := ParseTrusted([]string{"10.0.0.0/8", "fd00::/8"})
+	res := NewResolver(trusted)
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "", "203.0.113.5"},
+		{"untrusted peer forging headers", "203.0.113.5:4000", []string{"1.1.1.1"}, "2.2.2.2", "203.0.113.5"},
+		{"one trusted proxy", "10.0.0.2:4000", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"client prepends a forged hop", "10.0.0.2:4000", []string{"1.1.1.1, 198.51.100.7"}, "", "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.2:4000", []string{"198.51.100.7, 10.1.1.1", "10.2.2.2"}, "", "198.51.100.7"},
+		{"hop with port", "10.0.0.2:4000", []string{"198.51.100.7:5555"}, "", "198.51.100.7"},
+		{"garbage stops the walk", "10.0.0.2:4000", []string{"198.51.100.7, garbage, 10.1.1.1"}, "", "10.1.1.1"},
+		{"all hops trusted", "10.0.0.2:4000", []string{"10.3.3.3, 10.1.1.1"}, "", "10.3.3.3"},
+		{"x-real-ip from trusted proxy", "10.0.0.2:4000", nil, "198.51.100.9", "198.51.100.9"},
+		{"ipv6 proxy", "[fd00::1]:4000", []string{"2001:db8::5"}, "", "2001:db8::5"},
+		{"ipv4-mapped peer", "[::ffff:10.0.0.2]:4000", []string{"198.51.100.7"}, "", "198.51.100.7"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+			if got := res.Resolve(r); got != tc.want {
+				t.Errorf("Resolve = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStoresIP(t *testing.T) {
+	trusted, _ := ParseTrusted([]string{"10.0.0.0/8"})
+	var got string
+	h := NewResolver(trusted).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromRequest(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "198.51.100.7" {
+		t.Errorf("FromRequest = %s, want 198.51.100.7", got)
+	}
+
+	// Без Middleware — адрес соединения
+	if ip := FromRequest(r); ip != "10.0.0.2" {
+		t.Errorf("FromRequest without middleware = %s", ip)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, addr []byte) string {
+		hdr := append([]byte(nil), proxyV2Signature...)
+		hdr = append(hdr, 0x20|cmd, family<<4|0x1, 0, 0)
+		binary.BigEndian.PutUint16(hdr[14:], uint16(len(addr)))
+		return string(append(hdr, addr...))
+	}
+	ipv4Block := []byte{198, 51, 100, 7, 10, 0, 0, 1, 0x15, 0xb3, 0x01, 0xbb}
+
+	cases := []struct {
+		name    string
+		input   string
+		want    string // "" — адреса нет
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 198.51.100.7 10.0.0.1 5555 443\r\nGET /", "198.51.100.7:5555", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::5 fd00::1 5555 443\r\nGET /", "[2001:db8::5]:5555", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\nGET /", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::5 fd00::1 5555 443\r\n", "", true},
+		{"v1 without crlf", "PROXY TCP4 198.51.100.7 10.0.0.1 5555 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v2 proxy ipv4", v2(0x1, 0x1, ipv4Block) + "GET /", "198.51.100.7:5555", false},
+		{"v2 local", v2(0x0, 0x0, nil) + "GET /", "", false},
+		{"v2 short block", v2(0x1, 0x1, ipv4Block[:8]), "", true},
+		{"plain http", "GET / HTTP/1.1\r\n", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tc.input))
+			addr, err := readProxyHeader(br)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Errorf("addr = %q, want %q", got, tc.want)
+			}
+			// Данные после заголовка не теряются
+			if rest, _ := br.ReadString('/'); rest != "GET /" {
+				t.Errorf("rest = %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	trusted, _ := ParseTrusted([]string{"127.0.0.1"})
+	pl := NewProxyListener(ln, NewResolver(trusted))
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 198.51.100.7 10.0.0.1 5555 443\r\nping"))
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().String(); got != "198.51.100.7:5555" {
+		t.Errorf("RemoteAddr = %s", got)
+	}
+	buf := make([]byte, 4)
+	if _, err := c.Read(buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Read = %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,210 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol (v1 и v2, https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt):
+// TCP-балансировщик передает адрес клиента заголовком в начале соединения.
+// Заголовок принимается только от доверенных прокси и от них обязателен;
+// остальные соединения обслуживаются как есть.
+
+// proxyHeaderTimeout — сколько ждать заголовок от прокси
+const proxyHeaderTimeout = 10 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyV1MaxLen — максимальная длина строки v1 вместе с CRLF
+const proxyV1MaxLen = 107
+
+var errNoProxyHeader = errors.New("proxy protocol: missing header")
+
+// ProxyListener разбирает заголовок PROXY protocol у соединений от доверенных
+// прокси; RemoteAddr таких соединений — адрес клиента из заголовка
+type ProxyListener struct {
+	net.Listener
+	resolver *Resolver
+}
+
+func NewProxyListener(l net.Listener, resolver *Resolver) *ProxyListener {
+	return &ProxyListener{Listener: l, resolver: resolver}
+}
+
+// Accept не читает заголовок сам, чтобы медленный клиент не задерживал
+// прием остальных соединений: он разбирается при первом чтении или RemoteAddr
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, resolver: l.resolver}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	resolver *Resolver
+
+	once   sync.Once
+	reader *bufio.Reader // nil — заголовка нет, читаем соединение напрямую
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.remote = c.Conn.RemoteAddr()
+
+	peer, ok := addrOf(c.remote)
+	if !ok || !c.resolver.Trusted(peer) {
+		return
+	}
+
+	c.reader = bufio.NewReader(c.Conn)
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	src, err := readProxyHeader(c.reader)
+	c.Conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.err = fmt.Errorf("%w (from %s)", err, c.remote)
+		log.Printf("Rejected connection: %v", c.err)
+		return
+	}
+	if src != nil {
+		c.remote = src
+	}
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.reader != nil {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.init)
+	return c.remote
+}
+
+func addrOf(a net.Addr) (netip.Addr, bool) {
+	if tcp, ok := a.(*net.TCPAddr); ok {
+		return tcp.AddrPort().Addr().Unmap(), true
+	}
+	return parseHop(a.String())
+}
+
+// readProxyHeader читает заголовок v1 или v2. Возвращает адрес клиента или nil,
+// если заголовок адреса не несет (v1 UNKNOWN, v2 LOCAL — проверки балансировщика).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Самый короткий заголовок ("PROXY UNKNOWN\r\n") длиннее 12 байт
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, errNoProxyHeader
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(sig, proxyV1Prefix):
+		return readProxyV1(r)
+	default:
+		return nil, errNoProxyHeader
+	}
+}
+
+// readProxyV1: "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol v1: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("proxy protocol v1: header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol v1: header must end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol v1: malformed header %q", line)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("proxy protocol v1: invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: invalid source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2: сигнатура, версия/команда, семейство/протокол, длина, адреса
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol v2: unsupported version %d", hdr[12]>>4)
+	}
+	cmd, family := hdr[12]&0x0f, hdr[13]>>4
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+
+	switch cmd {
+	case 0x0: // LOCAL: соединение самого балансировщика
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxy protocol v2: unsupported command %d", cmd)
+	}
+
+	switch family {
+	case 0x1: // AF_INET: src(4) dst(4) sport(2) dport(2)
+		if len(payload) < 12 {
+			return nil, errors.New("proxy protocol v2: short IPv4 address block")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x2: // AF_INET6: src(16) dst(16) sport(2) dport(2)
+		if len(payload) < 36 {
+			return nil, errors.New("proxy protocol v2: short IPv6 address block")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34]))), nil
+	default:
+		// AF_UNSPEC и AF_UNIX: адреса клиента нет
+		return nil, nil
+	}
+}
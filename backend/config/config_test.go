@@ -0,0 +1,324 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envMap(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := values[key]
+		return v, ok
+	}
+}
+
+func secureConfig() *Config {
+	cfg := Default()
+	cfg.Database.URL = "postgres://noteflow:s3cr3t-pass@db:5432/noteflow"
+	cfg.S3.AccessKey = "AKIAEXAMPLE"
+	cfg.S3.SecretKey = "s3-secret-key"
+	cfg.S3.Secure = true
+	cfg.Auth.JWTSecret = strings.Repeat("k", 32)
+	cfg.OAuth.DeviceVerificationURI = "https://app.example.com/device"
+	cfg.Payments.ReturnURL = "https://app.example.com/subscription"
+	return cfg
+}
+
+func TestValidate_RejectsInsecureDefaultsOutsideDevMode(t *testing.T) {
+	cfg := Default()
+	_, err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected insecure defaults to be rejected")
+	}
+	for _, want := range []string{"jwt_secret", "MinIO defaults", "database.url"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestValidate_AllowsInsecureDefaultsInDevMode(t *testing.T) {
+	cfg := Default()
+	cfg.DevMode = true
+	warnings, err := cfg.Validate()
+	if err != nil {
+		t.Fatalf("unexpected error in dev mode: %v", err)
+	}
+	if len(warnings) == 0 {
+		t.Error("expected warnings about insecure defaults")
+	}
+}
+
+func TestValidate_SecureConfig(t *testing.T) {
+	if _, err := secureConfig().Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate_InvalidValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"short jwt secret", func(c *Config) { c.Auth.JWTSecret = "short" }, "shorter than 32 bytes"},
+		{"unknown broker", func(c *Config) { c.SSE.Broker = "redis" }, "sse.broker"},
+		{"access ttl longer than refresh", func(c *Config) { c.Auth.AccessTokenTTL = 48 * time.Hour; c.Auth.RefreshTokenTTL = time.Hour }, "access_token_ttl"},
+		{"bad port", func(c *Config) { c.Server.Port = 70000 }, "server.port"},
+		{"bad trusted proxy", func(c *Config) { c.Server.TrustedProxies = []string{"10.0.0.0/40"} }, "server.trusted_proxies"},
+		{"trust everyone", func(c *Config) { c.Server.TrustedProxies = []string{"0.0.0.0/0"} }, "from any address"},
+		{"proxy protocol without trusted proxies", func(c *Config) { c.Server.ProxyProtocol = true }, "server.proxy_protocol"},
+		{"bad origin", func(c *Config) { c.CORS.AllowedOrigins = []string{"localhost:5173"} }, "cors.allowed_origins"},
+		{"zero rate limit", func(c *Config) { c.RateLimit.Burst = 0 }, "rate_limit"},
+		{"unknown rate limit store", func(c *Config) { c.RateLimit.Store = "redis" }, "rate_limit.store"},
+		{"missing default budget", func(c *Config) { delete(c.RateLimit.Budgets["files"], "default") }, "rate_limit.budgets.files"},
+		{"short key rotation", func(c *Config) { c.Auth.KeyRotationInterval = time.Hour }, "key_rotation_interval"},
+		{"lockout disabled", func(c *Config) { c.Lockout.Threshold = 0; c.Lockout.BaseDelay = 0 }, "login_lockout is disabled"},
+		{"unknown payments provider", func(c *Config) { c.Payments.Provider = "stripe" }, "payments.provider"},
+		{"fake payments in production", func(c *Config) { c.Payments.Provider = "fake" }, "only allowed in dev mode"},
+		{"unsupported currency", func(c *Config) { c.Payments.Currencies = []string{"RUB", "GBP"} }, "payments.currencies"},
+		{"unknown vat code", func(c *Config) { c.Payments.Receipt = ReceiptConfig{Enabled: true, VATCode: 9} }, "payments.receipt.vat_code"},
+		{"no renewal attempts", func(c *Config) { c.Billing.MaxAttempts = 0 }, "billing"},
+		{"bad mail from", func(c *Config) { c.Mail.SMTPHost = "smtp.example.com"; c.Mail.From = "noreply" }, "mail.from"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := secureConfig()
+			tt.modify(cfg)
+			_, err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidate_DatabaseAuthentication(t *testing.T) {
+	// Окружение тестов не должно подставлять пароль
+	t.Setenv("PGPASSWORD", "")
+	t.Setenv("PGPASSFILE", filepath.Join(t.TempDir(), "missing"))
+
+	pgpass := filepath.Join(t.TempDir(), "pgpass")
+	if err := os.WriteFile(pgpass, []byte("db:5432:noteflow:noteflow:from-pgpass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		env    string // PGPASSWORD
+		secure bool
+	}{
+		{"url password", "postgres://noteflow:s3cr3t-pass@db:5432/noteflow", "", true},
+		{"url default password", "postgres://noteflow:password@db:5432/noteflow", "", false},
+		{"url without password", "postgres://noteflow@db:5432/noteflow", "", false},
+		{"query password", "postgres://noteflow@db:5432/noteflow?password=s3cr3t-pass", "", true},
+		{"keyword password", "host=db user=noteflow dbname=noteflow password='s3cr3t pass'", "", true},
+		{"keyword default password", "host=db user=noteflow password=password", "", false},
+		{"keyword without password", "host=db user=noteflow dbname=noteflow", "", false},
+		{"PGPASSWORD", "host=db user=noteflow dbname=noteflow", "s3cr3t-pass", true},
+		{".pgpass", "host=db port=5432 user=noteflow dbname=noteflow passfile=" + pgpass, "", true},
+		{"unix socket", "host=/var/run/postgresql user=noteflow dbname=noteflow", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PGPASSWORD", tt.env)
+			cfg := secureConfig()
+			cfg.Database.URL = tt.url
+			_, err := cfg.Validate()
+			if tt.secure && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.secure && (err == nil || !strings.Contains(err.Error(), "database.url")) {
+				t.Errorf("expected database.url to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyEnv_Overrides(t *testing.T) {
+	cfg := Default()
+	err := cfg.applyEnv(envMap(map[string]string{
+		"PORT":                 "9090",
+		"SSE_IDLE_TIMEOUT":     "90s",
+		"S3_SECURE":            "true",
+		"RATE_LIMIT_RPS":       "2.5",
+		"CORS_ALLOWED_ORIGINS": "https://app.example.com, tauri://localhost",
+	}))
+	if err != nil {
+		t.Fatalf("applyEnv failed: %v", err)
+	}
+	if cfg.Server.Port != 9090 {
+		t.Errorf("port = %d, want 9090", cfg.Server.Port)
+	}
+	if cfg.SSE.IdleTimeout != 90*time.Second {
+		t.Errorf("idle timeout = %v, want 90s", cfg.SSE.IdleTimeout)
+	}
+	if !cfg.S3.Secure {
+		t.Error("expected S3 secure to be enabled")
+	}
+	if cfg.RateLimit.RequestsPerSecond != 2.5 {
+		t.Errorf("rps = %v, want 2.5", cfg.RateLimit.RequestsPerSecond)
+	}
+	if len(cfg.CORS.AllowedOrigins) != 2 || cfg.CORS.AllowedOrigins[1] != "tauri://localhost" {
+		t.Errorf("unexpected origins: %v", cfg.CORS.AllowedOrigins)
+	}
+}
+
+func TestApplyEnv_InvalidValues(t *testing.T) {
+	cfg := Default()
+	err := cfg.applyEnv(envMap(map[string]string{"PORT": "abc", "SSE_IDLE_TIMEOUT": "soon"}))
+	if err == nil {
+		t.Fatal("expected parse errors")
+	}
+	if !strings.Contains(err.Error(), "PORT") || !strings.Contains(err.Error(), "SSE_IDLE_TIMEOUT") {
+		t.Errorf("expected both keys in error, got: %v", err)
+	}
+}
+
+func TestLoad_FileThenEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+dev_mode: true
+server:
+  port: 7000
+sse:
+  broker: postgres
+  idle_timeout: 2m
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PORT", "7001")
+
+	cfg, _, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Server.Port != 7001 {
+		t.Errorf("env should override file: port = %d", cfg.Server.Port)
+	}
+	if cfg.SSE.Broker != "postgres" || cfg.SSE.IdleTimeout != 2*time.Minute {
+		t.Errorf("file values not applied: %+v", cfg.SSE)
+	}
+	if cfg.SSE.MaxDevicesPerUser != 5 {
+		t.Errorf("defaults should be kept for missing keys, got %d", cfg.SSE.MaxDevicesPerUser)
+	}
+}
+
+func TestLoad_UnknownFieldRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("dev_mode: true\nserver:\n  prot: 80\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Load(path); err == nil {
+		t.Error("expected typo in config file to be rejected")
+	}
+}
+
+func TestDump_RedactsSecrets(t *testing.T) {
+	cfg := secureConfig()
+	cfg.Mail.Password = "smtp-password"
+	cfg.Payments.SecretKey = "live_yookassa-secret"
+	out := cfg.Dump()
+
+	for _, secret := range []string{"s3cr3t-pass", cfg.Auth.JWTSecret, "AKIAEXAMPLE", "s3-secret-key", "smtp-password", "live_yookassa-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("dump leaks secret %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "noteflow:xxxxx@db:5432") {
+		t.Errorf("expected DB URL with masked password, got:\n%s", out)
+	}
+	if !strings.Contains(out, "idle_timeout: 5m0s") {
+		t.Errorf("expected durations to be human readable, got:\n%s", out)
+	}
+}
+
+func TestDump_RedactsDatabasePasswords(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"postgres://noteflow@db:5432/noteflow?password=s3cr3t-pass&sslmode=require",
+			"postgres://noteflow@db:5432/noteflow?password=xxxxx&sslmode=require"},
+		{"postgres://noteflow:s3cr3t-pass@db/noteflow?sslpassword=s3cr3t-key",
+			"postgres://noteflow:xxxxx@db/noteflow?sslpassword=xxxxx"},
+		{"host=db user=noteflow password=s3cr3t-pass dbname=noteflow",
+			"host=db user=noteflow password=xxxxx dbname=noteflow"},
+		{"host=db password = 's3cr3t \\' pass' sslpassword=s3cr3t-key user=noteflow",
+			"host=db password = xxxxx sslpassword=xxxxx user=noteflow"},
+		{"host=db password='unterminated", "<redacted>"},
+	}
+	for _, tt := range tests {
+		cfg := secureConfig()
+		cfg.Database.URL = tt.url
+		out := cfg.Dump()
+		if strings.Contains(out, "s3cr3t") {
+			t.Errorf("dump leaks password of %q:\n%s", tt.url, out)
+		}
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("expected %q in dump of %q:\n%s", tt.want, tt.url, out)
+		}
+	}
+}
+
+func TestCORSOrigins_DevOnlyInDevMode(t *testing.T) {
+	c := Default().CORS
+	contains := func(origins []string, want string) bool {
+		for _, o := range origins {
+			if o == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	if contains(c.Origins(false), "http://localhost:5173") {
+		t.Error("dev origin allowed outside dev mode")
+	}
+	if !contains(c.Origins(false), "tauri://localhost") {
+		t.Error("tauri origin must be allowed by default")
+	}
+	if !contains(c.Origins(true), "http://localhost:5173") {
+		t.Error("dev origin not allowed in dev mode")
+	}
+}
+
+func TestOIDCProviders(t *testing.T) {
+	cfg := secureConfig()
+	cfg.OIDC.CallbackBaseURL = "https://api.example.com"
+	cfg.OIDC.FrontendRedirectURI = "https://app.example.com/auth/callback"
+	cfg.OIDC.Providers = []OIDCProvider{{ID: "corp-sso", Issuer: "https://sso.example.com", ClientID: "glyf"}}
+
+	if err := cfg.applyEnv(envMap(map[string]string{"OIDC_CORP_SSO_CLIENT_SECRET": "oidc-client-secret"})); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OIDC.Providers[0].ClientSecret != "oidc-client-secret" {
+		t.Errorf("client secret not taken from env: %+v", cfg.OIDC.Providers[0])
+	}
+	if _, err := cfg.Validate(); err != nil {
+		t.Errorf("valid OIDC config rejected: %v", err)
+	}
+	if out := cfg.Dump(); strings.Contains(out, "oidc-client-secret") {
+		t.Errorf("dump leaks OIDC client secret:\n%s", out)
+	}
+	if cfg.OIDC.Providers[0].ClientSecret != "oidc-client-secret" {
+		t.Error("Dump modified the original config")
+	}
+
+	cfg.OIDC.Providers = append(cfg.OIDC.Providers,
+		OIDCProvider{ID: "corp-sso", Issuer: "https://sso.example.com", ClientID: "glyf"},
+		OIDCProvider{ID: "Bad ID", Issuer: "https://sso.example.com", ClientID: "glyf"},
+		OIDCProvider{ID: "plain", Issuer: "http://sso.example.com"},
+	)
+	_, err := cfg.Validate()
+	for _, want := range []string{"duplicate id", "invalid id", "client_id is required", "issuer is not https"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q error, got %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// cors/cors.go
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy — политика CORS: какие Origin допускаются и с какими заголовками.
+//
+// Поддерживаемые шаблоны источников:
+//   - точный Origin: https://app.example.com, http://localhost:5173
+//   - поддомены: https://*.example.com (не совпадает с самим example.com)
+//   - схемы приложений: tauri://localhost, capacitor://localhost
+//
+// Запросам с неразрешенного Origin CORS-заголовки не выставляются вовсе,
+// поэтому браузер блокирует чтение ответа.
+type Policy struct {
+	exact     map[string]bool
+	wildcards []wildcard
+
+	AllowCredentials bool
+	MaxAge           time.Duration
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+}
+
+// wildcard — шаблон вида scheme://*.suffix[:port]
+type wildcard struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string
+}
+
+// Options — параметры политики помимо списка источников
+type Options struct {
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// NewPolicy строит политику из списка шаблонов источников
+func NewPolicy(origins []string, opts Options) (*Policy, error) {
+	p := &Policy{
+		exact:            make(map[string]bool),
+		AllowCredentials: opts.AllowCredentials,
+		MaxAge:           opts.MaxAge,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"},
+		ExposedHeaders:   []string{"Retry-After", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
+	}
+
+	var errs []error
+	for _, origin := range origins {
+		if err := p.add(origin); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ValidateOrigin проверяет шаблон источника (для валидации конфигурации)
+func ValidateOrigin(origin string) error {
+	_, err := NewPolicy([]string{origin}, Options{})
+	return err
+}
+
+func (p *Policy) add(pattern string) error {
+	u, err := url.Parse(strings.ToLower(strings.TrimSpace(pattern)))
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("invalid origin %q: expected scheme://host[:port]", pattern)
+	}
+
+	host := u.Hostname()
+	if strings.Contains(host, "*") {
+		if !strings.HasPrefix(host, "*.") || strings.Count(host, "*") != 1 || len(host) < 3 {
+			return fmt.Errorf("invalid origin %q: wildcard must be a leading \"*.\" label", pattern)
+		}
+		suffix := host[1:]
+		// *.com и подобные разрешили бы целый домен верхнего уровня
+		if !strings.Contains(suffix[1:], ".") && suffix != ".localhost" {
+			return fmt.Errorf("invalid origin %q: wildcard is too broad", pattern)
+		}
+		p.wildcards = append(p.wildcards, wildcard{scheme: u.Scheme, suffix: suffix, port: u.Port()})
+		return nil
+	}
+
+	p.exact[u.Scheme+"://"+u.Host] = true
+	return nil
+}
+
+// Allowed сообщает, разрешен ли Origin
+func (p *Policy) Allowed(origin string) bool {
+	if origin == "" || origin == "null" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	if len(p.wildcards) == 0 {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.Path != "" {
+		return false
+	}
+	host := u.Hostname()
+	for _, w := range p.wildcards {
+		if u.Scheme == w.scheme && u.Port() == w.port &&
+			strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler — middleware, применяющий политику ко всем маршрутам
+func (p *Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// Ответ зависит от Origin — кэши должны это учитывать
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin == "" {
+			// Не CORS-запрос (нативные клиенты, curl)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !p.Allowed(origin) {
+			if preflight {
+				// Без CORS-заголовков браузер не отправит основной запрос
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if p.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+			if p.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if len(p.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,239 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"noteflow/ratelimit"
+)
+
+func TestValidateOrigin(t *testing.T) {
+	valid := []string{
+		"https://app.example.com",
+		"http://localhost:5173",
+		"tauri://localhost",
+		"capacitor://localhost",
+		"https://*.example.com",
+		"http://*.localhost:8080",
+	}
+	for _, origin := range valid {
+		if err := ValidateOrigin(origin); err != nil {
+			t.Errorf("ValidateOrigin(%q) = %v, want nil", origin, err)
+		}
+	}
+
+	invalid := []string{
+		"localhost:5173",
+		"*",
+		"https://",
+		"https://app.example.com/path",
+		"https://*.com",
+		"https://app.*.example.com",
+		"https://*example.com",
+	}
+	for _, origin := range invalid {
+		if err := ValidateOrigin(origin); err == nil {
+			t.Errorf("ValidateOrigin(%q) = nil, want error", origin)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	p, err := NewPolicy([]string{
+		"https://app.example.com",
+		"https://*.notes.example.com",
+		"tauri://localhost",
+		"capacitor://localhost",
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://evil.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://eu.notes.example.com", true},
+		{"https://a.b.notes.example.com", true},
+		{"https://notes.example.com", false},
+		{"https://evilnotes.example.com", false},
+		{"http://eu.notes.example.com", false},
+		{"tauri://localhost", true},
+		{"capacitor://localhost", true},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := p.Allowed(tt.origin); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func serve(p *Policy, method, origin string, headers map[string]string) (*httptest.ResponseRecorder, bool) {
+	called := false
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(method, "/sync/pull", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, called
+}
+
+func hasVary(rec *httptest.ResponseRecorder, value string) bool {
+	for _, v := range rec.Header().Values("Vary") {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandler_AllowedOrigin(t *testing.T) {
+	p, _ := NewPolicy([]string{"https://app.example.com"}, Options{})
+
+	rec, called := serve(p, http.MethodGet, "https://app.example.com", nil)
+	if !called {
+		t.Fatal("handler was not called")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Allow-Origin = %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Allow-Credentials must not be set by default, got %q", got)
+	}
+	if !hasVary(rec, "Origin") {
+		t.Error("missing Vary: Origin")
+	}
+}
+
+func TestHandler_DisallowedOriginGetsNoCORSHeaders(t *testing.T) {
+	p, _ := NewPolicy([]string{"https://app.example.com"}, Options{AllowCredentials: true})
+
+	rec, called := serve(p, http.MethodGet, "https://evil.com", nil)
+	if !called {
+		t.Fatal("handler was not called")
+	}
+	for name := range rec.Header() {
+		if strings.HasPrefix(name, "Access-Control-") {
+			t.Errorf("unexpected CORS header %s for disallowed origin", name)
+		}
+	}
+	if !hasVary(rec, "Origin") {
+		t.Error("missing Vary: Origin")
+	}
+}
+
+func TestHandler_Preflight(t *testing.T) {
+	p, _ := NewPolicy([]string{"https://app.example.com"}, Options{AllowCredentials: true, MaxAge: 10 * time.Minute})
+	preflight := map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "authorization, content-type",
+	}
+
+	rec, called := serve(p, http.MethodOptions, "https://app.example.com", preflight)
+	if called {
+		t.Error("preflight must not reach the handler")
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Allow-Origin = %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Allow-Credentials = %q, want true", got)
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Max-Age = %q, want 600", got)
+	}
+	if !strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Error("Allow-Headers must include Authorization")
+	}
+	if !hasVary(rec, "Access-Control-Request-Headers") {
+		t.Error("missing Vary: Access-Control-Request-Headers")
+	}
+
+	// Preflight с чужого источника отклоняется без CORS-заголовков
+	rec, called = serve(p, http.MethodOptions, "https://evil.com", preflight)
+	if called || rec.Code != http.StatusForbidden {
+		t.Errorf("disallowed preflight: called=%v status=%d, want 403", called, rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Allow-Origin = %q for disallowed preflight", got)
+	}
+}
+
+func TestHandler_NoOriginPassesThrough(t *testing.T) {
+	p, _ := NewPolicy(nil, Options{})
+
+	// Нативные клиенты не шлют Origin; обычный OPTIONS без preflight-заголовков идет в обработчик
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		rec, called := serve(p, method, "", nil)
+		if !called {
+			t.Errorf("%s without Origin did not reach the handler", method)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Allow-Origin = %q without Origin", got)
+		}
+	}
+}
+
+func TestHandler_ExposesRateLimitHeaders(t *testing.T) {
+	p, _ := NewPolicy([]string{"https://app.example.com"}, Options{})
+	// Как в main: CORS снаружи, лимит запросов внутри
+	limiter := ratelimit.New(ratelimit.NewMemoryStore())
+	limit := ratelimit.Limit{Requests: 1, Period: time.Minute, Burst: 1}
+	h := p.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, _ := limiter.Allow(r.Context(), "ip:192.0.2.1", limit)
+		ratelimit.SetHeaders(w, res)
+		if !res.Allowed {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		}
+	}))
+
+	// Первый запрос проходит, второй упирается в лимит: браузер должен
+	// видеть заголовки лимита в обоих ответах
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/sync/pull", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("status %d, want %d", rec.Code, want)
+		}
+
+		exposed := strings.Split(rec.Header().Get("Access-Control-Expose-Headers"), ", ")
+		headers := []string{"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"}
+		if want == http.StatusTooManyRequests {
+			headers = append(headers, "Retry-After")
+		}
+		for _, name := range headers {
+			if rec.Header().Get(name) == "" {
+				t.Errorf("%d: missing %s", want, name)
+			}
+			if !slices.Contains(exposed, name) {
+				t.Errorf("%d: %s is not exposed: %v", want, name, exposed)
+			}
+		}
+	}
+}
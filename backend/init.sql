@@ -5,7 +5,7 @@ CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     email TEXT UNIQUE NOT NULL,
     password_hash TEXT NOT NULL,
-    tier TEXT NOT NULL DEFAULT 'free' CHECK (tier IN ('free', 'start', 'medium', 'ultra')),
+    tier TEXT NOT NULL DEFAULT 'free', -- тариф из каталога plans
     storage_limit BIGINT NOT NULL DEFAULT 0, -- Will be set based on tier
     subscription_expires_at TIMESTAMP WITH TIME ZONE,
     free_since TIMESTAMP WITH TIME ZONE,
@@ -22,7 +22,7 @@ CREATE TABLE IF NOT EXISTS transactions (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     payment_id TEXT UNIQUE NOT NULL, -- YooKassa payment ID
-    tier TEXT NOT NULL CHECK (tier IN ('start', 'medium', 'ultra')),
+    tier TEXT NOT NULL,
     amount DECIMAL(10, 2) NOT NULL,
     currency TEXT NOT NULL DEFAULT 'RUB',
     status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'canceled', 'failed')),
@@ -120,19 +120,9 @@ CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user ON refresh_tokens(user_id);
 CREATE OR REPLACE FUNCTION update_user_storage_limit()
 RETURNS TRIGGER AS $$
 BEGIN
-    -- Устанавливаем лимит хранилища в зависимости от тарифа (используем BIGINT)
-    CASE NEW.tier
-        WHEN 'free' THEN
-            NEW.storage_limit := 0; -- Бесплатный тариф: нет облачного хранилища
-        WHEN 'start' THEN
-            NEW.storage_limit := 5::bigint * 1024 * 1024 * 1024; -- 5 GB
-        WHEN 'medium' THEN
-            NEW.storage_limit := 50::bigint * 1024 * 1024 * 1024; -- 50 GB
-        WHEN 'ultra' THEN
-            NEW.storage_limit := 200::bigint * 1024 * 1024 * 1024; -- 200 GB
-        ELSE
-            NEW.storage_limit := 0;
-    END CASE;
+    -- Лимит хранилища берем из каталога тарифов (plans, раздел PLAN CATALOG)
+    SELECT storage_limit INTO NEW.storage_limit FROM plans WHERE tier = NEW.tier;
+    NEW.storage_limit := COALESCE(NEW.storage_limit, 0);
     
     -- Обновляем free_since при изменении тарифа
     IF NEW.tier = 'free' AND (OLD.tier IS NULL OR OLD.tier != 'free') THEN
@@ -207,3 +197,520 @@ UPDATE notes SET server_updated_at = updated_at WHERE server_updated_at IS NULL;
 UPDATE folders SET server_updated_at = updated_at WHERE server_updated_at IS NULL;
 UPDATE tags SET server_updated_at = updated_at WHERE server_updated_at IS NULL;
 UPDATE files SET server_updated_at = updated_at WHERE server_updated_at IS NULL;
+
+
+-- ==================== SESSIONS & SSE TICKETS ====================
+
+-- session_id объединяет цепочку refresh-токенов одной сессии (сохраняется при ротации)
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS session_id UUID NOT NULL DEFAULT gen_random_uuid();
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens(session_id);
+
+-- Одноразовые короткоживущие тикеты для подключения к SSE (вместо access token в URL)
+CREATE TABLE IF NOT EXISTS sse_tickets (
+    ticket_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_id UUID NOT NULL,
+    audience TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sse_tickets_expires ON sse_tickets(expires_at);
+
+
+-- ==================== JWT SIGNING KEYS ====================
+
+-- Асимметричные ключи подписи access-токенов (EdDSA) с ротацией.
+-- private_key зашифрован секретом сервера (auth.jwt_secret), public_key публикуется в JWKS.
+CREATE TABLE IF NOT EXISTS signing_keys (
+    kid TEXT PRIMARY KEY,
+    algorithm TEXT NOT NULL,
+    public_key BYTEA NOT NULL,
+    private_key BYTEA NOT NULL,
+    kek_id TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    not_before TIMESTAMP WITH TIME ZONE NOT NULL,
+    retires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_signing_keys_expires ON signing_keys(expires_at);
+
+
+-- ==================== PERSONAL ACCESS TOKENS ====================
+
+-- Именованные токены публичного API с областями доступа (хранится только SHA-256 хеш)
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_prefix TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scopes JSONB NOT NULL DEFAULT '[]',
+    allowed_ips JSONB NOT NULL DEFAULT '[]',
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    last_used_ip TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user ON personal_access_tokens(user_id);
+
+
+-- ==================== OAUTH2 AUTHORIZATION SERVER ====================
+
+-- Сторонние клиенты (веб-клиппер, CLI). secret_hash = NULL у публичных клиентов
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id TEXT PRIMARY KEY,
+    owner_user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    secret_hash TEXT,
+    redirect_uris JSONB NOT NULL DEFAULT '[]',
+    grant_types JSONB NOT NULL DEFAULT '[]',
+    scopes JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_oauth_clients_owner ON oauth_clients(owner_user_id);
+
+-- Согласие пользователя на доступ клиента к областям
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    scopes JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, client_id)
+);
+
+-- Одноразовые коды авторизации (authorization code + PKCE)
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+    code_hash TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scopes JSONB NOT NULL DEFAULT '[]',
+    code_challenge TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_oauth_codes_expires ON oauth_authorization_codes(expires_at);
+
+-- Device authorization grant (RFC 8628): status pending -> approved / denied
+CREATE TABLE IF NOT EXISTS oauth_device_codes (
+    device_code_hash TEXT PRIMARY KEY,
+    user_code TEXT NOT NULL UNIQUE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    scopes JSONB NOT NULL DEFAULT '[]',
+    status TEXT NOT NULL DEFAULT 'pending',
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    poll_interval INTEGER NOT NULL DEFAULT 5,
+    last_polled_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_oauth_device_codes_expires ON oauth_device_codes(expires_at);
+
+-- Refresh-токены сторонних клиентов: client_id и выданные области (NULL — сессия приложения GLYF)
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS client_id TEXT REFERENCES oauth_clients(id) ON DELETE CASCADE;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS scopes JSONB;
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_client ON refresh_tokens(client_id) WHERE client_id IS NOT NULL;
+
+-- ==================== OIDC LOGIN ====================
+-- У пользователей, созданных через внешнего провайдера, password_hash = '' (вход по паролю невозможен)
+
+-- Внешние учетные записи (issuer + sub), привязанные к пользователю
+CREATE TABLE IF NOT EXISTS user_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_login_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (provider, subject),
+    UNIQUE (user_id, provider)
+);
+
+-- Незавершенные входы: state, nonce и PKCE verifier до возврата пользователя от IdP.
+-- link_user_id задан, если вход начат для привязки провайдера к существующему аккаунту
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state_hash TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    link_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_oidc_login_states_expires ON oidc_login_states(expires_at);
+
+-- Одноразовые коды, которыми фронтенд обменивает результат входа на токены
+CREATE TABLE IF NOT EXISTS oidc_login_codes (
+    code_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_user BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_oidc_login_codes_expires ON oidc_login_codes(expires_at);
+
+-- Хранилище ключа E2EE: мастер-ключ, зашифрованный на клиенте ключом из
+-- парольной фразы хранилища. Сервер не знает ни фразы, ни ключа; kdf — параметры
+-- (алгоритм, соль, итерации), нужные клиенту для расшифровки на новом устройстве
+CREATE TABLE IF NOT EXISTS user_vaults (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    wrapped_key TEXT NOT NULL,
+    kdf JSONB NOT NULL,
+    version INTEGER NOT NULL DEFAULT 1,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- ==================== LOGIN LOCKOUT ====================
+
+-- Неудачные попытки входа по аккаунту (а не по IP): защита от подбора пароля
+-- с множества адресов. Ключ — SHA-256 email в нижнем регистре; записи заводятся
+-- и для несуществующих email, чтобы ответы не раскрывали наличие аккаунта
+CREATE TABLE IF NOT EXISTS login_attempts (
+    email_hash TEXT PRIMARY KEY,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    blocked_until TIMESTAMP WITH TIME ZONE,
+    -- locked: достигнут порог блокировки (а не просто задержка между попытками)
+    locked BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(user_id) WHERE user_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_login_attempts_last_failed ON login_attempts(last_failed_at);
+
+-- Уведомления пользователя в приложении (блокировка входа и т.п.)
+CREATE TABLE IF NOT EXISTS user_notifications (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    read_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_notifications_user ON user_notifications(user_id, created_at DESC);
+
+-- Администраторы назначаются вручную: UPDATE users SET is_admin = TRUE WHERE email = '...';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- ==================== AUDIT LOG ====================
+
+-- Журнал событий безопасности: входы, ошибки входа, повторное использование
+-- refresh-токенов, смена тарифа, удаления. Только добавление: UPDATE и DELETE
+-- запрещены триггером, поэтому у user_id нет внешнего ключа (события удаленных
+-- пользователей сохраняются)
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID,
+    event TEXT NOT NULL,
+    client_ip TEXT,
+    user_agent TEXT,
+    session_id TEXT,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_user ON audit_events(user_id, id DESC);
+CREATE INDEX IF NOT EXISTS idx_audit_events_event ON audit_events(event, id DESC);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created ON audit_events(created_at);
+
+CREATE OR REPLACE FUNCTION audit_events_append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trigger_audit_events_append_only ON audit_events;
+CREATE TRIGGER trigger_audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW
+    EXECUTE FUNCTION audit_events_append_only();
+
+-- Уже использованные (замененные при ротации) refresh-токены: повторное
+-- предъявление такого токена означает, что он утек
+CREATE TABLE IF NOT EXISTS rotated_refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_id UUID NOT NULL,
+    client_id TEXT,
+    rotated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rotated_refresh_tokens_expires ON rotated_refresh_tokens(expires_at);
+
+-- ==================== RATE LIMITS ====================
+
+-- Состояние лимитов запросов (GCRA): tat — момент, когда бюджет ключа полностью
+-- восстановится. UNLOGGED: таблица не пишется в WAL, после сбоя БД лимиты
+-- просто начинаются заново
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key TEXT PRIMARY KEY,
+    tat TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- ==================== PAYMENT WEBHOOKS ====================
+
+-- Входящие уведомления платежного сервиса. event_key (объект и его статус)
+-- одинаков у повторных доставок: запись в одной транзакции БД со сменой
+-- статуса платежа не дает обработать событие дважды
+CREATE TABLE IF NOT EXISTS payment_webhook_inbox (
+    event_key TEXT PRIMARY KEY,
+    event TEXT NOT NULL,
+    object_id TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_webhook_inbox_received ON payment_webhook_inbox(received_at);
+
+-- ==================== SUBSCRIPTIONS ====================
+
+-- Оплаченный период тарифа и автопродление сохраненным способом оплаты.
+-- Неудачное списание повторяется (next_attempt_at), доступ сохраняется до
+-- grace_until; после этого задача очистки переводит пользователя на free
+CREATE TABLE IF NOT EXISTS subscriptions (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    tier TEXT NOT NULL,
+    payment_method_id TEXT,
+    payment_method_title TEXT,
+    auto_renew BOOLEAN NOT NULL DEFAULT FALSE,
+    status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'past_due', 'expired')),
+    current_period_end TIMESTAMP WITH TIME ZONE NOT NULL,
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    failed_attempts INT NOT NULL DEFAULT 0,
+    grace_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_renewal ON subscriptions(current_period_end) WHERE auto_renew AND status <> 'expired';
+
+-- ==================== PLAN CHANGES ====================
+
+-- Понижение тарифа применяется при следующем продлении
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS scheduled_tier TEXT;
+
+-- ==================== PLAN CATALOG ====================
+
+-- Каталог тарифов: цена за период, лимиты, флаги возможностей и тексты по
+-- языкам. Сервер кэширует его в памяти; администратор меняет тарифы через
+-- /admin/plans. Снятый с продажи тариф (active = FALSE) продолжает продлеваться
+CREATE TABLE IF NOT EXISTS plans (
+    tier TEXT PRIMARY KEY,
+    price DECIMAL(10, 2) NOT NULL CHECK (price >= 0),
+    currency TEXT NOT NULL DEFAULT 'RUB',
+    period_days INT NOT NULL DEFAULT 30 CHECK (period_days > 0),
+    storage_limit BIGINT NOT NULL DEFAULT 0,
+    max_file_size BIGINT NOT NULL DEFAULT 0,
+    features JSONB NOT NULL DEFAULT '{}', -- {"sync": true, "priority_support": true, "backup": true}
+    display JSONB NOT NULL DEFAULT '{}',  -- {"ru": {"name": ..., "features": [...]}, "en": {...}}
+    sort_order INT NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Начальный каталог (совпадает с model.DefaultPlans). Колонки price, currency и
+-- period_days удаляются ниже (BILLING PERIODS & CURRENCIES): при повторном
+-- запуске каталог уже перенесен в prices
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'plans' AND column_name = 'price') THEN
+        INSERT INTO plans (tier, price, currency, period_days, storage_limit, max_file_size, features, display, sort_order) VALUES
+            ('free', 0, 'RUB', 30, 0, 0, '{}',
+             '{"ru": {"name": "Free", "features": ["Заметки на одном устройстве"]}, "en": {"name": "Free", "features": ["Notes on a single device"]}}', 0),
+            ('start', 99, 'RUB', 30, 5::bigint * 1024 * 1024 * 1024, 100::bigint * 1024 * 1024, '{"sync": true}',
+             '{"ru": {"name": "Start", "features": ["Синхронизация между устройствами", "Облачное хранилище 5 GB", "Максимальный размер файла 100 MB"]}, "en": {"name": "Start", "features": ["Sync across devices", "5 GB cloud storage", "Files up to 100 MB"]}}', 1),
+            ('medium', 299, 'RUB', 30, 50::bigint * 1024 * 1024 * 1024, 500::bigint * 1024 * 1024, '{"sync": true, "priority_support": true}',
+             '{"ru": {"name": "Medium", "features": ["Синхронизация между устройствами", "Облачное хранилище 50 GB", "Максимальный размер файла 500 MB", "Приоритетная поддержка"]}, "en": {"name": "Medium", "features": ["Sync across devices", "50 GB cloud storage", "Files up to 500 MB", "Priority support"]}}', 2),
+            ('ultra', 999, 'RUB', 30, 200::bigint * 1024 * 1024 * 1024, 5::bigint * 1024 * 1024 * 1024, '{"sync": true, "priority_support": true, "backup": true}',
+             '{"ru": {"name": "Ultra", "features": ["Синхронизация между устройствами", "Облачное хранилище 200 GB", "Максимальный размер файла 5 GB", "Приоритетная поддержка", "Резервное копирование"]}, "en": {"name": "Ultra", "features": ["Sync across devices", "200 GB cloud storage", "Files up to 5 GB", "Priority support", "Backups"]}}', 3)
+        ON CONFLICT (tier) DO NOTHING;
+    END IF;
+END $$;
+
+-- Тарифы пользователей, платежей и подписок ссылаются на каталог
+-- (вместо прежних CHECK со списком тарифов)
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_tier_check;
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_tier_check;
+ALTER TABLE subscriptions DROP CONSTRAINT IF EXISTS subscriptions_tier_check;
+ALTER TABLE subscriptions DROP CONSTRAINT IF EXISTS subscriptions_scheduled_tier_check;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'users_tier_fkey') THEN
+        ALTER TABLE users ADD CONSTRAINT users_tier_fkey FOREIGN KEY (tier) REFERENCES plans(tier);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'transactions_tier_fkey') THEN
+        ALTER TABLE transactions ADD CONSTRAINT transactions_tier_fkey FOREIGN KEY (tier) REFERENCES plans(tier);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'subscriptions_tier_fkey') THEN
+        ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_tier_fkey FOREIGN KEY (tier) REFERENCES plans(tier);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'subscriptions_scheduled_tier_fkey') THEN
+        ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_scheduled_tier_fkey FOREIGN KEY (scheduled_tier) REFERENCES plans(tier);
+    END IF;
+END $$;
+
+-- Новый лимит хранилища тарифа сразу применяется к его пользователям
+CREATE OR REPLACE FUNCTION apply_plan_storage_limit()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.storage_limit IS DISTINCT FROM OLD.storage_limit THEN
+        UPDATE users SET storage_limit = NEW.storage_limit WHERE tier = NEW.tier;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trigger_apply_plan_storage_limit ON plans;
+CREATE TRIGGER trigger_apply_plan_storage_limit
+    AFTER UPDATE OF storage_limit ON plans
+    FOR EACH ROW
+    EXECUTE FUNCTION apply_plan_storage_limit();
+
+-- ==================== PROMO CODES & TRIALS ====================
+
+-- Промокоды: скидка в процентах или фиксированной суммой на первую оплату
+CREATE TABLE IF NOT EXISTS coupons (
+    code TEXT PRIMARY KEY,
+    percent_off INT NOT NULL DEFAULT 0 CHECK (percent_off BETWEEN 0 AND 100),
+    amount_off DECIMAL(10, 2) NOT NULL DEFAULT 0 CHECK (amount_off >= 0),
+    currency TEXT, -- валюта amount_off
+    tiers JSONB NOT NULL DEFAULT '[]', -- тарифы, к которым применяется ([] — любой платный)
+    expires_at TIMESTAMP WITH TIME ZONE,
+    max_redemptions INT NOT NULL DEFAULT 0, -- 0 — без ограничения
+    per_user_limit INT NOT NULL DEFAULT 1,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Использования промокодов. Строка создается вместе с платежом и удаляется,
+-- если платеж отменен
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    transaction_id UUID PRIMARY KEY,
+    code TEXT NOT NULL REFERENCES coupons(code),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_code_user ON coupon_redemptions(code, user_id);
+
+-- Длина пробного периода тарифа (0 — пробного периода нет)
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS trial_days INT NOT NULL DEFAULT 0 CHECK (trial_days >= 0);
+
+-- Пробные периоды: не более одного на аккаунт
+CREATE TABLE IF NOT EXISTS trials (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    tier TEXT NOT NULL REFERENCES plans(tier),
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- ==================== BILLING PERIODS & CURRENCIES ====================
+
+-- Цены тарифа по периодам оплаты и валютам:
+-- [{"period": "monthly", "currency": "RUB", "amount": 299}, {"period": "yearly", ...}]
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS prices JSONB NOT NULL DEFAULT '[]';
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'plans' AND column_name = 'price') THEN
+        -- Прежняя цена тарифа становится месячной ценой в его валюте
+        UPDATE plans
+        SET prices = jsonb_build_array(jsonb_build_object('period', 'monthly', 'currency', currency, 'amount', price))
+        WHERE price > 0 AND prices = '[]';
+        ALTER TABLE plans DROP COLUMN price, DROP COLUMN currency, DROP COLUMN period_days;
+    END IF;
+END $$;
+
+-- Годовые цены тарифов по умолчанию (совпадают с model.DefaultPlans)
+UPDATE plans SET prices = prices || jsonb_build_array(jsonb_build_object('period', 'yearly', 'currency', 'RUB', 'amount', y.amount))
+FROM (VALUES ('start', 990), ('medium', 2990), ('ultra', 9990)) AS y(tier, amount)
+WHERE plans.tier = y.tier AND NOT plans.prices @> '[{"period": "yearly", "currency": "RUB"}]';
+
+-- Оплаченный период транзакции: на него продлевается тариф
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS billing_period TEXT NOT NULL DEFAULT 'monthly'
+    CHECK (billing_period IN ('monthly', 'yearly'));
+
+-- Период и валюта, в которых продлевается подписка
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS billing_period TEXT NOT NULL DEFAULT 'monthly'
+    CHECK (billing_period IN ('monthly', 'yearly'));
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'RUB';
+
+-- ==================== RECEIPTS & INVOICES ====================
+
+-- Последний номер счета за год: строка блокируется при выдаче счета, поэтому
+-- номера идут подряд без пропусков
+CREATE TABLE IF NOT EXISTS invoice_counters (
+    year INT PRIMARY KEY,
+    last_number INT NOT NULL
+);
+
+-- Счета за оплаченные транзакции (номер вида 2026-000001)
+CREATE TABLE IF NOT EXISTS invoices (
+    number TEXT PRIMARY KEY,
+    transaction_id UUID NOT NULL UNIQUE REFERENCES transactions(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    customer_email TEXT NOT NULL,
+    issued_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_user_created ON transactions(user_id, created_at DESC);
+
+-- Счета за оплаты, прошедшие до появления счетов: по порядку оплаты
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM invoice_counters) THEN
+        WITH paid AS (
+            SELECT t.id, t.user_id, u.email, t.updated_at,
+                EXTRACT(YEAR FROM t.updated_at AT TIME ZONE 'UTC')::INT AS year,
+                ROW_NUMBER() OVER (
+                    PARTITION BY EXTRACT(YEAR FROM t.updated_at AT TIME ZONE 'UTC')
+                    ORDER BY t.updated_at, t.id
+                ) AS n
+            FROM transactions t
+            JOIN users u ON u.id = t.user_id
+            WHERE t.status = 'succeeded'
+        ), issued AS (
+            INSERT INTO invoices (number, transaction_id, user_id, customer_email, issued_at)
+            SELECT year || '-' || lpad(n::TEXT, 6, '0'), id, user_id, email, updated_at
+            FROM paid
+        )
+        INSERT INTO invoice_counters (year, last_number)
+        SELECT year, MAX(n) FROM paid GROUP BY year;
+    END IF;
+END $$;
+
+-- ==================== REFUNDS ====================
+
+-- Возвращенная часть оплаты; транзакция с возвратом — partially_refunded или refunded
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS refunded_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_status_check;
+ALTER TABLE transactions ADD CONSTRAINT transactions_status_check
+    CHECK (status IN ('pending', 'succeeded', 'canceled', 'failed', 'partially_refunded', 'refunded'));
+
+-- Возвраты YooKassa и чарджбэки (ID вида chargeback:<uuid>), учтенные в доступе
+CREATE TABLE IF NOT EXISTS refunds (
+    id TEXT PRIMARY KEY,
+    transaction_id UUID NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+    amount DECIMAL(10,2) NOT NULL,
+    currency TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('refund', 'chargeback')),
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_refunds_transaction ON refunds(transaction_id);
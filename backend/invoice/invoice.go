@@ -0,0 +1,92 @@
+// invoice/invoice.go
+package invoice
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"noteflow/model"
+)
+
+// Счета за оплаченные транзакции в PDF. Текст счета на английском: стандартные
+// шрифты PDF не содержат кириллицы (см. page).
+
+// Seller — реквизиты продавца
+type Seller struct {
+	Name    string
+	TaxID   string // ИНН
+	Address string
+}
+
+// Invoice — данные счета
+type Invoice struct {
+	Number   string
+	IssuedAt time.Time
+	Seller   Seller
+	// Customer — email покупателя
+	Customer string
+	// Description — оплаченная услуга (тариф и период)
+	Description string
+	Amount      float64
+	Currency    string
+	// VATCode — код ставки НДС YooKassa (0 или 1 — без НДС)
+	VATCode   int
+	PaymentID string
+}
+
+// Render формирует счет в PDF
+func Render(inv Invoice) []byte {
+	const left, right = 50.0, pageWidth - 50.0
+	const amountX = 430.0
+	var p page
+
+	y := 780.0
+	p.text(left, y, 22, true, "INVOICE")
+	p.text(amountX, y+6, 10, false, "No. "+inv.Number)
+	p.text(amountX, y-8, 10, false, "Date: "+inv.IssuedAt.UTC().Format("2006-01-02"))
+
+	y -= 50
+	p.text(left, y, 10, true, "Seller")
+	p.text(amountX, y, 10, true, "Bill to")
+	sellerLines := []string{inv.Seller.Name}
+	if inv.Seller.TaxID != "" {
+		sellerLines = append(sellerLines, "Tax ID (INN): "+inv.Seller.TaxID)
+	}
+	sellerLines = append(sellerLines, inv.Seller.Address)
+	for i, s := range sellerLines {
+		p.text(left, y-14*float64(i+1), 10, false, s)
+	}
+	p.text(amountX, y-14, 10, false, inv.Customer)
+
+	y -= 90
+	p.text(left, y, 10, true, "Description")
+	p.text(amountX, y, 10, true, "Amount")
+	p.line(left, y-6, right, y-6)
+	y -= 22
+	p.text(left, y, 10, false, inv.Description)
+	p.text(amountX, y, 10, false, formatAmount(inv.Amount, inv.Currency))
+	p.line(left, y-8, right, y-8)
+
+	y -= 26
+	p.text(left, y, 11, true, "Total")
+	p.text(amountX, y, 11, true, formatAmount(inv.Amount, inv.Currency))
+	y -= 16
+	if rate, ok := model.VATRate(inv.VATCode); ok {
+		vat := fmt.Sprintf("Including VAT %d%%", rate)
+		p.text(left, y, 10, false, vat)
+		p.text(amountX, y, 10, false, formatAmount(model.IncludedVAT(inv.Amount, rate), inv.Currency))
+	} else {
+		p.text(left, y, 10, false, "VAT not applicable")
+	}
+
+	y -= 40
+	p.text(left, y, 10, false, "Paid in full on "+inv.IssuedAt.UTC().Format("2006-01-02")+" via YooKassa, payment "+inv.PaymentID+".")
+
+	return p.render("Invoice "+inv.Number, inv.IssuedAt)
+}
+
+// formatAmount — сумма с копейками и кодом валюты (2990.00 RUB)
+func formatAmount(amount float64, currency string) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64) + " " + currency
+}
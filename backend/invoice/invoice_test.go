@@ -0,0 +1,55 @@
+package invoice
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	pdf := Render(Invoice{
+		Number:      "2026-000042",
+		IssuedAt:    time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		Seller:      Seller{Name: "ООО «Ромашка»", TaxID: "7700000000", Address: "Moscow"},
+		Customer:    "user@example.com",
+		Description: "NoteFlow Medium subscription (1 year)",
+		Amount:      2990,
+		Currency:    "RUB",
+		VATCode:     4,
+		PaymentID:   "p1",
+	})
+
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("not a PDF document")
+	}
+	for _, want := range []string{"(No. 2026-000042)", `(OOO "Romashka")`, "(2990.00 RUB)", "(Including VAT 20%)", "(498.33 RUB)"} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("PDF does not contain %s", want)
+		}
+	}
+
+	// Смещения в таблице xref указывают на начала объектов
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("startxref not found")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point to xref", xref)
+	}
+	offsets := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xref:], -1)
+	for i, off := range offsets {
+		n, _ := strconv.Atoi(string(off[1]))
+		if want := strconv.Itoa(i+1) + " 0 obj\n"; !bytes.HasPrefix(pdf[n:], []byte(want)) {
+			t.Errorf("xref entry %d points to %q", i+1, pdf[n:n+10])
+		}
+	}
+}
+
+func TestPDFStringEscapesAndTransliterates(t *testing.T) {
+	if got := string(pdfString(`Счет (a\b) 中`)); got != `(Schet \(a\\b\) ?)` {
+		t.Errorf("pdfString = %s", got)
+	}
+}
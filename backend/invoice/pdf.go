@@ -0,0 +1,118 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Размер страницы A4 в пунктах
+const (
+	pageWidth  = 595
+	pageHeight = 842
+)
+
+// page — одностраничный PDF со стандартными шрифтами Helvetica (их не нужно
+// встраивать). Стандартные шрифты содержат только латиницу (WinAnsiEncoding),
+// поэтому кириллица транслитерируется.
+type page struct {
+	content bytes.Buffer
+}
+
+// text выводит строку s с левым нижним углом в (x, y)
+func (p *page) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.2f %.2f Td ", font, size, x, y)
+	p.content.Write(pdfString(s))
+	p.content.WriteString(" Tj ET\n")
+}
+
+// line рисует отрезок толщиной 0.5 пт
+func (p *page) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&p.content, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// render собирает документ: объекты, таблицу смещений (xref) и трейлер
+func (p *page) render(title string, created time.Time) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>", pageWidth, pageHeight),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", p.content.Len(), p.content.Bytes()),
+		fmt.Sprintf("<< /Title %s /Producer (NoteFlow) /CreationDate (D:%s) >>", pdfString(title), created.UTC().Format("20060102150405Z")),
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, len(objects), xref)
+	return buf.Bytes()
+}
+
+// pdfString кодирует s строкой PDF в WinAnsiEncoding. Кириллица
+// транслитерируется, остальные символы вне кодировки заменяются на "?".
+func pdfString(s string) []byte {
+	var b bytes.Buffer
+	b.WriteByte('(')
+	for _, r := range transliterate(s) {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r >= 0x20 && r < 0x7f, r >= 0xa0 && r <= 0xff:
+			b.WriteByte(byte(r))
+		case r == '–':
+			b.WriteByte(0x96)
+		case r == '—':
+			b.WriteByte(0x97)
+		case r == '€':
+			b.WriteByte(0x80)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte(')')
+	return b.Bytes()
+}
+
+var cyrillic = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", '№': "No.", '«': "\"", '»': "\"",
+}
+
+// transliterate заменяет русские буквы латиницей (ООО «Ромашка» -> OOO "Romashka")
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		lower := []rune(strings.ToLower(string(r)))[0]
+		latin, ok := cyrillic[lower]
+		switch {
+		case !ok:
+			b.WriteRune(r)
+		case lower != r && latin != "":
+			// Заглавная буква: первая буква замены тоже заглавная
+			b.WriteString(strings.ToUpper(latin[:1]) + latin[1:])
+		default:
+			b.WriteString(latin)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,28 @@
+package mail
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildMessageEncodesSubject(t *testing.T) {
+	from := &mail.Address{Name: "GLYF", Address: "noreply@example.com"}
+	to := &mail.Address{Address: "user@example.com"}
+
+	msg := string(buildMessage(from, to, "Hello\r\nBcc: evil@example.com", "line1\nline2", time.Unix(0, 0)))
+
+	headers, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header/body separator in:\n%s", msg)
+	}
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("subject injected a header: %q", line)
+		}
+	}
+	if body != "line1\r\nline2" {
+		t.Errorf("body = %q, want CRLF line endings", body)
+	}
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
-	"net"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"noteflow/api"
+	"noteflow/auth"
+	"noteflow/clientip"
+	"noteflow/config"
+	"noteflow/cors"
+	"noteflow/model"
+	"noteflow/ratelimit"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/time/rate"
 )
 
 // --- CONTEXT KEYS ---
@@ -20,136 +26,128 @@ const UserIDContextKey contextKey = "user_id"
 
 // --- RATE LIMITER ---
 
-type visitor struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
-}
-
-var (
-	visitors = make(map[string]*visitor)
-	mu       sync.Mutex
-)
-
-// Separate stricter limits for auth endpoints
-type authLimiterKey struct {
-	ip    string
-	route string // "login", "register", "refresh"
+// rateLimits — лимиты запросов. Состояние хранится в ratelimit.Store (память
+// процесса или Postgres), поэтому с хранилищем postgres бюджеты общие для реплик
+// и не сбрасываются при перезапуске.
+type rateLimits struct {
+	limiter *ratelimit.Limiter
+	general ratelimit.Limit // на IP, все запросы
+	auth    ratelimit.Limit // на IP и маршрут /auth/*
+	budgets ratelimit.Budgets
+	tiers   *ratelimit.TierCache
 }
 
-var (
-	authVisitors = make(map[authLimiterKey]*visitor)
-	authMu       sync.Mutex
-)
-
-func initRateLimiter() {
-	// Clean up general visitors
-	go func() {
-		for {
-			time.Sleep(5 * time.Minute)
-			mu.Lock()
-			for ip, v := range visitors {
-				if time.Since(v.lastSeen) > 10*time.Minute {
-					delete(visitors, ip)
-				}
-			}
-			mu.Unlock()
-		}
-	}()
-	// Clean up auth visitors
-	go func() {
-		for {
-			time.Sleep(5 * time.Minute)
-			authMu.Lock()
-			for key, v := range authVisitors {
-				if time.Since(v.lastSeen) > 10*time.Minute {
-					delete(authVisitors, key)
-				}
-			}
-			authMu.Unlock()
+// newRateLimits создает лимиты из конфигурации; tiers определяет тариф пользователя
+func newRateLimits(cfg config.RateLimitConfig, store ratelimit.Store, tiers *ratelimit.TierCache) *rateLimits {
+	budgets := make(ratelimit.Budgets)
+	for group, byTier := range cfg.Budgets {
+		budgets[group] = make(map[string]ratelimit.Limit)
+		for tier, b := range byTier {
+			budgets[group][tier] = ratelimit.Limit{Requests: b.Requests, Period: b.Period, Burst: b.Burst}
 		}
-	}()
+	}
+	return &rateLimits{
+		limiter: ratelimit.New(store),
+		// Дробные requests_per_second переводим в запросы в минуту
+		general: ratelimit.Limit{Requests: max(int(math.Round(cfg.RequestsPerSecond*60)), 1), Period: time.Minute, Burst: cfg.Burst},
+		auth:    ratelimit.Limit{Requests: 1, Period: cfg.AuthInterval, Burst: cfg.AuthBurst},
+		budgets: budgets,
+		tiers:   tiers,
+	}
 }
 
-func getVisitor(ip string) *rate.Limiter {
-	mu.Lock()
-	defer mu.Unlock()
-
-	v, exists := visitors[ip]
-	if !exists {
-		limiter := rate.NewLimiter(5, 15) // 5 req/sec burst 15
-		visitors[ip] = &visitor{limiter, time.Now()}
-		return limiter
+// allow расходует бюджет key, выставляет заголовки RateLimit-* и при
+// исчерпании отвечает 429 с Retry-After
+func (rl *rateLimits) allow(w http.ResponseWriter, r *http.Request, key string, limit ratelimit.Limit) bool {
+	res, err := rl.limiter.Allow(r.Context(), key, limit)
+	if err != nil {
+		log.Printf("Rate limit check failed for %s: %v", key, err)
 	}
-	v.lastSeen = time.Now()
-	return v.limiter
+	ratelimit.SetHeaders(w, res)
+	if !res.Allowed {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
 }
 
-func getAuthVisitor(ip, route string) *rate.Limiter {
-	key := authLimiterKey{ip, route}
-	authMu.Lock()
-	defer authMu.Unlock()
+// perIP — общий лимит на IP для всех запросов (защита от потока запросов)
+func (rl *rateLimits) perIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rl.allow(w, r, "ip:"+clientip.FromRequest(r), rl.general) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	v, exists := authVisitors[key]
-	if !exists {
-		// Stricter limits for auth endpoints: 2 req/min burst 5
-		limiter := rate.NewLimiter(rate.Every(30*time.Second), 2) // 2 per 30 sec = 4 per min
-		authVisitors[key] = &visitor{limiter, time.Now()}
-		return limiter
+// authRoute — отдельные бюджеты для маршрутов входа
+func authRoute(path string) string {
+	switch path {
+	case "/auth/login":
+		return "login"
+	case "/auth/register":
+		return "register"
+	case "/auth/refresh":
+		return "refresh"
+	default:
+		return "other"
 	}
-	v.lastSeen = time.Now()
-	return v.limiter
 }
 
-func rateLimitMiddleware(next http.Handler) http.Handler {
+// perAuthRoute — строгий лимит на IP для /auth/*
+func (rl *rateLimits) perAuthRoute(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			ip = r.RemoteAddr
-		}
-
-		limiter := getVisitor(ip)
-		if !limiter.Allow() {
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		if !rl.allow(w, r, "auth:"+authRoute(r.URL.Path)+":"+clientip.FromRequest(r), rl.auth) {
 			return
 		}
-
 		next.ServeHTTP(w, r)
 	})
 }
 
-func authRateLimitMiddleware(next http.Handler) http.Handler {
+// rateLimitGroup — группа маршрутов с общим бюджетом (config.RateLimitGroups)
+func rateLimitGroup(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/sync/"), strings.HasPrefix(path, "/notes/"):
+		return "sync"
+	case strings.HasPrefix(path, "/files/"):
+		return "files"
+	default:
+		return "account"
+	}
+}
+
+// perUser — бюджет аутентифицированного пользователя по группе маршрутов и тарифу.
+// Ставится после authMiddleware: ключ — ID пользователя, а не IP, поэтому
+// пользователи за одним NAT не делят бюджет, а смена IP его не обходит.
+func (rl *rateLimits) perUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			ip = r.RemoteAddr
-		}
+		userID, _ := r.Context().Value(api.UserIDContextKey).(string)
+		group := rateLimitGroup(r.URL.Path)
 
-		path := r.URL.Path
-		var route string
-		switch path {
-		case "/auth/login":
-			route = "login"
-		case "/auth/register":
-			route = "register"
-		case "/auth/refresh":
-			route = "refresh"
-		default:
-			route = "other"
+		tier, err := rl.tiers.Tier(r.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to load tier of user %s for rate limiting: %v", userID, err)
+			tier = "default"
 		}
-
-		limiter := getAuthVisitor(ip, route)
-		if !limiter.Allow() {
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		limit, ok := rl.budgets.For(group, tier)
+		if ok && !rl.allow(w, r, "user:"+group+":"+userID, limit) {
 			return
 		}
-
 		next.ServeHTTP(w, r)
 	})
 }
 
 // --- AUTHENTICATION ---
 
-func authMiddleware(jwtSecret []byte) func(http.Handler) http.Handler {
+// tokenAuthenticator проверяет personal access tokens (api.Handler)
+type tokenAuthenticator interface {
+	AuthenticateToken(ctx context.Context, token, clientIP string) (*model.PersonalAccessToken, error)
+}
+
+// authMiddleware принимает access-токен сессии (проверяется общим верификатором:
+// EdDSA, kid из JWKS) или personal access token с префиксом nf_pat_
+func authMiddleware(verifier auth.Verifier, tokens tokenAuthenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -160,33 +158,108 @@ func authMiddleware(jwtSecret []byte) func(http.Handler) http.Handler {
 
 			tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
 
-			token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, jwt.ErrSignatureInvalid
+			if strings.HasPrefix(tokenStr, api.PersonalTokenPrefix) {
+				pat, err := tokens.AuthenticateToken(r.Context(), tokenStr, clientip.FromRequest(r))
+				switch {
+				case errors.Is(err, sql.ErrNoRows):
+					http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+					return
+				case errors.Is(err, api.ErrTokenIPNotAllowed):
+					http.Error(w, "Forbidden: Token is not allowed from this IP", http.StatusForbidden)
+					return
+				case err != nil:
+					log.Printf("Personal access token check failed: %v", err)
+					http.Error(w, "Database error", http.StatusInternalServerError)
+					return
 				}
-				return jwtSecret, nil
-			})
 
-			if err != nil || !token.Valid {
-				http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+				// id токена служит сессией для SSE/WS: отзыв токена закрывает его потоки
+				ctx := context.WithValue(r.Context(), api.UserIDContextKey, pat.UserID)
+				ctx = context.WithValue(ctx, api.SessionIDContextKey, pat.ID)
+				ctx = context.WithValue(ctx, api.ScopesContextKey, pat.Scopes)
+				ctx = context.WithValue(ctx, api.AuthMethodContextKey, api.AuthMethodToken)
+				next.ServeHTTP(w, r.WithContext(ctx))
 				return
 			}
 
-			// ИСПРАВЛЕНИЕ: Используем стандартный метод GetSubject(),
-			// который ожидает поле "sub" в claims.
-			userID, err := token.Claims.GetSubject()
-			if err != nil || userID == "" {
-				http.Error(w, "Unauthorized: Invalid claims", http.StatusUnauthorized)
+			claims, err := verifier.Verify(r.Context(), tokenStr)
+			if err != nil {
+				http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 				return
 			}
 
 			// ИСПРАВЛЕНИЕ: Используем типизированный ключ UserIDContextKey
-			ctx := context.WithValue(r.Context(), api.UserIDContextKey, userID)
+			ctx := context.WithValue(r.Context(), api.UserIDContextKey, claims.Subject)
+			if claims.SessionID != "" {
+				ctx = context.WithValue(ctx, api.SessionIDContextKey, claims.SessionID)
+			}
+			if claims.ClientID != "" {
+				// Токен OAuth-клиента: только согласованные пользователем области
+				ctx = context.WithValue(ctx, api.ScopesContextKey, strings.Fields(claims.Scope))
+				ctx = context.WithValue(ctx, api.AuthMethodContextKey, api.AuthMethodOAuth)
+			} else {
+				// Сессия пользователя имеет все области доступа
+				ctx = context.WithValue(ctx, api.ScopesContextKey, auth.AllScopes)
+				ctx = context.WithValue(ctx, api.AuthMethodContextKey, api.AuthMethodSession)
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// requireScopes пропускает запрос, только если токену выданы все указанные области
+func requireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			granted, _ := r.Context().Value(api.ScopesContextKey).([]string)
+			if !auth.HasScopes(granted, scopes...) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(scopes, " ")))
+				http.Error(w, "Forbidden: Insufficient scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession пропускает только запросы с access-токеном сессии: управлять
+// токенами и подпиской через personal access token нельзя
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if method, _ := r.Context().Value(api.AuthMethodContextKey).(string); method != api.AuthMethodSession {
+			http.Error(w, "Forbidden: Requires a signed-in session", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminChecker проверяет права администратора (api.Handler)
+type adminChecker interface {
+	IsAdmin(ctx context.Context, userID string) (bool, error)
+}
+
+// requireAdmin пропускает только сессии администраторов (users.is_admin).
+// Права читаются из БД на каждый запрос, поэтому отзыв действует сразу.
+func requireAdmin(admins adminChecker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, _ := r.Context().Value(api.UserIDContextKey).(string)
+			isAdmin, err := admins.IsAdmin(r.Context(), userID)
+			if err != nil {
+				log.Printf("Admin check failed: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if !isAdmin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // --- SECURITY HEADERS ---
 
 func securityHeadersMiddleware(next http.Handler) http.Handler {
@@ -201,35 +274,15 @@ func securityHeadersMiddleware(next http.Handler) http.Handler {
 
 // --- CORS ---
 
-// --- CORS ---
-
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Получаем заголовок Origin из запроса
-		origin := r.Header.Get("Origin")
-
-		// Список разрешенных источников
-		allowedOrigins := map[string]bool{
-			"http://localhost:5173":      true,
-			"http://localhost:3000":      true,
-			"http://localhost:8080":      true,
-		}
-
-		if allowedOrigins[origin] {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		} else {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token, X-Requested-With")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
+// corsMiddleware строит политику CORS из конфигурации. Источники не из списка
+// не получают CORS-заголовков, а их preflight-запросы отклоняются.
+func corsMiddleware(cfg config.CORSConfig, devMode bool) (func(http.Handler) http.Handler, error) {
+	policy, err := cors.NewPolicy(cfg.Origins(devMode), cors.Options{
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
 	})
+	if err != nil {
+		return nil, err
+	}
+	return policy.Handler, nil
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"noteflow/api"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// admins — adminChecker по списку ID
+type admins map[string]bool
+
+func (a admins) IsAdmin(_ context.Context, userID string) (bool, error) {
+	if userID == "broken" {
+		return false, errors.New("database is down")
+	}
+	return a[userID], nil
+}
+
+func TestRequireAdmin_AdminPlans(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(requireAdmin(admins{"admin-1": true}))
+	r.Put("/admin/plans/{tier}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		userID string
+		want   int
+	}{
+		{"admin-1", http.StatusOK},
+		{"user-1", http.StatusForbidden},
+		{"", http.StatusForbidden},
+		{"broken", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/admin/plans/pro", nil)
+		req = req.WithContext(context.WithValue(req.Context(), api.UserIDContextKey, tt.userID))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("user %q: status %d, want %d", tt.userID, rec.Code, tt.want)
+		}
+	}
+}
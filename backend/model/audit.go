@@ -0,0 +1,75 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// События журнала аудита (audit_events.event)
+const (
+	AuditLogin             = "login"
+	AuditLoginFailed       = "login_failed"
+	AuditLoginLocked       = "login_locked"
+	AuditLoginUnlocked     = "login_unlocked"
+	AuditOIDCLogin         = "oidc_login"
+	AuditRegister          = "register"
+	AuditRefreshTokenReuse = "refresh_token_reuse"
+	AuditPasswordChanged   = "password_changed"
+	AuditTokenCreated      = "token_created"
+	AuditTokenRevoked      = "token_revoked"
+	AuditIdentityLinked    = "identity_linked"
+	AuditIdentityUnlinked  = "identity_unlinked"
+	AuditConsentRevoked    = "consent_revoked"
+	AuditTierChanged       = "tier_changed"
+	AuditPaymentSucceeded  = "payment_succeeded"
+	AuditPaymentRefunded   = "payment_refunded"
+	AuditStorageOverQuota  = "storage_over_quota"
+	AuditRenewalFailed     = "renewal_failed"
+	AuditAutoRenewChanged  = "auto_renew_changed"
+	AuditPlanChanged       = "plan_changed"
+	AuditPlanUpdated       = "plan_updated"
+	AuditTrialStarted      = "trial_started"
+	AuditCouponUpdated     = "coupon_updated"
+	AuditNoteDeleted       = "note_deleted"
+	AuditFilesDeleted      = "files_deleted"
+)
+
+// SecurityAuditEvents — события, которые пользователь видит в «недавней активности»
+var SecurityAuditEvents = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditLoginLocked,
+	AuditLoginUnlocked,
+	AuditOIDCLogin,
+	AuditRegister,
+	AuditRefreshTokenReuse,
+	AuditPasswordChanged,
+	AuditTokenCreated,
+	AuditTokenRevoked,
+	AuditIdentityLinked,
+	AuditIdentityUnlinked,
+	AuditConsentRevoked,
+}
+
+// AuditEvent — запись журнала аудита
+type AuditEvent struct {
+	ID        int64           `json:"id"`
+	UserID    *string         `json:"userId"`
+	Event     string          `json:"event"`
+	ClientIP  string          `json:"ip"`
+	UserAgent string          `json:"userAgent"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// AuditFilter — условия выборки журнала для администратора
+type AuditFilter struct {
+	UserID   string
+	Events   []string
+	ClientIP string
+	Since    time.Time
+	Until    time.Time
+	BeforeID int64 // пагинация: события с id меньше BeforeID
+	Limit    int
+}
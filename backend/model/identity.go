@@ -0,0 +1,36 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// UserIdentity — учетная запись внешнего OIDC-провайдера, привязанная к пользователю
+type UserIdentity struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"-"`
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"-"`
+	Email       *string    `json:"email"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastLoginAt *time.Time `json:"lastLoginAt"`
+}
+
+// OIDCLoginState — незавершенный вход через провайдера (до возврата от IdP)
+type OIDCLoginState struct {
+	StateHash    string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   *string // привязка провайдера к аккаунту вошедшего пользователя
+	ExpiresAt    time.Time
+}
+
+// Vault — мастер-ключ E2EE, зашифрованный на клиенте парольной фразой хранилища.
+// Сервер хранит его как есть и не может расшифровать.
+type Vault struct {
+	WrappedKey string          `json:"wrappedKey"`
+	KDF        json.RawMessage `json:"kdf"` // параметры KDF для клиента: алгоритм, соль, итерации
+	Version    int             `json:"version"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+}
@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// Счет выдается в момент успешной оплаты транзакции. Номера идут подряд без
+// пропусков в пределах календарного года (UTC): 2026-000001, 2026-000002, ...
+
+// Invoice — счет за оплаченную транзакцию. Email покупателя и дата
+// сохраняются при выдаче и потом не меняются.
+type Invoice struct {
+	Number      string      `json:"number"`
+	IssuedAt    time.Time   `json:"issuedAt"`
+	Email       string      `json:"email"`
+	Transaction Transaction `json:"transaction"`
+}
+
+// BillingRecord — строка истории оплат пользователя
+type BillingRecord struct {
+	Transaction
+	// InvoiceNumber — номер счета ("" — транзакция не оплачена)
+	InvoiceNumber string `json:"invoiceNumber,omitempty"`
+}
+
+// VATRate возвращает ставку НДС в процентах по коду YooKassa
+// (ok == false — без НДС)
+func VATRate(vatCode int) (rate int, ok bool) {
+	switch vatCode {
+	case 2:
+		return 0, true
+	case 3, 5:
+		return 10, true
+	case 4, 6:
+		return 20, true
+	default:
+		return 0, false
+	}
+}
+
+// IncludedVAT — НДС, включенный в сумму amount, по ставке rate процентов
+func IncludedVAT(amount float64, rate int) float64 {
+	return roundMoney(amount * float64(rate) / float64(100+rate))
+}
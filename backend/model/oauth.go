@@ -0,0 +1,90 @@
+package model
+
+import "time"
+
+// OAuth2 grant types
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// Статусы device-кода
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+)
+
+// OAuthClient — зарегистрированное стороннее приложение
+type OAuthClient struct {
+	ID           string    `json:"clientId"`
+	OwnerUserID  string    `json:"-"`
+	Name         string    `json:"name"`
+	SecretHash   *string   `json:"-"`
+	RedirectURIs []string  `json:"redirectUris"`
+	GrantTypes   []string  `json:"grantTypes"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Confidential сообщает, что клиент аутентифицируется секретом
+func (c *OAuthClient) Confidential() bool {
+	return c.SecretHash != nil
+}
+
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	GrantTypes   []string `json:"grantTypes"`
+	Scopes       []string `json:"scopes"`
+	// Confidential — серверное приложение, способное хранить секрет
+	Confidential bool `json:"confidential"`
+}
+
+type CreateOAuthClientResponse struct {
+	OAuthClient
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+// OAuthConsent — согласие пользователя на доступ клиента
+type OAuthConsent struct {
+	ClientID   string    `json:"clientId"`
+	ClientName string    `json:"clientName"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// OAuthAuthorizationCode — одноразовый код авторизации
+type OAuthAuthorizationCode struct {
+	CodeHash      string
+	ClientID      string
+	UserID        string
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+// OAuthDeviceCode — запрос авторизации устройства без браузера (RFC 8628)
+type OAuthDeviceCode struct {
+	DeviceCodeHash string
+	UserCode       string
+	ClientID       string
+	Scopes         []string
+	Status         string
+	UserID         *string
+	PollInterval   int
+	LastPolledAt   *time.Time
+	ExpiresAt      time.Time
+}
+
+// OAuthTokenResponse — ответ token endpoint (RFC 6749 §5.1)
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"math"
+	"time"
+)
+
+// transactionTransitions — допустимые переходы статуса транзакции.
+// Завершенные платежи (succeeded, canceled, failed) назад в pending не возвращаются;
+// оплаченные могут быть возвращены, в том числе несколькими частями.
+var transactionTransitions = map[TransactionStatus][]TransactionStatus{
+	TransactionPending:           {TransactionSucceeded, TransactionCanceled, TransactionFailed},
+	TransactionSucceeded:         {TransactionPartiallyRefunded, TransactionRefunded},
+	TransactionPartiallyRefunded: {TransactionPartiallyRefunded, TransactionRefunded},
+}
+
+// CanTransitionTo сообщает, допустим ли переход из статуса s в next
+func (s TransactionStatus) CanTransitionTo(next TransactionStatus) bool {
+	for _, allowed := range transactionTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// PaymentEvent — уведомление платежного сервиса, записываемое во входящие
+// (payment_webhook_inbox). Key одинаков у повторных доставок одного события.
+type PaymentEvent struct {
+	Key      string
+	Event    string
+	ObjectID string
+	Payload  []byte
+}
+
+// Назначение платежа (metadata "kind" платежа YooKassa)
+const (
+	PaymentPurchase = "purchase" // покупка или досрочное продление того же тарифа
+	PaymentRenewal  = "renewal"  // автопродление сохраненным способом оплаты
+	PaymentUpgrade  = "upgrade"  // доплата за повышение тарифа до конца текущего периода
+)
+
+// Виды возврата оплаты
+const (
+	RefundKindRefund     = "refund"     // возврат через платежный сервис
+	RefundKindChargeback = "chargeback" // оспаривание платежа через банк (вносится администратором)
+)
+
+// Refund — проведенный возврат части или всей оплаты транзакции
+type Refund struct {
+	// ID — ID возврата YooKassa или "chargeback:<uuid>" для чарджбэка
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transactionId"`
+	PaymentID     string    `json:"paymentId"`
+	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency"`
+	Kind          string    `json:"kind"`
+	Reason        string    `json:"reason,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Refundable сообщает, можно ли вернуть оплату транзакции (еще не возвращенную часть)
+func (t Transaction) Refundable() bool {
+	return t.Status == TransactionSucceeded || t.Status == TransactionPartiallyRefunded
+}
+
+// RefundStatus — статус транзакции после возвратов на сумму refunded
+func (t Transaction) RefundStatus(refunded float64) TransactionStatus {
+	if roundMoney(refunded) >= roundMoney(t.Amount) {
+		return TransactionRefunded
+	}
+	return TransactionPartiallyRefunded
+}
+
+// PaymentOutcome — что дает успешный платеж (срок продления берется из
+// периода транзакции): назначение и сохраненный способ оплаты (пусто, если
+// пользователь не включил автопродление)
+type PaymentOutcome struct {
+	Kind               string
+	PaymentMethodID    string
+	PaymentMethodTitle string
+}
+
+// Статусы подписки с автопродлением
+const (
+	SubscriptionActive  = "active"
+	SubscriptionPastDue = "past_due" // списание не прошло, действует льготный период
+	SubscriptionExpired = "expired"
+)
+
+// Subscription — оплаченный период тарифа и настройки автопродления
+type Subscription struct {
+	UserID             string        `json:"-"`
+	Email              string        `json:"-"`
+	Tier               UserTier      `json:"tier"`
+	Period             BillingPeriod `json:"period"`
+	Currency           string        `json:"currency"`
+	Status             string        `json:"status"`
+	AutoRenew          bool          `json:"autoRenew"`
+	PaymentMethodID    string        `json:"-"`
+	PaymentMethodTitle string        `json:"paymentMethod,omitempty"`
+	CurrentPeriodEnd   time.Time     `json:"currentPeriodEnd"`
+	NextAttemptAt      *time.Time    `json:"nextAttemptAt,omitempty"`
+	FailedAttempts     int           `json:"failedAttempts"`
+	GraceUntil         *time.Time    `json:"graceUntil,omitempty"`
+	// ScheduledTier — тариф, на который подписка перейдет при следующем продлении
+	ScheduledTier UserTier `json:"scheduledTier,omitempty"`
+}
+
+// MinimumCharge — минимальная сумма платежа YooKassa
+const MinimumCharge = 1.0
+
+// Proration — расчет перехода на другой тариф до конца оплаченного периода
+type Proration struct {
+	// Credit — неиспользованный остаток текущего тарифа
+	Credit float64 `json:"credit"`
+	// Charge — стоимость нового тарифа за остаток периода за вычетом Credit
+	Charge    float64       `json:"charge"`
+	Remaining time.Duration `json:"-"`
+}
+
+// Prorate считает переход с цены current на next (того же периода и валюты) в
+// момент now при оплаченном до periodEnd периоде: остаток считается долей
+// последнего периода подписки. Он может быть больше периода, если подписка
+// оплачена заранее.
+func Prorate(current, next PlanPrice, now, periodEnd time.Time) Proration {
+	remaining := periodEnd.Sub(now)
+	if remaining < 0 {
+		remaining = 0
+	}
+	share := float64(remaining) / float64(periodEnd.Sub(current.Period.Start(periodEnd)))
+
+	p := Proration{Credit: roundMoney(current.Amount * share), Remaining: remaining}
+	p.Charge = roundMoney(next.Amount*share - p.Credit)
+	if p.Charge < 0 {
+		p.Charge = 0
+	}
+	return p
+}
+
+// ShortenPeriod возвращает конец оплаченного периода end после возврата доли
+// share оплаты периода period: срок сокращается на ту же долю периода
+func ShortenPeriod(end time.Time, period BillingPeriod, share float64) time.Time {
+	share = math.Min(math.Max(share, 0), 1)
+	length := end.Sub(period.Start(end))
+	return end.Add(-time.Duration(float64(length) * share))
+}
+
+// roundMoney округляет сумму до копеек
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
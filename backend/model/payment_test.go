@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProrate(t *testing.T) {
+	start, _ := FindPlan(TierStart)
+	ultra, _ := FindPlan(TierUltra)
+	startMonthly, _ := start.Price(PeriodMonthly, "RUB")
+	ultraMonthly, _ := ultra.Price(PeriodMonthly, "RUB")
+	startYearly, _ := start.Price(PeriodYearly, "RUB")
+	ultraYearly, _ := ultra.Price(PeriodYearly, "RUB")
+	// Месяц, который заканчивается 1 мая, длится 30 дней
+	now := time.Date(2025, 4, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		from, to  PlanPrice
+		periodEnd time.Time
+		credit    float64
+		charge    float64
+	}{
+		{"half period left", startMonthly, ultraMonthly, now.Add(15 * 24 * time.Hour), 49.5, 450},
+		{"one day of a 31-day month left", startMonthly, ultraMonthly, now.Add(24 * time.Hour), 3.19, 29.04},
+		{"period over", startMonthly, ultraMonthly, now.Add(-time.Hour), 0, 0},
+		{"prepaid two periods", startMonthly, ultraMonthly, now.AddDate(0, 2, 0), 194.81, 1770.96},
+		{"half a year left", startYearly, ultraYearly, now.AddDate(0, 6, 0), 496.36, 4512.32},
+		{"downgrade", ultraMonthly, startMonthly, now.Add(15 * 24 * time.Hour), 499.5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Prorate(tt.from, tt.to, now, tt.periodEnd)
+			if p.Credit != tt.credit || p.Charge != tt.charge {
+				t.Errorf("Prorate = credit %v, charge %v; want %v, %v", p.Credit, p.Charge, tt.credit, tt.charge)
+			}
+		})
+	}
+}
+
+func TestRefundAdjustments(t *testing.T) {
+	end := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	if got := ShortenPeriod(end, PeriodMonthly, 1); !got.Equal(time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("full refund of a month: %v", got)
+	}
+	// Половина апреля (30 дней) — 15 дней
+	if got := ShortenPeriod(end, PeriodMonthly, 0.5); !got.Equal(time.Date(2026, 4, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("half refund of a month: %v", got)
+	}
+
+	tx := Transaction{Amount: 299, Status: TransactionSucceeded}
+	if tx.RefundStatus(100) != TransactionPartiallyRefunded || tx.RefundStatus(299) != TransactionRefunded {
+		t.Error("unexpected refund status")
+	}
+	if !TransactionPartiallyRefunded.CanTransitionTo(TransactionRefunded) || TransactionRefunded.CanTransitionTo(TransactionSucceeded) {
+		t.Error("unexpected refund transitions")
+	}
+}
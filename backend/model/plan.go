@@ -0,0 +1,273 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Каталог тарифов хранится в таблице plans и кэшируется в памяти: функции
+// модели (GetTierLimits, FindPlan, HasSyncAccess, ...) читают текущий снимок.
+// До первой загрузки из БД действует DefaultPlans.
+
+// Флаги возможностей тарифа (Plan.Features)
+const (
+	FeatureSync            = "sync"
+	FeaturePrioritySupport = "priority_support"
+	FeatureBackup          = "backup"
+)
+
+// DefaultLanguage — язык текстов тарифа, если запрошенного нет
+const DefaultLanguage = "ru"
+
+// BillingPeriod — период, за который оплачивается тариф
+type BillingPeriod string
+
+const (
+	PeriodMonthly BillingPeriod = "monthly"
+	PeriodYearly  BillingPeriod = "yearly"
+)
+
+// Months — длина периода в календарных месяцах (0 — неизвестный период)
+func (p BillingPeriod) Months() int {
+	switch p {
+	case PeriodMonthly:
+		return 1
+	case PeriodYearly:
+		return 12
+	default:
+		return 0
+	}
+}
+
+// Valid сообщает, известен ли период
+func (p BillingPeriod) Valid() bool {
+	return p.Months() > 0
+}
+
+// Start — начало периода, который заканчивается в end (как end - make_interval(months => ...) в БД)
+func (p BillingPeriod) Start(end time.Time) time.Time {
+	return end.AddDate(0, -p.Months(), 0)
+}
+
+// PlanPrice — цена тарифа за период в валюте
+type PlanPrice struct {
+	Period   BillingPeriod `json:"period"`
+	Currency string        `json:"currency"`
+	Amount   float64       `json:"amount"`
+}
+
+// PlanDisplay — тексты тарифа на одном языке
+type PlanDisplay struct {
+	Name     string   `json:"name"`
+	Features []string `json:"features"`
+}
+
+// Plan — тариф каталога
+type Plan struct {
+	Tier         UserTier    `json:"tier"`
+	Prices       []PlanPrice `json:"prices"`    // по периодам и валютам (пусто — бесплатный тариф)
+	TrialDays    int         `json:"trialDays"` // пробный период (0 — нет)
+	StorageLimit int64       `json:"storageLimit"`
+	MaxFileSize  int64       `json:"maxFileSize"`
+	// Features — флаги возможностей (FeatureSync, ...)
+	Features map[string]bool `json:"features"`
+	// Display — тексты по языкам ("ru", "en", ...)
+	Display   map[string]PlanDisplay `json:"display"`
+	SortOrder int                    `json:"sortOrder"`
+	// Active: false — тариф нельзя купить, но он продлевается у оформивших
+	Active    bool      `json:"active"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var tierPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,31}$`)
+
+// Validate проверяет тариф перед сохранением
+func (p Plan) Validate() error {
+	var errs []error
+	if !tierPattern.MatchString(string(p.Tier)) {
+		errs = append(errs, errors.New("tier must be 2-32 lowercase letters, digits or underscores"))
+	}
+	if (p.Tier == TierFree) != (len(p.Prices) == 0) {
+		errs = append(errs, errors.New("prices must be set for paid tiers and empty for the free tier"))
+	}
+	seen := make(map[PlanPrice]bool, len(p.Prices))
+	for _, price := range p.Prices {
+		if !price.Period.Valid() {
+			errs = append(errs, fmt.Errorf("prices: unknown period %q (monthly, yearly)", price.Period))
+		}
+		if len(price.Currency) != 3 || strings.ToUpper(price.Currency) != price.Currency {
+			errs = append(errs, fmt.Errorf("prices: currency %q must be an ISO 4217 code", price.Currency))
+		}
+		if price.Amount < MinimumCharge {
+			errs = append(errs, fmt.Errorf("prices: %s %s amount must be at least %.2f", price.Period, price.Currency, MinimumCharge))
+		}
+		key := PlanPrice{Period: price.Period, Currency: price.Currency}
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("prices: duplicate %s %s price", price.Period, price.Currency))
+		}
+		seen[key] = true
+	}
+	if p.TrialDays < 0 || (p.Tier == TierFree && p.TrialDays != 0) {
+		errs = append(errs, errors.New("trialDays must not be negative (zero for the free tier)"))
+	}
+	if p.StorageLimit < 0 || p.MaxFileSize < 0 || p.MaxFileSize > p.StorageLimit {
+		errs = append(errs, errors.New("storageLimit and maxFileSize must not be negative, maxFileSize must fit into storageLimit"))
+	}
+	if _, ok := p.Display[DefaultLanguage]; !ok {
+		errs = append(errs, fmt.Errorf("display must include %q", DefaultLanguage))
+	}
+	return errors.Join(errs...)
+}
+
+// Paid сообщает, платный ли тариф
+func (p Plan) Paid() bool {
+	return len(p.Prices) > 0
+}
+
+// Price возвращает цену тарифа за period в валюте currency
+func (p Plan) Price(period BillingPeriod, currency string) (PlanPrice, bool) {
+	for _, price := range p.Prices {
+		if price.Period == period && price.Currency == currency {
+			return price, true
+		}
+	}
+	return PlanPrice{}, false
+}
+
+// Name — название тарифа на языке по умолчанию
+func (p Plan) Name() string {
+	return p.display(DefaultLanguage).Name
+}
+
+func (p Plan) display(lang string) PlanDisplay {
+	if d, ok := p.Display[lang]; ok {
+		return d
+	}
+	if d, ok := p.Display[DefaultLanguage]; ok {
+		return d
+	}
+	return PlanDisplay{Name: string(p.Tier)}
+}
+
+// Localize возвращает описание тарифа для клиента на языке lang с ценами
+// только в валютах currencies
+func (p Plan) Localize(lang string, currencies []string) SubscriptionPlan {
+	d := p.display(lang)
+	prices := []PlanPrice{}
+	for _, price := range p.Prices {
+		if slices.Contains(currencies, price.Currency) {
+			prices = append(prices, price)
+		}
+	}
+	return SubscriptionPlan{
+		Tier:        p.Tier,
+		Name:        d.Name,
+		Prices:      prices,
+		TrialDays:   p.TrialDays,
+		Storage:     formatSize(p.StorageLimit),
+		MaxFileSize: formatSize(p.MaxFileSize),
+		Features:    d.Features,
+	}
+}
+
+func formatSize(bytes int64) string {
+	const gb, mb = 1 << 30, 1 << 20
+	if bytes >= gb && bytes%gb == 0 {
+		return fmt.Sprintf("%d GB", bytes/gb)
+	}
+	return fmt.Sprintf("%d MB", bytes/mb)
+}
+
+// Catalog — неизменяемый снимок каталога тарифов
+type Catalog struct {
+	plans  []Plan
+	byTier map[UserTier]Plan
+}
+
+// NewCatalog упорядочивает тарифы по SortOrder
+func NewCatalog(plans []Plan) *Catalog {
+	c := &Catalog{plans: append([]Plan(nil), plans...), byTier: make(map[UserTier]Plan, len(plans))}
+	sort.SliceStable(c.plans, func(i, j int) bool { return c.plans[i].SortOrder < c.plans[j].SortOrder })
+	for _, p := range c.plans {
+		c.byTier[p.Tier] = p
+	}
+	return c
+}
+
+// Plan возвращает тариф (в том числе неактивный)
+func (c *Catalog) Plan(tier UserTier) (Plan, bool) {
+	p, ok := c.byTier[tier]
+	return p, ok
+}
+
+// Plans возвращает все тарифы по порядку
+func (c *Catalog) Plans() []Plan {
+	return append([]Plan(nil), c.plans...)
+}
+
+var catalog atomic.Pointer[Catalog]
+
+func init() {
+	catalog.Store(NewCatalog(DefaultPlans()))
+}
+
+// SetCatalog заменяет текущий каталог (после загрузки из БД)
+func SetCatalog(c *Catalog) {
+	catalog.Store(c)
+}
+
+// CurrentCatalog возвращает текущий снимок каталога
+func CurrentCatalog() *Catalog {
+	return catalog.Load()
+}
+
+// DefaultPlans — начальный каталог (совпадает с тарифами, которые init.sql
+// записывает в plans)
+func DefaultPlans() []Plan {
+	return []Plan{
+		{
+			Tier: TierFree, SortOrder: 0, Active: true,
+			Features: map[string]bool{},
+			Display: map[string]PlanDisplay{
+				"ru": {Name: "Free", Features: []string{"Заметки на одном устройстве"}},
+				"en": {Name: "Free", Features: []string{"Notes on a single device"}},
+			},
+		},
+		{
+			Tier: TierStart, SortOrder: 1, Active: true,
+			Prices:       []PlanPrice{{PeriodMonthly, "RUB", 99}, {PeriodYearly, "RUB", 990}},
+			StorageLimit: 5 << 30, MaxFileSize: 100 << 20,
+			Features: map[string]bool{FeatureSync: true},
+			Display: map[string]PlanDisplay{
+				"ru": {Name: "Start", Features: []string{"Синхронизация между устройствами", "Облачное хранилище 5 GB", "Максимальный размер файла 100 MB"}},
+				"en": {Name: "Start", Features: []string{"Sync across devices", "5 GB cloud storage", "Files up to 100 MB"}},
+			},
+		},
+		{
+			Tier: TierMedium, SortOrder: 2, Active: true,
+			Prices:       []PlanPrice{{PeriodMonthly, "RUB", 299}, {PeriodYearly, "RUB", 2990}},
+			StorageLimit: 50 << 30, MaxFileSize: 500 << 20,
+			Features: map[string]bool{FeatureSync: true, FeaturePrioritySupport: true},
+			Display: map[string]PlanDisplay{
+				"ru": {Name: "Medium", Features: []string{"Синхронизация между устройствами", "Облачное хранилище 50 GB", "Максимальный размер файла 500 MB", "Приоритетная поддержка"}},
+				"en": {Name: "Medium", Features: []string{"Sync across devices", "50 GB cloud storage", "Files up to 500 MB", "Priority support"}},
+			},
+		},
+		{
+			Tier: TierUltra, SortOrder: 3, Active: true,
+			Prices:       []PlanPrice{{PeriodMonthly, "RUB", 999}, {PeriodYearly, "RUB", 9990}},
+			StorageLimit: 200 << 30, MaxFileSize: 5 << 30,
+			Features: map[string]bool{FeatureSync: true, FeaturePrioritySupport: true, FeatureBackup: true},
+			Display: map[string]PlanDisplay{
+				"ru": {Name: "Ultra", Features: []string{"Синхронизация между устройствами", "Облачное хранилище 200 GB", "Максимальный размер файла 5 GB", "Приоритетная поддержка", "Резервное копирование"}},
+				"en": {Name: "Ultra", Features: []string{"Sync across devices", "200 GB cloud storage", "Files up to 5 GB", "Priority support", "Backups"}},
+			},
+		},
+	}
+}
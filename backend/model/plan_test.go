@@ -0,0 +1,76 @@
+package model
+
+import "testing"
+
+func TestCatalogSnapshot(t *testing.T) {
+	defer SetCatalog(NewCatalog(DefaultPlans()))
+
+	plans := DefaultPlans()
+	plans[1].Active = false // start снят с продажи
+	plans[3].StorageLimit = 300 << 30
+	SetCatalog(NewCatalog(plans))
+
+	if got, _ := GetTierLimits(TierUltra); got != 300<<30 {
+		t.Errorf("ultra storage limit = %d, want %d", got, int64(300<<30))
+	}
+	if _, ok := FindPlan(TierStart); !ok {
+		t.Error("inactive plan must still be found for renewals")
+	}
+	if _, ok := FindPlan(TierFree); ok {
+		t.Error("free plan must not be purchasable")
+	}
+	for _, p := range GetSubscriptionPlans("en", []string{"RUB"}) {
+		if p.Tier == TierStart {
+			t.Error("inactive plan must not be listed")
+		}
+	}
+	if IsValidTier("gold") {
+		t.Error("unknown tier must be invalid")
+	}
+}
+
+func TestPlanLocalize(t *testing.T) {
+	ultra, _ := FindPlan(TierUltra)
+
+	if got := ultra.Localize("en", []string{"RUB"}); got.Features[0] != "Sync across devices" || got.Storage != "200 GB" || got.MaxFileSize != "5 GB" || len(got.Prices) != 2 {
+		t.Errorf("Localize(en) = %+v", got)
+	}
+	// Неизвестный язык — тексты на языке по умолчанию
+	if got := ultra.Localize("de", []string{"RUB"}); got.Features[0] != ultra.Display[DefaultLanguage].Features[0] {
+		t.Errorf("Localize(de) = %+v", got)
+	}
+	// Цены только в принимаемых валютах
+	if got := ultra.Localize("en", []string{"USD"}); len(got.Prices) != 0 {
+		t.Errorf("Localize(USD) = %+v", got)
+	}
+}
+
+func TestPlanValidate(t *testing.T) {
+	valid, _ := FindPlan(TierMedium)
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("default plan is invalid: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *Plan)
+	}{
+		{"bad tier", func(p *Plan) { p.Tier = "Gold!" }},
+		{"no prices", func(p *Plan) { p.Prices = nil }},
+		{"zero price", func(p *Plan) { p.Prices = []PlanPrice{{PeriodMonthly, "RUB", 0}} }},
+		{"bad currency", func(p *Plan) { p.Prices = []PlanPrice{{PeriodMonthly, "rubles", 299}} }},
+		{"unknown period", func(p *Plan) { p.Prices = []PlanPrice{{"weekly", "RUB", 99}} }},
+		{"duplicate price", func(p *Plan) { p.Prices = []PlanPrice{{PeriodMonthly, "RUB", 299}, {PeriodMonthly, "RUB", 199}} }},
+		{"file larger than storage", func(p *Plan) { p.MaxFileSize = p.StorageLimit + 1 }},
+		{"no default language", func(p *Plan) { p.Display = map[string]PlanDisplay{"en": {Name: "Medium"}} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.modify(&p)
+			if err := p.Validate(); err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
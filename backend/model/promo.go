@@ -0,0 +1,118 @@
+package model
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Промокоды дают скидку на первую оплату тарифа (продления идут по полной
+// цене); пробный период включает платный тариф без оплаты один раз на аккаунт.
+
+// Ошибки применения промокода
+var (
+	ErrCouponNotFound      = errors.New("coupon not found")
+	ErrCouponExpired       = errors.New("coupon has expired")
+	ErrCouponNotApplicable = errors.New("coupon does not apply to this plan")
+	ErrCouponExhausted     = errors.New("coupon has been fully redeemed")
+	ErrCouponAlreadyUsed   = errors.New("coupon has already been used")
+)
+
+// Coupon — промокод со скидкой в процентах (PercentOff) или фиксированной
+// суммой (AmountOff в валюте Currency)
+type Coupon struct {
+	Code       string  `json:"code"`
+	PercentOff int     `json:"percentOff,omitempty"`
+	AmountOff  float64 `json:"amountOff,omitempty"`
+	Currency   string  `json:"currency,omitempty"`
+	// Tiers — тарифы, к которым применяется промокод (пусто — любой платный)
+	Tiers     []UserTier `json:"tiers"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// MaxRedemptions — сколько раз промокод можно использовать всего (0 — без ограничения)
+	MaxRedemptions int `json:"maxRedemptions"`
+	PerUserLimit   int `json:"perUserLimit"`
+	// Redemptions — использования, включая еще не оплаченные платежи (только чтение)
+	Redemptions int       `json:"redemptions"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// NormalizeCouponCode приводит введенный пользователем промокод к виду, в котором он хранится
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate проверяет промокод перед сохранением
+func (c Coupon) Validate() error {
+	var errs []error
+	if !couponCodePattern.MatchString(c.Code) {
+		errs = append(errs, errors.New("code must be 3-32 uppercase letters, digits, dashes or underscores"))
+	}
+	switch {
+	case c.PercentOff != 0 && c.AmountOff != 0:
+		errs = append(errs, errors.New("set either percentOff or amountOff, not both"))
+	case c.PercentOff != 0:
+		if c.PercentOff < 1 || c.PercentOff > 100 {
+			errs = append(errs, errors.New("percentOff must be between 1 and 100"))
+		}
+	case c.AmountOff > 0:
+		if len(c.Currency) != 3 {
+			errs = append(errs, errors.New("amountOff needs an ISO 4217 currency"))
+		}
+	default:
+		errs = append(errs, errors.New("percentOff or amountOff must be positive"))
+	}
+	if c.MaxRedemptions < 0 {
+		errs = append(errs, errors.New("maxRedemptions must not be negative"))
+	}
+	if c.PerUserLimit < 1 {
+		errs = append(errs, errors.New("perUserLimit must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// Check проверяет, что промокод можно применить к цене price тарифа plan
+// сейчас (без учета числа использований — его проверяет хранилище)
+func (c Coupon) Check(plan Plan, price PlanPrice, now time.Time) error {
+	if !c.Active {
+		return ErrCouponNotFound
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return ErrCouponExpired
+	}
+	if len(c.Tiers) > 0 && !slices.Contains(c.Tiers, plan.Tier) {
+		return ErrCouponNotApplicable
+	}
+	if c.AmountOff > 0 && c.Currency != price.Currency {
+		return ErrCouponNotApplicable
+	}
+	return nil
+}
+
+// Apply возвращает цену со скидкой. Платеж не может быть меньше MinimumCharge:
+// бесплатный доступ дает пробный период, а не промокод.
+func (c Coupon) Apply(price float64) float64 {
+	discounted := price - c.AmountOff
+	if c.PercentOff > 0 {
+		discounted = price * float64(100-c.PercentOff) / 100
+	}
+	return math.Max(roundMoney(discounted), MinimumCharge)
+}
+
+// Trial — пробный период пользователя (не более одного на аккаунт)
+type Trial struct {
+	UserID    string    `json:"userId"`
+	Tier      UserTier  `json:"tier"`
+	StartedAt time.Time `json:"startedAt"`
+	EndsAt    time.Time `json:"endsAt"`
+}
+
+// Active сообщает, идет ли пробный период сейчас
+func (t Trial) Active(now time.Time) bool {
+	return now.Before(t.EndsAt)
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCouponApply(t *testing.T) {
+	medium, _ := FindPlan(TierMedium)
+	price, _ := medium.Price(PeriodMonthly, "RUB")
+	tests := []struct {
+		name   string
+		coupon Coupon
+		want   float64
+	}{
+		{"percent", Coupon{PercentOff: 50}, 149.5},
+		{"odd percent", Coupon{PercentOff: 33}, 200.33},
+		{"fixed", Coupon{AmountOff: 100, Currency: "RUB"}, 199},
+		{"not below minimum charge", Coupon{AmountOff: 500, Currency: "RUB"}, MinimumCharge},
+		{"full discount", Coupon{PercentOff: 100}, MinimumCharge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.coupon.Apply(price.Amount); got != tt.want {
+				t.Errorf("Apply(%v) = %v, want %v", price.Amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCouponCheck(t *testing.T) {
+	start, _ := FindPlan(TierStart)
+	price, _ := start.Price(PeriodYearly, "RUB")
+	now := time.Now()
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		coupon Coupon
+		want   error
+	}{
+		{"valid", Coupon{PercentOff: 10, Active: true}, nil},
+		{"inactive", Coupon{PercentOff: 10}, ErrCouponNotFound},
+		{"expired", Coupon{PercentOff: 10, Active: true, ExpiresAt: &past}, ErrCouponExpired},
+		{"other tier", Coupon{PercentOff: 10, Active: true, Tiers: []UserTier{TierUltra}}, ErrCouponNotApplicable},
+		{"other currency", Coupon{AmountOff: 5, Currency: "USD", Active: true}, ErrCouponNotApplicable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.coupon.Check(start, price, now); !errors.Is(err, tt.want) {
+				t.Errorf("Check() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// LoginLockout — аккаунт с неудачными попытками входа (для администратора)
+type LoginLockout struct {
+	UserID       string     `json:"userId"`
+	Email        string     `json:"email"`
+	FailedCount  int        `json:"failedCount"`
+	LastFailedAt time.Time  `json:"lastFailedAt"`
+	BlockedUntil *time.Time `json:"blockedUntil"`
+	Locked       bool       `json:"locked"`
+}
+
+// Notification — уведомление пользователя в приложении
+type Notification struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ReadAt    *time.Time `json:"readAt"`
+}
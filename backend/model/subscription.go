@@ -16,38 +16,22 @@ const (
 	TierUltra  UserTier = "ultra"
 )
 
-// IsValidTier checks if tier is valid
+// IsValidTier checks if tier is in the plan catalog
 func IsValidTier(tier string) bool {
-	switch UserTier(tier) {
-	case TierFree, TierStart, TierMedium, TierUltra:
-		return true
-	default:
-		return false
-	}
+	_, ok := CurrentCatalog().Plan(UserTier(tier))
+	return ok
 }
 
-// GetTierLimits returns storage limit and max file size for a tier
+// GetTierLimits returns storage limit and max file size for a tier (0, 0 for unknown tiers)
 func GetTierLimits(tier UserTier) (storageLimit int64, maxFileSize int64) {
-	switch tier {
-	case TierFree:
-		return 0, 0 // No cloud storage for free tier
-	case TierStart:
-		return 5 * 1024 * 1024 * 1024, // 5 GB
-			100 * 1024 * 1024 // 100 MB
-	case TierMedium:
-		return 50 * 1024 * 1024 * 1024, // 50 GB
-			500 * 1024 * 1024 // 500 MB
-	case TierUltra:
-		return 200 * 1024 * 1024 * 1024, // 200 GB
-			5 * 1024 * 1024 * 1024 // 5 GB
-	default:
-		return 0, 0
-	}
+	plan, _ := CurrentCatalog().Plan(tier)
+	return plan.StorageLimit, plan.MaxFileSize
 }
 
 // HasSyncAccess returns true if tier has sync access
 func (t UserTier) HasSyncAccess() bool {
-	return t != TierFree
+	plan, _ := CurrentCatalog().Plan(t)
+	return plan.Features[FeatureSync]
 }
 
 // TransactionStatus represents payment transaction status
@@ -58,6 +42,9 @@ const (
 	TransactionSucceeded TransactionStatus = "succeeded"
 	TransactionCanceled  TransactionStatus = "canceled"
 	TransactionFailed    TransactionStatus = "failed"
+	// Возвращена часть оплаты (возврат или чарджбэк) / вся оплата
+	TransactionPartiallyRefunded TransactionStatus = "partially_refunded"
+	TransactionRefunded          TransactionStatus = "refunded"
 )
 
 // Transaction represents a payment transaction
@@ -68,10 +55,13 @@ type Transaction struct {
 	Tier      UserTier          `json:"tier"`
 	Amount    float64           `json:"amount"`
 	Currency  string            `json:"currency"`
+	Period    BillingPeriod     `json:"period"`
 	Status    TransactionStatus `json:"status"`
-	Metadata  json.RawMessage   `json:"metadata"`
-	CreatedAt time.Time         `json:"createdAt"`
-	UpdatedAt time.Time         `json:"updatedAt"`
+	// RefundedAmount — сумма возвратов и чарджбэков по транзакции
+	RefundedAmount float64         `json:"refundedAmount"`
+	Metadata       json.RawMessage `json:"metadata"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
 }
 
 // UserProfile represents user subscription profile
@@ -86,6 +76,9 @@ type UserProfile struct {
 	FreeSince             *time.Time `json:"freeSince,omitempty"`
 	CleanupWarningDate    *time.Time `json:"cleanupWarningDate,omitempty"` // Date when files will be deleted (free_since + 90 days)
 	HasSyncAccess         bool       `json:"hasSyncAccess"`
+	// OverQuota — файлы занимают больше лимита тарифа (например, после возврата
+	// оплаты): новые файлы не загружаются, пока пользователь не удалит лишние
+	OverQuota bool `json:"overQuota"`
 }
 
 // NewUserProfile creates a UserProfile from database fields
@@ -121,49 +114,42 @@ func NewUserProfile(userID string, tier string, storageLimit, storageUsed int64,
 		FreeSince:             freeSincePtr,
 		CleanupWarningDate:    cleanupWarningDate,
 		HasSyncAccess:         userTier.HasSyncAccess(),
+		OverQuota:             storageUsed > storageLimit,
 	}
 }
 
 // SubscriptionPlan represents a subscription plan for display
 type SubscriptionPlan struct {
-	Tier        UserTier `json:"tier"`
-	Name        string   `json:"name"`
-	Price       float64  `json:"price"`
-	Currency    string   `json:"currency"`
-	Storage     string   `json:"storage"`
-	MaxFileSize string   `json:"maxFileSize"`
-	Features    []string `json:"features"`
+	Tier        UserTier    `json:"tier"`
+	Name        string      `json:"name"`
+	Prices      []PlanPrice `json:"prices"`
+	TrialDays   int         `json:"trialDays,omitempty"`
+	Storage     string      `json:"storage"`
+	MaxFileSize string      `json:"maxFileSize"`
+	Features    []string    `json:"features"`
+}
+
+// GetSubscriptionPlans returns plans available for purchase in the given
+// currencies, localized to lang
+func GetSubscriptionPlans(lang string, currencies []string) []SubscriptionPlan {
+	var plans []SubscriptionPlan
+	for _, plan := range CurrentCatalog().Plans() {
+		if !plan.Active || !plan.Paid() {
+			continue
+		}
+		if p := plan.Localize(lang, currencies); len(p.Prices) > 0 {
+			plans = append(plans, p)
+		}
+	}
+	return plans
 }
 
-// GetSubscriptionPlans returns available subscription plans
-func GetSubscriptionPlans() []SubscriptionPlan {
-	return []SubscriptionPlan{
-		{
-			Tier:        TierStart,
-			Name:        "Start",
-			Price:       99.0,
-			Currency:    "RUB",
-			Storage:     "5 GB",
-			MaxFileSize: "100 MB",
-			Features:    []string{"Синхронизация между устройствами", "Облачное хранилище 5 GB", "Максимальный размер файла 100 MB"},
-		},
-		{
-			Tier:        TierMedium,
-			Name:        "Medium",
-			Price:       299.0,
-			Currency:    "RUB",
-			Storage:     "50 GB",
-			MaxFileSize: "500 MB",
-			Features:    []string{"Синхронизация между устройствами", "Облачное хранилище 50 GB", "Максимальный размер файла 500 MB", "Приоритетная поддержка"},
-		},
-		{
-			Tier:        TierUltra,
-			Name:        "Ultra",
-			Price:       999.0,
-			Currency:    "RUB",
-			Storage:     "200 GB",
-			MaxFileSize: "5 GB",
-			Features:    []string{"Синхронизация между устройствами", "Облачное хранилище 200 GB", "Максимальный размер файла 5 GB", "Приоритетная поддержка", "Резервное копирование"},
-		},
+// FindPlan returns the catalog plan for a paid tier (inactive plans included:
+// they still renew for existing subscribers)
+func FindPlan(tier UserTier) (Plan, bool) {
+	plan, ok := CurrentCatalog().Plan(tier)
+	if !ok || !plan.Paid() {
+		return Plan{}, false
 	}
+	return plan, true
 }
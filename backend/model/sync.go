@@ -0,0 +1,44 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// SyncCursor — позиция в потоке изменений синхронизации: изменения
+// упорядочены по (server_updated_at, id), курсор указывает на последнее
+// полученное. ID пуст, если известно только время (since из REST pull).
+type SyncCursor struct {
+	Time time.Time
+	ID   string
+}
+
+// ErrInvalidSyncCursor — курсор не разобран
+var ErrInvalidSyncCursor = errors.New("invalid sync cursor")
+
+// ParseSyncCursor разбирает курсор вида "<RFC 3339>" или "<RFC 3339>|<id>"
+func ParseSyncCursor(s string) (SyncCursor, error) {
+	ts, id, _ := strings.Cut(s, "|")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return SyncCursor{}, ErrInvalidSyncCursor
+	}
+	return SyncCursor{Time: t, ID: id}, nil
+}
+
+func (c SyncCursor) String() string {
+	s := c.Time.UTC().Format(time.RFC3339Nano)
+	if c.ID != "" {
+		s += "|" + c.ID
+	}
+	return s
+}
+
+// Before сообщает, что c идет в потоке раньше other
+func (c SyncCursor) Before(other SyncCursor) bool {
+	if !c.Time.Equal(other.Time) {
+		return c.Time.Before(other.Time)
+	}
+	return c.ID < other.ID
+}
@@ -74,4 +74,47 @@ type AuthResponse struct {
 	UserID       string `json:"user_id"`
 	StorageLimit int64  `json:"storageLimit"`
 	StorageUsed  int64  `json:"storageUsed"`
-}
\ No newline at end of file
+}
+
+// SigningKey — ключ подписи access-токенов. Приватная часть хранится зашифрованной.
+// Ключ публикуется в JWKS с момента создания, подписывает токены в интервале
+// [NotBefore, RetiresAt) и остается в JWKS до ExpiresAt, пока живут выданные им токены.
+type SigningKey struct {
+	KID        string
+	Algorithm  string
+	PublicKey  []byte
+	PrivateKey []byte // зашифрован
+	KEKID      string // идентификатор секрета, которым зашифрован PrivateKey
+	CreatedAt  time.Time
+	NotBefore  time.Time
+	RetiresAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// PersonalAccessToken — именованный токен для публичного API. В БД хранится только
+// хеш; сам токен показывается пользователю один раз при создании.
+type PersonalAccessToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // первые символы токена, чтобы пользователь мог его узнать
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowedIps"` // CIDR; пусто = любой адрес
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	LastUsedIP *string    `json:"lastUsedIp"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+type CreateTokenRequest struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	AllowedIPs []string   `json:"allowedIps"`
+}
+
+type CreateTokenResponse struct {
+	Token string `json:"token"`
+	PersonalAccessToken
+}
@@ -0,0 +1,305 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP — минимальный OpenID Provider: discovery, JWKS и token endpoint.
+// Коды авторизации выдает Authorize, как будто пользователь вошел в IdP.
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu         sync.Mutex
+	key        *rsa.PrivateKey
+	kid        string
+	codes      map[string]mockCode
+	jwksHits   int
+	claimsHook func(jwt.MapClaims)
+}
+
+type mockCode struct {
+	challenge, nonce, subject, email string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	idp := &mockIdP{t: t, codes: make(map[string]mockCode)}
+	idp.rotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	// Провайдер, который отдает metadata чужого issuer
+	mux.HandleFunc("/tenant/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		idp.jwksHits++
+		pub := idp.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, secret, _ := r.BasicAuth()
+		idp.mu.Lock()
+		code, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		switch {
+		case clientID != "glyf" || secret != "s3cret":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		case !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		default:
+			json.NewEncoder(w).Encode(map[string]string{
+				"access_token": "opaque",
+				"token_type":   "Bearer",
+				"id_token":     idp.idToken(code),
+			})
+		}
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) rotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.key = key
+	idp.kid = base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()[:8])
+	idp.mu.Unlock()
+}
+
+func (idp *mockIdP) idToken(code mockCode) string {
+	claims := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            code.subject,
+		"aud":            "glyf",
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          code.nonce,
+		"email":          code.email,
+		"email_verified": true,
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	if idp.claimsHook != nil {
+		idp.claimsHook(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed
+}
+
+// Authorize имитирует вход пользователя на странице IdP по адресу authURL
+func (idp *mockIdP) Authorize(authURL, subject, email string) (code, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+		idp.t.Fatalf("unexpected authorization request: %s", authURL)
+	}
+	code = "code-" + subject
+	idp.mu.Lock()
+	idp.codes[code] = mockCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), subject: subject, email: email}
+	idp.mu.Unlock()
+	return code, q.Get("state")
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+const verifier = "dBjftJeZ4CVP-mJ92ZvmRpCiVsgW1lK7wtIdrWQsTjXk"
+
+func newTestProvider(idp *mockIdP) *Provider {
+	return NewProvider(Config{
+		Issuer:       idp.server.URL,
+		ClientID:     "glyf",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"email", "profile"},
+		RedirectURL:  "https://api.example.com/auth/oidc/corp/callback",
+	}, idp.server.Client())
+}
+
+func login(t *testing.T, p *Provider, idp *mockIdP, subject string) (*IDToken, error) {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), "state1", "nonce1", challenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := idp.Authorize(authURL, subject, subject+"@corp.example")
+	if state != "state1" {
+		t.Fatalf("state = %q", state)
+	}
+	return p.Exchange(context.Background(), code, verifier, "nonce1")
+}
+
+func TestExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(idp)
+
+	token, err := login(t, p, idp, "alice")
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if token.Subject != "alice" || token.Email != "alice@corp.example" || !token.EmailVerified || token.Issuer != idp.server.URL {
+		t.Errorf("unexpected id token: %+v", token)
+	}
+
+	// Код одноразовый
+	if _, err := p.Exchange(context.Background(), "code-alice", verifier, "nonce1"); !errors.Is(err, ErrExchange) {
+		t.Errorf("expected ErrExchange for reused code, got %v", err)
+	}
+}
+
+func TestExchange_WrongVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(idp)
+
+	authURL, _ := p.AuthCodeURL(context.Background(), "s", "n", challenge(verifier))
+	code, _ := idp.Authorize(authURL, "alice", "alice@corp.example")
+	if _, err := p.Exchange(context.Background(), code, verifier+"x", "n"); !errors.Is(err, ErrExchange) {
+		t.Errorf("expected ErrExchange, got %v", err)
+	}
+}
+
+func TestVerifyIDToken_Rejects(t *testing.T) {
+	tests := map[string]func(jwt.MapClaims){
+		"wrong audience": func(c jwt.MapClaims) { c["aud"] = "other-client" },
+		"wrong issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example" },
+		"expired":        func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-5 * time.Minute).Unix() },
+		"no expiry":      func(c jwt.MapClaims) { delete(c, "exp") },
+		"wrong nonce":    func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+		"azp mismatch":   func(c jwt.MapClaims) { c["aud"] = []string{"glyf", "other"}; c["azp"] = "other" },
+	}
+	for name, hook := range tests {
+		t.Run(name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			idp.claimsHook = hook
+			if _, err := login(t, newTestProvider(idp), idp, "alice"); !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("expected ErrInvalidIDToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDToken_ForgedSignature(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(idp)
+	if _, err := login(t, p, idp, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Токен подписан чужим ключом с kid провайдера
+	foreign, _ := rsa.GenerateKey(rand.Reader, 2048)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": idp.server.URL, "sub": "mallory", "aud": "glyf", "nonce": "n",
+		"exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix(),
+	})
+	token.Header["kid"] = idp.kid
+	forged, _ := token.SignedString(foreign)
+	if _, err := p.VerifyIDToken(context.Background(), forged, "n"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("expected ErrInvalidIDToken, got %v", err)
+	}
+
+	// HS256 с открытым ключом в качестве секрета
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": idp.server.URL, "sub": "mallory", "aud": "glyf", "nonce": "n",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	hs.Header["kid"] = idp.kid
+	hsToken, _ := hs.SignedString(idp.key.PublicKey.N.Bytes())
+	if _, err := p.VerifyIDToken(context.Background(), hsToken, "n"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("expected ErrInvalidIDToken for HS256, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(idp)
+	clock := time.Now()
+	p.now = func() time.Time { return clock }
+
+	if _, err := login(t, p, idp, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// IdP сменил ключ: неизвестный kid приводит к перезапросу JWKS
+	idp.rotateKey()
+	clock = clock.Add(2 * jwksMinRefresh)
+	if _, err := login(t, p, idp, "bob"); err != nil {
+		t.Fatalf("login after key rotation failed: %v", err)
+	}
+	if idp.jwksHits != 2 {
+		t.Errorf("expected 2 JWKS fetches, got %d", idp.jwksHits)
+	}
+
+	// Токены с неизвестным kid не вызывают перезапрос чаще jwksMinRefresh
+	idp.rotateKey()
+	login(t, p, idp, "carol")
+	login(t, p, idp, "dave")
+	if idp.jwksHits != 2 {
+		t.Errorf("JWKS refetched too often: %d fetches", idp.jwksHits)
+	}
+}
+
+func TestDiscovery_IssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	p := NewProvider(Config{Issuer: idp.server.URL + "/tenant", ClientID: "glyf"}, idp.server.Client())
+	if _, err := p.AuthCodeURL(context.Background(), "s", "n", challenge(verifier)); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("expected issuer mismatch, got %v", err)
+	}
+}
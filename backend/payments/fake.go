@@ -0,0 +1,474 @@
+package payments
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FakeServer эмулирует API YooKassa v3 на 127.0.0.1: платежи, подтверждение,
+// отмену, возвраты, сохраненные способы оплаты и ключи идемпотентности.
+// Страница оплаты ({URL}/confirm/{id}) сразу «оплачивает» платеж картой и
+// возвращает пользователя на return_url, поэтому весь сценарий покупки
+// проверяется без сети.
+type FakeServer struct {
+	// URL — адрес сервера; API доступен по URL + "/v3"
+	URL string
+
+	shopID    string
+	secretKey string
+	srv       *httptest.Server
+
+	mu         sync.Mutex
+	payments   map[string]*fakePayment
+	refunds    map[string]*Refund
+	methods    map[string]bool         // сохраненные способы оплаты -> списания отклоняются
+	idempotent map[string]fakeResponse // ключ идемпотентности -> первый ответ
+}
+
+type fakePayment struct {
+	Payment
+	capture    bool
+	saveMethod bool
+}
+
+type fakeResponse struct {
+	request string // метод, путь и тело первого запроса
+	status  int
+	body    []byte
+}
+
+// NewFakeServer запускает эмулятор с учетными данными магазина shopID:secretKey
+func NewFakeServer(shopID, secretKey string) *FakeServer {
+	f := &FakeServer{
+		shopID:     shopID,
+		secretKey:  secretKey,
+		payments:   make(map[string]*fakePayment),
+		refunds:    make(map[string]*Refund),
+		methods:    make(map[string]bool),
+		idempotent: make(map[string]fakeResponse),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v3/payments", f.api(f.createPayment))
+	mux.HandleFunc("GET /v3/payments/{id}", f.api(f.getPayment))
+	mux.HandleFunc("POST /v3/payments/{id}/capture", f.api(f.capturePayment))
+	mux.HandleFunc("POST /v3/payments/{id}/cancel", f.api(f.cancelPayment))
+	mux.HandleFunc("POST /v3/refunds", f.api(f.createRefund))
+	mux.HandleFunc("GET /v3/refunds/{id}", f.api(f.getRefund))
+	mux.HandleFunc("GET /confirm/{id}", f.handleConfirm)
+
+	f.srv = httptest.NewServer(mux)
+	f.URL = f.srv.URL
+	return f
+}
+
+// Close останавливает сервер
+func (f *FakeServer) Close() {
+	f.srv.Close()
+}
+
+// Config возвращает параметры клиента YooKassa для этого сервера
+func (f *FakeServer) Config() Config {
+	return Config{ShopID: f.shopID, SecretKey: f.secretKey, BaseURL: f.URL + "/v3"}
+}
+
+// Confirm эмулирует оплату платежа пользователем
+func (f *FakeServer) Confirm(paymentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return errors.New("payment not found")
+	}
+	if p.Status != StatusPending {
+		return fmt.Errorf("payment is %s", p.Status)
+	}
+	p.PaymentMethod = &PaymentMethod{Type: "bank_card", ID: uuid.New().String(), Saved: p.saveMethod, Title: "Bank card *4444"}
+	if p.saveMethod {
+		f.methods[p.PaymentMethod.ID] = false
+	}
+	p.markPaid()
+	return nil
+}
+
+// DeclineMethod заставляет отклонять (declined = true) или снова принимать
+// списания сохраненным способом оплаты
+func (f *FakeServer) DeclineMethod(methodID string, declined bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.methods[methodID] = declined
+}
+
+func (p *fakePayment) markPaid() {
+	p.Paid = true
+	if p.capture {
+		p.succeed()
+	} else {
+		p.Status = StatusWaitingForCapture
+	}
+}
+
+// Decline эмулирует отказ в оплате (например, недостаточно средств)
+func (f *FakeServer) Decline(paymentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[paymentID]
+	if !ok {
+		return errors.New("payment not found")
+	}
+	if p.Status != StatusPending {
+		return fmt.Errorf("payment is %s", p.Status)
+	}
+	p.decline()
+	return nil
+}
+
+// succeed завершает платеж; чек считается отправленным в кассу
+func (p *fakePayment) succeed() {
+	now := time.Now().UTC()
+	p.Status = StatusSucceeded
+	p.CapturedAt = &now
+	if p.ReceiptRegistration != "" {
+		p.ReceiptRegistration = StatusSucceeded
+	}
+}
+
+func (p *fakePayment) decline() {
+	p.Status = StatusCanceled
+	p.CancellationDetails = &CancellationDetails{Party: "payment_network", Reason: "insufficient_funds"}
+}
+
+// handleConfirm — страница оплаты: ?result=decline отклоняет платеж
+func (f *FakeServer) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var err error
+	if r.URL.Query().Get("result") == "decline" {
+		err = f.Decline(id)
+	} else {
+		err = f.Confirm(id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	returnURL := f.payments[id].Confirmation.ReturnURL
+	f.mu.Unlock()
+	http.Redirect(w, r, returnURL, http.StatusFound)
+}
+
+// fakeHandler обрабатывает запрос к API: возвращает статус и тело ответа
+type fakeHandler func(r *http.Request, body []byte) (int, interface{})
+
+// api проверяет аутентификацию и ключ идемпотентности. Повтор POST с тем же
+// ключом возвращает первый ответ; тот же ключ с другим запросом — ошибка.
+func (f *FakeServer) api(handle fakeHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if shopID, secret, ok := r.BasicAuth(); !ok || shopID != f.shopID || secret != f.secretKey {
+			writeFake(w, http.StatusUnauthorized, fakeError("invalid_credentials", "Authentication by given credentials failed", ""))
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeFake(w, http.StatusBadRequest, fakeError("invalid_request", "Failed to read request body", ""))
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			status, resp := handle(r, body)
+			writeFake(w, status, resp)
+			return
+		}
+
+		key := r.Header.Get("Idempotence-Key")
+		if key == "" {
+			writeFake(w, http.StatusBadRequest, fakeError("invalid_request", "Idempotence key is required", "Idempotence-Key"))
+			return
+		}
+		request := r.Method + " " + r.URL.Path + " " + string(bytes.TrimSpace(body))
+
+		f.mu.Lock()
+		prev, seen := f.idempotent[key]
+		f.mu.Unlock()
+		if seen {
+			if prev.request != request {
+				writeFake(w, http.StatusBadRequest, fakeError("invalid_request", "Idempotence key duplicated with another request", "Idempotence-Key"))
+				return
+			}
+			writeRaw(w, prev.status, prev.body)
+			return
+		}
+
+		status, resp := handle(r, body)
+		data, _ := json.Marshal(resp)
+		f.mu.Lock()
+		f.idempotent[key] = fakeResponse{request: request, status: status, body: data}
+		f.mu.Unlock()
+		writeRaw(w, status, data)
+	}
+}
+
+func (f *FakeServer) createPayment(r *http.Request, body []byte) (int, interface{}) {
+	var req struct {
+		Amount            Amount            `json:"amount"`
+		Capture           bool              `json:"capture"`
+		Description       string            `json:"description"`
+		Confirmation      *Confirmation     `json:"confirmation"`
+		Metadata          map[string]string `json:"metadata"`
+		SavePaymentMethod bool              `json:"save_payment_method"`
+		PaymentMethodID   string            `json:"payment_method_id"`
+		Receipt           *Receipt          `json:"receipt"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return http.StatusBadRequest, fakeError("invalid_request", "Invalid JSON", "")
+	}
+	if minor, err := req.Amount.minor(); err != nil || minor <= 0 {
+		return http.StatusBadRequest, fakeError("invalid_request", "Invalid amount value", "amount.value")
+	}
+	if req.Amount.Currency == "" {
+		return http.StatusBadRequest, fakeError("invalid_request", "Currency is required", "amount.currency")
+	}
+	if req.Receipt != nil {
+		if param, description := checkFakeReceipt(req.Receipt, req.Amount); param != "" {
+			return http.StatusBadRequest, fakeError("invalid_request", description, param)
+		}
+	}
+	if req.PaymentMethodID == "" {
+		if req.Confirmation == nil || req.Confirmation.Type != "redirect" {
+			return http.StatusBadRequest, fakeError("invalid_request", "Unsupported confirmation type", "confirmation.type")
+		}
+		if u, err := url.Parse(req.Confirmation.ReturnURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return http.StatusBadRequest, fakeError("invalid_request", "Invalid return_url", "confirmation.return_url")
+		}
+	}
+
+	id := uuid.New().String()
+	p := &fakePayment{
+		Payment: Payment{
+			ID:          id,
+			Status:      StatusPending,
+			Amount:      req.Amount,
+			Description: req.Description,
+			Metadata:    req.Metadata,
+			Test:        true,
+			CreatedAt:   time.Now().UTC(),
+		},
+		capture:    req.Capture,
+		saveMethod: req.SavePaymentMethod,
+	}
+	if req.Receipt != nil {
+		p.ReceiptRegistration = StatusPending
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if req.PaymentMethodID != "" {
+		// Рекуррентный платеж: списывается сразу, без страницы оплаты
+		declined, ok := f.methods[req.PaymentMethodID]
+		if !ok {
+			return http.StatusBadRequest, fakeError("invalid_request", "Payment method is not saved", "payment_method_id")
+		}
+		p.PaymentMethod = &PaymentMethod{Type: "bank_card", ID: req.PaymentMethodID, Saved: true, Title: "Bank card *4444"}
+		if declined {
+			p.decline()
+		} else {
+			p.markPaid()
+		}
+	} else {
+		p.Confirmation = &Confirmation{
+			Type:            "redirect",
+			ReturnURL:       req.Confirmation.ReturnURL,
+			ConfirmationURL: f.URL + "/confirm/" + id,
+		}
+	}
+	f.payments[id] = p
+	return http.StatusOK, p.Payment
+}
+
+func (f *FakeServer) getPayment(r *http.Request, _ []byte) (int, interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[r.PathValue("id")]
+	if !ok {
+		return http.StatusNotFound, fakeError("not_found", "Payment not found", "payment_id")
+	}
+	return http.StatusOK, p.Payment
+}
+
+func (f *FakeServer) capturePayment(r *http.Request, body []byte) (int, interface{}) {
+	var req struct {
+		Amount *Amount `json:"amount"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return http.StatusBadRequest, fakeError("invalid_request", "Invalid JSON", "")
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[r.PathValue("id")]
+	if !ok {
+		return http.StatusNotFound, fakeError("not_found", "Payment not found", "payment_id")
+	}
+	if p.Status != StatusWaitingForCapture {
+		return http.StatusBadRequest, fakeError("invalid_request", "Payment is not waiting for capture", "")
+	}
+	if req.Amount != nil {
+		// Частичное подтверждение: сумма не больше оплаченной
+		capture, err := req.Amount.minor()
+		paid, _ := p.Amount.minor()
+		if err != nil || capture <= 0 || capture > paid || req.Amount.Currency != p.Amount.Currency {
+			return http.StatusBadRequest, fakeError("invalid_request", "Invalid capture amount", "amount")
+		}
+		p.Amount = *req.Amount
+	}
+	p.succeed()
+	return http.StatusOK, p.Payment
+}
+
+func (f *FakeServer) cancelPayment(r *http.Request, _ []byte) (int, interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[r.PathValue("id")]
+	if !ok {
+		return http.StatusNotFound, fakeError("not_found", "Payment not found", "payment_id")
+	}
+	if p.Status != StatusWaitingForCapture {
+		return http.StatusBadRequest, fakeError("invalid_request", "Payment is not waiting for capture", "")
+	}
+	p.Status = StatusCanceled
+	p.Paid = false
+	p.CancellationDetails = &CancellationDetails{Party: "merchant", Reason: "canceled_by_merchant"}
+	return http.StatusOK, p.Payment
+}
+
+func (f *FakeServer) createRefund(_ *http.Request, body []byte) (int, interface{}) {
+	var req struct {
+		PaymentID   string   `json:"payment_id"`
+		Amount      Amount   `json:"amount"`
+		Description string   `json:"description"`
+		Receipt     *Receipt `json:"receipt"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return http.StatusBadRequest, fakeError("invalid_request", "Invalid JSON", "")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.payments[req.PaymentID]
+	if !ok {
+		return http.StatusNotFound, fakeError("not_found", "Payment not found", "payment_id")
+	}
+	if p.Status != StatusSucceeded {
+		return http.StatusBadRequest, fakeError("invalid_request", "Payment is not succeeded", "payment_id")
+	}
+	amount, err := req.Amount.minor()
+	paid, _ := p.Amount.minor()
+	var refunded int64
+	if p.RefundedAmount != nil {
+		refunded, _ = p.RefundedAmount.minor()
+	}
+	if err != nil || amount <= 0 || req.Amount.Currency != p.Amount.Currency {
+		return http.StatusBadRequest, fakeError("invalid_request", "Invalid refund amount", "amount")
+	}
+	if amount > paid-refunded {
+		return http.StatusBadRequest, fakeError("invalid_request", "Refund amount exceeds the remaining payment amount", "amount")
+	}
+	// Магазину, который передает чеки, нужен и чек возврата на его сумму
+	if req.Receipt == nil && p.ReceiptRegistration != "" {
+		return http.StatusBadRequest, fakeError("invalid_request", "Receipt is required for refunds of payments with receipts", "receipt")
+	}
+	if req.Receipt != nil {
+		if param, description := checkFakeReceipt(req.Receipt, req.Amount); param != "" {
+			return http.StatusBadRequest, fakeError("invalid_request", description, param)
+		}
+	}
+
+	total := amountFromMinor(refunded+amount, p.Amount.Currency)
+	p.RefundedAmount = &total
+	refund := &Refund{
+		ID:          uuid.New().String(),
+		PaymentID:   p.ID,
+		Status:      RefundSucceeded,
+		Amount:      req.Amount,
+		Description: req.Description,
+		CreatedAt:   time.Now().UTC(),
+	}
+	f.refunds[refund.ID] = refund
+	return http.StatusOK, refund
+}
+
+func (f *FakeServer) getRefund(r *http.Request, _ []byte) (int, interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refund, ok := f.refunds[r.PathValue("id")]
+	if !ok {
+		return http.StatusNotFound, fakeError("not_found", "Refund not found", "refund_id")
+	}
+	return http.StatusOK, refund
+}
+
+// checkFakeReceipt проверяет чек так же, как YooKassa: нужен контакт
+// покупателя, а сумма позиций должна совпадать с суммой платежа (возврата). Возвращает
+// параметр запроса с ошибкой и ее описание ("" — чек корректен).
+func checkFakeReceipt(r *Receipt, amount Amount) (param, description string) {
+	if r.Customer.Email == "" {
+		return "receipt.customer", "Receipt customer contact is required"
+	}
+	if len(r.Items) == 0 {
+		return "receipt.items", "Receipt items are required"
+	}
+	var total int64
+	for _, item := range r.Items {
+		price, err := item.Amount.minor()
+		quantity, qerr := strconv.ParseFloat(item.Quantity, 64)
+		if err != nil || qerr != nil || quantity <= 0 || item.Amount.Currency != amount.Currency {
+			return "receipt.items", "Invalid receipt item"
+		}
+		if item.VATCode < 1 || item.VATCode > 6 {
+			return "receipt.items.vat_code", "Invalid vat_code"
+		}
+		total += int64(math.Round(float64(price) * quantity))
+	}
+	if paid, _ := amount.minor(); total != paid {
+		return "receipt.items.amount", "Receipt items amount does not match payment amount"
+	}
+	return "", ""
+}
+
+func fakeError(code, description, parameter string) *APIError {
+	return &APIError{Type: "error", ID: uuid.New().String(), Code: code, Description: description, Parameter: parameter}
+}
+
+func writeFake(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	writeRaw(w, status, data)
+}
+
+func writeRaw(w http.ResponseWriter, status int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
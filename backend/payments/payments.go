@@ -0,0 +1,218 @@
+// payments/payments.go
+package payments
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Прием платежей. PaymentProvider описывает операции платежного сервиса;
+// реализация — клиент YooKassa (API v3), для тестов и локальной разработки
+// есть FakeServer, эмулирующий тот же HTTP API.
+
+// Статусы платежа YooKassa
+const (
+	StatusPending           = "pending"             // ожидает оплаты пользователем
+	StatusWaitingForCapture = "waiting_for_capture" // оплачен, ждет подтверждения (capture: false)
+	StatusSucceeded         = "succeeded"
+	StatusCanceled          = "canceled"
+)
+
+// Статусы возврата
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundCanceled  = "canceled"
+)
+
+// PaymentProvider — платежный сервис. idempotenceKey защищает от повторного
+// создания платежа или возврата при повторе запроса после сетевой ошибки:
+// с тем же ключом сервис вернет результат первого запроса.
+type PaymentProvider interface {
+	CreatePayment(ctx context.Context, req CreatePaymentRequest, idempotenceKey string) (*Payment, error)
+	// CapturePayment подтверждает оплаченный платеж (waiting_for_capture);
+	// amount == nil — на всю сумму
+	CapturePayment(ctx context.Context, paymentID string, amount *Amount, idempotenceKey string) (*Payment, error)
+	CancelPayment(ctx context.Context, paymentID, idempotenceKey string) (*Payment, error)
+	GetPayment(ctx context.Context, paymentID string) (*Payment, error)
+	CreateRefund(ctx context.Context, req CreateRefundRequest, idempotenceKey string) (*Refund, error)
+	GetRefund(ctx context.Context, refundID string) (*Refund, error)
+}
+
+// Amount — сумма в формате YooKassa: строка с двумя знаками после точки
+type Amount struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+func NewAmount(value float64, currency string) Amount {
+	return Amount{Value: strconv.FormatFloat(value, 'f', 2, 64), Currency: currency}
+}
+
+// Float возвращает сумму числом (0, если значение некорректно)
+func (a Amount) Float() float64 {
+	v, _ := strconv.ParseFloat(a.Value, 64)
+	return v
+}
+
+// minor — сумма в копейках (центах)
+func (a Amount) minor() (int64, error) {
+	v, err := strconv.ParseFloat(a.Value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid amount %q", a.Value)
+	}
+	return int64(math.Round(v * 100)), nil
+}
+
+func amountFromMinor(minor int64, currency string) Amount {
+	return NewAmount(float64(minor)/100, currency)
+}
+
+// Confirmation — способ подтверждения платежа пользователем
+type Confirmation struct {
+	Type            string `json:"type"`
+	ReturnURL       string `json:"return_url,omitempty"`
+	ConfirmationURL string `json:"confirmation_url,omitempty"`
+}
+
+// PaymentMethod — способ оплаты, выбранный пользователем
+type PaymentMethod struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Saved bool   `json:"saved"`
+	Title string `json:"title,omitempty"`
+}
+
+// CancellationDetails — кто и почему отменил платеж
+type CancellationDetails struct {
+	Party  string `json:"party"`
+	Reason string `json:"reason"`
+}
+
+// Payment — платеж
+type Payment struct {
+	ID                  string               `json:"id"`
+	Status              string               `json:"status"`
+	Paid                bool                 `json:"paid"`
+	Amount              Amount               `json:"amount"`
+	RefundedAmount      *Amount              `json:"refunded_amount,omitempty"`
+	Description         string               `json:"description,omitempty"`
+	Confirmation        *Confirmation        `json:"confirmation,omitempty"`
+	PaymentMethod       *PaymentMethod       `json:"payment_method,omitempty"`
+	CancellationDetails *CancellationDetails `json:"cancellation_details,omitempty"`
+	Metadata            map[string]string    `json:"metadata,omitempty"`
+	Test                bool                 `json:"test"`
+	CreatedAt           time.Time            `json:"created_at"`
+	CapturedAt          *time.Time           `json:"captured_at,omitempty"`
+	// ReceiptRegistration — статус отправки чека в онлайн-кассу (pending, succeeded, canceled)
+	ReceiptRegistration string `json:"receipt_registration,omitempty"`
+}
+
+// CreatePaymentRequest — параметры нового платежа. Пользователь подтверждает
+// оплату на странице YooKassa и возвращается на ReturnURL. Платеж сохраненным
+// способом оплаты (PaymentMethodID) списывается без участия пользователя.
+type CreatePaymentRequest struct {
+	Amount      Amount
+	Description string
+	ReturnURL   string
+	// Capture: true — платеж подтверждается автоматически после оплаты
+	Capture  bool
+	Metadata map[string]string
+	// SavePaymentMethod — сохранить способ оплаты для автопродления
+	SavePaymentMethod bool
+	// PaymentMethodID — списание сохраненным способом оплаты (рекуррентный платеж)
+	PaymentMethodID string
+	// Receipt — данные чека по 54-ФЗ (nil — без чека)
+	Receipt *Receipt
+}
+
+// Receipt — чек по 54-ФЗ, который YooKassa передает в онлайн-кассу. Сумма
+// позиций должна совпадать с суммой платежа.
+type Receipt struct {
+	Customer ReceiptCustomer `json:"customer"`
+	Items    []ReceiptItem   `json:"items"`
+	// TaxSystemCode — система налогообложения (0 — не передается)
+	TaxSystemCode int `json:"tax_system_code,omitempty"`
+}
+
+// ReceiptCustomer — покупатель, которому касса отправит чек
+type ReceiptCustomer struct {
+	Email string `json:"email,omitempty"`
+}
+
+// ReceiptItem — позиция чека
+type ReceiptItem struct {
+	Description string `json:"description"`
+	Quantity    string `json:"quantity"`
+	// Amount — цена за единицу
+	Amount  Amount `json:"amount"`
+	VATCode int    `json:"vat_code"`
+	// PaymentSubject и PaymentMode — признаки предмета и способа расчета
+	// (service, full_payment для подписки)
+	PaymentSubject string `json:"payment_subject,omitempty"`
+	PaymentMode    string `json:"payment_mode,omitempty"`
+}
+
+// maxReceiptDescription — максимальная длина названия позиции чека (символов)
+const maxReceiptDescription = 128
+
+// NewServiceReceipt создает чек из одной услуги description на сумму amount,
+// оплаченной полностью
+func NewServiceReceipt(email, description string, amount Amount, vatCode, taxSystemCode int) *Receipt {
+	if r := []rune(description); len(r) > maxReceiptDescription {
+		description = string(r[:maxReceiptDescription])
+	}
+	return &Receipt{
+		Customer: ReceiptCustomer{Email: email},
+		Items: []ReceiptItem{{
+			Description:    description,
+			Quantity:       "1.00",
+			Amount:         amount,
+			VATCode:        vatCode,
+			PaymentSubject: "service",
+			PaymentMode:    "full_payment",
+		}},
+		TaxSystemCode: taxSystemCode,
+	}
+}
+
+// Refund — возврат платежа
+type Refund struct {
+	ID          string    `json:"id"`
+	PaymentID   string    `json:"payment_id"`
+	Status      string    `json:"status"`
+	Amount      Amount    `json:"amount"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreateRefundRequest — параметры возврата (полного или частичного)
+type CreateRefundRequest struct {
+	PaymentID   string
+	Amount      Amount
+	Description string
+	// Receipt — чек возврата по 54-ФЗ на сумму Amount; обязателен, если чек
+	// передавался с платежом (nil — без чека)
+	Receipt *Receipt
+}
+
+// APIError — ошибка, которую вернул API платежного сервиса
+type APIError struct {
+	StatusCode  int    `json:"-"`
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Parameter   string `json:"parameter,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("yookassa: %d %s: %s", e.StatusCode, e.Code, e.Description)
+	if e.Parameter != "" {
+		msg += " (parameter " + e.Parameter + ")"
+	}
+	return msg
+}
@@ -0,0 +1,226 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultAPIURL — адрес API YooKassa
+const DefaultAPIURL = "https://api.yookassa.ru/v3"
+
+const (
+	yookassaMaxAttempts = 3
+	yookassaRetryDelay  = time.Second
+)
+
+// Config — учетные данные магазина YooKassa
+type Config struct {
+	ShopID    string
+	SecretKey string
+	// BaseURL — адрес API (по умолчанию DefaultAPIURL; для FakeServer — его URL + "/v3")
+	BaseURL string
+}
+
+// YooKassa — клиент API YooKassa v3 (https://yookassa.ru/developers/api).
+// Запросы аутентифицируются HTTP Basic (shopId:secretKey). Ответ 202 и ошибки
+// 5xx означают, что результат еще не готов: запрос повторяется с тем же
+// Idempotence-Key, поэтому повтор не создаст второй платеж.
+type YooKassa struct {
+	cfg  Config
+	http *http.Client
+}
+
+// NewYooKassa проверяет конфигурацию и создает клиент
+func NewYooKassa(cfg Config) (*YooKassa, error) {
+	if cfg.ShopID == "" || cfg.SecretKey == "" {
+		return nil, errors.New("yookassa: shop id and secret key are required")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultAPIURL
+	}
+	if _, err := url.Parse(cfg.BaseURL); err != nil {
+		return nil, fmt.Errorf("yookassa: invalid api url: %w", err)
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	return &YooKassa{cfg: cfg, http: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (c *YooKassa) CreatePayment(ctx context.Context, req CreatePaymentRequest, idempotenceKey string) (*Payment, error) {
+	body := map[string]interface{}{
+		"amount":  req.Amount,
+		"capture": req.Capture,
+	}
+	if req.PaymentMethodID != "" {
+		// Рекуррентный платеж: подтверждение пользователем не требуется
+		body["payment_method_id"] = req.PaymentMethodID
+	} else {
+		body["confirmation"] = Confirmation{
+			Type:      "redirect",
+			ReturnURL: req.ReturnURL,
+		}
+	}
+	if req.SavePaymentMethod {
+		body["save_payment_method"] = true
+	}
+	if req.Description != "" {
+		body["description"] = req.Description
+	}
+	if len(req.Metadata) > 0 {
+		body["metadata"] = req.Metadata
+	}
+	if req.Receipt != nil {
+		body["receipt"] = req.Receipt
+	}
+
+	var p Payment
+	if err := c.do(ctx, http.MethodPost, "/payments", body, idempotenceKey, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *YooKassa) CapturePayment(ctx context.Context, paymentID string, amount *Amount, idempotenceKey string) (*Payment, error) {
+	body := map[string]interface{}{}
+	if amount != nil {
+		body["amount"] = amount
+	}
+
+	var p Payment
+	if err := c.do(ctx, http.MethodPost, "/payments/"+url.PathEscape(paymentID)+"/capture", body, idempotenceKey, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *YooKassa) CancelPayment(ctx context.Context, paymentID, idempotenceKey string) (*Payment, error) {
+	var p Payment
+	if err := c.do(ctx, http.MethodPost, "/payments/"+url.PathEscape(paymentID)+"/cancel", map[string]interface{}{}, idempotenceKey, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *YooKassa) GetPayment(ctx context.Context, paymentID string) (*Payment, error) {
+	var p Payment
+	if err := c.do(ctx, http.MethodGet, "/payments/"+url.PathEscape(paymentID), nil, "", &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *YooKassa) CreateRefund(ctx context.Context, req CreateRefundRequest, idempotenceKey string) (*Refund, error) {
+	body := map[string]interface{}{
+		"payment_id": req.PaymentID,
+		"amount":     req.Amount,
+	}
+	if req.Description != "" {
+		body["description"] = req.Description
+	}
+	if req.Receipt != nil {
+		body["receipt"] = req.Receipt
+	}
+
+	var refund Refund
+	if err := c.do(ctx, http.MethodPost, "/refunds", body, idempotenceKey, &refund); err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+func (c *YooKassa) GetRefund(ctx context.Context, refundID string) (*Refund, error) {
+	var refund Refund
+	if err := c.do(ctx, http.MethodGet, "/refunds/"+url.PathEscape(refundID), nil, "", &refund); err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+// do выполняет запрос и декодирует ответ в out, повторяя его при 202 и 5xx
+func (c *YooKassa) do(ctx context.Context, method, path string, body interface{}, idempotenceKey string, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	if method == http.MethodPost && idempotenceKey == "" {
+		return errors.New("yookassa: idempotence key is required")
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= yookassaMaxAttempts; attempt++ {
+		retry, err := c.attempt(ctx, method, path, payload, idempotenceKey, out)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || attempt == yookassaMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * yookassaRetryDelay):
+		}
+	}
+	return lastErr
+}
+
+// attempt выполняет один запрос; retry — можно ли повторить его с тем же ключом
+func (c *YooKassa) attempt(ctx context.Context, method, path string, payload []byte, idempotenceKey string, out interface{}) (retry bool, err error) {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.cfg.BaseURL+path, reqBody)
+	if err != nil {
+		return false, err
+	}
+	req.SetBasicAuth(c.cfg.ShopID, c.cfg.SecretKey)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotenceKey != "" {
+		req.Header.Set("Idempotence-Key", idempotenceKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// Сетевая ошибка: повтор безопасен благодаря ключу идемпотентности
+		return ctx.Err() == nil, fmt.Errorf("yookassa: %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return true, fmt.Errorf("yookassa: read response: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if err := json.Unmarshal(data, out); err != nil {
+			return false, fmt.Errorf("yookassa: decode response: %w", err)
+		}
+		return false, nil
+	case resp.StatusCode == http.StatusAccepted:
+		// Запрос принят, но еще обрабатывается
+		return true, fmt.Errorf("yookassa: %s %s: request is still being processed", method, path)
+	default:
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Code = http.StatusText(resp.StatusCode)
+			apiErr.Description = strings.TrimSpace(string(data))
+		}
+		return resp.StatusCode >= 500, apiErr
+	}
+}
@@ -0,0 +1,321 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestClient(t *testing.T) (*YooKassa, *FakeServer) {
+	t.Helper()
+	fake := NewFakeServer("shop-1", "secret-1")
+	t.Cleanup(fake.Close)
+	client, err := NewYooKassa(fake.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, fake
+}
+
+func testPaymentRequest() CreatePaymentRequest {
+	return CreatePaymentRequest{
+		Amount:      NewAmount(299, "RUB"),
+		Description: "Medium, 30 дней",
+		ReturnURL:   "https://app.example.com/subscription",
+		Capture:     true,
+		Metadata:    map[string]string{"userId": "u1"},
+	}
+}
+
+func TestPurchaseFlow(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+
+	p, err := client.CreatePayment(ctx, testPaymentRequest(), "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != StatusPending || p.Amount.Value != "299.00" || p.Metadata["userId"] != "u1" {
+		t.Fatalf("unexpected payment: %+v", p)
+	}
+
+	// Пользователь открывает страницу оплаты и возвращается на return_url
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(p.Confirmation.ConfirmationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://app.example.com/subscription" {
+		t.Fatalf("confirmation: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	got, err := client.GetPayment(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusSucceeded || !got.Paid || got.CapturedAt == nil {
+		t.Fatalf("payment after confirmation: %+v", got)
+	}
+
+	// Частичный, затем слишком большой возврат
+	refund, err := client.CreateRefund(ctx, CreateRefundRequest{PaymentID: p.ID, Amount: NewAmount(100, "RUB")}, "refund-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Status != RefundSucceeded {
+		t.Errorf("refund status = %s", refund.Status)
+	}
+	_, err = client.CreateRefund(ctx, CreateRefundRequest{PaymentID: p.ID, Amount: NewAmount(200, "RUB")}, "refund-2")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("refund over the paid amount: %v", err)
+	}
+	if got, _ := client.GetPayment(ctx, p.ID); got.RefundedAmount == nil || got.RefundedAmount.Value != "100.00" {
+		t.Errorf("refunded amount = %+v", got.RefundedAmount)
+	}
+}
+
+func TestCreatePaymentIdempotence(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+
+	a, err := client.CreatePayment(ctx, testPaymentRequest(), "same-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := client.CreatePayment(ctx, testPaymentRequest(), "same-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != b.ID {
+		t.Errorf("retry with the same key created a second payment: %s, %s", a.ID, b.ID)
+	}
+
+	other := testPaymentRequest()
+	other.Amount = NewAmount(999, "RUB")
+	if _, err := client.CreatePayment(ctx, other, "same-key"); err == nil {
+		t.Error("same key with another request must fail")
+	}
+}
+
+func TestCaptureAndCancel(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+
+	req := testPaymentRequest()
+	req.Capture = false
+	p, _ := client.CreatePayment(ctx, req, "k1")
+	if err := fake.Confirm(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := client.GetPayment(ctx, p.ID); got.Status != StatusWaitingForCapture {
+		t.Fatalf("status = %s, want waiting_for_capture", got.Status)
+	}
+	partial := NewAmount(150, "RUB")
+	captured, err := client.CapturePayment(ctx, p.ID, &partial, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captured.Status != StatusSucceeded || captured.Amount.Value != "150.00" {
+		t.Errorf("captured: %+v", captured)
+	}
+
+	p2, _ := client.CreatePayment(ctx, req, "k3")
+	fake.Confirm(p2.ID)
+	canceled, err := client.CancelPayment(ctx, p2.ID, "k4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled.Status != StatusCanceled || canceled.CancellationDetails == nil {
+		t.Errorf("canceled: %+v", canceled)
+	}
+
+	p3, _ := client.CreatePayment(ctx, req, "k5")
+	fake.Decline(p3.ID)
+	if got, _ := client.GetPayment(ctx, p3.ID); got.Status != StatusCanceled || got.CancellationDetails.Reason != "insufficient_funds" {
+		t.Errorf("declined: %+v", got)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFakeServer("shop-1", "secret-1")
+	defer fake.Close()
+
+	cfg := fake.Config()
+	cfg.SecretKey = "wrong"
+	client, _ := NewYooKassa(cfg)
+	_, err := client.GetPayment(ctx, "missing")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong credentials: %v", err)
+	}
+
+	client, _ = NewYooKassa(fake.Config())
+	if _, err := client.GetPayment(ctx, "missing"); !errors.As(err, &apiErr) || apiErr.Code != "not_found" {
+		t.Errorf("missing payment: %v", err)
+	}
+	if _, err := client.CreatePayment(ctx, testPaymentRequest(), ""); err == nil {
+		t.Error("POST without idempotence key must fail")
+	}
+
+	if _, err := NewYooKassa(Config{ShopID: "shop-1"}); err == nil {
+		t.Error("missing secret key must fail")
+	}
+}
+
+func TestRetryWithSameKey(t *testing.T) {
+	fake := NewFakeServer("shop-1", "secret-1")
+	defer fake.Close()
+
+	// Первый ответ — 500: клиент повторяет запрос с тем же ключом
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotence-Key"))
+		if len(keys) == 1 {
+			http.Error(w, `{"type":"error","code":"internal_server_error","description":"try later"}`, http.StatusInternalServerError)
+			return
+		}
+		proxy, _ := http.NewRequestWithContext(r.Context(), r.Method, fake.URL+"/v3"+r.URL.Path, r.Body)
+		proxy.Header = r.Header
+		resp, err := http.DefaultClient.Do(proxy)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer srv.Close()
+
+	cfg := fake.Config()
+	cfg.BaseURL = srv.URL
+	client, _ := NewYooKassa(cfg)
+	if _, err := client.CreatePayment(context.Background(), testPaymentRequest(), "retry-key"); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "retry-key" || keys[1] != "retry-key" {
+		t.Errorf("idempotence keys = %v", keys)
+	}
+}
+
+func TestRecurringPayment(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+
+	// Первый платеж сохраняет способ оплаты
+	req := testPaymentRequest()
+	req.SavePaymentMethod = true
+	p, _ := client.CreatePayment(ctx, req, "first")
+	if err := fake.Confirm(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := client.GetPayment(ctx, p.ID)
+	if first.PaymentMethod == nil || !first.PaymentMethod.Saved {
+		t.Fatalf("payment method not saved: %+v", first.PaymentMethod)
+	}
+
+	// Продление списывается сразу, без страницы оплаты
+	renewal := testPaymentRequest()
+	renewal.ReturnURL = ""
+	renewal.PaymentMethodID = first.PaymentMethod.ID
+	got, err := client.CreatePayment(ctx, renewal, "renewal-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusSucceeded || got.Confirmation != nil {
+		t.Errorf("renewal: %+v", got)
+	}
+
+	fake.DeclineMethod(first.PaymentMethod.ID, true)
+	got, err = client.CreatePayment(ctx, renewal, "renewal-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusCanceled || got.CancellationDetails == nil {
+		t.Errorf("declined renewal: %+v", got)
+	}
+
+	renewal.PaymentMethodID = "unknown"
+	var apiErr *APIError
+	if _, err := client.CreatePayment(ctx, renewal, "renewal-3"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsaved method: %v", err)
+	}
+}
+
+func TestPaymentReceipt(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+
+	req := testPaymentRequest()
+	req.Receipt = NewServiceReceipt("user@example.com", req.Description, NewAmount(199, "RUB"), 1, 0)
+	_, err := client.CreatePayment(ctx, req, "receipt-1")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Parameter != "receipt.items.amount" {
+		t.Fatalf("receipt not matching the amount: %v", err)
+	}
+
+	req.Receipt = NewServiceReceipt("user@example.com", req.Description, req.Amount, 1, 0)
+	p, err := client.CreatePayment(ctx, req, "receipt-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ReceiptRegistration != StatusPending {
+		t.Errorf("receipt registration = %q", p.ReceiptRegistration)
+	}
+	if err := fake.Confirm(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := client.GetPayment(ctx, p.ID); got.ReceiptRegistration != StatusSucceeded {
+		t.Errorf("receipt registration after payment = %q", got.ReceiptRegistration)
+	}
+}
+
+func TestRefundReceipt(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+
+	req := testPaymentRequest()
+	req.Receipt = NewServiceReceipt("user@example.com", req.Description, req.Amount, 1, 0)
+	p, err := client.CreatePayment(ctx, req, "receipt-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Confirm(p.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Платеж был с чеком: возврат без чека отклоняется
+	_, err = client.CreateRefund(ctx, CreateRefundRequest{PaymentID: p.ID, Amount: NewAmount(100, "RUB")}, "refund-1")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Parameter != "receipt" {
+		t.Fatalf("refund without receipt: %v", err)
+	}
+
+	// Чек частичного возврата — на сумму возврата, а не платежа
+	_, err = client.CreateRefund(ctx, CreateRefundRequest{
+		PaymentID: p.ID,
+		Amount:    NewAmount(100, "RUB"),
+		Receipt:   NewServiceReceipt("user@example.com", req.Description, req.Amount, 1, 0),
+	}, "refund-2")
+	if !errors.As(err, &apiErr) || apiErr.Parameter != "receipt.items.amount" {
+		t.Fatalf("receipt not matching the refund amount: %v", err)
+	}
+
+	refund, err := client.CreateRefund(ctx, CreateRefundRequest{
+		PaymentID: p.ID,
+		Amount:    NewAmount(100, "RUB"),
+		Receipt:   NewServiceReceipt("user@example.com", req.Description, NewAmount(100, "RUB"), 1, 0),
+	}, "refund-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Status != RefundSucceeded {
+		t.Errorf("refund status = %q", refund.Status)
+	}
+}
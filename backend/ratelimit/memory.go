@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore хранит состояние в памяти процесса: подходит для одного экземпляра
+// (с несколькими репликами бюджет фактически умножается на их число)
+type MemoryStore struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+	now  func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tats: make(map[string]time.Time), now: time.Now}
+}
+
+// Take реализует GCRA для одного ключа
+func (s *MemoryStore) Take(_ context.Context, key string, interval time.Duration, burst int) (bool, time.Time, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	tat, ok := s.tats[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(interval)
+	if newTAT.After(now.Add(interval * time.Duration(burst))) {
+		return false, tat, now, nil
+	}
+	s.tats[key] = newTAT
+	return true, newTAT, now, nil
+}
+
+// Cleanup удаляет ключи, бюджет которых полностью восстановился
+func (s *MemoryStore) Cleanup(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for key, tat := range s.tats {
+		if tat.Before(now) {
+			delete(s.tats, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// ratelimit/ratelimit.go
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Ограничение частоты запросов по алгоритму GCRA (эквивалент token bucket).
+// Для каждого ключа хранится одно значение — TAT (theoretical arrival time):
+// момент, когда «ведро» снова станет полным. Запрос разрешен, если после него
+// TAT не уходит дальше, чем на Burst интервалов вперед от текущего времени.
+// Одно значение на ключ позволяет хранить состояние в Postgres и атомарно
+// обновлять его одним запросом, общим для всех реплик.
+
+// Limit — бюджет: Requests запросов за Period, не больше Burst подряд
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// Interval — интервал, за который восстанавливается одна единица бюджета
+func (l Limit) Interval() time.Duration {
+	return l.Period / time.Duration(l.Requests)
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return 1
+}
+
+// Policy — описание бюджета для заголовка RateLimit-Policy, например "100;w=60"
+func (l Limit) Policy() string {
+	return fmt.Sprintf("%d;w=%d;burst=%d", l.Requests, int(math.Ceil(l.Period.Seconds())), l.burst())
+}
+
+// Store атомарно расходует единицу бюджета ключа.
+// interval — время восстановления одной единицы, burst — емкость.
+// Возвращает, разрешен ли запрос, TAT после операции (при отказе — текущий)
+// и время хранилища, относительно которого он посчитан.
+type Store interface {
+	Take(ctx context.Context, key string, interval time.Duration, burst int) (allowed bool, tat, now time.Time, err error)
+	// Cleanup удаляет ключи с полным бюджетом (их состояние не отличается от отсутствия)
+	Cleanup(ctx context.Context) error
+}
+
+// Result — результат проверки лимита
+type Result struct {
+	Allowed    bool
+	Limit      Limit
+	Remaining  int
+	Reset      time.Duration // через сколько бюджет восстановится полностью
+	RetryAfter time.Duration // при отказе: через сколько можно повторить
+}
+
+func newResult(l Limit, allowed bool, tat, now time.Time) Result {
+	interval := l.Interval()
+	window := interval * time.Duration(l.burst())
+
+	res := Result{Allowed: allowed, Limit: l, Reset: max(tat.Sub(now), 0)}
+	if allowed {
+		res.Remaining = int((now.Add(window).Sub(tat)) / interval)
+	} else {
+		// Следующий запрос поместится, когда TAT + interval окажется в пределах окна
+		res.RetryAfter = max(tat.Add(interval).Sub(now.Add(window)), 0)
+	}
+	return res
+}
+
+// Limiter проверяет бюджеты в выбранном хранилище
+type Limiter struct {
+	store Store
+}
+
+func New(store Store) *Limiter {
+	return &Limiter{store: store}
+}
+
+// Allow расходует единицу бюджета key. При ошибке хранилища запрос разрешается
+// (отказ БД не должен останавливать весь API), ошибка возвращается для логирования.
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	allowed, tat, now, err := l.store.Take(ctx, key, limit.Interval(), limit.burst())
+	if err != nil {
+		return Result{Allowed: true, Limit: limit, Remaining: limit.burst()}, err
+	}
+	return newResult(limit, allowed, tat, now), nil
+}
+
+// Run периодически очищает хранилище, пока не отменен ctx
+func (l *Limiter) Run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.store.Cleanup(ctx); err != nil {
+			log.Printf("Rate limit cleanup failed: %v", err)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// SetHeaders выставляет заголовки RateLimit-* (draft-ietf-httpapi-ratelimit-headers)
+// и Retry-After при отказе
+func SetHeaders(w http.ResponseWriter, res Result) {
+	h := w.Header()
+	h.Set("RateLimit-Policy", res.Limit.Policy())
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit.burst()))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(ceilSeconds(res.RetryAfter), 1)))
+	}
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreBurstAndRefill(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	limiter := New(store)
+	limit := Limit{Requests: 60, Period: time.Minute, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, _ := limiter.Allow(context.Background(), "k", limit)
+		if !res.Allowed || res.Remaining != i {
+			t.Fatalf("request %d: allowed=%v remaining=%d, want remaining %d", 3-i, res.Allowed, res.Remaining, i)
+		}
+	}
+
+	res, _ := limiter.Allow(context.Background(), "k", limit)
+	if res.Allowed {
+		t.Fatal("request over burst was allowed")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %v, want 1s", res.RetryAfter)
+	}
+	if res.Reset != 3*time.Second {
+		t.Errorf("Reset = %v, want 3s", res.Reset)
+	}
+
+	// Через интервал восстанавливается одна единица
+	now = now.Add(time.Second)
+	if res, _ := limiter.Allow(context.Background(), "k", limit); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("after refill: allowed=%v remaining=%d", res.Allowed, res.Remaining)
+	}
+
+	// Ключи независимы
+	if res, _ := limiter.Allow(context.Background(), "other", limit); !res.Allowed {
+		t.Error("other key was limited")
+	}
+
+	// Полностью восстановившиеся ключи удаляются
+	now = now.Add(time.Minute)
+	store.Cleanup(context.Background())
+	if len(store.tats) != 0 {
+		t.Errorf("cleanup left %d keys", len(store.tats))
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	limit := Limit{Requests: 120, Period: time.Minute, Burst: 60}
+	w := httptest.NewRecorder()
+	SetHeaders(w, Result{Allowed: false, Limit: limit, Reset: 30 * time.Second, RetryAfter: 1500 * time.Millisecond})
+
+	want := map[string]string{
+		"RateLimit-Policy":    "120;w=60;burst=60",
+		"RateLimit-Limit":     "60",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "30",
+		"Retry-After":         "2",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestBudgetsFallBackToDefault(t *testing.T) {
+	b := Budgets{"sync": {
+		"default": {Requests: 1, Period: time.Second},
+		"ultra":   {Requests: 10, Period: time.Second},
+	}}
+	if l, ok := b.For("sync", "ultra"); !ok || l.Requests != 10 {
+		t.Errorf("ultra: %+v %v", l, ok)
+	}
+	if l, ok := b.For("sync", "free"); !ok || l.Requests != 1 {
+		t.Errorf("free: %+v %v", l, ok)
+	}
+	if _, ok := b.For("files", "free"); ok {
+		t.Error("unknown group must have no budget")
+	}
+}
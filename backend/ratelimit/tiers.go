@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Budgets — бюджеты по группам маршрутов и тарифам; тариф "default"
+// применяется к тарифам без собственного бюджета
+type Budgets map[string]map[string]Limit
+
+// For возвращает бюджет группы для тарифа
+func (b Budgets) For(group, tier string) (Limit, bool) {
+	tiers, ok := b[group]
+	if !ok {
+		return Limit{}, false
+	}
+	if l, ok := tiers[tier]; ok {
+		return l, true
+	}
+	l, ok := tiers["default"]
+	return l, ok
+}
+
+// TierCache кеширует тариф пользователя, чтобы не читать его из БД на каждый
+// запрос. Смена тарифа вступает в силу для лимитов в пределах ttl.
+type TierCache struct {
+	lookup func(ctx context.Context, userID string) (string, error)
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]tierEntry
+}
+
+type tierEntry struct {
+	tier    string
+	expires time.Time
+}
+
+func NewTierCache(lookup func(ctx context.Context, userID string) (string, error), ttl time.Duration) *TierCache {
+	return &TierCache{lookup: lookup, ttl: ttl, entries: make(map[string]tierEntry)}
+}
+
+// Tier возвращает тариф пользователя из кеша или через lookup
+func (c *TierCache) Tier(ctx context.Context, userID string) (string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.tier, nil
+	}
+
+	tier, err := c.lookup(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Заодно удаляем устаревшие записи, чтобы кеш не рос без ограничений
+	if len(c.entries) > 10000 {
+		for id, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, id)
+			}
+		}
+	}
+	c.entries[userID] = tierEntry{tier: tier, expires: now.Add(c.ttl)}
+	return tier, nil
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"noteflow/model"
+	"strings"
+)
+
+// AuditRepository пишет и читает журнал аудита (audit_events, только добавление)
+type AuditRepository struct {
+	db *sql.DB
+}
+
+func NewAuditRepository(db *sql.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+// Record добавляет событие в журнал
+func (r *AuditRepository) Record(ctx context.Context, e *model.AuditEvent) error {
+	details := e.Details
+	if len(details) == 0 {
+		details = []byte("{}")
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO audit_events (user_id, event, client_ip, user_agent, session_id, details)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6)
+	`, e.UserID, e.Event, e.ClientIP, e.UserAgent, e.SessionID, details)
+	return err
+}
+
+const auditColumns = `id, user_id, event, COALESCE(client_ip, ''), COALESCE(user_agent, ''), COALESCE(session_id, ''), details, created_at`
+
+func scanAuditEvents(rows *sql.Rows) ([]model.AuditEvent, error) {
+	defer rows.Close()
+
+	events := []model.AuditEvent{}
+	for rows.Next() {
+		var e model.AuditEvent
+		var userID sql.NullString
+		var details []byte
+		if err := rows.Scan(&e.ID, &userID, &e.Event, &e.ClientIP, &e.UserAgent, &e.SessionID, &details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			e.UserID = &userID.String
+		}
+		e.Details = details
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ListUserEvents возвращает последние события пользователя из списка events
+func (r *AuditRepository) ListUserEvents(ctx context.Context, userID string, events []string, limit int) ([]model.AuditEvent, error) {
+	rawEvents, err := jsonList(events)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+auditColumns+`
+		FROM audit_events
+		WHERE user_id = $1 AND event IN (SELECT jsonb_array_elements_text($2::jsonb))
+		ORDER BY id DESC
+		LIMIT $3
+	`, userID, rawEvents, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEvents(rows)
+}
+
+// Query выбирает события по фильтру (новые первыми)
+func (r *AuditRepository) Query(ctx context.Context, f model.AuditFilter) ([]model.AuditEvent, error) {
+	var conds []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.UserID != "" {
+		conds = append(conds, "user_id = "+arg(f.UserID))
+	}
+	if len(f.Events) > 0 {
+		rawEvents, err := jsonList(f.Events)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, "event IN (SELECT jsonb_array_elements_text("+arg(rawEvents)+"::jsonb))")
+	}
+	if f.ClientIP != "" {
+		conds = append(conds, "client_ip = "+arg(f.ClientIP))
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "created_at >= "+arg(f.Since))
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "created_at < "+arg(f.Until))
+	}
+	if f.BeforeID > 0 {
+		conds = append(conds, "id < "+arg(f.BeforeID))
+	}
+
+	query := "SELECT " + auditColumns + " FROM audit_events"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT " + arg(f.Limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEvents(rows)
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuditQuery_BuildsFilters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewAuditRepository(db)
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Now()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM audit_events WHERE user_id = $1 AND event IN (SELECT jsonb_array_elements_text($2::jsonb)) AND created_at >= $3 AND id < $4 ORDER BY id DESC LIMIT $5`)).
+		WithArgs("user-1", []byte(`["login","login_failed"]`), since, int64(42), 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "event", "client_ip", "user_agent", "session_id", "details", "created_at"}).
+			AddRow(int64(41), "user-1", "login", "10.0.0.1", "curl", "", []byte(`{}`), now))
+
+	events, err := repo.Query(context.Background(), model.AuditFilter{
+		UserID:   "user-1",
+		Events:   []string{"login", "login_failed"},
+		Since:    since,
+		BeforeID: 42,
+		Limit:    10,
+	})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != 41 || events[0].UserID == nil || *events[0].UserID != "user-1" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditQuery_NoFilters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM audit_events ORDER BY id DESC LIMIT $1`)).
+		WithArgs(100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "event", "client_ip", "user_agent", "session_id", "details", "created_at"}))
+
+	events, err := NewAuditRepository(db).Query(context.Background(), model.AuditFilter{Limit: 100})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if events == nil || len(events) != 0 {
+		t.Errorf("expected empty non-nil slice, got %#v", events)
+	}
+}
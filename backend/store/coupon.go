@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"noteflow/model"
+)
+
+// CouponRepository хранит промокоды и их использования. Использование
+// записывается при создании платежа (резерв) и снимается, если платеж
+// отменен, поэтому лимиты не превышаются параллельными оплатами.
+type CouponRepository struct {
+	db *sql.DB
+}
+
+func NewCouponRepository(db *sql.DB) *CouponRepository {
+	return &CouponRepository{db: db}
+}
+
+const couponColumns = `c.code, c.percent_off, c.amount_off, COALESCE(c.currency, ''), c.tiers, c.expires_at,
+	c.max_redemptions, c.per_user_limit, c.active, c.created_at,
+	(SELECT COUNT(*) FROM coupon_redemptions cr WHERE cr.code = c.code)`
+
+func scanCoupon(row rowScanner) (*model.Coupon, error) {
+	var c model.Coupon
+	var tiers []byte
+	var expiresAt sql.NullTime
+	if err := row.Scan(&c.Code, &c.PercentOff, &c.AmountOff, &c.Currency, &tiers, &expiresAt,
+		&c.MaxRedemptions, &c.PerUserLimit, &c.Active, &c.CreatedAt, &c.Redemptions); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(tiers, &c.Tiers); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		c.ExpiresAt = &expiresAt.Time
+	}
+	return &c, nil
+}
+
+// ListCoupons возвращает все промокоды (новые первыми)
+func (r *CouponRepository) ListCoupons(ctx context.Context) ([]model.Coupon, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+couponColumns+`
+		FROM coupons c
+		ORDER BY c.created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []model.Coupon
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, *c)
+	}
+	return coupons, rows.Err()
+}
+
+// UpsertCoupon создает или изменяет промокод; использования не меняются
+func (r *CouponRepository) UpsertCoupon(ctx context.Context, c model.Coupon) error {
+	tiers := make([]string, 0, len(c.Tiers))
+	for _, t := range c.Tiers {
+		tiers = append(tiers, string(t))
+	}
+	rawTiers, err := jsonList(tiers)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO coupons (code, percent_off, amount_off, currency, tiers, expires_at, max_redemptions, per_user_limit, active)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9)
+		ON CONFLICT (code) DO UPDATE SET
+			percent_off = EXCLUDED.percent_off,
+			amount_off = EXCLUDED.amount_off,
+			currency = EXCLUDED.currency,
+			tiers = EXCLUDED.tiers,
+			expires_at = EXCLUDED.expires_at,
+			max_redemptions = EXCLUDED.max_redemptions,
+			per_user_limit = EXCLUDED.per_user_limit,
+			active = EXCLUDED.active
+	`, c.Code, c.PercentOff, c.AmountOff, c.Currency, rawTiers, c.ExpiresAt, c.MaxRedemptions, c.PerUserLimit, c.Active)
+	return err
+}
+
+// CheckCoupon проверяет, может ли пользователь применить промокод к тарифу,
+// ничего не резервируя (предпросмотр скидки)
+func (r *CouponRepository) CheckCoupon(ctx context.Context, code, userID string, plan model.Plan, price model.PlanPrice) (*model.Coupon, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return checkCoupon(ctx, tx, code, userID, plan, price, false)
+}
+
+// ReserveCoupon проверяет промокод и записывает его использование за
+// транзакцией transactionID. Строка промокода блокируется до конца транзакции
+// БД, так что MaxRedemptions и PerUserLimit не превышаются.
+func (r *CouponRepository) ReserveCoupon(ctx context.Context, code, userID string, plan model.Plan, price model.PlanPrice, transactionID string) (*model.Coupon, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	c, err := checkCoupon(ctx, tx, code, userID, plan, price, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO coupon_redemptions (transaction_id, code, user_id) VALUES ($1, $2, $3)
+	`, transactionID, c.Code, userID); err != nil {
+		return nil, err
+	}
+	c.Redemptions++
+	return c, tx.Commit()
+}
+
+// ReleaseCoupon снимает резерв промокода (платеж не создан или отменен)
+func (r *CouponRepository) ReleaseCoupon(ctx context.Context, transactionID string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM coupon_redemptions WHERE transaction_id = $1`, transactionID)
+	return err
+}
+
+func checkCoupon(ctx context.Context, tx *sql.Tx, code, userID string, plan model.Plan, price model.PlanPrice, lock bool) (*model.Coupon, error) {
+	query := `SELECT ` + couponColumns + ` FROM coupons c WHERE c.code = $1`
+	if lock {
+		query += ` FOR UPDATE OF c`
+	}
+	c, err := scanCoupon(tx.QueryRowContext(ctx, query, code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, model.ErrCouponNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if err := c.Check(plan, price, time.Now()); err != nil {
+		return nil, err
+	}
+	if c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions {
+		return nil, model.ErrCouponExhausted
+	}
+
+	var used int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM coupon_redemptions WHERE code = $1 AND user_id = $2
+	`, c.Code, userID).Scan(&used); err != nil {
+		return nil, err
+	}
+	if used >= c.PerUserLimit {
+		return nil, model.ErrCouponAlreadyUsed
+	}
+	return c, nil
+}
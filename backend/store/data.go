@@ -3,6 +3,8 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -20,11 +22,41 @@ func NewDataRepository(db *sql.DB) *DataRepository {
 
 // ==================== SYNC OPERATIONS ====================
 
+var (
+	// ErrSyncMissingID — элемент пакета без ID, он пропускается
+	ErrSyncMissingID = errors.New("missing ID")
+	// ErrSyncNotOwned — запись с таким ID принадлежит другому пользователю
+	ErrSyncNotOwned = errors.New("item belongs to another user")
+)
+
+// SyncSaveResult — результат сохранения каждого элемента пакета, по порядку
+// внутри типа: nil — сохранен, иначе ErrSyncMissingID или ErrSyncNotOwned
+type SyncSaveResult struct {
+	Notes   []error
+	Folders []error
+	Files   []error
+	Tags    []error
+}
+
 // SaveSyncData выполняет массовое сохранение изменений (Push) с использованием подготовленных statements
 func (r *DataRepository) SaveSyncData(ctx context.Context, userID string, payload model.SyncPayload) error {
+	_, err := r.SaveSyncBatch(ctx, userID, payload)
+	return err
+}
+
+// SaveSyncBatch сохраняет пакет одной транзакцией и сообщает, что стало с
+// каждым элементом. Ошибка — транзакция не прошла и ничего не сохранено.
+func (r *DataRepository) SaveSyncBatch(ctx context.Context, userID string, payload model.SyncPayload) (*SyncSaveResult, error) {
+	res := &SyncSaveResult{
+		Notes:   make([]error, len(payload.Notes)),
+		Folders: make([]error, len(payload.Folders)),
+		Files:   make([]error, len(payload.Files)),
+		Tags:    make([]error, len(payload.Tags)),
+	}
+
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
@@ -42,12 +74,13 @@ func (r *DataRepository) SaveSyncData(ctx context.Context, userID string, payloa
 			WHERE notes.user_id = $2
 		`)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer stmt.Close()
 
-		for _, n := range payload.Notes {
+		for i, n := range payload.Notes {
 			if n.ID == "" {
+				res.Notes[i] = ErrSyncMissingID
 				continue
 			}
 			tagsJSON := n.Tags
@@ -60,14 +93,15 @@ func (r *DataRepository) SaveSyncData(ctx context.Context, userID string, payloa
 			}
 			noteSize := int64(len(n.Content))
 
-			_, err := stmt.ExecContext(ctx,
+			result, err := stmt.ExecContext(ctx,
 				n.ID, userID, n.FolderID, n.Title, n.Content, noteSize,
 				n.IsPinned, n.IsArchived, n.IsDeleted, n.Color, n.CoverImage,
 				tagsJSON, attJSON, n.CreatedAt, n.UpdatedAt)
 			if err != nil {
 				log.Printf("Push Note Error (ID: %s): %v", n.ID, err)
-				return err
+				return nil, err
 			}
+			res.Notes[i] = syncRowResult(result)
 		}
 	}
 
@@ -82,19 +116,21 @@ func (r *DataRepository) SaveSyncData(ctx context.Context, userID string, payloa
 			WHERE folders.user_id = $2
 		`)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer stmt.Close()
 
-		for _, f := range payload.Folders {
+		for i, f := range payload.Folders {
 			if f.ID == "" {
+				res.Folders[i] = ErrSyncMissingID
 				continue
 			}
-			_, err := stmt.ExecContext(ctx, f.ID, userID, f.ParentID, f.Name, f.Color, f.IsDeleted, f.UpdatedAt)
+			result, err := stmt.ExecContext(ctx, f.ID, userID, f.ParentID, f.Name, f.Color, f.IsDeleted, f.UpdatedAt)
 			if err != nil {
 				log.Printf("Push Folder Error: %v", err)
-				return err
+				return nil, err
 			}
+			res.Folders[i] = syncRowResult(result)
 		}
 	}
 
@@ -119,12 +155,13 @@ func (r *DataRepository) SaveSyncData(ctx context.Context, userID string, payloa
 			WHERE files.user_id = $2
 		`)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer stmt.Close()
 
-		for _, f := range payload.Files {
+		for i, f := range payload.Files {
 			if f.ID == "" {
+				res.Files[i] = ErrSyncMissingID
 				continue
 			}
 			created := f.CreatedAt
@@ -137,11 +174,12 @@ func (r *DataRepository) SaveSyncData(ctx context.Context, userID string, payloa
 			}
 			isUploadedByClient := f.S3Key != nil && *f.S3Key != ""
 
-			_, err := stmt.ExecContext(ctx, f.ID, userID, f.NoteID, f.Name, f.Type, f.Size, f.S3Key, isUploadedByClient, created, updated)
+			result, err := stmt.ExecContext(ctx, f.ID, userID, f.NoteID, f.Name, f.Type, f.Size, f.S3Key, isUploadedByClient, created, updated)
 			if err != nil {
 				log.Printf("Push File Error (ID: %s): %v", f.ID, err)
-				return err
+				return nil, err
 			}
+			res.Files[i] = syncRowResult(result)
 		}
 	}
 
@@ -155,28 +193,64 @@ func (r *DataRepository) SaveSyncData(ctx context.Context, userID string, payloa
 			WHERE tags.user_id = $2
 		`)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer stmt.Close()
 
-		for _, t := range payload.Tags {
+		for i, t := range payload.Tags {
 			if t.ID == "" {
+				res.Tags[i] = ErrSyncMissingID
 				continue
 			}
-			_, err := stmt.ExecContext(ctx, t.ID, userID, t.Name, t.Color, t.UpdatedAt)
+			result, err := stmt.ExecContext(ctx, t.ID, userID, t.Name, t.Color, t.UpdatedAt)
 			if err != nil {
 				log.Printf("Push Tag Error: %v", err)
-				return err
+				return nil, err
 			}
+			res.Tags[i] = syncRowResult(result)
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// syncRowResult: upsert не меняет строк, если запись с этим ID чужая
+func syncRowResult(result sql.Result) error {
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrSyncNotOwned
+	}
+	return nil
 }
 
 // GetSyncData возвращает изменения с момента last_sync (Pull)
 // limit <= 0 означает отсутствие ограничения
 func (r *DataRepository) GetSyncData(ctx context.Context, userID string, since string, limit int) (*model.SyncPayload, error) {
+	return r.getSyncData(ctx, limit, "server_updated_at > $2", userID, since)
+}
+
+// GetSyncPage возвращает до limit изменений каждого типа после курсора after.
+// Записи идут в порядке (server_updated_at, id): ID различает записи одного
+// push, у которых server_updated_at совпадает.
+func (r *DataRepository) GetSyncPage(ctx context.Context, userID string, after model.SyncCursor, limit int) (*model.SyncPayload, error) {
+	// Без ID сравнение (server_updated_at, id) > ($2, NULL) равно server_updated_at > $2
+	afterID := sql.NullString{String: after.ID, Valid: after.ID != ""}
+	return r.getSyncData(ctx, limit, "(server_updated_at, id) > ($2, $3)", userID, after.Time, afterID)
+}
+
+// getSyncData выбирает изменения всех типов по условию cond с аргументами args;
+// limit передается последним аргументом
+func (r *DataRepository) getSyncData(ctx context.Context, limit int, cond string, args ...interface{}) (*model.SyncPayload, error) {
+	query := func(q string) (*sql.Rows, error) {
+		q += " AND " + cond + " ORDER BY server_updated_at, id"
+		if limit > 0 {
+			return r.db.QueryContext(ctx, q+fmt.Sprintf(" LIMIT $%d", len(args)+1), append(args, limit)...)
+		}
+		return r.db.QueryContext(ctx, q, args...)
+	}
+
 	resp := &model.SyncPayload{
 		Notes:   []model.NoteDTO{},
 		Folders: []model.FolderDTO{},
@@ -188,14 +262,8 @@ func (r *DataRepository) GetSyncData(ctx context.Context, userID string, since s
 	notesQuery := `
 		SELECT id, folder_id, title, content, is_pinned, is_archived, is_deleted, color, cover_image, tags, attachments, created_at, updated_at, server_updated_at
 		FROM notes
-		WHERE user_id=$1 AND server_updated_at > $2`
-	var rows *sql.Rows
-	var err error
-	if limit > 0 {
-		rows, err = r.db.QueryContext(ctx, notesQuery+" LIMIT $3", userID, since, limit)
-	} else {
-		rows, err = r.db.QueryContext(ctx, notesQuery, userID, since)
-	}
+		WHERE user_id=$1`
+	rows, err := query(notesQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -229,13 +297,8 @@ func (r *DataRepository) GetSyncData(ctx context.Context, userID string, since s
 	foldersQuery := `
 		SELECT id, parent_id, name, color, is_deleted, updated_at, server_updated_at
 		FROM folders
-		WHERE user_id=$1 AND server_updated_at > $2`
-	var fRows *sql.Rows
-	if limit > 0 {
-		fRows, err = r.db.QueryContext(ctx, foldersQuery+" LIMIT $3", userID, since, limit)
-	} else {
-		fRows, err = r.db.QueryContext(ctx, foldersQuery, userID, since)
-	}
+		WHERE user_id=$1`
+	fRows, err := query(foldersQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -262,13 +325,8 @@ func (r *DataRepository) GetSyncData(ctx context.Context, userID string, since s
 	filesQuery := `
 		SELECT id, note_id, name, type, size, s3_key, created_at, updated_at, server_updated_at
 		FROM files
-		WHERE user_id=$1 AND server_updated_at > $2`
-	var flRows *sql.Rows
-	if limit > 0 {
-		flRows, err = r.db.QueryContext(ctx, filesQuery+" LIMIT $3", userID, since, limit)
-	} else {
-		flRows, err = r.db.QueryContext(ctx, filesQuery, userID, since)
-	}
+		WHERE user_id=$1`
+	flRows, err := query(filesQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -297,13 +355,8 @@ func (r *DataRepository) GetSyncData(ctx context.Context, userID string, since s
 	tagsQuery := `
 		SELECT id, name, color, updated_at, server_updated_at
 		FROM tags
-		WHERE user_id=$1 AND server_updated_at > $2`
-	var tRows *sql.Rows
-	if limit > 0 {
-		tRows, err = r.db.QueryContext(ctx, tagsQuery+" LIMIT $3", userID, since, limit)
-	} else {
-		tRows, err = r.db.QueryContext(ctx, tagsQuery, userID, since)
-	}
+		WHERE user_id=$1`
+	tRows, err := query(tagsQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -361,20 +361,20 @@ func TestGetSyncData_WithLimit(t *testing.T) {
 	notesRows := sqlmock.NewRows([]string{"id", "folder_id", "title", "content", "is_pinned", "is_archived", "is_deleted", "color", "cover_image", "tags", "attachments", "created_at", "updated_at", "server_updated_at"}).
 		AddRow("note1", nil, "Title 1", "Content 1", false, false, false, "", "", []byte(`[]`), []byte(`[]`), now, now, now)
 
-	mock.ExpectQuery(`SELECT id, folder_id, title, content, is_pinned, is_archived, is_deleted, color, cover_image, tags, attachments, created_at, updated_at, server_updated_at FROM notes WHERE user_id=\$1 AND server_updated_at > \$2 LIMIT \$3`).
+	mock.ExpectQuery(`SELECT id, folder_id, title, content, is_pinned, is_archived, is_deleted, color, cover_image, tags, attachments, created_at, updated_at, server_updated_at FROM notes WHERE user_id=\$1 AND server_updated_at > \$2 ORDER BY server_updated_at, id LIMIT \$3`).
 		WithArgs("user123", "1970-01-01T00:00:00Z", 10).
 		WillReturnRows(notesRows)
 
 	// Mock other tables with limit
-	mock.ExpectQuery(`SELECT id, parent_id, name, color, is_deleted, updated_at, server_updated_at FROM folders WHERE user_id=\$1 AND server_updated_at > \$2 LIMIT \$3`).
+	mock.ExpectQuery(`SELECT id, parent_id, name, color, is_deleted, updated_at, server_updated_at FROM folders WHERE user_id=\$1 AND server_updated_at > \$2 ORDER BY server_updated_at, id LIMIT \$3`).
 		WithArgs("user123", "1970-01-01T00:00:00Z", 10).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "parent_id", "name", "color", "is_deleted", "updated_at", "server_updated_at"}))
 
-	mock.ExpectQuery(`SELECT id, note_id, name, type, size, s3_key, created_at, updated_at, server_updated_at FROM files WHERE user_id=\$1 AND server_updated_at > \$2 LIMIT \$3`).
+	mock.ExpectQuery(`SELECT id, note_id, name, type, size, s3_key, created_at, updated_at, server_updated_at FROM files WHERE user_id=\$1 AND server_updated_at > \$2 ORDER BY server_updated_at, id LIMIT \$3`).
 		WithArgs("user123", "1970-01-01T00:00:00Z", 10).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "note_id", "name", "type", "size", "s3_key", "created_at", "updated_at", "server_updated_at"}))
 
-	mock.ExpectQuery(`SELECT id, name, color, updated_at, server_updated_at FROM tags WHERE user_id=\$1 AND server_updated_at > \$2 LIMIT \$3`).
+	mock.ExpectQuery(`SELECT id, name, color, updated_at, server_updated_at FROM tags WHERE user_id=\$1 AND server_updated_at > \$2 ORDER BY server_updated_at, id LIMIT \$3`).
 		WithArgs("user123", "1970-01-01T00:00:00Z", 10).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "color", "updated_at", "server_updated_at"}))
 
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"noteflow/model"
+	"time"
+)
+
+// IdentityRepository хранит привязки внешних OIDC-провайдеров, состояние
+// незавершенных входов и хранилище ключа E2EE пользователя
+type IdentityRepository struct {
+	db *sql.DB
+}
+
+func NewIdentityRepository(db *sql.DB) *IdentityRepository {
+	return &IdentityRepository{db: db}
+}
+
+// ==================== IDENTITIES ====================
+
+// GetUserIDByIdentity возвращает пользователя, привязанного к (provider, subject), или sql.ErrNoRows
+func (r *IdentityRepository) GetUserIDByIdentity(ctx context.Context, provider, subject string) (string, error) {
+	var userID string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2
+	`, provider, subject).Scan(&userID)
+	return userID, err
+}
+
+// GetUserIDByEmail ищет пользователя по email без учета регистра (для привязки по подтвержденному email)
+func (r *IdentityRepository) GetUserIDByEmail(ctx context.Context, email string) (string, error) {
+	var userID string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id FROM users WHERE lower(email) = lower($1)
+	`, email).Scan(&userID)
+	return userID, err
+}
+
+// CreateIdentity привязывает учетную запись провайдера к пользователю.
+// Возвращает false, если у пользователя уже есть привязка к этому провайдеру
+// или учетная запись привязана к другому пользователю.
+func (r *IdentityRepository) CreateIdentity(ctx context.Context, userID, provider, subject, email string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NOW())
+		ON CONFLICT DO NOTHING
+	`, userID, provider, subject, email)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CreateUserWithIdentity создает пользователя без пароля и привязку в одной транзакции
+func (r *IdentityRepository) CreateUserWithIdentity(ctx context.Context, email, provider, subject string) (string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (email, password_hash) VALUES ($1, '') RETURNING id
+	`, email).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`, userID, provider, subject, email)
+	if err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit()
+}
+
+// TouchIdentity обновляет время входа и email, который сообщил провайдер
+func (r *IdentityRepository) TouchIdentity(ctx context.Context, provider, subject, email string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE user_identities
+		SET last_login_at = NOW(), email = COALESCE(NULLIF($3, ''), email)
+		WHERE provider = $1 AND subject = $2
+	`, provider, subject, email)
+	return err
+}
+
+// ListIdentities возвращает привязанные провайдеры пользователя
+func (r *IdentityRepository) ListIdentities(ctx context.Context, userID string) ([]model.UserIdentity, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, user_id, provider, subject, email, created_at, last_login_at
+		FROM user_identities WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []model.UserIdentity{}
+	for rows.Next() {
+		var i model.UserIdentity
+		if err := rows.Scan(&i.ID, &i.UserID, &i.Provider, &i.Subject, &i.Email, &i.CreatedAt, &i.LastLoginAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteIdentity отвязывает провайдера. Последний способ входа удалить нельзя:
+// привязка удаляется, только если у пользователя есть пароль или другой провайдер.
+// Возвращает (найдена, удалена).
+func (r *IdentityRepository) DeleteIdentity(ctx context.Context, userID, identityID string) (bool, bool, error) {
+	var exists, deleted bool
+	err := r.db.QueryRowContext(ctx, `
+		WITH target AS (
+			SELECT id FROM user_identities WHERE id::text = $2 AND user_id = $1
+		), removed AS (
+			DELETE FROM user_identities
+			WHERE id IN (SELECT id FROM target)
+			  AND (
+				EXISTS (SELECT 1 FROM users WHERE id = $1 AND password_hash <> '')
+				OR (SELECT COUNT(*) FROM user_identities WHERE user_id = $1) > 1
+			  )
+			RETURNING id
+		)
+		SELECT EXISTS (SELECT 1 FROM target), EXISTS (SELECT 1 FROM removed)
+	`, userID, identityID).Scan(&exists, &deleted)
+	return exists, deleted, err
+}
+
+// ==================== LOGIN STATE ====================
+
+// CreateLoginState сохраняет state незавершенного входа
+func (r *IdentityRepository) CreateLoginState(ctx context.Context, s model.OIDCLoginState) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, link_user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, s.StateHash, s.Provider, s.Nonce, s.CodeVerifier, s.LinkUserID, s.ExpiresAt)
+	return err
+}
+
+// ConsumeLoginState атомарно удаляет и возвращает неистекший state (одноразовый) или sql.ErrNoRows
+func (r *IdentityRepository) ConsumeLoginState(ctx context.Context, stateHash string) (*model.OIDCLoginState, error) {
+	var s model.OIDCLoginState
+	err := r.db.QueryRowContext(ctx, `
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING state_hash, provider, nonce, code_verifier, link_user_id::text, expires_at
+	`, stateHash).Scan(&s.StateHash, &s.Provider, &s.Nonce, &s.CodeVerifier, &s.LinkUserID, &s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateLoginCode сохраняет хеш одноразового кода обмена результата входа на токены
+func (r *IdentityRepository) CreateLoginCode(ctx context.Context, codeHash, userID string, createdUser bool, ttl time.Duration) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO oidc_login_codes (code_hash, user_id, created_user, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, codeHash, userID, createdUser, time.Now().Add(ttl))
+	return err
+}
+
+// ConsumeLoginCode погашает код и возвращает пользователя или sql.ErrNoRows
+func (r *IdentityRepository) ConsumeLoginCode(ctx context.Context, codeHash string) (string, bool, error) {
+	var userID string
+	var createdUser bool
+	err := r.db.QueryRowContext(ctx, `
+		DELETE FROM oidc_login_codes
+		WHERE code_hash = $1 AND expires_at > NOW()
+		RETURNING user_id, created_user
+	`, codeHash).Scan(&userID, &createdUser)
+	return userID, createdUser, err
+}
+
+// DeleteExpiredLoginStates удаляет истекшие state и коды входа
+func (r *IdentityRepository) DeleteExpiredLoginStates(ctx context.Context) (int64, error) {
+	var total int64
+	for _, query := range []string{
+		`DELETE FROM oidc_login_states WHERE expires_at < NOW()`,
+		`DELETE FROM oidc_login_codes WHERE expires_at < NOW()`,
+	} {
+		res, err := r.db.ExecContext(ctx, query)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// ==================== VAULT ====================
+
+// GetVault возвращает хранилище ключа пользователя или sql.ErrNoRows
+func (r *IdentityRepository) GetVault(ctx context.Context, userID string) (*model.Vault, error) {
+	var v model.Vault
+	var kdf []byte
+	err := r.db.QueryRowContext(ctx, `
+		SELECT wrapped_key, kdf, version, updated_at FROM user_vaults WHERE user_id = $1
+	`, userID).Scan(&v.WrappedKey, &kdf, &v.Version, &v.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	v.KDF = kdf
+	return &v, nil
+}
+
+// HasVault сообщает, настроено ли хранилище ключа
+func (r *IdentityRepository) HasVault(ctx context.Context, userID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM user_vaults WHERE user_id = $1)
+	`, userID).Scan(&exists)
+	return exists, err
+}
+
+// PutVault создает или заменяет хранилище. expectedVersion — версия, которую
+// клиент видел (0 — хранилища еще нет): так одно устройство не перезапишет
+// ключ, сохраненный другим. Возвращает false при конфликте версий.
+func (r *IdentityRepository) PutVault(ctx context.Context, userID string, v *model.Vault, expectedVersion int) (bool, error) {
+	var err error
+	if expectedVersion == 0 {
+		err = r.db.QueryRowContext(ctx, `
+			INSERT INTO user_vaults (user_id, wrapped_key, kdf)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id) DO NOTHING
+			RETURNING version, updated_at
+		`, userID, v.WrappedKey, []byte(v.KDF)).Scan(&v.Version, &v.UpdatedAt)
+	} else {
+		err = r.db.QueryRowContext(ctx, `
+			UPDATE user_vaults
+			SET wrapped_key = $2, kdf = $3, version = version + 1, updated_at = NOW()
+			WHERE user_id = $1 AND version = $4
+			RETURNING version, updated_at
+		`, userID, v.WrappedKey, []byte(v.KDF), expectedVersion).Scan(&v.Version, &v.UpdatedAt)
+	}
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
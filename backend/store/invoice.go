@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"noteflow/model"
+)
+
+// InvoiceRepository — история оплат и счета пользователя. Счета выдает
+// PaymentRepository.ApplyPaymentStatus в транзакции успешной оплаты.
+type InvoiceRepository struct {
+	db *sql.DB
+}
+
+func NewInvoiceRepository(db *sql.DB) *InvoiceRepository {
+	return &InvoiceRepository{db: db}
+}
+
+// ListBillingHistory возвращает транзакции пользователя, созданные раньше
+// before (нулевое время — с последней), новые первыми, с номерами счетов
+func (r *InvoiceRepository) ListBillingHistory(ctx context.Context, userID string, before time.Time, limit int) ([]model.BillingRecord, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+transactionFields+`, COALESCE(i.number, '')
+		FROM transactions t
+		LEFT JOIN invoices i ON i.transaction_id = t.id
+		WHERE t.user_id = $1 AND ($2::TIMESTAMPTZ IS NULL OR t.created_at < $2)
+		ORDER BY t.created_at DESC
+		LIMIT $3
+	`, userID, sql.NullTime{Time: before, Valid: !before.IsZero()}, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []model.BillingRecord{}
+	for rows.Next() {
+		var rec model.BillingRecord
+		if err := scanTransaction(rows, &rec.Transaction, &rec.InvoiceNumber); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// GetInvoice возвращает счет за платеж paymentID пользователя userID
+// (sql.ErrNoRows — платежа нет или он не оплачен)
+func (r *InvoiceRepository) GetInvoice(ctx context.Context, userID, paymentID string) (*model.Invoice, error) {
+	var inv model.Invoice
+	row := r.db.QueryRowContext(ctx, `
+		SELECT `+transactionFields+`, i.number, i.issued_at, i.customer_email
+		FROM invoices i
+		JOIN transactions t ON t.id = i.transaction_id
+		WHERE t.payment_id = $1 AND i.user_id = $2
+	`, paymentID, userID)
+	if err := scanTransaction(row, &inv.Transaction, &inv.Number, &inv.IssuedAt, &inv.Email); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// issueInvoice выдает счет за оплаченную транзакцию в транзакции БД tx.
+// Счетчик года блокируется до конца tx, поэтому номера идут без пропусков.
+func issueInvoice(ctx context.Context, tx *sql.Tx, transactionID, userID string) error {
+	_, err := tx.ExecContext(ctx, `
+		WITH n AS (
+			INSERT INTO invoice_counters (year, last_number)
+			VALUES (EXTRACT(YEAR FROM NOW() AT TIME ZONE 'UTC')::INT, 1)
+			ON CONFLICT (year) DO UPDATE SET last_number = invoice_counters.last_number + 1
+			RETURNING year, last_number
+		)
+		INSERT INTO invoices (number, transaction_id, user_id, customer_email)
+		SELECT n.year || '-' || lpad(n.last_number::TEXT, 6, '0'), $1, u.id, u.email
+		FROM n, users u
+		WHERE u.id = $2
+	`, transactionID, userID)
+	return err
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestListBillingHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewInvoiceRepository(db)
+	now := time.Now()
+	columns := append(append([]string{}, transactionColumns...), "number")
+
+	// Первая страница — без ограничения по времени
+	mock.ExpectQuery(regexp.QuoteMeta("LEFT JOIN invoices")).
+		WithArgs("user-1", sql.NullTime{}, 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("tx2", "user-1", "p2", "medium", 2990.0, "RUB", "yearly", "succeeded", 0.0, []byte(`{}`), now, now, "2026-000002").
+			AddRow("tx1", "user-1", "p1", "medium", 299.0, "RUB", "monthly", "canceled", 0.0, []byte(`{}`), now, now, ""))
+
+	records, err := repo.ListBillingHistory(context.Background(), "user-1", time.Time{}, 2)
+	if err != nil {
+		t.Fatalf("ListBillingHistory failed: %v", err)
+	}
+	if len(records) != 2 || records[0].InvoiceNumber != "2026-000002" || records[0].Period != model.PeriodYearly ||
+		records[1].InvoiceNumber != "" || records[1].Status != model.TransactionCanceled {
+		t.Errorf("unexpected records: %+v", records)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"noteflow/model"
+	"time"
+)
+
+// SigningKeyRepository хранит ключи подписи access-токенов, общие для всех реплик
+type SigningKeyRepository struct {
+	db *sql.DB
+}
+
+func NewSigningKeyRepository(db *sql.DB) *SigningKeyRepository {
+	return &SigningKeyRepository{db: db}
+}
+
+// ListSigningKeys возвращает ключи, которые еще годятся для проверки токенов
+func (r *SigningKeyRepository) ListSigningKeys(ctx context.Context) ([]model.SigningKey, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT kid, algorithm, public_key, private_key, kek_id, created_at, not_before, retires_at, expires_at
+		FROM signing_keys
+		WHERE expires_at > NOW()
+		ORDER BY not_before
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []model.SigningKey
+	for rows.Next() {
+		var k model.SigningKey
+		if err := rows.Scan(&k.KID, &k.Algorithm, &k.PublicKey, &k.PrivateKey, &k.KEKID, &k.CreatedAt, &k.NotBefore, &k.RetiresAt, &k.ExpiresAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// CreateSigningKeyIfNeeded сохраняет ключ, только если ни один существующий ключ,
+// зашифрованный тем же секретом (kek_id), не подписывает токены дольше coveredUntil.
+// Advisory-lock не дает нескольким репликам одновременно выпустить лишние ключи.
+// Возвращает true, если ключ сохранен.
+func (r *SigningKeyRepository) CreateSigningKeyIfNeeded(ctx context.Context, key model.SigningKey, coveredUntil time.Time) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('signing_keys'))"); err != nil {
+		return false, err
+	}
+
+	var covered bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM signing_keys WHERE retires_at > $1 AND kek_id = $2)
+	`, coveredUntil, key.KEKID).Scan(&covered)
+	if err != nil {
+		return false, err
+	}
+	if covered {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO signing_keys (kid, algorithm, public_key, private_key, kek_id, not_before, retires_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, key.KID, key.Algorithm, key.PublicKey, key.PrivateKey, key.KEKID, key.NotBefore, key.RetiresAt, key.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// DeleteExpiredSigningKeys удаляет ключи, которыми больше нельзя проверить ни один токен
+func (r *SigningKeyRepository) DeleteExpiredSigningKeys(ctx context.Context) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM signing_keys WHERE expires_at < NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
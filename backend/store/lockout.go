@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"noteflow/model"
+	"time"
+)
+
+// LoginAttemptRepository считает неудачные попытки входа по аккаунту
+type LoginAttemptRepository struct {
+	db *sql.DB
+}
+
+func NewLoginAttemptRepository(db *sql.DB) *LoginAttemptRepository {
+	return &LoginAttemptRepository{db: db}
+}
+
+// ==================== LOGIN ATTEMPTS ====================
+
+// GetBlockedUntil возвращает время, до которого вход по ключу запрещен
+// (нулевое время — ограничений нет)
+func (r *LoginAttemptRepository) GetBlockedUntil(ctx context.Context, emailHash string) (time.Time, error) {
+	var until sql.NullTime
+	err := r.db.QueryRowContext(ctx, `
+		SELECT blocked_until FROM login_attempts WHERE email_hash = $1 AND blocked_until > NOW()
+	`, emailHash).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until.Time, err
+}
+
+// RecordFailure увеличивает счетчик неудачных попыток (счетчик старше resetAfter
+// начинается заново) и запрещает вход на время, которое вернет delay.
+// userID пустой, если аккаунта с таким email нет.
+// Возвращает время окончания запрета и true, если этой попыткой аккаунт
+// впервые достиг порога блокировки.
+func (r *LoginAttemptRepository) RecordFailure(ctx context.Context, emailHash, userID string, resetAfter time.Duration, delay func(failures int) (time.Duration, bool)) (time.Time, bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	var failures int
+	var wasLocked bool
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO login_attempts (email_hash, user_id, failed_count, last_failed_at)
+		VALUES ($1, NULLIF($2, '')::uuid, 1, NOW())
+		ON CONFLICT (email_hash) DO UPDATE SET
+			failed_count = CASE WHEN login_attempts.last_failed_at < NOW() - make_interval(secs => $3)
+				THEN 1 ELSE login_attempts.failed_count + 1 END,
+			locked = login_attempts.locked AND login_attempts.last_failed_at >= NOW() - make_interval(secs => $3),
+			user_id = EXCLUDED.user_id,
+			last_failed_at = NOW()
+		RETURNING failed_count, locked
+	`, emailHash, userID, resetAfter.Seconds()).Scan(&failures, &wasLocked)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	wait, locked := delay(failures)
+	var until time.Time
+	if wait > 0 {
+		until = time.Now().Add(wait)
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE login_attempts SET blocked_until = $2, locked = locked OR $3 WHERE email_hash = $1
+	`, emailHash, sql.NullTime{Time: until, Valid: wait > 0}, locked)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return until, locked && !wasLocked, tx.Commit()
+}
+
+// Reset сбрасывает счетчик после успешного входа
+func (r *LoginAttemptRepository) Reset(ctx context.Context, emailHash string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE email_hash = $1", emailHash)
+	return err
+}
+
+// ListLockouts возвращает существующие аккаунты с действующим запретом входа
+// или достигнутым порогом блокировки
+func (r *LoginAttemptRepository) ListLockouts(ctx context.Context) ([]model.LoginLockout, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT a.user_id, u.email, a.failed_count, a.last_failed_at, a.blocked_until, a.locked
+		FROM login_attempts a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.locked OR a.blocked_until > NOW()
+		ORDER BY a.last_failed_at DESC
+		LIMIT 500
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []model.LoginLockout{}
+	for rows.Next() {
+		var l model.LoginLockout
+		var until sql.NullTime
+		if err := rows.Scan(&l.UserID, &l.Email, &l.FailedCount, &l.LastFailedAt, &until, &l.Locked); err != nil {
+			return nil, err
+		}
+		if until.Valid {
+			l.BlockedUntil = &until.Time
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// UnlockUser снимает блокировку входа с аккаунта (администратором).
+// Возвращает false, если блокировки не было.
+func (r *LoginAttemptRepository) UnlockUser(ctx context.Context, userID string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE user_id = $1", userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteStale удаляет счетчики без ошибок дольше resetAfter и без действующего запрета
+func (r *LoginAttemptRepository) DeleteStale(ctx context.Context, resetAfter time.Duration) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM login_attempts
+		WHERE last_failed_at < NOW() - make_interval(secs => $1)
+		  AND (blocked_until IS NULL OR blocked_until < NOW())
+	`, resetAfter.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
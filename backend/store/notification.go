@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"noteflow/model"
+)
+
+// NotificationRepository хранит уведомления пользователей в приложении
+type NotificationRepository struct {
+	db *sql.DB
+}
+
+func NewNotificationRepository(db *sql.DB) *NotificationRepository {
+	return &NotificationRepository{db: db}
+}
+
+// ==================== NOTIFICATIONS ====================
+
+// CreateNotification добавляет уведомление пользователю
+func (r *NotificationRepository) CreateNotification(ctx context.Context, userID, kind, title, body string) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO user_notifications (user_id, kind, title, body) VALUES ($1, $2, $3, $4)
+	`, userID, kind, title, body)
+	return err
+}
+
+// ListNotifications возвращает последние 50 уведомлений пользователя
+func (r *NotificationRepository) ListNotifications(ctx context.Context, userID string) ([]model.Notification, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, kind, title, body, created_at, read_at
+		FROM user_notifications
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 50
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []model.Notification{}
+	for rows.Next() {
+		var n model.Notification
+		var readAt sql.NullTime
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Title, &n.Body, &n.CreatedAt, &readAt); err != nil {
+			return nil, err
+		}
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// MarkNotificationsRead отмечает все уведомления пользователя прочитанными
+func (r *NotificationRepository) MarkNotificationsRead(ctx context.Context, userID string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE user_notifications SET read_at = NOW() WHERE user_id = $1 AND read_at IS NULL
+	`, userID)
+	return err
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SyncChannel — канал LISTEN/NOTIFY для событий синхронизации
+const SyncChannel = "noteflow_sync"
+
+// PGNotifier рассылает события синхронизации через Postgres LISTEN/NOTIFY,
+// чтобы уведомление, отправленное одним экземпляром API, дошло до всех остальных.
+// Реализует api.BrokerBackend.
+type PGNotifier struct {
+	db      *sql.DB
+	dbURL   string
+	channel string
+}
+
+// NewPGNotifier создает бэкенд брокера поверх существующей БД
+func (s *Store) NewPGNotifier(channel string) *PGNotifier {
+	return &PGNotifier{
+		db:      s.DB,
+		dbURL:   s.dbURL,
+		channel: channel,
+	}
+}
+
+// Publish отправляет NOTIFY с ID пользователя в качестве payload
+func (n *PGNotifier) Publish(ctx context.Context, userID string) error {
+	_, err := n.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", n.channel, userID)
+	return err
+}
+
+// Listen открывает выделенное соединение (пул database/sql не подходит для LISTEN)
+// и вызывает deliver для каждого уведомления, пока не отменен ctx
+func (n *PGNotifier) Listen(ctx context.Context, deliver func(userID string)) error {
+	conn, err := pgx.Connect(ctx, n.dbURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{n.channel}.Sanitize()); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		deliver(notification.Payload)
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// LISTEN/NOTIFY нельзя проверить через sqlmock: тест идет на настоящей БД
+// из NOTEFLOW_TEST_DB_URL и пропускается, если она не задана
+func newTestNotifier(t *testing.T, channel string) *PGNotifier {
+	t.Helper()
+	url := os.Getenv("NOTEFLOW_TEST_DB_URL")
+	if url == "" {
+		t.Skip("NOTEFLOW_TEST_DB_URL is not set")
+	}
+	st, err := New(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.DB.Close() })
+	return st.NewPGNotifier(channel)
+}
+
+// listenUntilDelivered запускает Listen и публикует userID, пока уведомление
+// не дойдет: LISTEN выполняется асинхронно, и первые NOTIFY могут уйти раньше
+func listenUntilDelivered(t *testing.T, ctx context.Context, n *PGNotifier, userID string) <-chan error {
+	t.Helper()
+	delivered := make(chan string, 16)
+	done := make(chan error, 1)
+	go func() { done <- n.Listen(ctx, func(id string) { delivered <- id }) }()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		if err := n.Publish(ctx, userID); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+		select {
+		case id := <-delivered:
+			if id != userID {
+				t.Fatalf("delivered %q, want %q", id, userID)
+			}
+			return done
+		case err := <-done:
+			t.Fatalf("Listen returned before delivery: %v", err)
+		case <-timeout:
+			t.Fatal("notification was not delivered")
+		case <-ticker.C:
+		}
+	}
+}
+
+func TestPGNotifier_DeliversAcrossConnections(t *testing.T) {
+	n := newTestNotifier(t, "noteflow_sync_test_deliver")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Publish идет через пул database/sql, Listen — через отдельное соединение
+	done := listenUntilDelivered(t, ctx, n, "user-1")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Listen returned %v after cancel, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not stop after cancel")
+	}
+}
+
+func TestPGNotifier_ListenAgainAfterDroppedConnection(t *testing.T) {
+	const channel = "noteflow_sync_test_reconnect"
+	n := newTestNotifier(t, channel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := listenUntilDelivered(t, ctx, n, "user-1")
+
+	// Сервер обрывает соединение слушателя: Listen возвращает ошибку, и
+	// брокер (api.SSEBroker.listen) вызывает его снова
+	if _, err := n.db.ExecContext(ctx, `
+		SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE pid <> pg_backend_pid() AND query = $1
+	`, `LISTEN "`+channel+`"`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Listen returned nil after the connection was dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not notice the dropped connection")
+	}
+
+	done = listenUntilDelivered(t, ctx, n, "user-2")
+	cancel()
+	<-done
+}
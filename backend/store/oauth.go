@@ -0,0 +1,342 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"noteflow/model"
+)
+
+// OAuthRepository хранит клиентов, согласия, коды авторизации и device-коды OAuth2.
+// Refresh-токены клиентов живут в общей таблице refresh_tokens (см. SessionRepository).
+type OAuthRepository struct {
+	db *sql.DB
+}
+
+func NewOAuthRepository(db *sql.DB) *OAuthRepository {
+	return &OAuthRepository{db: db}
+}
+
+// jsonList сериализует список для JSONB-колонки (nil -> [])
+func jsonList(items []string) ([]byte, error) {
+	if items == nil {
+		items = []string{}
+	}
+	return json.Marshal(items)
+}
+
+// ==================== CLIENTS ====================
+
+const clientColumns = `id, owner_user_id, name, secret_hash, redirect_uris, grant_types, scopes, created_at`
+
+func scanClient(row rowScanner) (*model.OAuthClient, error) {
+	var c model.OAuthClient
+	var redirectURIs, grantTypes, scopes []byte
+	if err := row.Scan(&c.ID, &c.OwnerUserID, &c.Name, &c.SecretHash, &redirectURIs, &grantTypes, &scopes, &c.CreatedAt); err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		raw []byte
+		dst *[]string
+	}{{redirectURIs, &c.RedirectURIs}, {grantTypes, &c.GrantTypes}, {scopes, &c.Scopes}} {
+		if err := json.Unmarshal(f.raw, f.dst); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// CreateClient регистрирует клиента; CreatedAt заполняется из БД
+func (r *OAuthRepository) CreateClient(ctx context.Context, c *model.OAuthClient) error {
+	redirectURIs, err := jsonList(c.RedirectURIs)
+	if err != nil {
+		return err
+	}
+	grantTypes, err := jsonList(c.GrantTypes)
+	if err != nil {
+		return err
+	}
+	scopes, err := jsonList(c.Scopes)
+	if err != nil {
+		return err
+	}
+
+	return r.db.QueryRowContext(ctx, `
+		INSERT INTO oauth_clients (id, owner_user_id, name, secret_hash, redirect_uris, grant_types, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at
+	`, c.ID, c.OwnerUserID, c.Name, c.SecretHash, redirectURIs, grantTypes, scopes).Scan(&c.CreatedAt)
+}
+
+// GetClient возвращает клиента или sql.ErrNoRows
+func (r *OAuthRepository) GetClient(ctx context.Context, clientID string) (*model.OAuthClient, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+clientColumns+` FROM oauth_clients WHERE id = $1`, clientID)
+	return scanClient(row)
+}
+
+// ListClients возвращает клиентов, зарегистрированных пользователем
+func (r *OAuthRepository) ListClients(ctx context.Context, ownerUserID string) ([]model.OAuthClient, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+clientColumns+` FROM oauth_clients
+		WHERE owner_user_id = $1
+		ORDER BY created_at DESC
+	`, ownerUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []model.OAuthClient{}
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *c)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteClient удаляет клиента владельца; каскадно удаляются его согласия,
+// коды и refresh-токены. Возвращает false, если клиент не найден.
+func (r *OAuthRepository) DeleteClient(ctx context.Context, ownerUserID, clientID string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM oauth_clients WHERE id = $1 AND owner_user_id = $2
+	`, clientID, ownerUserID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ==================== CONSENTS ====================
+
+// GetConsentScopes возвращает области, на которые пользователь уже согласился
+// (пустой список, если согласия нет)
+func (r *OAuthRepository) GetConsentScopes(ctx context.Context, userID, clientID string) ([]string, error) {
+	var raw []byte
+	err := r.db.QueryRowContext(ctx, `
+		SELECT scopes FROM oauth_consents WHERE user_id = $1 AND client_id = $2
+	`, userID, clientID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var scopes []string
+	err = json.Unmarshal(raw, &scopes)
+	return scopes, err
+}
+
+// SaveConsent сохраняет согласие пользователя (scopes — итоговый набор областей)
+func (r *OAuthRepository) SaveConsent(ctx context.Context, userID, clientID string, scopes []string) error {
+	raw, err := jsonList(scopes)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO oauth_consents (user_id, client_id, scopes)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, client_id) DO UPDATE
+		SET scopes = EXCLUDED.scopes, updated_at = NOW()
+	`, userID, clientID, raw)
+	return err
+}
+
+// ListConsents возвращает клиентов, которым пользователь выдал доступ
+func (r *OAuthRepository) ListConsents(ctx context.Context, userID string) ([]model.OAuthConsent, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT c.client_id, cl.name, c.scopes, c.created_at, c.updated_at
+		FROM oauth_consents c
+		JOIN oauth_clients cl ON cl.id = c.client_id
+		WHERE c.user_id = $1
+		ORDER BY c.updated_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := []model.OAuthConsent{}
+	for rows.Next() {
+		var c model.OAuthConsent
+		var raw []byte
+		if err := rows.Scan(&c.ClientID, &c.ClientName, &raw, &c.CreatedAt, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &c.Scopes); err != nil {
+			return nil, err
+		}
+		consents = append(consents, c)
+	}
+	return consents, rows.Err()
+}
+
+// RevokeConsent отзывает согласие и все refresh-токены клиента у пользователя.
+// Возвращает false, если согласия не было.
+func (r *OAuthRepository) RevokeConsent(ctx context.Context, userID, clientID string) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM oauth_consents WHERE user_id = $1 AND client_id = $2
+	`, userID, clientID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM refresh_tokens WHERE user_id = $1 AND client_id = $2
+	`, userID, clientID)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, tx.Commit()
+}
+
+// ==================== AUTHORIZATION CODES ====================
+
+// CreateAuthorizationCode сохраняет хеш кода авторизации
+func (r *OAuthRepository) CreateAuthorizationCode(ctx context.Context, code model.OAuthAuthorizationCode) error {
+	scopes, err := jsonList(code.Scopes)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, code.CodeHash, code.ClientID, code.UserID, code.RedirectURI, scopes, code.CodeChallenge, code.ExpiresAt)
+	return err
+}
+
+// ConsumeAuthorizationCode погашает код: удаление гарантирует однократное использование.
+// Код удаляется, только если совпали клиент, redirect_uri и PKCE challenge, —
+// тот, кто узнал код, не может погасить его раньше настоящего клиента.
+// Возвращает sql.ErrNoRows, если код не найден, истек или не совпал.
+func (r *OAuthRepository) ConsumeAuthorizationCode(ctx context.Context, codeHash, clientID, redirectURI, codeChallenge string) (*model.OAuthAuthorizationCode, error) {
+	var code model.OAuthAuthorizationCode
+	var scopes []byte
+	err := r.db.QueryRowContext(ctx, `
+		DELETE FROM oauth_authorization_codes
+		WHERE code_hash = $1 AND client_id = $2 AND redirect_uri = $3 AND code_challenge = $4 AND expires_at > NOW()
+		RETURNING code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at
+	`, codeHash, clientID, redirectURI, codeChallenge).Scan(&code.CodeHash, &code.ClientID, &code.UserID, &code.RedirectURI, &scopes, &code.CodeChallenge, &code.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(scopes, &code.Scopes); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// ==================== DEVICE CODES ====================
+
+const deviceCodeColumns = `device_code_hash, user_code, client_id, scopes, status, user_id, poll_interval, last_polled_at, expires_at`
+
+func scanDeviceCode(row rowScanner) (*model.OAuthDeviceCode, error) {
+	var dc model.OAuthDeviceCode
+	var scopes []byte
+	if err := row.Scan(&dc.DeviceCodeHash, &dc.UserCode, &dc.ClientID, &scopes, &dc.Status, &dc.UserID, &dc.PollInterval, &dc.LastPolledAt, &dc.ExpiresAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(scopes, &dc.Scopes); err != nil {
+		return nil, err
+	}
+	return &dc, nil
+}
+
+// CreateDeviceCode сохраняет запрос авторизации устройства
+func (r *OAuthRepository) CreateDeviceCode(ctx context.Context, dc model.OAuthDeviceCode) error {
+	scopes, err := jsonList(dc.Scopes)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO oauth_device_codes (device_code_hash, user_code, client_id, scopes, poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, dc.DeviceCodeHash, dc.UserCode, dc.ClientID, scopes, dc.PollInterval, dc.ExpiresAt)
+	return err
+}
+
+// GetDeviceCode возвращает device-код по хешу (в любом статусе, включая истекший)
+func (r *OAuthRepository) GetDeviceCode(ctx context.Context, deviceCodeHash string) (*model.OAuthDeviceCode, error) {
+	row := r.db.QueryRowContext(ctx, `
+		SELECT `+deviceCodeColumns+` FROM oauth_device_codes WHERE device_code_hash = $1
+	`, deviceCodeHash)
+	return scanDeviceCode(row)
+}
+
+// GetPendingDeviceCode возвращает ожидающий решения запрос по коду пользователя
+// или sql.ErrNoRows
+func (r *OAuthRepository) GetPendingDeviceCode(ctx context.Context, userCode string) (*model.OAuthDeviceCode, error) {
+	row := r.db.QueryRowContext(ctx, `
+		SELECT `+deviceCodeColumns+` FROM oauth_device_codes
+		WHERE user_code = $1 AND status = 'pending' AND expires_at > NOW()
+	`, userCode)
+	return scanDeviceCode(row)
+}
+
+// DecideDeviceCode фиксирует решение пользователя (approved / denied).
+// Возвращает false, если запрос уже обработан или истек.
+func (r *OAuthRepository) DecideDeviceCode(ctx context.Context, userCode, userID, status string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE oauth_device_codes SET status = $3, user_id = $2
+		WHERE user_code = $1 AND status = 'pending' AND expires_at > NOW()
+	`, userCode, userID, status)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// TouchDeviceCode запоминает время опроса и интервал (увеличивается при slow_down)
+func (r *OAuthRepository) TouchDeviceCode(ctx context.Context, deviceCodeHash string, pollInterval int) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE oauth_device_codes SET last_polled_at = NOW(), poll_interval = $2
+		WHERE device_code_hash = $1
+	`, deviceCodeHash, pollInterval)
+	return err
+}
+
+// ConsumeDeviceCode удаляет device-код в статусе status и возвращает его:
+// одобренный код обменивается на токены только один раз.
+// Возвращает sql.ErrNoRows, если код уже погашен или статус изменился.
+func (r *OAuthRepository) ConsumeDeviceCode(ctx context.Context, deviceCodeHash, status string) (*model.OAuthDeviceCode, error) {
+	row := r.db.QueryRowContext(ctx, `
+		DELETE FROM oauth_device_codes
+		WHERE device_code_hash = $1 AND status = $2
+		RETURNING `+deviceCodeColumns+`
+	`, deviceCodeHash, status)
+	return scanDeviceCode(row)
+}
+
+// DeleteExpiredCodes удаляет истекшие коды авторизации и device-коды
+func (r *OAuthRepository) DeleteExpiredCodes(ctx context.Context) (int64, error) {
+	var total int64
+	for _, query := range []string{
+		"DELETE FROM oauth_authorization_codes WHERE expires_at < NOW()",
+		"DELETE FROM oauth_device_codes WHERE expires_at < NOW()",
+	} {
+		res, err := r.db.ExecContext(ctx, query)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,224 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"noteflow/model"
+)
+
+var (
+	// ErrDuplicatePaymentEvent — событие уже обработано (повторная доставка вебхука)
+	ErrDuplicatePaymentEvent = errors.New("payment event already processed")
+	// ErrIllegalTransition — недопустимая смена статуса транзакции
+	ErrIllegalTransition = errors.New("illegal transaction status transition")
+)
+
+// PaymentRepository применяет изменения статусов платежей
+type PaymentRepository struct {
+	db *sql.DB
+}
+
+func NewPaymentRepository(db *sql.DB) *PaymentRepository {
+	return &PaymentRepository{db: db}
+}
+
+const transactionFields = `t.id, t.user_id, t.payment_id, t.tier, t.amount, t.currency, t.billing_period, t.status,
+	t.refunded_amount, t.metadata, t.created_at, t.updated_at`
+
+// scanTransaction читает транзакцию (transactionFields) и дополнительные колонки extra
+func scanTransaction(row rowScanner, t *model.Transaction, extra ...interface{}) error {
+	var tierStr, periodStr, statusStr string
+	dest := []interface{}{&t.ID, &t.UserID, &t.PaymentID, &tierStr, &t.Amount, &t.Currency, &periodStr, &statusStr,
+		&t.RefundedAmount, &t.Metadata, &t.CreatedAt, &t.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	t.Tier = model.UserTier(tierStr)
+	t.Period = model.BillingPeriod(periodStr)
+	t.Status = model.TransactionStatus(statusStr)
+	return nil
+}
+
+// PaymentUpdate — результат ApplyPaymentStatus
+type PaymentUpdate struct {
+	Transaction *model.Transaction
+	Previous    model.TransactionStatus
+	Changed     bool
+	// ExpiresAt — новый конец оплаченного периода (только после успешной оплаты)
+	ExpiresAt time.Time
+	// Хранилище после продления (для остальных платежей не заполняется)
+	StorageUsed  int64
+	StorageLimit int64
+}
+
+// OverQuota сообщает, что файлы пользователя не помещаются в лимит тарифа,
+// на который перешла подписка при продлении
+func (u PaymentUpdate) OverQuota() bool {
+	return u.StorageUsed > u.StorageLimit
+}
+
+// ApplyPaymentStatus переводит транзакцию paymentID в статус status. В одной
+// транзакции БД: событие записывается во входящие (event == nil — без записи),
+// строка транзакции блокируется, проверяется допустимость перехода, а при
+// успешной оплате пользователю выставляется тариф (на оплаченный период
+// транзакции или, для доплаты за повышение, до конца текущего периода) и
+// обновляется подписка и выдается счет. Поэтому параллельные вебхук и
+// проверка статуса не применят оплату дважды.
+func (r *PaymentRepository) ApplyPaymentStatus(ctx context.Context, paymentID string, status model.TransactionStatus, event *model.PaymentEvent, outcome model.PaymentOutcome) (*PaymentUpdate, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := recordPaymentEvent(ctx, tx, event); err != nil {
+		return nil, err
+	}
+	t, err := lockTransaction(ctx, tx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	upd := &PaymentUpdate{Transaction: t, Previous: t.Status}
+	if t.Status == status {
+		// Статус не изменился, но событие во входящих сохраняем
+		return upd, tx.Commit()
+	}
+	if !t.Status.CanTransitionTo(status) {
+		return upd, ErrIllegalTransition
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE transactions SET status = $2, updated_at = NOW() WHERE id = $1
+	`, t.ID, string(status)); err != nil {
+		return nil, err
+	}
+	if status == model.TransactionSucceeded {
+		// Оплата того же тарифа и автопродление продлевают действующий период
+		// (или пробный период того же тарифа), а не начинают новый; доплата за
+		// повышение тарифа срок не меняет
+		err := tx.QueryRowContext(ctx, `
+			WITH cur AS (
+				SELECT tier, current_period_end FROM subscriptions
+				WHERE user_id = $1 AND status <> 'expired'
+			)
+			UPDATE users
+			SET tier = $2,
+				subscription_expires_at = CASE
+					WHEN $4 = 'upgrade' THEN GREATEST(NOW(), COALESCE((SELECT current_period_end FROM cur), subscription_expires_at, NOW()))
+					ELSE GREATEST(NOW(), COALESCE(
+						(SELECT current_period_end FROM cur WHERE tier = $2 OR $4 = 'renewal'),
+						CASE WHEN tier = $2 THEN subscription_expires_at END,
+						NOW())) + make_interval(months => $3)
+				END,
+				free_since = NULL
+			WHERE id = $1
+			RETURNING subscription_expires_at
+		`, t.UserID, string(t.Tier), t.Period.Months(), outcome.Kind).Scan(&upd.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		// Новый сохраненный способ оплаты включает автопродление; успешное
+		// списание сбрасывает неудачные попытки и льготный период
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO subscriptions (user_id, tier, payment_method_id, payment_method_title, auto_renew, status, current_period_end, billing_period, currency)
+			VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $3 <> '', 'active', $5, $6, $7)
+			ON CONFLICT (user_id) DO UPDATE SET
+				tier = EXCLUDED.tier,
+				billing_period = EXCLUDED.billing_period,
+				currency = EXCLUDED.currency,
+				payment_method_id = COALESCE(EXCLUDED.payment_method_id, subscriptions.payment_method_id),
+				payment_method_title = COALESCE(EXCLUDED.payment_method_title, subscriptions.payment_method_title),
+				auto_renew = EXCLUDED.auto_renew OR subscriptions.auto_renew,
+				status = 'active',
+				current_period_end = EXCLUDED.current_period_end,
+				next_attempt_at = NULL,
+				failed_attempts = 0,
+				grace_until = NULL,
+				scheduled_tier = NULL,
+				updated_at = NOW()
+		`, t.UserID, string(t.Tier), outcome.PaymentMethodID, outcome.PaymentMethodTitle, upd.ExpiresAt, string(t.Period), t.Currency); err != nil {
+			return nil, err
+		}
+		if err := issueInvoice(ctx, tx, t.ID, t.UserID); err != nil {
+			return nil, err
+		}
+		// Продление применяет запланированное понижение тарифа: файлы могли
+		// вырасти с момента планирования и уже не помещаться в новый лимит
+		if outcome.Kind == model.PaymentRenewal {
+			if err := tx.QueryRowContext(ctx, `
+				SELECT u.storage_limit,
+					COALESCE((SELECT SUM(f.size) FROM files f WHERE f.user_id = u.id AND f.is_uploaded = TRUE), 0)
+				FROM users u
+				WHERE u.id = $1
+			`, t.UserID).Scan(&upd.StorageLimit, &upd.StorageUsed); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if status == model.TransactionCanceled {
+		// Промокод отмененного платежа снова можно использовать
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM coupon_redemptions WHERE transaction_id = $1
+		`, t.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	t.Status = status
+	upd.Changed = true
+	return upd, nil
+}
+
+// recordPaymentEvent записывает событие во входящие (event == nil — без записи);
+// ErrDuplicatePaymentEvent — событие уже записано
+func recordPaymentEvent(ctx context.Context, tx *sql.Tx, event *model.PaymentEvent) error {
+	if event == nil {
+		return nil
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO payment_webhook_inbox (event_key, event, object_id, payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (event_key) DO NOTHING
+	`, event.Key, event.Event, event.ObjectID, event.Payload)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDuplicatePaymentEvent
+	}
+	return nil
+}
+
+// lockTransaction читает транзакцию платежа paymentID и блокирует ее строку до конца tx
+func lockTransaction(ctx context.Context, tx *sql.Tx, paymentID string) (*model.Transaction, error) {
+	var t model.Transaction
+	err := scanTransaction(tx.QueryRowContext(ctx, `
+		SELECT `+transactionFields+`
+		FROM transactions t
+		WHERE t.payment_id = $1
+		FOR UPDATE
+	`, paymentID), &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// DeleteOldPaymentEvents удаляет записи входящих старше olderThan
+// (YooKassa повторяет доставку не дольше суток)
+func (r *PaymentRepository) DeleteOldPaymentEvents(ctx context.Context, olderThan time.Duration) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM payment_webhook_inbox WHERE received_at < NOW() - make_interval(secs => $1)
+	`, olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
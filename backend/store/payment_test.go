@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var transactionColumns = []string{"id", "user_id", "payment_id", "tier", "amount", "currency", "billing_period", "status", "refunded_amount", "metadata", "created_at", "updated_at"}
+
+func TestApplyPaymentStatus_SucceededExtendsSubscriptionAndIssuesInvoice(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewPaymentRepository(db)
+	now := time.Now()
+	expiresAt := now.AddDate(1, 0, 0)
+	outcome := model.PaymentOutcome{Kind: model.PaymentPurchase, PaymentMethodID: "pm-1", PaymentMethodTitle: "Bank card *4444"}
+	event := &model.PaymentEvent{Key: "payment:p1:succeeded", Event: "payment.succeeded", ObjectID: "p1", Payload: []byte(`{}`)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO payment_webhook_inbox")).
+		WithArgs("payment:p1:succeeded", "payment.succeeded", "p1", []byte(`{}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("FOR UPDATE")).
+		WithArgs("p1").
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx1", "user-1", "p1", "medium", 2990.0, "RUB", "yearly", "pending", 0.0, []byte(`{}`), now, now))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status")).
+		WithArgs("tx1", "succeeded").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users")).
+		WithArgs("user-1", "medium", 12, model.PaymentPurchase).
+		WillReturnRows(sqlmock.NewRows([]string{"subscription_expires_at"}).AddRow(expiresAt))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO subscriptions")).
+		WithArgs("user-1", "medium", "pm-1", "Bank card *4444", expiresAt, "yearly", "RUB").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invoices")).
+		WithArgs("tx1", "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	upd, err := repo.ApplyPaymentStatus(context.Background(), "p1", model.TransactionSucceeded, event, outcome)
+	if err != nil {
+		t.Fatalf("ApplyPaymentStatus failed: %v", err)
+	}
+	if !upd.Changed || upd.Previous != model.TransactionPending || upd.Transaction.Status != model.TransactionSucceeded || !upd.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("unexpected update: %+v", upd)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyPaymentStatus_RenewalToScheduledTierReportsOverQuota(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	expiresAt := now.AddDate(0, 1, 0)
+	// Понижение с medium на start запланировано, когда файлы помещались в 5 GB;
+	// к продлению их стало 6 GB
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FOR UPDATE")).
+		WithArgs("p1").
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx1", "user-1", "p1", "start", 99.0, "RUB", "monthly", "pending", 0.0, []byte(`{}`), now, now))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status")).
+		WithArgs("tx1", "succeeded").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users")).
+		WithArgs("user-1", "start", 1, model.PaymentRenewal).
+		WillReturnRows(sqlmock.NewRows([]string{"subscription_expires_at"}).AddRow(expiresAt))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO subscriptions")).
+		WithArgs("user-1", "start", "", "", expiresAt, "monthly", "RUB").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO invoices")).
+		WithArgs("tx1", "user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT u.storage_limit")).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"storage_limit", "used"}).AddRow(int64(5<<30), int64(6<<30)))
+	mock.ExpectCommit()
+
+	upd, err := NewPaymentRepository(db).ApplyPaymentStatus(context.Background(), "p1", model.TransactionSucceeded, nil, model.PaymentOutcome{Kind: model.PaymentRenewal})
+	if err != nil {
+		t.Fatalf("ApplyPaymentStatus failed: %v", err)
+	}
+	if !upd.OverQuota() || upd.StorageLimit != 5<<30 || upd.StorageUsed != 6<<30 {
+		t.Errorf("unexpected storage: %d of %d used, over quota %v", upd.StorageUsed, upd.StorageLimit, upd.OverQuota())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyPaymentStatus_DuplicateEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO payment_webhook_inbox")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	event := &model.PaymentEvent{Key: "payment:p1:succeeded", Event: "payment.succeeded", ObjectID: "p1", Payload: []byte(`{}`)}
+	_, err = NewPaymentRepository(db).ApplyPaymentStatus(context.Background(), "p1", model.TransactionSucceeded, event, model.PaymentOutcome{})
+	if !errors.Is(err, ErrDuplicatePaymentEvent) {
+		t.Errorf("expected ErrDuplicatePaymentEvent, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyPaymentStatus_IllegalTransition(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FOR UPDATE")).
+		WithArgs("p1").
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx1", "user-1", "p1", "medium", 299.0, "RUB", "monthly", "canceled", 0.0, []byte(`{}`), now, now))
+	mock.ExpectRollback()
+
+	// Отмененный платеж не может стать оплаченным: тариф не меняется
+	_, err = NewPaymentRepository(db).ApplyPaymentStatus(context.Background(), "p1", model.TransactionSucceeded, nil, model.PaymentOutcome{})
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("expected ErrIllegalTransition, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyPaymentStatus_CanceledReleasesCoupon(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FOR UPDATE")).
+		WithArgs("p1").
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx1", "user-1", "p1", "medium", 149.5, "RUB", "monthly", "pending", 0.0, []byte(`{"coupon":"LAUNCH50"}`), now, now))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status")).
+		WithArgs("tx1", "canceled").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM coupon_redemptions WHERE transaction_id = $1")).
+		WithArgs("tx1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	upd, err := NewPaymentRepository(db).ApplyPaymentStatus(context.Background(), "p1", model.TransactionCanceled, nil, model.PaymentOutcome{})
+	if err != nil {
+		t.Fatalf("ApplyPaymentStatus failed: %v", err)
+	}
+	if !upd.Changed || upd.Transaction.Status != model.TransactionCanceled {
+		t.Errorf("unexpected update: %+v", upd)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -16,9 +16,25 @@ type Store struct {
 	DB    *sql.DB
 	Minio *minio.Client
 
+	dbURL string
+
 	// Репозитории
-	UserRepository *UserRepository
-	DataRepository *DataRepository
+	UserRepository         *UserRepository
+	DataRepository         *DataRepository
+	SessionRepository      *SessionRepository
+	SigningKeyRepository   *SigningKeyRepository
+	TokenRepository        *TokenRepository
+	OAuthRepository        *OAuthRepository
+	IdentityRepository     *IdentityRepository
+	LoginAttemptRepository *LoginAttemptRepository
+	NotificationRepository *NotificationRepository
+	AuditRepository        *AuditRepository
+	RateLimitRepository    *RateLimitRepository
+	PaymentRepository      *PaymentRepository
+	SubscriptionRepository *SubscriptionRepository
+	PlanRepository         *PlanRepository
+	CouponRepository       *CouponRepository
+	InvoiceRepository      *InvoiceRepository
 }
 
 func New(dbUrl string, minioClient *minio.Client) (*Store, error) {
@@ -43,6 +59,13 @@ func New(dbUrl string, minioClient *minio.Client) (*Store, error) {
 	db.SetMaxIdleConns(25)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
+	store := NewWithDB(db, minioClient)
+	store.dbURL = dbUrl
+	return store, nil
+}
+
+// NewWithDB собирает хранилище и репозитории поверх открытого подключения
+func NewWithDB(db *sql.DB, minioClient *minio.Client) *Store {
 	store := &Store{
 		DB:    db,
 		Minio: minioClient,
@@ -51,8 +74,22 @@ func New(dbUrl string, minioClient *minio.Client) (*Store, error) {
 	// Инициализация репозиториев
 	store.UserRepository = NewUserRepository(db, minioClient)
 	store.DataRepository = NewDataRepository(db)
+	store.SessionRepository = NewSessionRepository(db)
+	store.SigningKeyRepository = NewSigningKeyRepository(db)
+	store.TokenRepository = NewTokenRepository(db)
+	store.OAuthRepository = NewOAuthRepository(db)
+	store.IdentityRepository = NewIdentityRepository(db)
+	store.LoginAttemptRepository = NewLoginAttemptRepository(db)
+	store.NotificationRepository = NewNotificationRepository(db)
+	store.AuditRepository = NewAuditRepository(db)
+	store.RateLimitRepository = NewRateLimitRepository(db)
+	store.PaymentRepository = NewPaymentRepository(db)
+	store.SubscriptionRepository = NewSubscriptionRepository(db)
+	store.PlanRepository = NewPlanRepository(db)
+	store.CouponRepository = NewCouponRepository(db)
+	store.InvoiceRepository = NewInvoiceRepository(db)
 
-	return store, nil
+	return store
 }
 
 func (s *Store) Close() error {
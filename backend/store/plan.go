@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"noteflow/model"
+)
+
+// PlanRepository хранит каталог тарифов
+type PlanRepository struct {
+	db *sql.DB
+}
+
+func NewPlanRepository(db *sql.DB) *PlanRepository {
+	return &PlanRepository{db: db}
+}
+
+// ListPlans возвращает все тарифы, включая снятые с продажи
+func (r *PlanRepository) ListPlans(ctx context.Context) ([]model.Plan, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT tier, prices, trial_days, storage_limit, max_file_size,
+			features, display, sort_order, active, updated_at
+		FROM plans
+		ORDER BY sort_order, tier
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []model.Plan
+	for rows.Next() {
+		var p model.Plan
+		var tier string
+		var prices, features, display []byte
+		if err := rows.Scan(&tier, &prices, &p.TrialDays, &p.StorageLimit, &p.MaxFileSize,
+			&features, &display, &p.SortOrder, &p.Active, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		p.Tier = model.UserTier(tier)
+		if err := json.Unmarshal(prices, &p.Prices); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(features, &p.Features); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(display, &p.Display); err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+// UpsertPlan создает или обновляет тариф. Новый лимит хранилища применяется к
+// пользователям тарифа триггером в БД.
+func (r *PlanRepository) UpsertPlan(ctx context.Context, p model.Plan) error {
+	if p.Prices == nil {
+		p.Prices = []model.PlanPrice{}
+	}
+	prices, err := json.Marshal(p.Prices)
+	if err != nil {
+		return err
+	}
+	features, err := json.Marshal(p.Features)
+	if err != nil {
+		return err
+	}
+	display, err := json.Marshal(p.Display)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO plans (tier, prices, storage_limit, max_file_size, features, display, sort_order, active, trial_days)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (tier) DO UPDATE SET
+			prices = EXCLUDED.prices,
+			storage_limit = EXCLUDED.storage_limit,
+			max_file_size = EXCLUDED.max_file_size,
+			features = EXCLUDED.features,
+			display = EXCLUDED.display,
+			sort_order = EXCLUDED.sort_order,
+			active = EXCLUDED.active,
+			trial_days = EXCLUDED.trial_days,
+			updated_at = NOW()
+	`, string(p.Tier), prices, p.StorageLimit, p.MaxFileSize, features, display, p.SortOrder, p.Active, p.TrialDays)
+	return err
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// RateLimitRepository хранит состояние лимитов запросов (GCRA) в Postgres:
+// бюджеты общие для всех реплик и переживают перезапуск
+type RateLimitRepository struct {
+	db *sql.DB
+}
+
+func NewRateLimitRepository(db *sql.DB) *RateLimitRepository {
+	return &RateLimitRepository{db: db}
+}
+
+// Take атомарно расходует единицу бюджета key. Условный upsert блокирует строку,
+// поэтому параллельные запросы реплик не превысят бюджет. Время берется из БД,
+// чтобы расхождение часов реплик не влияло на лимит.
+func (r *RateLimitRepository) Take(ctx context.Context, key string, interval time.Duration, burst int) (bool, time.Time, time.Time, error) {
+	var tat, now time.Time
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO rate_limits (key, tat)
+		VALUES ($1, NOW() + make_interval(secs => $2))
+		ON CONFLICT (key) DO UPDATE
+			SET tat = GREATEST(rate_limits.tat, NOW()) + make_interval(secs => $2)
+			WHERE GREATEST(rate_limits.tat, NOW()) + make_interval(secs => $2) <= NOW() + make_interval(secs => $3)
+		RETURNING tat, NOW()
+	`, key, interval.Seconds(), (interval*time.Duration(burst)).Seconds()).Scan(&tat, &now)
+	if err == nil {
+		return true, tat, now, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, time.Time{}, time.Time{}, err
+	}
+
+	// Бюджет исчерпан: текущий TAT нужен для Retry-After
+	err = r.db.QueryRowContext(ctx, `
+		SELECT tat, NOW() FROM rate_limits WHERE key = $1
+	`, key).Scan(&tat, &now)
+	if err != nil {
+		return false, time.Time{}, time.Time{}, err
+	}
+	return false, tat, now, nil
+}
+
+// Cleanup удаляет ключи, бюджет которых полностью восстановился
+func (r *RateLimitRepository) Cleanup(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE tat < NOW()")
+	return err
+}
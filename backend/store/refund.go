@@ -0,0 +1,207 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"noteflow/model"
+)
+
+// ErrRefundExceedsPayment — возврат больше еще не возвращенной части оплаты
+var ErrRefundExceedsPayment = errors.New("refund exceeds the remaining payment amount")
+
+// RefundUpdate — результат ApplyRefund
+type RefundUpdate struct {
+	Transaction *model.Transaction
+	Previous    model.TransactionStatus
+	// Changed == false — возврат уже был учтен
+	Changed bool
+	// Тариф и конец оплаченного периода пользователя после возврата
+	Tier      model.UserTier
+	ExpiresAt *time.Time
+	// TierChanged — тариф понижен (до тарифа перед повышением или до free)
+	TierChanged bool
+	// PeriodShortened — оплаченный период сокращен
+	PeriodShortened bool
+	StorageUsed     int64
+	StorageLimit    int64
+}
+
+// OverQuota сообщает, что файлы пользователя не помещаются в лимит нового тарифа
+func (u RefundUpdate) OverQuota() bool {
+	return u.StorageUsed > u.StorageLimit
+}
+
+// ApplyRefund учитывает проведенный возврат (или чарджбэк) refund по платежу
+// refund.PaymentID. В одной транзакции БД: событие записывается во входящие,
+// возврат — в refunds (повторный возврат с тем же ID ничего не меняет),
+// транзакция переходит в partially_refunded или refunded, а доступ
+// пользователя уменьшается:
+//   - возврат доплаты за повышение целиком возвращает прежний тариф;
+//   - возврат покупки или продления сокращает оплаченный период на ту же долю,
+//     а если период закончился — переводит пользователя на free.
+//
+// Полный возврат отключает автопродление, чарджбэк еще и удаляет сохраненный
+// способ оплаты. Файлы не удаляются: если они больше лимита нового тарифа,
+// хранилище остается доступным только для чтения и удаления.
+func (r *PaymentRepository) ApplyRefund(ctx context.Context, refund model.Refund, event *model.PaymentEvent) (*RefundUpdate, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := recordPaymentEvent(ctx, tx, event); err != nil {
+		return nil, err
+	}
+	t, err := lockTransaction(ctx, tx, refund.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	upd := &RefundUpdate{Transaction: t, Previous: t.Status}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO refunds (id, transaction_id, amount, currency, kind, reason)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+		ON CONFLICT (id) DO NOTHING
+	`, refund.ID, t.ID, refund.Amount, refund.Currency, refund.Kind, refund.Reason)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Возврат уже учтен, но событие во входящих сохраняем
+		return upd, tx.Commit()
+	}
+	if !t.Refundable() {
+		return upd, ErrIllegalTransition
+	}
+	if refund.Currency != t.Currency || refund.Amount <= 0 || refund.Amount > t.Amount-t.RefundedAmount+0.005 {
+		return upd, ErrRefundExceedsPayment
+	}
+
+	refunded := t.RefundedAmount + refund.Amount
+	status := t.RefundStatus(refunded)
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE transactions SET status = $2, refunded_amount = $3, updated_at = NOW() WHERE id = $1
+	`, t.ID, string(status), refunded); err != nil {
+		return nil, err
+	}
+	full := status == model.TransactionRefunded
+
+	var meta struct {
+		Kind     string         `json:"kind"`
+		FromTier model.UserTier `json:"fromTier"`
+	}
+	json.Unmarshal(t.Metadata, &meta)
+
+	var tier string
+	var expiresAt sql.NullTime
+	if err := tx.QueryRowContext(ctx, `
+		SELECT tier, subscription_expires_at FROM users WHERE id = $1 FOR UPDATE
+	`, t.UserID).Scan(&tier, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	// Доступ меняется, только если у пользователя все еще оплаченный этой транзакцией тариф
+	if model.UserTier(tier) == t.Tier && expiresAt.Valid {
+		switch {
+		case meta.Kind == model.PaymentUpgrade:
+			if full && meta.FromTier != "" {
+				if err := setRefundTier(ctx, tx, t.UserID, meta.FromTier); err != nil {
+					return nil, err
+				}
+				upd.TierChanged = true
+			}
+		default:
+			end := model.ShortenPeriod(expiresAt.Time, t.Period, refund.Amount/t.Amount)
+			if err := shortenPaidPeriod(ctx, tx, t.UserID, end); err != nil {
+				return nil, err
+			}
+			upd.PeriodShortened = true
+			upd.TierChanged = !end.After(time.Now())
+		}
+	}
+
+	if refund.Kind == model.RefundKindChargeback {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE subscriptions
+			SET auto_renew = FALSE, payment_method_id = NULL, payment_method_title = NULL, next_attempt_at = NULL, updated_at = NOW()
+			WHERE user_id = $1
+		`, t.UserID); err != nil {
+			return nil, err
+		}
+	} else if full && meta.Kind != model.PaymentUpgrade {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE subscriptions SET auto_renew = FALSE, next_attempt_at = NULL, updated_at = NOW() WHERE user_id = $1
+		`, t.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.QueryRowContext(ctx, `
+		SELECT u.tier, u.subscription_expires_at, u.storage_limit,
+			COALESCE((SELECT SUM(f.size) FROM files f WHERE f.user_id = u.id AND f.is_uploaded = TRUE), 0)
+		FROM users u
+		WHERE u.id = $1
+	`, t.UserID).Scan(&tier, &expiresAt, &upd.StorageLimit, &upd.StorageUsed); err != nil {
+		return nil, err
+	}
+	upd.Tier = model.UserTier(tier)
+	if expiresAt.Valid {
+		upd.ExpiresAt = &expiresAt.Time
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	t.Status = status
+	t.RefundedAmount = refunded
+	upd.Changed = true
+	return upd, nil
+}
+
+// setRefundTier возвращает пользователю тариф tier до конца оплаченного периода
+func setRefundTier(ctx context.Context, tx *sql.Tx, userID string, tier model.UserTier) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET tier = $2 WHERE id = $1`, userID, string(tier)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE subscriptions SET tier = $2, scheduled_tier = NULL, updated_at = NOW()
+		WHERE user_id = $1 AND status <> 'expired'
+	`, userID, string(tier))
+	return err
+}
+
+// shortenPaidPeriod переносит конец оплаченного периода на end; если он уже
+// прошел, пользователь сразу переходит на free, а подписка истекает
+func shortenPaidPeriod(ctx context.Context, tx *sql.Tx, userID string, end time.Time) error {
+	if end.After(time.Now()) {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE users SET subscription_expires_at = $2 WHERE id = $1
+		`, userID, end); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE subscriptions SET current_period_end = $2, updated_at = NOW()
+			WHERE user_id = $1 AND status <> 'expired'
+		`, userID, end)
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET tier = 'free', subscription_expires_at = NOW(), free_since = COALESCE(free_since, NOW())
+		WHERE id = $1
+	`, userID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET status = 'expired', auto_renew = FALSE, next_attempt_at = NULL, scheduled_tier = NULL, updated_at = NOW()
+		WHERE user_id = $1
+	`, userID)
+	return err
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestApplyRefund_FullRefundDowngradesToFree(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewPaymentRepository(db)
+	now := time.Now()
+	refund := model.Refund{ID: "r1", PaymentID: "p1", Amount: 299, Currency: "RUB", Kind: model.RefundKindRefund}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FOR UPDATE")).
+		WithArgs("p1").
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx1", "user-1", "p1", "medium", 299.0, "RUB", "monthly", "succeeded", 0.0, []byte(`{"kind":"purchase"}`), now, now))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refunds")).
+		WithArgs("r1", "tx1", 299.0, "RUB", model.RefundKindRefund, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status")).
+		WithArgs("tx1", "refunded", 299.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Оплаченный месяц заканчивается через 10 дней: после возврата он уже прошел
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT tier, subscription_expires_at FROM users")).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"tier", "subscription_expires_at"}).AddRow("medium", now.Add(10*24*time.Hour)))
+	mock.ExpectExec(regexp.QuoteMeta("SET tier = 'free'")).
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("SET status = 'expired'")).
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE subscriptions SET auto_renew = FALSE")).
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("u.storage_limit")).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"tier", "subscription_expires_at", "storage_limit", "used"}).
+			AddRow("free", now, int64(1<<30), int64(3<<30)))
+	mock.ExpectCommit()
+
+	upd, err := repo.ApplyRefund(context.Background(), refund, nil)
+	if err != nil {
+		t.Fatalf("ApplyRefund failed: %v", err)
+	}
+	if !upd.Changed || !upd.TierChanged || upd.Tier != model.TierFree || !upd.OverQuota() ||
+		upd.Transaction.Status != model.TransactionRefunded || upd.Transaction.RefundedAmount != 299 {
+		t.Errorf("unexpected update: %+v", upd)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApplyRefund_DuplicateRefund(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewPaymentRepository(db)
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FOR UPDATE")).
+		WithArgs("p1").
+		WillReturnRows(sqlmock.NewRows(transactionColumns).
+			AddRow("tx1", "user-1", "p1", "medium", 299.0, "RUB", "monthly", "partially_refunded", 100.0, []byte(`{}`), now, now))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refunds")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	upd, err := repo.ApplyRefund(context.Background(), model.Refund{ID: "r1", PaymentID: "p1", Amount: 100, Currency: "RUB", Kind: model.RefundKindRefund}, nil)
+	if err != nil {
+		t.Fatalf("ApplyRefund failed: %v", err)
+	}
+	if upd.Changed || upd.Transaction.RefundedAmount != 100 {
+		t.Errorf("duplicate refund must not change anything: %+v", upd)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
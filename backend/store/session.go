@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// SessionRepository объединяет операции с сессиями (refresh-токенами) и SSE-тикетами.
+// Сессия — это цепочка refresh-токенов с общим session_id: при ротации
+// токен меняется, а session_id переносится в новую запись.
+type SessionRepository struct {
+	db *sql.DB
+}
+
+func NewSessionRepository(db *sql.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+// ==================== REFRESH TOKEN OPERATIONS ====================
+
+// CreateRefreshToken сохраняет хеш refresh-токена новой сессии
+func (r *SessionRepository) CreateRefreshToken(ctx context.Context, tokenHash, userID, sessionID, ip, userAgent string, ttl time.Duration) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, user_id, session_id, expires_at, client_ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, tokenHash, userID, sessionID, time.Now().Add(ttl), ip, userAgent)
+	return err
+}
+
+// CreateClientRefreshToken сохраняет refresh-токен, выданный OAuth-клиенту
+// с ограниченными областями доступа
+func (r *SessionRepository) CreateClientRefreshToken(ctx context.Context, tokenHash, userID, sessionID, clientID string, scopes []string, ip, userAgent string, ttl time.Duration) error {
+	rawScopes, err := jsonList(scopes)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, user_id, session_id, client_id, scopes, expires_at, client_ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, tokenHash, userID, sessionID, clientID, rawScopes, time.Now().Add(ttl), ip, userAgent)
+	return err
+}
+
+// RotateRefreshToken атомарно заменяет действующий refresh-токен новым в рамках той же сессии.
+// clientID должен совпадать с клиентом, которому выдан токен ("" — приложение GLYF),
+// поэтому токен стороннего клиента нельзя обменять на полноправную сессию.
+// Возвращает userID, sessionID и области токена (nil для сессии приложения).
+// Возвращает sql.ErrNoRows, если старый токен не найден, истек или выдан другому клиенту.
+func (r *SessionRepository) RotateRefreshToken(ctx context.Context, oldHash, newHash, clientID, ip, userAgent string, ttl time.Duration) (string, string, []string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer tx.Rollback()
+
+	var userID, sessionID string
+	var client sql.NullString
+	var rawScopes []byte
+	var oldExpiresAt time.Time
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM refresh_tokens
+		WHERE token_hash = $1 AND expires_at > NOW() AND client_id IS NOT DISTINCT FROM NULLIF($2, '')
+		RETURNING user_id, session_id, client_id, scopes, expires_at
+	`, oldHash, clientID).Scan(&userID, &sessionID, &client, &rawScopes, &oldExpiresAt)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	// Запоминаем замененный токен до истечения его срока, чтобы распознать повторное предъявление
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rotated_refresh_tokens (token_hash, user_id, session_id, client_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (token_hash) DO NOTHING
+	`, oldHash, userID, sessionID, client, oldExpiresAt)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	var scopes []string
+	if rawScopes != nil {
+		if err := json.Unmarshal(rawScopes, &scopes); err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, user_id, session_id, client_id, scopes, expires_at, client_ip, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, newHash, userID, sessionID, client, rawScopes, time.Now().Add(ttl), ip, userAgent)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return userID, sessionID, scopes, tx.Commit()
+}
+
+// GetRefreshTokenScopes возвращает области действующего refresh-токена клиента clientID.
+// Возвращает sql.ErrNoRows, если токен не найден, истек или выдан другому клиенту.
+func (r *SessionRepository) GetRefreshTokenScopes(ctx context.Context, tokenHash, clientID string) ([]string, error) {
+	var rawScopes []byte
+	err := r.db.QueryRowContext(ctx, `
+		SELECT scopes FROM refresh_tokens
+		WHERE token_hash = $1 AND expires_at > NOW() AND client_id IS NOT DISTINCT FROM NULLIF($2, '')
+	`, tokenHash, clientID).Scan(&rawScopes)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []string
+	if rawScopes != nil {
+		if err := json.Unmarshal(rawScopes, &scopes); err != nil {
+			return nil, err
+		}
+	}
+	return scopes, nil
+}
+
+// FindRotatedRefreshToken ищет уже замененный при ротации refresh-токен.
+// Возвращает userID, sessionID и время ротации или sql.ErrNoRows.
+func (r *SessionRepository) FindRotatedRefreshToken(ctx context.Context, tokenHash string) (string, string, time.Time, error) {
+	var userID, sessionID string
+	var rotatedAt time.Time
+	err := r.db.QueryRowContext(ctx, `
+		SELECT user_id, session_id, rotated_at FROM rotated_refresh_tokens
+		WHERE token_hash = $1 AND expires_at > NOW()
+	`, tokenHash).Scan(&userID, &sessionID, &rotatedAt)
+	return userID, sessionID, rotatedAt, err
+}
+
+// RevokeSession удаляет все refresh-токены сессии
+func (r *SessionRepository) RevokeSession(ctx context.Context, userID, sessionID string) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM refresh_tokens WHERE user_id = $1 AND session_id::text = $2
+	`, userID, sessionID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredRotatedTokens удаляет записи о замененных токенах, срок которых истек
+func (r *SessionRepository) DeleteExpiredRotatedTokens(ctx context.Context) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM rotated_refresh_tokens WHERE expires_at < NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetSessionExpiry возвращает время истечения сессии. Сессией SSE/WS-подключения
+// может быть и personal access token (session_id = id токена); бессрочный токен
+// считается действующим 100 лет.
+// Возвращает sql.ErrNoRows, если сессия истекла или была отозвана.
+func (r *SessionRepository) GetSessionExpiry(ctx context.Context, sessionID string) (time.Time, error) {
+	var expiresAt sql.NullTime
+	err := r.db.QueryRowContext(ctx, `
+		SELECT GREATEST(
+			(SELECT MAX(expires_at) FROM refresh_tokens
+			 WHERE session_id = $1 AND expires_at > NOW()),
+			(SELECT COALESCE(expires_at, NOW() + INTERVAL '100 years') FROM personal_access_tokens
+			 WHERE id = $1 AND (expires_at IS NULL OR expires_at > NOW()))
+		)
+	`, sessionID).Scan(&expiresAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !expiresAt.Valid {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return expiresAt.Time, nil
+}
+
+// ==================== SSE TICKET OPERATIONS ====================
+
+// CreateSSETicket сохраняет хеш одноразового тикета, привязанного к сессии
+func (r *SessionRepository) CreateSSETicket(ctx context.Context, ticketHash, userID, sessionID, audience string, ttl time.Duration) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO sse_tickets (ticket_hash, user_id, session_id, audience, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, ticketHash, userID, sessionID, audience, time.Now().Add(ttl))
+	return err
+}
+
+// ConsumeSSETicket погашает тикет: удаление гарантирует, что он сработает только один раз.
+// Возвращает sql.ErrNoRows, если тикет не найден, истек или выпущен для другой аудитории.
+func (r *SessionRepository) ConsumeSSETicket(ctx context.Context, ticketHash, audience string) (string, string, error) {
+	var userID, sessionID string
+	err := r.db.QueryRowContext(ctx, `
+		DELETE FROM sse_tickets
+		WHERE ticket_hash = $1 AND audience = $2 AND expires_at > NOW()
+		RETURNING user_id, session_id
+	`, ticketHash, audience).Scan(&userID, &sessionID)
+	return userID, sessionID, err
+}
+
+// DeleteExpiredSSETickets удаляет непогашенные истекшие тикеты
+func (r *SessionRepository) DeleteExpiredSSETickets(ctx context.Context) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM sse_tickets WHERE expires_at < NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RevokeOtherSessions удаляет refresh-токены сессий приложения пользователя,
+// кроме текущей. Токены OAuth-клиентов (client_id задан) не затрагиваются.
+func (r *SessionRepository) RevokeOtherSessions(ctx context.Context, userID, keepSessionID string) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM refresh_tokens
+		WHERE user_id = $1 AND client_id IS NULL AND session_id::text <> $2
+	`, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
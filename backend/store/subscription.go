@@ -0,0 +1,224 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"noteflow/model"
+)
+
+var (
+	// ErrTrialUsed — пользователь уже использовал пробный период
+	ErrTrialUsed = errors.New("trial already used")
+	// ErrSubscriptionActive — у пользователя уже действует платный тариф
+	ErrSubscriptionActive = errors.New("subscription is already active")
+)
+
+// SubscriptionRepository хранит подписки с автопродлением
+type SubscriptionRepository struct {
+	db *sql.DB
+}
+
+func NewSubscriptionRepository(db *sql.DB) *SubscriptionRepository {
+	return &SubscriptionRepository{db: db}
+}
+
+const subscriptionColumns = `s.user_id, u.email, s.tier, s.billing_period, s.currency, s.status, s.auto_renew,
+	COALESCE(s.payment_method_id, ''), COALESCE(s.payment_method_title, ''),
+	s.current_period_end, s.next_attempt_at, s.failed_attempts, s.grace_until,
+	COALESCE(s.scheduled_tier, '')`
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (*model.Subscription, error) {
+	var s model.Subscription
+	var tier, period, scheduledTier string
+	var nextAttempt, graceUntil sql.NullTime
+	if err := row.Scan(&s.UserID, &s.Email, &tier, &period, &s.Currency, &s.Status, &s.AutoRenew, &s.PaymentMethodID, &s.PaymentMethodTitle,
+		&s.CurrentPeriodEnd, &nextAttempt, &s.FailedAttempts, &graceUntil, &scheduledTier); err != nil {
+		return nil, err
+	}
+	s.Tier = model.UserTier(tier)
+	s.Period = model.BillingPeriod(period)
+	s.ScheduledTier = model.UserTier(scheduledTier)
+	if nextAttempt.Valid {
+		s.NextAttemptAt = &nextAttempt.Time
+	}
+	if graceUntil.Valid {
+		s.GraceUntil = &graceUntil.Time
+	}
+	return &s, nil
+}
+
+// GetSubscription возвращает подписку пользователя (sql.ErrNoRows — ее нет)
+func (r *SubscriptionRepository) GetSubscription(ctx context.Context, userID string) (*model.Subscription, error) {
+	return scanSubscription(r.db.QueryRowContext(ctx, `
+		SELECT `+subscriptionColumns+`
+		FROM subscriptions s JOIN users u ON u.id = s.user_id
+		WHERE s.user_id = $1
+	`, userID))
+}
+
+// SetAutoRenew включает или выключает автопродление действующей подписки.
+// Включить можно только при сохраненном способе оплаты; false — подписки нет
+// или условие не выполнено.
+func (r *SubscriptionRepository) SetAutoRenew(ctx context.Context, userID string, autoRenew bool) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET auto_renew = $2, updated_at = NOW()
+		WHERE user_id = $1 AND status <> 'expired' AND (NOT $2 OR payment_method_id IS NOT NULL)
+	`, userID, autoRenew)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ScheduleTierChange назначает переход на tier при следующем продлении
+// ("" — отменить переход); false — нет действующей подписки
+func (r *SubscriptionRepository) ScheduleTierChange(ctx context.Context, userID string, tier model.UserTier) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET scheduled_tier = NULLIF($2, ''), updated_at = NOW()
+		WHERE user_id = $1 AND status <> 'expired'
+	`, userID, string(tier))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimDueRenewals выбирает до limit подписок, которые пора продлить: за
+// renewBefore до конца периода или по расписанию повтора, не больше
+// maxAttempts неудачных попыток. next_attempt_at сдвигается на lease, поэтому
+// другой экземпляр сервера не спишет оплату одновременно, а списание,
+// прерванное сбоем, повторится после lease.
+func (r *SubscriptionRepository) ClaimDueRenewals(ctx context.Context, renewBefore, lease time.Duration, maxAttempts, limit int) ([]model.Subscription, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		WITH due AS (
+			SELECT user_id FROM subscriptions
+			WHERE auto_renew AND payment_method_id IS NOT NULL
+				AND status <> 'expired' AND failed_attempts < $3
+				AND COALESCE(next_attempt_at, current_period_end - make_interval(secs => $1)) <= NOW()
+			ORDER BY current_period_end
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			UPDATE subscriptions s
+			SET next_attempt_at = NOW() + make_interval(secs => $2), updated_at = NOW()
+			FROM due WHERE s.user_id = due.user_id
+			RETURNING s.*
+		)
+		SELECT `+subscriptionColumns+`
+		FROM claimed s JOIN users u ON u.id = s.user_id
+	`, renewBefore.Seconds(), lease.Seconds(), maxAttempts, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []model.Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *s)
+	}
+	return subs, rows.Err()
+}
+
+// RecordRenewalFailure отмечает неудачное списание: подписка переходит в
+// past_due, следующая попытка — в nextAttempt (nil — попытки исчерпаны).
+// Доступ к тарифу продлевается до graceUntil.
+func (r *SubscriptionRepository) RecordRenewalFailure(ctx context.Context, userID string, nextAttempt *time.Time, graceUntil time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET status = 'past_due', failed_attempts = failed_attempts + 1,
+			next_attempt_at = $2, grace_until = $3, updated_at = NOW()
+		WHERE user_id = $1
+	`, userID, nextAttempt, graceUntil); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET subscription_expires_at = GREATEST(subscription_expires_at, $2)
+		WHERE id = $1 AND tier <> 'free'
+	`, userID, graceUntil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkExpired завершает подписку пользователя, переведенного на free.
+// Автопродление выключается: новая покупка включит его заново.
+func (r *SubscriptionRepository) MarkExpired(ctx context.Context, userID string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET status = 'expired', auto_renew = FALSE, next_attempt_at = NULL, updated_at = NOW()
+		WHERE user_id = $1
+	`, userID)
+	return err
+}
+
+// GetTrial возвращает пробный период пользователя (sql.ErrNoRows — его не было)
+func (r *SubscriptionRepository) GetTrial(ctx context.Context, userID string) (*model.Trial, error) {
+	var t model.Trial
+	var tier string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT user_id, tier, started_at, ends_at FROM trials WHERE user_id = $1
+	`, userID).Scan(&t.UserID, &tier, &t.StartedAt, &t.EndsAt)
+	if err != nil {
+		return nil, err
+	}
+	t.Tier = model.UserTier(tier)
+	return &t, nil
+}
+
+// StartTrial включает пользователю тариф tier на period без оплаты. Пробный
+// период дается один раз на аккаунт (ErrTrialUsed) и только без действующего
+// платного тарифа (ErrSubscriptionActive). По окончании пользователь
+// переводится на free той же задачей, что и при истечении подписки.
+func (r *SubscriptionRepository) StartTrial(ctx context.Context, userID string, tier model.UserTier, period time.Duration) (*model.Trial, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t := model.Trial{UserID: userID, Tier: tier}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO trials (user_id, tier, started_at, ends_at)
+		VALUES ($1, $2, NOW(), NOW() + make_interval(secs => $3))
+		ON CONFLICT (user_id) DO NOTHING
+		RETURNING started_at, ends_at
+	`, userID, string(tier), period.Seconds()).Scan(&t.StartedAt, &t.EndsAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTrialUsed
+	} else if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET tier = $2, subscription_expires_at = $3, free_since = NULL
+		WHERE id = $1 AND (tier = 'free' OR subscription_expires_at <= NOW())
+	`, userID, string(tier), t.EndsAt)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrSubscriptionActive
+	}
+	return &t, tx.Commit()
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"noteflow/model"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRecordRenewalFailure_ExtendsTierUntilGracePeriodEnds(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	next := time.Now().Add(24 * time.Hour)
+	graceUntil := time.Now().Add(7 * 24 * time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET status = 'past_due', failed_attempts = failed_attempts + 1")).
+		WithArgs("user-1", &next, graceUntil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("SET subscription_expires_at = GREATEST(subscription_expires_at, $2)")).
+		WithArgs("user-1", graceUntil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := NewSubscriptionRepository(db).RecordRenewalFailure(context.Background(), "user-1", &next, graceUntil); err != nil {
+		t.Fatalf("RecordRenewalFailure failed: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetUsersWithExpiredSubscriptions_SkipsRenewalsInProgress(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// Подписка, которую еще пытаются продлить, не переводится на free до
+	// grace_until или, если списаний не было, до конца периода плюс grace
+	mock.ExpectQuery(regexp.QuoteMeta("AND s.status IN ('active', 'past_due')") + "(?s).*" +
+		regexp.QuoteMeta("COALESCE(s.grace_until, s.current_period_end + make_interval(secs => $1)) > NOW()")).
+		WithArgs((7 * 24 * time.Hour).Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-2"))
+
+	ids, err := NewUserRepository(db, nil).GetUsersWithExpiredSubscriptions(7 * 24 * time.Hour)
+	if err != nil {
+		t.Fatalf("GetUsersWithExpiredSubscriptions failed: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "user-2" {
+		t.Errorf("ids %v, want [user-2]", ids)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartTrial_OncePerAccount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO trials")).
+		WithArgs("user-1", "medium", float64(7*24*60*60)).
+		WillReturnRows(sqlmock.NewRows([]string{"started_at", "ends_at"}))
+	mock.ExpectRollback()
+
+	// Запись о пробном периоде уже есть: тариф не меняется
+	_, err = NewSubscriptionRepository(db).StartTrial(context.Background(), "user-1", model.TierMedium, 7*24*time.Hour)
+	if !errors.Is(err, ErrTrialUsed) {
+		t.Errorf("expected ErrTrialUsed, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartTrial_RefusedWithActiveSubscription(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO trials")).
+		WithArgs("user-1", "medium", float64(7*24*60*60)).
+		WillReturnRows(sqlmock.NewRows([]string{"started_at", "ends_at"}).AddRow(now, now.Add(7*24*time.Hour)))
+	mock.ExpectExec(regexp.QuoteMeta("WHERE id = $1 AND (tier = 'free' OR subscription_expires_at <= NOW())")).
+		WithArgs("user-1", "medium", now.Add(7*24*time.Hour)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	// Запись о пробном периоде откатывается вместе с отказом
+	_, err = NewSubscriptionRepository(db).StartTrial(context.Background(), "user-1", model.TierMedium, 7*24*time.Hour)
+	if !errors.Is(err, ErrSubscriptionActive) {
+		t.Errorf("expected ErrSubscriptionActive, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"noteflow/model"
+)
+
+// TokenRepository хранит personal access tokens публичного API
+type TokenRepository struct {
+	db *sql.DB
+}
+
+func NewTokenRepository(db *sql.DB) *TokenRepository {
+	return &TokenRepository{db: db}
+}
+
+const tokenColumns = `id, user_id, name, token_prefix, token_hash, scopes, allowed_ips, expires_at, last_used_at, last_used_ip, created_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row rowScanner) (*model.PersonalAccessToken, error) {
+	var t model.PersonalAccessToken
+	var scopes, allowedIPs []byte
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.TokenHash, &scopes, &allowedIPs, &t.ExpiresAt, &t.LastUsedAt, &t.LastUsedIP, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(scopes, &t.Scopes); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(allowedIPs, &t.AllowedIPs); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateToken сохраняет токен; ID и CreatedAt заполняются из БД
+func (r *TokenRepository) CreateToken(ctx context.Context, t *model.PersonalAccessToken) error {
+	scopes, err := json.Marshal(t.Scopes)
+	if err != nil {
+		return err
+	}
+	if t.AllowedIPs == nil {
+		t.AllowedIPs = []string{}
+	}
+	allowedIPs, err := json.Marshal(t.AllowedIPs)
+	if err != nil {
+		return err
+	}
+
+	return r.db.QueryRowContext(ctx, `
+		INSERT INTO personal_access_tokens (user_id, name, token_prefix, token_hash, scopes, allowed_ips, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, t.UserID, t.Name, t.Prefix, t.TokenHash, scopes, allowedIPs, t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+// CountTokens возвращает число действующих токенов пользователя
+func (r *TokenRepository) CountTokens(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM personal_access_tokens
+		WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`, userID).Scan(&n)
+	return n, err
+}
+
+// ListTokens возвращает токены пользователя, включая истекшие (новые первыми)
+func (r *TokenRepository) ListTokens(ctx context.Context, userID string) ([]model.PersonalAccessToken, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+tokenColumns+`
+		FROM personal_access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []model.PersonalAccessToken{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// GetTokenByHash находит действующий токен по хешу.
+// Возвращает sql.ErrNoRows, если токен не найден, отозван или истек.
+func (r *TokenRepository) GetTokenByHash(ctx context.Context, tokenHash string) (*model.PersonalAccessToken, error) {
+	row := r.db.QueryRowContext(ctx, `
+		SELECT `+tokenColumns+`
+		FROM personal_access_tokens
+		WHERE token_hash = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`, tokenHash)
+	return scanToken(row)
+}
+
+// TouchToken запоминает время и адрес последнего использования
+// (не чаще раза в минуту, чтобы не писать в БД на каждый запрос)
+func (r *TokenRepository) TouchToken(ctx context.Context, id, ip string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE personal_access_tokens
+		SET last_used_at = NOW(), last_used_ip = $2
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute' OR last_used_ip IS DISTINCT FROM $2)
+	`, id, ip)
+	return err
+}
+
+// DeleteToken отзывает токен пользователя. Возвращает false, если токен не найден.
+func (r *TokenRepository) DeleteToken(ctx context.Context, userID, id string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2
+	`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
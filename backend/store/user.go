@@ -100,9 +100,9 @@ func (r *UserRepository) GetUserTier(userID string) (string, *time.Time, *time.T
 	return tier, expiresAt, freeSincePtr, nil
 }
 
-// UpdateUserTier обновляет тариф пользователя
+// UpdateUserTier обновляет тариф пользователя (sql.ErrNoRows — пользователя нет)
 func (r *UserRepository) UpdateUserTier(userID, tier string, expiresAt time.Time) error {
-	_, err := r.db.Exec(`
+	res, err := r.db.Exec(`
 		UPDATE users 
 		SET tier = $2, 
 		    subscription_expires_at = $3,
@@ -112,7 +112,13 @@ func (r *UserRepository) UpdateUserTier(userID, tier string, expiresAt time.Time
 		    END
 		WHERE id = $1
 	`, userID, tier, expiresAt)
-	return err
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 // GetUserStorageStats возвращает лимит и использованное место
@@ -129,15 +135,25 @@ func (r *UserRepository) GetUserStorageStats(userID string) (int64, int64) {
 
 // ==================== SUBSCRIPTION OPERATIONS ====================
 
-// GetUsersWithExpiredSubscriptions возвращает ID пользователей с истекшей подпиской
-func (r *UserRepository) GetUsersWithExpiredSubscriptions() ([]string, error) {
+// GetUsersWithExpiredSubscriptions возвращает ID пользователей с истекшей подпиской.
+// Подписки с автопродлением, которые еще пытаются списать оплату, не истекают
+// до grace_until, а если неудачных списаний не было (сбой сети или YooKassa) —
+// до конца периода плюс gracePeriod.
+func (r *UserRepository) GetUsersWithExpiredSubscriptions(gracePeriod time.Duration) ([]string, error) {
 	rows, err := r.db.Query(`
 		SELECT id 
 		FROM users 
 		WHERE tier != 'free' 
 		  AND subscription_expires_at IS NOT NULL 
 		  AND subscription_expires_at < NOW()
-	`)
+		  AND NOT EXISTS (
+			SELECT 1 FROM subscriptions s
+			WHERE s.user_id = users.id
+			  AND s.auto_renew AND s.payment_method_id IS NOT NULL
+			  AND s.status IN ('active', 'past_due')
+			  AND COALESCE(s.grace_until, s.current_period_end + make_interval(secs => $1)) > NOW()
+		  )
+	`, gracePeriod.Seconds())
 	if err != nil {
 		return nil, err
 	}
@@ -160,32 +176,23 @@ func (r *UserRepository) GetUsersWithExpiredSubscriptions() ([]string, error) {
 // CreateTransaction создает запись о транзакции
 func (r *UserRepository) CreateTransaction(tx *model.Transaction) error {
 	_, err := r.db.Exec(`
-		INSERT INTO transactions (id, user_id, payment_id, tier, amount, currency, status, metadata, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-	`, tx.ID, tx.UserID, tx.PaymentID, string(tx.Tier), tx.Amount, tx.Currency, string(tx.Status), tx.Metadata, tx.CreatedAt, tx.UpdatedAt)
+		INSERT INTO transactions (id, user_id, payment_id, tier, amount, currency, billing_period, status, metadata, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, tx.ID, tx.UserID, tx.PaymentID, string(tx.Tier), tx.Amount, tx.Currency, string(tx.Period), string(tx.Status), tx.Metadata, tx.CreatedAt, tx.UpdatedAt)
 	return err
 }
 
 // GetTransactionByPaymentID возвращает транзакцию по payment_id
 func (r *UserRepository) GetTransactionByPaymentID(paymentID string) (*model.Transaction, error) {
 	var tx model.Transaction
-	var tierStr, statusStr string
-	var metadata []byte
-
-	err := r.db.QueryRow(`
-		SELECT id, user_id, payment_id, tier, amount, currency, status, metadata, created_at, updated_at
-		FROM transactions
-		WHERE payment_id = $1
-	`, paymentID).Scan(&tx.ID, &tx.UserID, &tx.PaymentID, &tierStr, &tx.Amount, &tx.Currency, &statusStr, &metadata, &tx.CreatedAt, &tx.UpdatedAt)
-
+	err := scanTransaction(r.db.QueryRow(`
+		SELECT `+transactionFields+`
+		FROM transactions t
+		WHERE t.payment_id = $1
+	`, paymentID), &tx)
 	if err != nil {
 		return nil, err
 	}
-
-	tx.Tier = model.UserTier(tierStr)
-	tx.Status = model.TransactionStatus(statusStr)
-	tx.Metadata = metadata
-
 	return &tx, nil
 }
 
@@ -259,9 +266,9 @@ func (r *UserRepository) DeleteUserFiles(ctx context.Context, bucket, userID str
 }
 
 // CleanupExpiredData удаляет данные пользователей с истекшими подписками
-func (r *UserRepository) CleanupExpiredData(ctx context.Context, bucket string) error {
+func (r *UserRepository) CleanupExpiredData(ctx context.Context, bucket string, gracePeriod time.Duration) error {
 	// Получаем пользователей с истекшими подписками
-	userIDs, err := r.GetUsersWithExpiredSubscriptions()
+	userIDs, err := r.GetUsersWithExpiredSubscriptions(gracePeriod)
 	if err != nil {
 		return err
 	}
@@ -278,4 +285,39 @@ func (r *UserRepository) CleanupExpiredData(ctx context.Context, bucket string)
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+// GetPasswordHash возвращает хеш пароля пользователя ("" — пароль не задан)
+func (r *UserRepository) GetPasswordHash(ctx context.Context, userID string) (string, error) {
+	var hash string
+	err := r.db.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = $1", userID).Scan(&hash)
+	return hash, err
+}
+
+// UpdatePasswordHash заменяет хеш пароля, только если он все еще равен oldHash
+func (r *UserRepository) UpdatePasswordHash(ctx context.Context, userID, oldHash, newHash string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE users SET password_hash = $3 WHERE id = $1 AND password_hash = $2
+	`, userID, oldHash, newHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// IsAdmin сообщает, является ли пользователь администратором
+func (r *UserRepository) IsAdmin(ctx context.Context, userID string) (bool, error) {
+	var admin bool
+	err := r.db.QueryRowContext(ctx, "SELECT is_admin FROM users WHERE id = $1", userID).Scan(&admin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return admin, err
+}
+
+// GetUserEmail возвращает email пользователя
+func (r *UserRepository) GetUserEmail(ctx context.Context, userID string) (string, error) {
+	var email string
+	err := r.db.QueryRowContext(ctx, "SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	return email, err
+}
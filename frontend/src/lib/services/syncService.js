@@ -36,6 +36,7 @@ let eventSource = null;
 let tokenRefreshTimer = null;
 let reconnectAttempts = 0;
 let reconnectTimer = null;
+let ticketPending = false;
 const MAX_RECONNECT_ATTEMPTS = 10;
 const RECONNECT_BASE_DELAY = 2000; // 2 seconds
 const RECONNECT_MAX_DELAY = 60000; // 1 minute
@@ -469,8 +470,24 @@ export const syncService = {
             console.debug('[SSE] Token not a JWT or parse error:', e);
         }
 
-        // Передаем токен в URL, так как EventSource не поддерживает заголовки
-        const url = `${API_URL}/sync/events?token=${token}`;
+        // EventSource не поддерживает заголовки, поэтому вместо access token
+        // передаем в URL одноразовый короткоживущий тикет
+        if (ticketPending) return;
+        ticketPending = true;
+        fetchWithRetry(`${API_URL}/sync/events/ticket`, { method: 'POST' })
+            .then(res => res.json())
+            .then(({ ticket }) => this.openEventSource(ticket))
+            .catch(err => {
+                console.error('[SSE] Failed to obtain ticket:', err);
+                scheduleReconnect();
+            })
+            .finally(() => {
+                ticketPending = false;
+            });
+    },
+
+    openEventSource(ticket) {
+        const url = `${API_URL}/sync/events?ticket=${encodeURIComponent(ticket)}`;
 
         // Закрываем старое, если "зависло" в состоянии connecting
         if (eventSource) eventSource.close();
@@ -500,6 +517,34 @@ export const syncService = {
             }
         };
 
+        // Сервер перезапускается: переподключаемся с подсказанной им задержкой
+        eventSource.addEventListener('reconnect', (event) => {
+            let retryAfter = RECONNECT_BASE_DELAY;
+            try {
+                retryAfter = JSON.parse(event.data).retryAfter || retryAfter;
+            } catch (e) {
+                // оставляем задержку по умолчанию
+            }
+            console.log(`[SSE] Server restarting, reconnecting in ${retryAfter}ms`);
+            this.stopListening();
+            reconnectTimer = setTimeout(() => {
+                reconnectTimer = null;
+                this.startListening();
+            }, retryAfter);
+        });
+
+        // Сервер закрывает поток, когда истекает или отзывается сессия
+        eventSource.addEventListener('session_expired', async () => {
+            console.warn('[SSE] Session expired, refreshing before reconnect');
+            this.stopListening();
+            try {
+                await authService.refreshSession();
+                scheduleReconnect();
+            } catch (refreshErr) {
+                console.error('[SSE] Failed to refresh session:', refreshErr);
+            }
+        });
+
         eventSource.onerror = async (err) => {
             // readyState 2 означает, что мы закрыли соединение или произошла фатальная ошибка
             if (eventSource.readyState === 2) {